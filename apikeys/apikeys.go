@@ -0,0 +1,262 @@
+// Package apikeys implements issuing and checking API keys, and the limits on
+// how much each key may use the API.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are the limits of keys which do not set their own.
+// DefaultRateLimit: requests per minute.
+// DefaultMaxJobs: jobs running at once.
+const (
+	DefaultRateLimit = 60
+	DefaultMaxJobs   = 5
+)
+
+// prefix starts every key, making keys easy to recognize, e.g. by secret
+// scanners.
+const prefix = "t4a_"
+
+// Issue fills in the id, hash and creation time of k, which holds the new
+// key's name, limits and organization, stores it and returns the key's token.
+// The token is not stored and cannot be recovered. If k.Org is set, the key
+// is restricted to that organization with k.Role, which defaults to editor.
+func Issue(k *db.APIKey) (string, error) {
+	if k.RateLimit < 0 || k.MaxJobs < 0 || k.MonthlyMinutes < 0 {
+		return "", errors.NotValidf("negative limit")
+	}
+	if k.Org == "" && k.Role != "" {
+		return "", errors.NotValidf("role without an organization")
+	}
+	if k.Org != "" {
+		if k.Role == "" {
+			k.Role = orgs.Editor
+		}
+		if !orgs.ValidRole(k.Role) {
+			return "", errors.NotValidf("role %q", k.Role)
+		}
+		if _, err := db.Orgs.Get(k.Org); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	secret := randomHex(24)
+	k.ID = randomHex(8)
+	k.Hash = hash(secret)
+	k.CreatedAt = time.Now()
+	if err := db.APIKeys.Create(k); err != nil {
+		return "", errors.Trace(err)
+	}
+	return prefix + k.ID + "_" + secret, nil
+}
+
+// Revoke revokes the key with the given id.
+func Revoke(id string) error {
+	k, err := db.APIKeys.Get(id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if k.Revoked() {
+		return nil
+	}
+	k.RevokedAt = time.Now()
+	return errors.Trace(db.APIKeys.Update(k))
+}
+
+// Authenticate returns the key whose token is given. The error satisfies
+// errors.IsUnauthorized if the token is not a valid key.
+func Authenticate(token string) (*db.APIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(token, prefix), "_")
+	if !strings.HasPrefix(token, prefix) || len(parts) != 2 {
+		return nil, errors.Unauthorizedf("malformed API key")
+	}
+
+	k, err := db.APIKeys.Get(parts[0])
+	if errors.IsNotFound(errors.Cause(err)) {
+		return nil, errors.Unauthorizedf("unknown API key")
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(parts[1])), []byte(k.Hash)) != 1 {
+		return nil, errors.Unauthorizedf("unknown API key")
+	}
+	if k.Revoked() {
+		return nil, errors.Unauthorizedf("revoked API key")
+	}
+	return k, nil
+}
+
+// RateLimit returns the number of requests per minute allowed with k.
+func RateLimit(k *db.APIKey) int {
+	if k.RateLimit > 0 {
+		return k.RateLimit
+	}
+	return DefaultRateLimit
+}
+
+// MaxJobs returns the number of jobs which may run at once for k.
+func MaxJobs(k *db.APIKey) int {
+	if k.MaxJobs > 0 {
+		return k.MaxJobs
+	}
+	return DefaultMaxJobs
+}
+
+// Limiter limits the rate of requests made with each key. Every key has a
+// bucket holding up to a minute's worth of requests which refills
+// continuously.
+type Limiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewLimiter returns a Limiter with full buckets.
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Allow reports whether a request may be made with k now and, if not, how
+// long until one may.
+func (l *Limiter) Allow(k *db.APIKey) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	perMinute := float64(RateLimit(k))
+	now := l.now()
+	b, ok := l.buckets[k.ID]
+	if !ok {
+		b = &bucket{tokens: perMinute, updated: now}
+		l.buckets[k.ID] = b
+	}
+	b.tokens += now.Sub(b.updated).Minutes() * perMinute
+	if b.tokens > perMinute {
+		b.tokens = perMinute
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perMinute * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Tracker keeps track of the jobs started with each key which are still
+// running, and of the jobs being started.
+type Tracker struct {
+	sync.Mutex
+	ex   tasks.TaskExecuter
+	jobs map[string][]string
+	// reserved counts the jobs of each key which have been reserved but
+	// not yet started.
+	reserved map[string]int
+}
+
+// NewTracker returns a Tracker checking the status of jobs on ex, or in
+// their records if ex is not running them.
+func NewTracker(ex tasks.TaskExecuter) *Tracker {
+	return &Tracker{ex: ex, jobs: make(map[string][]string), reserved: make(map[string]int)}
+}
+
+// Reservation holds places for jobs about to be started with a key, so that
+// requests made at the same time cannot together start more jobs than the
+// key may run. The methods of a nil Reservation do nothing.
+type Reservation struct {
+	t    *Tracker
+	key  string
+	left int
+}
+
+// Reserve reserves places for n more jobs started with k, returning an error
+// explaining why if they may not be started. The places count as running
+// jobs until they are filled with Add or given back with Release.
+func (t *Tracker) Reserve(k *db.APIKey, n int) (*Reservation, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	// jobs scheduled to start later are kept track of, but only count once
+	// they run
+	unfinished := []string{}
+	running := 0
+	for _, id := range t.jobs[k.ID] {
+		switch jobs.Status(t.ex, id) {
+		case tasks.INPROGRESS:
+			running++
+			unfinished = append(unfinished, id)
+		case tasks.SCHEDULED:
+			unfinished = append(unfinished, id)
+		}
+	}
+	t.jobs[k.ID] = unfinished
+
+	running += t.reserved[k.ID]
+	if running+n > MaxJobs(k) {
+		return nil, errors.Errorf("%d jobs already running (the maximum is %d)", running, MaxJobs(k))
+	}
+	t.reserved[k.ID] += n
+	return &Reservation{t: t, key: k.ID, left: n}, nil
+}
+
+// Add records that the job with the given id was started in one of r's
+// places.
+func (r *Reservation) Add(id string) {
+	if r == nil {
+		return
+	}
+	r.t.Lock()
+	defer r.t.Unlock()
+	if r.left > 0 {
+		r.left--
+		r.t.reserved[r.key]--
+	}
+	r.t.jobs[r.key] = append(r.t.jobs[r.key], id)
+}
+
+// Release gives back the places of r which were not filled, e.g. because
+// the request failed. It can be deferred as soon as r is reserved.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.t.Lock()
+	defer r.t.Unlock()
+	r.t.reserved[r.key] -= r.left
+	if r.t.reserved[r.key] == 0 {
+		delete(r.t.reserved, r.key)
+	}
+	r.left = 0
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
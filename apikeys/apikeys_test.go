@@ -0,0 +1,163 @@
+package apikeys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func useTempRepository(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.APIKeys, err = db.NewFileAPIKeyRepository(filepath.Join(dir, "apikeys.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Orgs, err = db.NewFileOrganizationRepository(filepath.Join(dir, "organizations.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestIssueAuthenticateRevoke(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+
+	k := &db.APIKey{Name: "partner", RateLimit: 10, MaxJobs: 2}
+	token, err := Issue(k)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(token, "t4a_"+k.ID+"_"))
+	assert.NotContains(k.Hash, strings.TrimPrefix(token, "t4a_"+k.ID+"_"))
+
+	authenticated, err := Authenticate(token)
+	assert.NoError(err)
+	assert.Equal(k.ID, authenticated.ID)
+
+	for _, bad := range []string{"", "t4a_", token + "x", "t4a_" + k.ID + "_wrong", "t4a_unknown_secret"} {
+		_, err = Authenticate(bad)
+		assert.True(errors.IsUnauthorized(err), bad)
+	}
+
+	assert.NoError(Revoke(k.ID))
+	_, err = Authenticate(token)
+	assert.True(errors.IsUnauthorized(err))
+
+	_, err = Issue(&db.APIKey{Name: "negative", RateLimit: -1})
+	assert.Error(err)
+}
+
+func TestIssueForOrganization(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	assert.NoError(db.Orgs.Create(&db.Organization{ID: "org"}))
+
+	k := &db.APIKey{Name: "station", Org: "org"}
+	_, err := Issue(k)
+	assert.NoError(err)
+	assert.Equal("editor", k.Role)
+
+	_, err = Issue(&db.APIKey{Name: "station", Org: "org", Role: "owner"})
+	assert.True(errors.IsNotValid(err))
+	_, err = Issue(&db.APIKey{Name: "station", Role: "viewer"})
+	assert.True(errors.IsNotValid(err))
+	_, err = Issue(&db.APIKey{Name: "station", Org: "missing", Role: "viewer"})
+	assert.True(errors.IsNotFound(errors.Cause(err)))
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	l := NewLimiter()
+	l.now = func() time.Time { return now }
+	k := &db.APIKey{ID: "key", RateLimit: 2}
+
+	ok, _ := l.Allow(k)
+	assert.True(ok)
+	ok, _ = l.Allow(k)
+	assert.True(ok)
+	ok, wait := l.Allow(k)
+	assert.False(ok)
+	assert.Equal(30*time.Second, wait)
+
+	// other keys have their own bucket
+	ok, _ = l.Allow(&db.APIKey{ID: "other", RateLimit: 2})
+	assert.True(ok)
+
+	now = now.Add(30 * time.Second)
+	ok, _ = l.Allow(k)
+	assert.True(ok)
+	ok, _ = l.Allow(k)
+	assert.False(ok)
+}
+
+func TestTracker(t *testing.T) {
+	assert := assert.New(t)
+	ex := tasks.NewTaskExecuter(time.Hour)
+	tracker := NewTracker(ex)
+	k := &db.APIKey{ID: "key", MaxJobs: 2}
+
+	release := make(chan bool)
+	block := func(string) error { <-release; return nil }
+	r, err := tracker.Reserve(k, 2)
+	assert.NoError(err)
+	// places are taken as soon as they are reserved
+	_, err = tracker.Reserve(k, 1)
+	assert.Error(err)
+	r.Add(ex.QueueTask(block, func(string, string) {}))
+	r.Add(ex.QueueTask(block, func(string, string) {}))
+	r.Release()
+	_, err = tracker.Reserve(k, 1)
+	assert.Error(err)
+
+	release <- true
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if r, err = tracker.Reserve(k, 1); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("finished job is still counted")
+		}
+	}
+	_, err = tracker.Reserve(k, 1)
+	assert.Error(err)
+	// places which are not filled are given back
+	r.Release()
+	r.Release()
+	_, err = tracker.Reserve(k, 1)
+	assert.NoError(err)
+	close(release)
+}
+
+func TestTrackerReservesAtomically(t *testing.T) {
+	ex := tasks.NewTaskExecuter(time.Hour)
+	tracker := NewTracker(ex)
+	k := &db.APIKey{ID: "key", MaxJobs: 3}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tracker.Reserve(k, 1); err == nil {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, granted)
+}
@@ -0,0 +1,301 @@
+// Package batch implements submitting many transcription jobs at once from a
+// CSV or JSON manifest and tracking them as a single batch.
+package batch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are limits used by the package.
+// MaxItems: the largest number of items accepted in one manifest.
+// PollInterval: how often watched batches check on their jobs.
+const (
+	MaxItems     = 1000
+	PollInterval = 10 * time.Second
+)
+
+// Item is a single job in a manifest.
+type Item struct {
+	AudioURL       string   `json:"audioURL"`
+	EmailAddresses []string `json:"emailAddresses"`
+	SearchWords    []string `json:"searchWords"`
+	Language       string   `json:"language"`
+	Force          bool     `json:"force,omitempty"`
+}
+
+// Manifest lists the jobs of a batch. EmailAddresses receive a single
+// summary once every job has finished.
+type Manifest struct {
+	EmailAddresses []string `json:"emailAddresses"`
+	Items          []Item   `json:"items"`
+	// StartAt and DelaySeconds defer every job until a given time, or for a
+	// number of seconds after the batch is submitted.
+	StartAt      time.Time `json:"startAt,omitempty"`
+	DelaySeconds int       `json:"delaySeconds,omitempty"`
+	// Priority is the name of the priority every job is queued with, e.g.
+	// "low" for a backfill, or empty for the default.
+	Priority string `json:"priority,omitempty"`
+	// Org is the organization the batch is submitted for. It is set by the
+	// server, not read from the manifest.
+	Org string `json:"-"`
+}
+
+// ParseJSON reads a manifest encoded as a JSON object.
+func ParseJSON(r io.Reader) (*Manifest, error) {
+	m := new(Manifest)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, errors.NewNotValid(err, "manifest")
+	}
+	return m, m.check()
+}
+
+// ParseCSV reads a manifest from CSV with a header row naming its columns:
+// audioURL, which is required, and optionally searchWords, language,
+// emailAddresses and force. Lists are comma-separated within their cell. The
+// emailAddresses column names the recipients of each job's own email; the
+// recipients of the batch's summary are not part of the CSV, and are left
+// for the caller to set.
+func ParseCSV(r io.Reader) (*Manifest, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.NewNotValid(err, "manifest")
+	}
+	if len(rows) == 0 {
+		return nil, errors.NotValidf("manifest without header row")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["audioURL"]; !ok {
+		return nil, errors.NotValidf("manifest without audioURL column")
+	}
+	cell := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	m := new(Manifest)
+	for i, row := range rows[1:] {
+		force := false
+		if s := cell(row, "force"); s != "" {
+			if force, err = strconv.ParseBool(s); err != nil {
+				return nil, errors.NotValidf("force %q in row %d", s, i+2)
+			}
+		}
+		m.Items = append(m.Items, Item{
+			AudioURL:       cell(row, "audioURL"),
+			EmailAddresses: splitList(cell(row, "emailAddresses")),
+			SearchWords:    splitList(cell(row, "searchWords")),
+			Language:       cell(row, "language"),
+			Force:          force,
+		})
+	}
+	return m, m.check()
+}
+
+func (m *Manifest) check() error {
+	if len(m.Items) == 0 {
+		return errors.NotValidf("empty manifest")
+	}
+	if len(m.Items) > MaxItems {
+		return errors.NotValidf("manifest with %d items (the maximum is %d)", len(m.Items), MaxItems)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Submit queues a job for every item of the manifest using queue, which
+// returns the id of the queued job, and stores the resulting batch. Items are
+// validated with validate before any job is queued. Items whose job could not
+// be queued are recorded as failed, without a job; if no job could be queued
+// at all, Submit returns the error and stores no batch.
+func Submit(m *Manifest, validate func(Item) error, queue func(Item) (string, error)) (*db.Batch, error) {
+	for i, item := range m.Items {
+		if err := validate(item); err != nil {
+			return nil, errors.Annotatef(err, "item %d", i+1)
+		}
+	}
+
+	b := &db.Batch{
+		ID:             newID(),
+		Org:            m.Org,
+		CreatedAt:      time.Now(),
+		EmailAddresses: m.EmailAddresses,
+	}
+	queued := 0
+	var queueErr error
+	for _, item := range m.Items {
+		job := db.BatchJob{AudioURL: item.AudioURL, Status: tasks.INPROGRESS.Name()}
+		id, err := queue(item)
+		if err != nil {
+			log.WithField("batch", b.ID).
+				Errorf("Could not queue the job for %s: %v", item.AudioURL, errors.ErrorStack(err))
+			job.Status = tasks.FAILURE.Name()
+			job.Error = "the job could not be queued"
+			queueErr = err
+		} else {
+			job.ID = id
+			queued++
+		}
+		b.Jobs = append(b.Jobs, job)
+	}
+	if queued == 0 {
+		return nil, errors.Annotate(queueErr, "no job could be queued")
+	}
+	if err := db.Batches.Create(b); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.WithField("batch", b.ID).
+		Infof("Batch of %d jobs started", len(b.Jobs))
+	return b, nil
+}
+
+// Watch polls the status of the batch's jobs every interval until all have
+// finished, then marks the batch finished and calls onFinish.
+func Watch(b *db.Batch, ex tasks.TaskExecuter, interval time.Duration, onFinish func(*db.Batch)) {
+	for !update(b, ex) {
+		time.Sleep(interval)
+	}
+	log.WithField("batch", b.ID).
+		Info("Batch finished")
+	onFinish(b)
+}
+
+// update refreshes the status of the batch's jobs and reports whether the
+// batch has finished.
+func update(b *db.Batch, ex tasks.TaskExecuter) bool {
+	changed := false
+	finished := true
+	for i, job := range b.Jobs {
+		if job.ID == "" {
+			// the job could not be queued
+			continue
+		}
+		status := jobs.Status(ex, job.ID).Name()
+		if status != job.Status {
+			b.Jobs[i].Status = status
+			changed = true
+		}
+		if status == tasks.INPROGRESS.Name() || status == tasks.SCHEDULED.Name() {
+			finished = false
+		}
+	}
+	if finished {
+		b.FinishedAt = time.Now()
+		changed = true
+	}
+	if changed {
+		if err := db.Batches.Update(b); err != nil {
+			log.WithField("batch", b.ID).
+				Error(err)
+		}
+	}
+	return finished
+}
+
+// Resume watches every unfinished batch, e.g. after a restart. The status of
+// jobs which are not running on ex is read from their records.
+func Resume(ex tasks.TaskExecuter, interval time.Duration, onFinish func(*db.Batch)) error {
+	batches, err := db.Batches.List(db.BatchFilter{Unfinished: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, b := range batches {
+		go Watch(b, ex, interval, onFinish)
+	}
+	return nil
+}
+
+// Summary counts the jobs of a batch by status.
+type Summary struct {
+	Status     string
+	Total      int
+	Scheduled  int
+	InProgress int
+	Succeeded  int
+	Failed     int
+}
+
+// Summarize returns the aggregate status of a batch: SCHEDULED while its jobs
+// wait for their start time, INPROGRESS until every job has finished, then
+// SUCCESS if every job succeeded, FAILURE if none did and PARTIAL otherwise.
+func Summarize(b *db.Batch) Summary {
+	s := Summary{Total: len(b.Jobs)}
+	for _, job := range b.Jobs {
+		switch job.Status {
+		case tasks.SCHEDULED.Name():
+			s.Scheduled++
+		case tasks.INPROGRESS.Name():
+			s.InProgress++
+		case tasks.SUCCESS.Name():
+			s.Succeeded++
+		default:
+			s.Failed++
+		}
+	}
+
+	switch {
+	case s.InProgress > 0:
+		s.Status = tasks.INPROGRESS.Name()
+	case s.Scheduled > 0:
+		s.Status = tasks.SCHEDULED.Name()
+	case s.Failed == 0:
+		s.Status = tasks.SUCCESS.Name()
+	case s.Succeeded == 0:
+		s.Status = tasks.FAILURE.Name()
+	default:
+		s.Status = "PARTIAL"
+	}
+	return s
+}
+
+// Report returns a plain-text report of a finished batch for notifications.
+func Report(b *db.Batch) string {
+	s := Summarize(b)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Batch %s finished: %d of %d jobs succeeded.\n\n", b.ID, s.Succeeded, s.Total)
+	for _, job := range b.Jobs {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", job.Status, job.ID, job.AudioURL)
+	}
+	return buf.String()
+}
+
+// newID returns a random batch id.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
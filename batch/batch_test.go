@@ -0,0 +1,136 @@
+package batch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func TestParseCSV(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := ParseCSV(strings.NewReader(`audioURL,searchWords,language,force
+http://example.com/one.mp3,"credit, card",en-GB,
+http://example.com/two.mp3,,,true
+`))
+	assert.NoError(err)
+	assert.Equal([]Item{
+		{AudioURL: "http://example.com/one.mp3", EmailAddresses: []string{}, SearchWords: []string{"credit", "card"}, Language: "en-GB"},
+		{AudioURL: "http://example.com/two.mp3", EmailAddresses: []string{}, SearchWords: []string{}, Force: true},
+	}, m.Items)
+
+	_, err = ParseCSV(strings.NewReader("audioURL,force\nhttp://example.com/one.mp3,maybe\n"))
+	assert.Error(err)
+
+	_, err = ParseCSV(strings.NewReader("url\nhttp://example.com/one.mp3\n"))
+	assert.Error(err)
+	_, err = ParseCSV(strings.NewReader("audioURL\n"))
+	assert.Error(err)
+}
+
+func TestParseJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := ParseJSON(strings.NewReader(`{"emailAddresses": ["a@example.com"], "items": [{"audioURL": "http://example.com/one.mp3"}]}`))
+	assert.NoError(err)
+	assert.Equal([]string{"a@example.com"}, m.EmailAddresses)
+	assert.Len(m.Items, 1)
+
+	_, err = ParseJSON(strings.NewReader(`{"items": []}`))
+	assert.Error(err)
+}
+
+func TestSubmitAndWatch(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "batch")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Batches, err = db.NewFileBatchRepository(filepath.Join(dir, "batches.json"))
+	assert.NoError(err)
+
+	ex := tasks.NewTaskExecuter(time.Hour)
+	m := &Manifest{Items: []Item{{AudioURL: "good"}, {AudioURL: "bad"}}}
+	validate := func(item Item) error { return nil }
+	queue := func(item Item) (string, error) {
+		return ex.QueueTask(func(string) error {
+			if item.AudioURL == "bad" {
+				return errors.New("bad audio")
+			}
+			return nil
+		}, func(string, string) {}), nil
+	}
+
+	b, err := Submit(m, validate, queue)
+	assert.NoError(err)
+
+	finished := make(chan *db.Batch)
+	go Watch(b, ex, time.Millisecond, func(b *db.Batch) { finished <- b })
+
+	select {
+	case b = <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch did not finish")
+	}
+	assert.Equal(Summary{Status: "PARTIAL", Total: 2, Succeeded: 1, Failed: 1}, Summarize(b))
+
+	stored, err := db.Batches.Get(b.ID)
+	assert.NoError(err)
+	assert.True(stored.Finished())
+	assert.Contains(Report(stored), "1 of 2 jobs succeeded")
+}
+
+func TestSubmitValidatesEveryItemFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	queued := 0
+	m := &Manifest{Items: []Item{{AudioURL: "good"}, {AudioURL: ""}}}
+	validate := func(item Item) error {
+		if item.AudioURL == "" {
+			return errors.New("empty audio url")
+		}
+		return nil
+	}
+	_, err := Submit(m, validate, func(Item) (string, error) { queued++; return "", nil })
+	assert.Error(err)
+	assert.Contains(err.Error(), "item 2")
+	assert.Equal(0, queued)
+}
+
+func TestSubmitRecordsItemsWhichCouldNotBeQueued(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "batch")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Batches, err = db.NewFileBatchRepository(filepath.Join(dir, "batches.json"))
+	assert.NoError(err)
+
+	m := &Manifest{Items: []Item{{AudioURL: "good"}, {AudioURL: "bad"}}}
+	validate := func(item Item) error { return nil }
+	queue := func(item Item) (string, error) {
+		if item.AudioURL == "bad" {
+			return "", errors.New("queue unavailable")
+		}
+		return "job", nil
+	}
+	b, err := Submit(m, validate, queue)
+	assert.NoError(err)
+	assert.Equal(db.BatchJob{ID: "job", AudioURL: "good", Status: tasks.INPROGRESS.Name()}, b.Jobs[0])
+	assert.Equal("", b.Jobs[1].ID)
+	assert.Equal(tasks.FAILURE.Name(), b.Jobs[1].Status)
+	assert.NotEmpty(b.Jobs[1].Error)
+	assert.Equal(Summary{Status: tasks.INPROGRESS.Name(), Total: 2, InProgress: 1, Failed: 1}, Summarize(b))
+
+	m.Items = m.Items[1:]
+	_, err = Submit(m, validate, queue)
+	assert.Error(err)
+	assert.Contains(err.Error(), "queue unavailable")
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof" // import for side effects
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/batch"
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/feeds"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/schedules"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/transcription"
+	"github.com/hack4impact/transcribe4all/usage"
+	"github.com/hack4impact/transcribe4all/users"
+	"github.com/hack4impact/transcribe4all/web"
+	"github.com/hack4impact/transcribe4all/worker"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	command{
+		"serve",
+		"serve\n\tRun the web server. This is the default command.",
+		serveCommand,
+	},
+	command{
+		"worker",
+		"worker [-concurrency n] [-name name]\n\tRun jobs queued by web servers with UseWorkers set.",
+		workerCommand,
+	},
+	command{
+		"transcribe",
+		"transcribe [-format txt|json|srt|vtt] [-o file] [-words a,b] [-language code] <file|url>\n\tTranscribe an audio file locally and print or write the transcript.",
+		transcribeCommand,
+	},
+	command{
+		"status",
+		"status [-server url] [-key key] <id>\n\tPrint the status of a job on a running server.",
+		statusCommand,
+	},
+	command{
+		"retry",
+		"retry [-server url] [-key key] [-stage name] <id>\n\tRetry a failed job on a running server from the stage which failed, or from the named stage.",
+		retryCommand,
+	},
+	command{
+		"batch",
+		"batch [-server url] [-key key] [-notify a,b] [-priority p] [-start time] <manifest.csv|manifest.json>\n\tSubmit a manifest of jobs to a running server.",
+		batchCommand,
+	},
+	command{
+		"export",
+		"export [-format txt|json|srt|vtt] [-o file] <id>\n\tPrint or write a stored transcript.",
+		exportCommand,
+	},
+	command{
+		"apikey",
+		"apikey create [-rate n] [-jobs n] [-minutes n] [-org id [-role role]] <name> | apikey list | apikey revoke <id>\n\tIssue, list or revoke API keys.",
+		apikeyCommand,
+	},
+	command{
+		"user",
+		"user create [-admin] [-name name] <email> | user list | user password <email>\n\tCreate users, list them or change a password. Passwords are read from stdin.",
+		userCommand,
+	},
+	command{
+		"org",
+		"org create -admin <email> <name> | org list | org member <id> <email> <admin|editor|viewer|remove>\n\tCreate and list organizations and manage their members.",
+		orgCommand,
+	},
+	command{
+		"usage",
+		"usage [-month 2016-10] [-org id] [-format csv|json]\n\tPrint the audio minutes transcribed in a month.",
+		usageCommand,
+	},
+	command{
+		"config",
+		"config check\n\tCheck the configuration for problems.",
+		configCommand,
+	},
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: transcribe4all [-config file] <command> [arguments]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+}
+
+// parseArgs parses flags which may appear before, between or after the
+// positional arguments, and returns the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// splitList splits a comma-separated list, ignoring empty entries.
+func splitList(s string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// apiKeyFlag adds the flag giving the API key used to call the server. It
+// defaults to the TRANSCRIBE4ALL_API_KEY environment variable, which keeps
+// the key out of the process list.
+func apiKeyFlag(flags *flag.FlagSet) *string {
+	return flags.String("key", os.Getenv("TRANSCRIBE4ALL_API_KEY"), "API key (default $TRANSCRIBE4ALL_API_KEY)")
+}
+
+// callAPI makes a request to the server using the given API key.
+func callAPI(method string, endpoint string, contentType string, body io.Reader, key string) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	return resp, errors.Trace(err)
+}
+
+// writeOutput writes data to the file at path, or to stdout if path is empty.
+func writeOutput(path string, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func serveCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("serve takes no arguments")
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	if err := setupStorage(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+	setupJobLogs()
+	interrupted, err := jobs.MarkInterrupted()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	setupQuotas()
+	setupIdempotency()
+	setupMetrics()
+	stopEvents, err := setupEvents()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// after shutdown, so that the webhooks hear how the last jobs ended
+	defer stopEvents()
+	tasks.DefaultTaskExecuter.SetMaxRunning(config.Config.MaxConcurrentJobs)
+
+	// before the batches, whose watchers would take the jobs for lost
+	if err := transcription.Resume(interrupted); err != nil {
+		return errors.Trace(err)
+	}
+	if err := batch.Resume(tasks.DefaultTaskExecuter, batch.PollInterval, transcription.NotifyBatchFinished); err != nil {
+		return errors.Trace(err)
+	}
+	stop := make(chan struct{})
+	go feeds.Run(feeds.PollInterval, transcription.QueueEpisode, stop)
+	go schedules.Run(schedules.PollInterval, transcription.StartDeferred, transcription.QueueScheduled, stop)
+	if err := setupWatcher(stop); err != nil {
+		return errors.Trace(err)
+	}
+
+	router := web.NewRouter()
+	middlewareRouter := web.ApplyMiddleware(router)
+
+	// serve http
+	http.Handle("/", middlewareRouter)
+	http.Handle("/static/", http.FileServer(http.Dir(".")))
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Config.Port)}
+	// event streams would otherwise hold up the shutdown until they time out
+	server.RegisterOnShutdown(web.Events.Close)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+	log.Infof("Server is running at http://localhost:%d", config.Config.Port)
+
+	if err := waitForSignal(failed); err != nil {
+		return errors.Trace(err)
+	}
+	shutdown(server, stop)
+	return nil
+}
+
+func workerCommand(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 1, "number of jobs to run at a time")
+	name := flags.String("name", "", "name of the worker, unique among the workers (default host:pid)")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errors.New("worker takes no arguments")
+	}
+	if config.Config.MongoURL == "" {
+		return errors.New("workers share the job queue through MongoDB, so MongoURL must be set")
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	if *name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		*name = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+
+	if err := setupStorage(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+	setupJobLogs()
+	stopEvents, err := setupEvents()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer stopEvents()
+
+	stop := make(chan struct{})
+	w := worker.New(*name, *concurrency, tasks.DefaultTaskExecuter, transcription.RecordedTask)
+	go w.Run(stop)
+	log.Infof("Worker %s is running up to %d job(s) at a time", *name, *concurrency)
+
+	if err := waitForSignal(nil); err != nil {
+		return errors.Trace(err)
+	}
+	shutdown(nil, stop)
+	return nil
+}
+
+func transcribeCommand(args []string) error {
+	flags := flag.NewFlagSet("transcribe", flag.ExitOnError)
+	format := flags.String("format", "txt", "output format: "+strings.Join(transcription.Formats, ", "))
+	output := flags.String("o", "", "write the transcript to this file instead of stdout")
+	words := flags.String("words", "", "comma-separated search words")
+	language := flags.String("language", "", "language of the audio, e.g. en-GB")
+	force := flags.Bool("force", false, "transcribe the audio even if it has been transcribed before")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("transcribe takes exactly one file or url")
+	}
+
+	if err := setupStorage(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+
+	job := transcription.Job{
+		AudioURL:    positional[0],
+		SearchWords: splitList(*words),
+		Language:    *language,
+		Force:       *force,
+		LocalFile:   true,
+	}
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	defer transcription.RemoveTempFiles()
+	id := "cli-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	log.WithField("task", id).
+		Infof("Transcribing %s", positional[0])
+
+	ctx, cancel := transcription.NewRunContext(context.Background(), job)
+	defer cancel()
+	t, err := transcription.Transcribe(ctx, id, job)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := transcription.Format(t, *format)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeOutput(*output, data)
+}
+
+func statusCommand(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	server := flags.String("server", publicURL(), "address of the server")
+	key := apiKeyFlag(flags)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("status takes exactly one job id")
+	}
+
+	resp, err := callAPI("GET", strings.TrimSuffix(*server, "/")+"/job_status/"+positional[0], "", nil, *key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("server responded with %s", resp.Status)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Println()
+	return nil
+}
+
+func retryCommand(args []string) error {
+	flags := flag.NewFlagSet("retry", flag.ExitOnError)
+	server := flags.String("server", publicURL(), "address of the server")
+	key := apiKeyFlag(flags)
+	stage := flags.String("stage", "", "stage to run again from, e.g. transcribe-chunk-3, instead of the one which failed")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("retry takes exactly one job id")
+	}
+
+	body, err := json.Marshal(map[string]string{"stage": *stage})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	endpoint := strings.TrimSuffix(*server, "/") + "/api/v1/jobs/" + positional[0] + "/retry"
+	resp, err := callAPI("POST", endpoint, "application/json", bytes.NewReader(body), *key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.Errorf("server responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func batchCommand(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	server := flags.String("server", publicURL(), "address of the server")
+	key := apiKeyFlag(flags)
+	notify := flags.String("notify", "", "comma-separated email addresses to send the summary to (CSV manifests only)")
+	priority := flags.String("priority", "", "priority of the jobs: low, normal or high (CSV manifests only)")
+	start := flags.String("start", "", "time to start the jobs at, e.g. 2016-10-01T01:00:00Z (CSV manifests only)")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("batch takes exactly one manifest")
+	}
+
+	manifest, err := os.Open(positional[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer manifest.Close()
+
+	endpoint := strings.TrimSuffix(*server, "/") + "/api/v1/batches"
+	contentType := "application/json"
+	if strings.HasSuffix(strings.ToLower(positional[0]), ".csv") {
+		contentType = "text/csv"
+		query := url.Values{}
+		if *notify != "" {
+			query.Set("emailAddresses", *notify)
+		}
+		if *priority != "" {
+			query.Set("priority", *priority)
+		}
+		if *start != "" {
+			query.Set("startAt", *start)
+		}
+		if len(query) > 0 {
+			endpoint += "?" + query.Encode()
+		}
+	}
+	resp, err := callAPI("POST", endpoint, contentType, manifest, *key)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("server responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "txt", "output format: "+strings.Join(transcription.Formats, ", "))
+	output := flags.String("o", "", "write the transcript to this file instead of stdout")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("export takes exactly one transcript id")
+	}
+
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+	t, err := db.Transcripts.Get(positional[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := transcription.Format(t, *format)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return writeOutput(*output, data)
+}
+
+func apikeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("apikey takes a subcommand: create, list or revoke")
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+		rate := flags.Int("rate", 0, fmt.Sprintf("requests allowed per minute (default %d)", apikeys.DefaultRateLimit))
+		jobs := flags.Int("jobs", 0, fmt.Sprintf("jobs allowed to run at once (default %d)", apikeys.DefaultMaxJobs))
+		minutes := flags.Int("minutes", 0, "audio minutes allowed per month (default APIKeyMonthlyQuotaMinutes)")
+		org := flags.String("org", "", "restrict the key to this organization")
+		role := flags.String("role", "", "the key's role in the organization (default editor)")
+		positional, err := parseArgs(flags, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 {
+			return errors.New("apikey create takes exactly one name")
+		}
+		k := &db.APIKey{
+			Name:           positional[0],
+			RateLimit:      *rate,
+			MaxJobs:        *jobs,
+			MonthlyMinutes: *minutes,
+			Org:            *org,
+			Role:           *role,
+		}
+		token, err := apikeys.Issue(k)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Created API key %s for %s. Keep it secret, it will not be shown again:\n%s\n", k.ID, k.Name, token)
+	case "list":
+		keys, err := db.APIKeys.List()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, k := range keys {
+			state := "active"
+			if k.Revoked() {
+				state = "revoked " + k.RevokedAt.Format(time.RFC3339)
+			}
+			scope := "instance"
+			if k.Org != "" {
+				scope = k.Role + " of " + k.Org
+			}
+			fmt.Printf("%s\t%s\t%d/min\t%d jobs\t%s\t%s\n", k.ID, k.Name, apikeys.RateLimit(k), apikeys.MaxJobs(k), scope, state)
+		}
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("apikey revoke takes exactly one key id")
+		}
+		if err := apikeys.Revoke(args[1]); err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Revoked API key %s\n", args[1])
+	default:
+		return errors.Errorf("unknown apikey subcommand %q", args[0])
+	}
+	return nil
+}
+
+func userCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("user takes a subcommand: create, list or password")
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("user create", flag.ExitOnError)
+		admin := flags.Bool("admin", false, "make the user an administrator")
+		name := flags.String("name", "", "the user's name")
+		positional, err := parseArgs(flags, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 {
+			return errors.New("user create takes exactly one email address")
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		u, err := users.Register(positional[0], *name, password, *admin)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Created user %s for %s\n", u.ID, u.Email)
+	case "list":
+		list, err := db.Users.List()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, u := range list {
+			role := "user"
+			if u.Admin {
+				role = "admin"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", u.ID, u.Email, u.Name, role)
+		}
+	case "password":
+		if len(args) != 2 {
+			return errors.New("user password takes exactly one email address")
+		}
+		u, err := db.Users.GetByEmail(args[1])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := users.SetPassword(u, password); err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Changed the password of %s\n", u.Email)
+	default:
+		return errors.Errorf("unknown user subcommand %q", args[0])
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of stdin.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Trace(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func orgCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("org takes a subcommand: create, list or member")
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("org create", flag.ExitOnError)
+		admin := flags.String("admin", "", "email address of the organization's first admin")
+		positional, err := parseArgs(flags, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 || *admin == "" {
+			return errors.New("org create takes an -admin email address and exactly one name")
+		}
+		u, err := db.Users.GetByEmail(*admin)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		o, err := orgs.Create(positional[0], u.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Created organization %s (%s) with admin %s\n", o.ID, o.Name, u.Email)
+	case "list":
+		list, err := db.Orgs.List("")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, o := range list {
+			fmt.Printf("%s\t%s\t%d members\n", o.ID, o.Name, len(o.Members))
+		}
+	case "member":
+		if len(args) != 4 {
+			return errors.New("org member takes an organization id, an email address and a role or remove")
+		}
+		o, err := db.Orgs.Get(args[1])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		u, err := db.Users.GetByEmail(args[2])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if args[3] == "remove" {
+			err = orgs.RemoveMember(o, u.ID)
+		} else {
+			err = orgs.SetMember(o, u.ID, args[3])
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Updated the members of %s\n", o.Name)
+	default:
+		return errors.Errorf("unknown org subcommand %q", args[0])
+	}
+	return nil
+}
+
+func usageCommand(args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	month := flags.String("month", time.Now().Format("2006-01"), "the month to report on")
+	org := flags.String("org", "", "only count the jobs of this organization")
+	format := flags.String("format", "csv", "output format: csv or json")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New("usage takes no arguments")
+	}
+	t, err := time.Parse("2006-01", *month)
+	if err != nil {
+		return errors.NotValidf("month %q", *month)
+	}
+	if err := setupDB(); err != nil {
+		return errors.Trace(err)
+	}
+	setupQuotas()
+
+	report, err := usage.MonthlyReport(t, *org)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch *format {
+	case "csv":
+		return report.WriteCSV(os.Stdout)
+	case "json":
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return writeOutput("", append(data, '\n'))
+	}
+	return errors.NotValidf("format %q", *format)
+}
+
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New(`the only config subcommand is "check"`)
+	}
+
+	type check struct {
+		name string
+		err  error
+	}
+	c := config.Config
+	checks := []check{}
+	// each problem with the settings fails on its own line
+	for _, problem := range configProblems(c) {
+		checks = append(checks, check{"settings", problem})
+	}
+	if len(checks) == 0 {
+		checks = append(checks, check{"settings", nil})
+	}
+	checks = append(checks,
+		check{"IBM credentials", checkf(c.IBMUsername != "" && c.IBMPassword != "", "IBMUsername and IBMPassword must be set")},
+		check{"ffmpeg", lookPath("ffmpeg")},
+		check{"storage", setupStorage()},
+		check{"database", setupDB()},
+	)
+
+	problems := 0
+	for _, check := range checks {
+		if check.err != nil {
+			problems++
+			fmt.Printf("FAIL %s: %v\n", check.name, check.err)
+		} else {
+			fmt.Printf("ok   %s\n", check.name)
+		}
+	}
+	if problems > 0 {
+		return errors.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+// checkf returns an error with the given message unless ok is true.
+func checkf(ok bool, format string, args ...interface{}) error {
+	if ok {
+		return nil
+	}
+	return errors.Errorf(format, args...)
+}
+
+func lookPath(file string) error {
+	_, err := exec.LookPath(file)
+	return err
+}
@@ -1,43 +1,223 @@
+// Package config holds the application-wide configuration, read from a TOML
+// file and from environment variables.
 package config
 
 import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/BurntSushi/toml"
 	log "github.com/Sirupsen/logrus"
 	"github.com/juju/errors"
 )
 
-// Config is the application-wide config
+// Config is the application-wide config, read by Load.
 var Config AppConfig
 
-func init() {
-	err := parseConfigFile(&Config, "config.toml")
-	if err != nil {
-		log.Fatal(err)
+// DefaultPath is the file Load reads when it is given no path, if it exists.
+const DefaultPath = "config.toml"
+
+// EnvPrefix starts the names of the environment variables which override the
+// settings of the config file, e.g. TRANSCRIBE4ALL_PORT for Port.
+const EnvPrefix = "TRANSCRIBE4ALL_"
+
+// Load reads Config from the TOML file at path, or at DefaultPath if path is
+// empty and the file exists, and then from the environment: each setting is
+// overridden by the environment variable named by EnvPrefix and its env tag,
+// if it is set. Lists are written as comma-separated values, and
+// StageTimeoutMinutes as comma-separated stage=minutes pairs. Load does not
+// check the settings make sense; see Validate.
+func Load(path string) error {
+	c := AppConfig{}
+	if path == "" {
+		if _, err := os.Stat(DefaultPath); err == nil {
+			path = DefaultPath
+		}
 	}
-	log.Infof("%+v", Config)
+	if path != "" {
+		if err := parseConfigFile(&c, path); err != nil {
+			return err
+		}
+	}
+	if err := parseEnv(&c, os.LookupEnv); err != nil {
+		return err
+	}
+	Config = c
+	return nil
 }
 
-// parseConfigFile parses the specified file into a given struct
+// parseConfigFile parses the specified file into a given struct, warning of
+// settings which do not exist, which are likely to be misspelled or left over
+// from an older version.
 func parseConfigFile(config *AppConfig, filename string) error {
-	if _, err := toml.DecodeFile(filename, config); err != nil {
-		return errors.Trace(err)
+	md, err := toml.DecodeFile(filename, config)
+	if err != nil {
+		return errors.Annotatef(err, "reading %s", filename)
+	}
+	for _, key := range md.Undecoded() {
+		log.Warnf("Ignoring the setting %q in %s, since there is no such setting", key.String(), filename)
 	}
 	return nil
 }
 
-// AppConfig contains the app config variables.
+// stageMinutes matches the value of StageTimeoutMinutes in the environment.
+var stageMinutes = regexp.MustCompile(`^\s*([^=,\s]+)\s*=\s*(\d+)\s*$`)
+
+// parseEnv overrides the settings in config with the environment variables
+// found by lookup.
+func parseEnv(config *AppConfig, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := EnvVar(field.Name)
+		raw, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		// the values are not repeated in errors, since they may be secret
+		switch f := v.Field(i); f.Interface().(type) {
+		case string:
+			f.SetString(raw)
+		case int:
+			n, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err != nil {
+				return errors.NotValidf("%s (it must be a whole number)", name)
+			}
+			f.SetInt(int64(n))
+		case bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return errors.NotValidf("%s (it must be true or false)", name)
+			}
+			f.SetBool(b)
+		case []string:
+			list := []string{}
+			for _, entry := range strings.Split(raw, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					list = append(list, entry)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+		case map[string]int:
+			m := make(map[string]int)
+			for _, pair := range strings.Split(raw, ",") {
+				if strings.TrimSpace(pair) == "" {
+					continue
+				}
+				match := stageMinutes.FindStringSubmatch(pair)
+				if match == nil {
+					return errors.NotValidf("%s (it must be a comma-separated list of stage=minutes pairs)", name)
+				}
+				m[match[1]], _ = strconv.Atoi(match[2])
+			}
+			f.Set(reflect.ValueOf(m))
+		default:
+			return errors.Errorf("%s cannot be set from the environment", field.Name)
+		}
+	}
+	return nil
+}
+
+// EnvVar returns the name of the environment variable overriding the named
+// setting, e.g. TRANSCRIBE4ALL_IBM_PASSWORD for IBMPassword.
+func EnvVar(setting string) string {
+	field, ok := reflect.TypeOf(AppConfig{}).FieldByName(setting)
+	if !ok {
+		return ""
+	}
+	return EnvPrefix + strings.Split(field.Tag.Get("env"), ",")[0]
+}
+
+// redacted replaces secrets in Redacted.
+const redacted = "[REDACTED]"
+
+// mongoPassword matches the password in a MongoDB URL.
+var mongoPassword = regexp.MustCompile(`(://[^/\s:@]+:)([^/\s@]+)@`)
+
+// Redacted returns a copy of c fit for logging: its secrets, whose env tags
+// say "secret", and the password in MongoURL are replaced by "[REDACTED]".
+func (c AppConfig) Redacted() AppConfig {
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if isSecret(v.Type().Field(i)) && v.Field(i).String() != "" {
+			v.Field(i).SetString(redacted)
+		}
+	}
+	c.MongoURL = mongoPassword.ReplaceAllString(c.MongoURL, "${1}"+redacted+"@")
+	return c
+}
+
+// Secrets returns the secrets in c which are set, including the password in
+// MongoURL, e.g. to redact them from logs.
+func (c AppConfig) Secrets() []string {
+	secrets := []string{}
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if isSecret(v.Type().Field(i)) && v.Field(i).String() != "" {
+			secrets = append(secrets, v.Field(i).String())
+		}
+	}
+	if match := mongoPassword.FindStringSubmatch(c.MongoURL); match != nil {
+		secrets = append(secrets, match[2])
+	}
+	return secrets
+}
+
+func isSecret(field reflect.StructField) bool {
+	options := strings.Split(field.Tag.Get("env"), ",")[1:]
+	for _, option := range options {
+		if option == "secret" {
+			return true
+		}
+	}
+	return false
+}
+
+// AppConfig contains the app config variables. The env tag of each names
+// the environment variable overriding it, after EnvPrefix, and says whether
+// it is secret.
 type AppConfig struct {
-	BackblazeAccountID      string
-	BackblazeApplicationKey string
-	BackblazeBucket         string
-	Debug                   bool
-	EmailUsername           string
-	EmailPassword           string
-	EmailSMTPServer         string
-	EmailPort               int
-	IBMUsername             string
-	IBMPassword             string
-	MongoURL                string
-	Port                    int
-	SecretKey               string
+	APIKeyMonthlyQuotaMinutes int            `env:"API_KEY_MONTHLY_QUOTA_MINUTES"`
+	BackblazeAccountID        string         `env:"BACKBLAZE_ACCOUNT_ID"`
+	BackblazeApplicationKey   string         `env:"BACKBLAZE_APPLICATION_KEY,secret"`
+	BackblazeBucket           string         `env:"BACKBLAZE_BUCKET"`
+	DataDir                   string         `env:"DATA_DIR"`
+	Debug                     bool           `env:"DEBUG"`
+	DisableRegistration       bool           `env:"DISABLE_REGISTRATION"`
+	EmailUsername             string         `env:"EMAIL_USERNAME"`
+	EmailPassword             string         `env:"EMAIL_PASSWORD,secret"`
+	EmailSMTPServer           string         `env:"EMAIL_SMTP_SERVER"`
+	EmailPort                 int            `env:"EMAIL_PORT"`
+	IBMUsername               string         `env:"IBM_USERNAME"`
+	IBMPassword               string         `env:"IBM_PASSWORD,secret"`
+	IdempotencyKeyHours       int            `env:"IDEMPOTENCY_KEY_HOURS"`
+	JobTimeoutMinutes         int            `env:"JOB_TIMEOUT_MINUTES"`
+	MaxConcurrentJobs         int            `env:"MAX_CONCURRENT_JOBS"`
+	MetricsToken              string         `env:"METRICS_TOKEN,secret"`
+	MonthlyQuotaMinutes       int            `env:"MONTHLY_QUOTA_MINUTES"`
+	MongoDatabase             string         `env:"MONGO_DATABASE"`
+	MongoURL                  string         `env:"MONGO_URL"`
+	Port                      int            `env:"PORT"`
+	PublicURL                 string         `env:"PUBLIC_URL"`
+	S3AccessKeyID             string         `env:"S3_ACCESS_KEY_ID"`
+	S3Bucket                  string         `env:"S3_BUCKET"`
+	S3Endpoint                string         `env:"S3_ENDPOINT"`
+	S3Region                  string         `env:"S3_REGION"`
+	S3SecretAccessKey         string         `env:"S3_SECRET_ACCESS_KEY,secret"`
+	SecretKey                 string         `env:"SECRET_KEY,secret"`
+	ShutdownGraceSeconds      int            `env:"SHUTDOWN_GRACE_SECONDS"`
+	StageTimeoutMinutes       map[string]int `env:"STAGE_TIMEOUT_MINUTES"`
+	StorageDriver             string         `env:"STORAGE_DRIVER"`
+	StoragePath               string         `env:"STORAGE_PATH"`
+	TempDir                   string         `env:"TEMP_DIR"`
+	UseWorkers                bool           `env:"USE_WORKERS"`
+	UserMonthlyQuotaMinutes   int            `env:"USER_MONTHLY_QUOTA_MINUTES"`
+	WatchDirs                 []string       `env:"WATCH_DIRS"`
+	WatchLanguage             string         `env:"WATCH_LANGUAGE"`
+	WebhookEvents             []string       `env:"WEBHOOK_EVENTS"`
+	WebhookSecret             string         `env:"WEBHOOK_SECRET,secret"`
+	WebhookURLs               []string       `env:"WEBHOOK_URLS"`
 }
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"net/url"
+
+	"github.com/juju/errors"
+)
+
+// Validate returns what is wrong with the settings in c, each problem naming
+// the settings at fault, or nothing if they make sense together. Settings
+// whose valid values are defined elsewhere, such as WatchLanguage and
+// StageTimeoutMinutes, are left to the packages which use them.
+func (c AppConfig) Validate() []error {
+	problems := []error{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, errors.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port != 0, "Port is not set; set it in the config file or %s", EnvVar("Port"))
+	check(c.Port >= 0 && c.Port < 65536, "Port %d is not between 1 and 65535", c.Port)
+	check(c.SecretKey != "", "SecretKey is not set; set it to a long random string, which signs the login cookies, in the config file or %s", EnvVar("SecretKey"))
+	if c.PublicURL != "" {
+		check(isHTTPURL(c.PublicURL), "PublicURL %q is not an http or https URL", c.PublicURL)
+	}
+
+	if c.EmailUsername != "" {
+		check(c.EmailPassword != "", "EmailPassword must be set when EmailUsername is")
+		check(c.EmailSMTPServer != "", "EmailSMTPServer must be set when EmailUsername is")
+		check(c.EmailPort != 0, "EmailPort must be set when EmailUsername is")
+	}
+	check(c.EmailPort >= 0 && c.EmailPort < 65536, "EmailPort %d is not between 1 and 65535", c.EmailPort)
+	check((c.IBMUsername == "") == (c.IBMPassword == ""), "IBMUsername and IBMPassword must be set together")
+
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"APIKeyMonthlyQuotaMinutes", c.APIKeyMonthlyQuotaMinutes},
+		{"IdempotencyKeyHours", c.IdempotencyKeyHours},
+		{"JobTimeoutMinutes", c.JobTimeoutMinutes},
+		{"MaxConcurrentJobs", c.MaxConcurrentJobs},
+		{"MonthlyQuotaMinutes", c.MonthlyQuotaMinutes},
+		{"ShutdownGraceSeconds", c.ShutdownGraceSeconds},
+		{"UserMonthlyQuotaMinutes", c.UserMonthlyQuotaMinutes},
+	} {
+		check(setting.value >= 0, "%s must not be negative, but is %d", setting.name, setting.value)
+	}
+
+	check(!c.UseWorkers || c.MongoURL != "", "UseWorkers requires MongoURL, since the workers share the job queue through MongoDB")
+	driver := c.StorageDriver
+	if driver == "" && c.BackblazeAccountID != "" {
+		// as in the server's setup
+		driver = "backblaze"
+	}
+	switch driver {
+	case "":
+	case "local":
+		check(c.StoragePath != "", "StoragePath must be set when StorageDriver is local")
+	case "s3":
+		check(c.S3Bucket != "", "S3Bucket must be set when StorageDriver is s3")
+		check((c.S3AccessKeyID == "") == (c.S3SecretAccessKey == ""), "S3AccessKeyID and S3SecretAccessKey must be set together")
+	case "backblaze":
+		check(c.BackblazeAccountID != "" && c.BackblazeApplicationKey != "" && c.BackblazeBucket != "",
+			"BackblazeAccountID, BackblazeApplicationKey and BackblazeBucket must be set when StorageDriver is backblaze")
+	default:
+		check(false, "StorageDriver %q is not one of local, s3 and backblaze", c.StorageDriver)
+	}
+
+	check(len(c.WatchDirs) == 0 || c.WatchLanguage != "", "WatchLanguage must be set when WatchDirs is")
+	for _, raw := range c.WebhookURLs {
+		check(isHTTPURL(raw), "WebhookURLs entry %q is not an http or https URL", raw)
+	}
+	check(len(c.WebhookEvents) == 0 && c.WebhookSecret == "" || len(c.WebhookURLs) > 0,
+		"WebhookEvents and WebhookSecret have no effect without WebhookURLs")
+	return problems
+}
+
+// isHTTPURL reports whether raw is an absolute http or https URL.
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// APIKey is a key granting access to the API. Only a hash of the key's
+// secret is stored.
+type APIKey struct {
+	ID        string `bson:"_id"`
+	Name      string
+	Hash      string
+	CreatedAt time.Time
+	RevokedAt time.Time
+	// RateLimit is the number of requests allowed per minute and MaxJobs
+	// the number of jobs which may run at once. Zero means the default.
+	RateLimit int
+	MaxJobs   int
+	// MonthlyMinutes is the number of audio minutes the key's jobs may
+	// transcribe each month. Zero means the default.
+	MonthlyMinutes int
+	// Org restricts the key to the jobs and transcripts of an organization,
+	// with the permissions of Role. Keys without an Org act for the whole
+	// instance.
+	Org  string
+	Role string
+}
+
+// Revoked reports whether the key has been revoked.
+func (k *APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// APIKeyRepository stores API keys. Get and Update return an error satisfying
+// errors.IsNotFound if there is no key with the id.
+type APIKeyRepository interface {
+	Create(k *APIKey) error
+	Get(id string) (*APIKey, error)
+	// List returns every key, oldest first.
+	List() ([]*APIKey, error)
+	Update(k *APIKey) error
+}
+
+type mongoAPIKeyRepository struct {
+	pool *Pool
+}
+
+// NewMongoAPIKeyRepository returns an APIKeyRepository storing keys in the
+// "apikeys" collection.
+func NewMongoAPIKeyRepository(pool *Pool) APIKeyRepository {
+	return &mongoAPIKeyRepository{pool: pool}
+}
+
+func (r *mongoAPIKeyRepository) Create(k *APIKey) error {
+	return r.pool.with("apikeys", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(k))
+	})
+}
+
+func (r *mongoAPIKeyRepository) Get(id string) (*APIKey, error) {
+	k := new(APIKey)
+	err := r.pool.with("apikeys", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(k), "API key %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (r *mongoAPIKeyRepository) List() ([]*APIKey, error) {
+	keys := []*APIKey{}
+	err := r.pool.with("apikeys", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(bson.M{}).Sort("createdat").All(&keys))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *mongoAPIKeyRepository) Update(k *APIKey) error {
+	return r.pool.with("apikeys", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(k.ID, k), "API key %q", k.ID)
+	})
+}
+
+type fileAPIKeyRepository struct {
+	c *fileCollection
+}
+
+// NewFileAPIKeyRepository returns an APIKeyRepository storing keys in the
+// JSON file at path.
+func NewFileAPIKeyRepository(path string) (APIKeyRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileAPIKeyRepository{c: c}, nil
+}
+
+func (r *fileAPIKeyRepository) Create(k *APIKey) error {
+	return r.c.insert(k.ID, k)
+}
+
+func (r *fileAPIKeyRepository) Get(id string) (*APIKey, error) {
+	k := new(APIKey)
+	if err := r.c.get(id, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (r *fileAPIKeyRepository) List() ([]*APIKey, error) {
+	keys := []*APIKey{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		k := new(APIKey)
+		if err := json.Unmarshal(raw, k); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(apiKeysByCreatedAt(keys))
+	return keys, nil
+}
+
+func (r *fileAPIKeyRepository) Update(k *APIKey) error {
+	return r.c.update(k.ID, k)
+}
+
+// apiKeysByCreatedAt sorts keys from least to most recently created.
+type apiKeysByCreatedAt []*APIKey
+
+func (s apiKeysByCreatedAt) Len() int           { return len(s) }
+func (s apiKeysByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s apiKeysByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Batch is a group of jobs submitted together from a manifest.
+type Batch struct {
+	ID             string `bson:"_id"`
+	Org            string
+	CreatedAt      time.Time
+	FinishedAt     time.Time
+	EmailAddresses []string
+	Jobs           []BatchJob
+}
+
+// BatchJob is a job belonging to a batch. Status is the name of the job's
+// tasks.Status, e.g. "SUCCESS".
+type BatchJob struct {
+	ID       string
+	AudioURL string
+	Status   string
+	// Error says why the job could not be queued, in which case it has no
+	// ID and its Status is FAILURE.
+	Error string `bson:",omitempty" json:",omitempty"`
+}
+
+// Finished reports whether every job of the batch has finished.
+func (b *Batch) Finished() bool {
+	return !b.FinishedAt.IsZero()
+}
+
+// BatchFilter selects batches in BatchRepository.List.
+type BatchFilter struct {
+	Unfinished bool
+}
+
+// BatchRepository stores batches. Get and Update return an error satisfying
+// errors.IsNotFound if there is no batch with the id.
+type BatchRepository interface {
+	Create(b *Batch) error
+	Get(id string) (*Batch, error)
+	// List returns the batches matching filter, most recent first.
+	List(filter BatchFilter) ([]*Batch, error)
+	Update(b *Batch) error
+}
+
+type mongoBatchRepository struct {
+	pool *Pool
+}
+
+// NewMongoBatchRepository returns a BatchRepository storing batches in the
+// "batches" collection.
+func NewMongoBatchRepository(pool *Pool) BatchRepository {
+	return &mongoBatchRepository{pool: pool}
+}
+
+func (r *mongoBatchRepository) Create(b *Batch) error {
+	return r.pool.with("batches", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(b))
+	})
+}
+
+func (r *mongoBatchRepository) Get(id string) (*Batch, error) {
+	b := new(Batch)
+	err := r.pool.with("batches", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(b), "batch %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (r *mongoBatchRepository) List(filter BatchFilter) ([]*Batch, error) {
+	query := bson.M{}
+	if filter.Unfinished {
+		query["finishedat"] = time.Time{}
+	}
+	batches := []*Batch{}
+	err := r.pool.with("batches", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(query).Sort("-createdat").All(&batches))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+func (r *mongoBatchRepository) Update(b *Batch) error {
+	return r.pool.with("batches", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(b.ID, b), "batch %q", b.ID)
+	})
+}
+
+type fileBatchRepository struct {
+	c *fileCollection
+}
+
+// NewFileBatchRepository returns a BatchRepository storing batches in the
+// JSON file at path.
+func NewFileBatchRepository(path string) (BatchRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileBatchRepository{c: c}, nil
+}
+
+func (r *fileBatchRepository) Create(b *Batch) error {
+	return r.c.insert(b.ID, b)
+}
+
+func (r *fileBatchRepository) Get(id string) (*Batch, error) {
+	b := new(Batch)
+	if err := r.c.get(id, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (r *fileBatchRepository) List(filter BatchFilter) ([]*Batch, error) {
+	batches := []*Batch{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		b := new(Batch)
+		if err := json.Unmarshal(raw, b); err != nil {
+			return err
+		}
+		if !filter.Unfinished || !b.Finished() {
+			batches = append(batches, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(batchesByCreatedAt(batches))
+	return batches, nil
+}
+
+func (r *fileBatchRepository) Update(b *Batch) error {
+	return r.c.update(b.ID, b)
+}
+
+// batchesByCreatedAt sorts batches from most to least recently created.
+type batchesByCreatedAt []*Batch
+
+func (s batchesByCreatedAt) Len() int           { return len(s) }
+func (s batchesByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s batchesByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.After(s[j].CreatedAt) }
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Checkpoint is the output of a finished stage of a job's pipeline, kept so
+// that the stage is not run again when the job is resumed or retried.
+type Checkpoint struct {
+	// ID is the job's id and the stage's name, separated by a slash.
+	ID    string `bson:"_id"`
+	Job   string
+	Stage string
+	// Data is the stage's output as JSON.
+	Data      string
+	CreatedAt time.Time
+}
+
+// checkpointID returns the id of the checkpoint of the stage of the job.
+func checkpointID(job string, stage string) string {
+	return job + "/" + stage
+}
+
+// CheckpointRepository stores checkpoints. Get returns an error satisfying
+// errors.IsNotFound if the stage has no checkpoint.
+type CheckpointRepository interface {
+	// Put stores c, whose ID is filled in, replacing any checkpoint of the
+	// same stage of the same job.
+	Put(c *Checkpoint) error
+	Get(job string, stage string) (*Checkpoint, error)
+	// List returns the checkpoints of the job, oldest first.
+	List(job string) ([]*Checkpoint, error)
+	// Delete removes the checkpoint of the stage of the job, if any.
+	Delete(job string, stage string) error
+	// DeleteJob removes every checkpoint of the job.
+	DeleteJob(job string) error
+}
+
+type mongoCheckpointRepository struct {
+	pool *Pool
+}
+
+// NewMongoCheckpointRepository returns a CheckpointRepository storing
+// checkpoints in the "checkpoints" collection, which it indexes by job.
+func NewMongoCheckpointRepository(pool *Pool) (CheckpointRepository, error) {
+	err := pool.with("checkpoints", func(c *mgo.Collection) error {
+		return errors.Trace(c.EnsureIndex(mgo.Index{Key: []string{"job"}}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoCheckpointRepository{pool: pool}, nil
+}
+
+func (r *mongoCheckpointRepository) Put(cp *Checkpoint) error {
+	cp.ID = checkpointID(cp.Job, cp.Stage)
+	return r.pool.with("checkpoints", func(c *mgo.Collection) error {
+		_, err := c.UpsertId(cp.ID, cp)
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoCheckpointRepository) Get(job string, stage string) (*Checkpoint, error) {
+	cp := new(Checkpoint)
+	err := r.pool.with("checkpoints", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(checkpointID(job, stage)).One(cp), "checkpoint of stage %q of job %q", stage, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (r *mongoCheckpointRepository) List(job string) ([]*Checkpoint, error) {
+	checkpoints := []*Checkpoint{}
+	err := r.pool.with("checkpoints", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(bson.M{"job": job}).Sort("createdat").All(&checkpoints))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+func (r *mongoCheckpointRepository) Delete(job string, stage string) error {
+	return r.pool.with("checkpoints", func(c *mgo.Collection) error {
+		err := c.RemoveId(checkpointID(job, stage))
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoCheckpointRepository) DeleteJob(job string) error {
+	return r.pool.with("checkpoints", func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"job": job})
+		return errors.Trace(err)
+	})
+}
+
+type fileCheckpointRepository struct {
+	c *fileCollection
+}
+
+// NewFileCheckpointRepository returns a CheckpointRepository storing
+// checkpoints in the JSON file at path.
+func NewFileCheckpointRepository(path string) (CheckpointRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileCheckpointRepository{c: c}, nil
+}
+
+func (r *fileCheckpointRepository) Put(cp *Checkpoint) error {
+	cp.ID = checkpointID(cp.Job, cp.Stage)
+	return r.c.upsert(cp.ID, cp)
+}
+
+func (r *fileCheckpointRepository) Get(job string, stage string) (*Checkpoint, error) {
+	cp := new(Checkpoint)
+	if err := r.c.get(checkpointID(job, stage), cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (r *fileCheckpointRepository) List(job string) ([]*Checkpoint, error) {
+	checkpoints := []*Checkpoint{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		cp := new(Checkpoint)
+		if err := json.Unmarshal(raw, cp); err != nil {
+			return err
+		}
+		if cp.Job == job {
+			checkpoints = append(checkpoints, cp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(checkpointsByCreatedAt(checkpoints))
+	return checkpoints, nil
+}
+
+func (r *fileCheckpointRepository) Delete(job string, stage string) error {
+	err := r.c.remove(checkpointID(job, stage))
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *fileCheckpointRepository) DeleteJob(job string) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		changed := false
+		for id, raw := range docs {
+			cp := new(Checkpoint)
+			if err := json.Unmarshal(raw, cp); err != nil {
+				return false, errors.Trace(err)
+			}
+			if cp.Job == job {
+				delete(docs, id)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// checkpointsByCreatedAt sorts checkpoints from least to most recently
+// created.
+type checkpointsByCreatedAt []*Checkpoint
+
+func (s checkpointsByCreatedAt) Len() int           { return len(s) }
+func (s checkpointsByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s checkpointsByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,159 @@
+// Package db implements persistence for transcripts and other records. Every
+// kind of record has a repository interface with a MongoDB implementation,
+// for production, and a JSON file implementation, for development and tests.
+package db
+
+import (
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// These are the application-wide repositories. They are set up by Open.
+var (
+	Transcripts     TranscriptRepository
+	Batches         BatchRepository
+	Feeds           FeedRepository
+	APIKeys         APIKeyRepository
+	Users           UserRepository
+	Jobs            JobRepository
+	Orgs            OrganizationRepository
+	IdempotencyKeys IdempotencyKeyRepository
+	JobLogs         JobLogRepository
+	Queue           QueueRepository
+	Schedules       ScheduleRepository
+	Checkpoints     CheckpointRepository
+)
+
+// Open sets up the application-wide repositories. If mongoURL is empty,
+// records are stored in JSON files inside dataDir instead of MongoDB.
+func Open(mongoURL string, database string, dataDir string) error {
+	if mongoURL == "" {
+		log.Infof("Storing records in %s", dataDir)
+		return openFiles(dataDir)
+	}
+
+	pool, err := Dial(mongoURL, database)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("Storing records in mongo database %s", database)
+	if Transcripts, err = NewMongoTranscriptRepository(pool); err != nil {
+		return errors.Trace(err)
+	}
+	Batches = NewMongoBatchRepository(pool)
+	Feeds = NewMongoFeedRepository(pool)
+	APIKeys = NewMongoAPIKeyRepository(pool)
+	if Users, err = NewMongoUserRepository(pool); err != nil {
+		return errors.Trace(err)
+	}
+	if Jobs, err = NewMongoJobRepository(pool); err != nil {
+		return errors.Trace(err)
+	}
+	Orgs = NewMongoOrganizationRepository(pool)
+	IdempotencyKeys = NewMongoIdempotencyKeyRepository(pool)
+	JobLogs = NewMongoJobLogRepository(pool)
+	if Queue, err = NewMongoQueueRepository(pool); err != nil {
+		return errors.Trace(err)
+	}
+	Schedules = NewMongoScheduleRepository(pool)
+	if Checkpoints, err = NewMongoCheckpointRepository(pool); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func openFiles(dataDir string) error {
+	var err error
+	if Transcripts, err = NewFileTranscriptRepository(filepath.Join(dataDir, "transcripts.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Batches, err = NewFileBatchRepository(filepath.Join(dataDir, "batches.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Feeds, err = NewFileFeedRepository(filepath.Join(dataDir, "feeds.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if APIKeys, err = NewFileAPIKeyRepository(filepath.Join(dataDir, "apikeys.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Users, err = NewFileUserRepository(filepath.Join(dataDir, "users.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Jobs, err = NewFileJobRepository(filepath.Join(dataDir, "jobs.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Orgs, err = NewFileOrganizationRepository(filepath.Join(dataDir, "organizations.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if IdempotencyKeys, err = NewFileIdempotencyKeyRepository(filepath.Join(dataDir, "idempotencykeys.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if JobLogs, err = NewFileJobLogRepository(filepath.Join(dataDir, "joblogs.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Queue, err = NewFileQueueRepository(filepath.Join(dataDir, "queue.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Schedules, err = NewFileScheduleRepository(filepath.Join(dataDir, "schedules.json")); err != nil {
+		return errors.Trace(err)
+	}
+	if Checkpoints, err = NewFileCheckpointRepository(filepath.Join(dataDir, "checkpoints.json")); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+type mgoLogger struct{}
+
+func (mgoLogger) Output(_ int, s string) error {
+	log.Debug(s)
+	return nil
+}
+
+// Pool shares a single MongoDB connection pool between repositories. Each
+// operation runs on a copy of the pool's session, which borrows a socket from
+// the pool and returns it when the operation is done.
+type Pool struct {
+	session  *mgo.Session
+	database string
+}
+
+// Dial connects to the MongoDB instance at url. Records are stored in the
+// given database.
+func Dial(url string, database string) (*Pool, error) {
+	mgo.SetLogger(mgoLogger{})
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	session.SetMode(mgo.Monotonic, true)
+
+	if database == "" {
+		database = "database"
+	}
+	return &Pool{session: session, database: database}, nil
+}
+
+// Close closes every connection in the pool.
+func (p *Pool) Close() {
+	p.session.Close()
+}
+
+// with runs fn on the named collection using a copy of the pool's session.
+func (p *Pool) with(collection string, fn func(*mgo.Collection) error) error {
+	session := p.session.Copy()
+	defer session.Close()
+	return fn(session.DB(p.database).C(collection))
+}
+
+// mongoError converts mgo.ErrNotFound into an error satisfying
+// errors.IsNotFound and traces any other error.
+func mongoError(err error, format string, args ...interface{}) error {
+	if err == mgo.ErrNotFound {
+		return errors.NotFoundf(format, args...)
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,400 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempPath(t *testing.T, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func TestFileTranscriptRepositoryCRUD(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "transcripts.json")
+	defer cleanup()
+
+	repo, err := NewFileTranscriptRepository(path)
+	assert.NoError(err)
+
+	assert.NoError(repo.Create(&Transcript{ID: "a", Transcript: "hello"}))
+	assert.True(errors.IsAlreadyExists(repo.Create(&Transcript{ID: "a"})))
+
+	transcript, err := repo.Get("a")
+	assert.NoError(err)
+	assert.Equal("hello", transcript.Transcript)
+
+	transcript.Transcript = "goodbye"
+	assert.NoError(repo.Update(transcript))
+	assert.True(errors.IsNotFound(repo.Update(&Transcript{ID: "b"})))
+
+	// records survive reopening the file
+	repo, err = NewFileTranscriptRepository(path)
+	assert.NoError(err)
+	transcript, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Equal("goodbye", transcript.Transcript)
+
+	assert.NoError(repo.Delete("a"))
+	_, err = repo.Get("a")
+	assert.True(errors.IsNotFound(err))
+	assert.True(errors.IsNotFound(repo.Delete("a")))
+}
+
+func TestFileTranscriptRepositoryList(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "transcripts.json")
+	defer cleanup()
+
+	repo, err := NewFileTranscriptRepository(path)
+	assert.NoError(err)
+
+	now := time.Now()
+	assert.NoError(repo.Create(&Transcript{ID: "old", AudioURL: "one.mp3", CompletedAt: now.Add(-2 * time.Hour)}))
+	assert.NoError(repo.Create(&Transcript{ID: "mid", AudioURL: "two.mp3", CompletedAt: now.Add(-time.Hour)}))
+	assert.NoError(repo.Create(&Transcript{ID: "new", AudioURL: "one.mp3", ContentKey: "k1", CompletedAt: now}))
+
+	ids := func(transcripts []*Transcript) []string {
+		result := []string{}
+		for _, t := range transcripts {
+			result = append(result, t.ID)
+		}
+		return result
+	}
+
+	all, err := repo.List(TranscriptFilter{})
+	assert.NoError(err)
+	assert.Equal([]string{"new", "mid", "old"}, ids(all))
+
+	byURL, err := repo.List(TranscriptFilter{AudioURL: "one.mp3"})
+	assert.NoError(err)
+	assert.Equal([]string{"new", "old"}, ids(byURL))
+
+	byKey, err := repo.List(TranscriptFilter{ContentKey: "k1"})
+	assert.NoError(err)
+	assert.Equal([]string{"new"}, ids(byKey))
+
+	recent, err := repo.List(TranscriptFilter{CompletedAfter: now.Add(-90 * time.Minute)})
+	assert.NoError(err)
+	assert.Equal([]string{"new", "mid"}, ids(recent))
+
+	paged, err := repo.List(TranscriptFilter{Offset: 1, Limit: 1})
+	assert.NoError(err)
+	assert.Equal([]string{"mid"}, ids(paged))
+
+	beyond, err := repo.List(TranscriptFilter{Offset: 5})
+	assert.NoError(err)
+	assert.Empty(beyond)
+}
+
+func TestFileUserRepositoryUniqueEmail(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "users.json")
+	defer cleanup()
+
+	repo, err := NewFileUserRepository(path)
+	assert.NoError(err)
+
+	assert.NoError(repo.Create(&User{ID: "a", Email: " Ada@Example.com"}))
+	assert.True(errors.IsAlreadyExists(repo.Create(&User{ID: "b", Email: "ada@example.com"})))
+	assert.NoError(repo.Create(&User{ID: "b", Email: "grace@example.com"}))
+
+	u, err := repo.GetByEmail("ADA@example.com")
+	assert.NoError(err)
+	assert.Equal("a", u.ID)
+	_, err = repo.GetByEmail("nobody@example.com")
+	assert.True(errors.IsNotFound(err))
+
+	u.Email = "grace@example.com"
+	assert.True(errors.IsAlreadyExists(repo.Update(u)))
+	u.Email = "ada@example.org"
+	assert.NoError(repo.Update(u))
+}
+
+func TestFileJobRepositoryList(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "jobs.json")
+	defer cleanup()
+
+	repo, err := NewFileJobRepository(path)
+	assert.NoError(err)
+
+	start := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, owner := range []string{"ada", "grace", "ada", "ada"} {
+		assert.NoError(repo.Create(&Job{
+			ID:           string('a' + rune(i)),
+			Owner:        owner,
+			Status:       "SUCCESS",
+			CreatedAt:    start.Add(time.Duration(i) * time.Hour),
+			AudioSeconds: float64(60 * (i + 1)),
+		}))
+	}
+	j, err := repo.Get("b")
+	assert.NoError(err)
+	j.APIKey = "key"
+	j.ShareToken = "token"
+	j.Labels = map[string]string{"source": "api", "engine": "ibm"}
+	assert.NoError(repo.Update(j))
+
+	jobs, err := repo.List(JobFilter{Owner: "ada"})
+	assert.NoError(err)
+	assert.Len(jobs, 3)
+	assert.Equal("d", jobs[0].ID)
+
+	jobs, err = repo.List(JobFilter{Owner: "ada", Offset: 1, Limit: 1})
+	assert.NoError(err)
+	assert.Len(jobs, 1)
+	assert.Equal("c", jobs[0].ID)
+
+	jobs, err = repo.List(JobFilter{Status: "FAILURE"})
+	assert.NoError(err)
+	assert.Empty(jobs)
+
+	jobs, err = repo.List(JobFilter{ShareToken: "token"})
+	assert.NoError(err)
+	if assert.Len(jobs, 1) {
+		assert.Equal("b", jobs[0].ID)
+	}
+
+	jobs, err = repo.List(JobFilter{Labels: map[string]string{"source": "api"}})
+	assert.NoError(err)
+	if assert.Len(jobs, 1) {
+		assert.Equal("b", jobs[0].ID)
+	}
+	jobs, err = repo.List(JobFilter{Labels: map[string]string{"source": "api", "engine": "other"}})
+	assert.NoError(err)
+	assert.Empty(jobs)
+
+	jobs, err = repo.List(JobFilter{CreatedSince: start.Add(time.Hour), CreatedBefore: start.Add(3 * time.Hour)})
+	assert.NoError(err)
+	assert.Len(jobs, 2)
+	assert.Equal("c", jobs[0].ID)
+	assert.Equal("b", jobs[1].ID)
+
+	totals, err := repo.SumAudio(JobFilter{CreatedSince: start.Add(time.Hour)}, "ada", "key")
+	assert.NoError(err)
+	assert.Equal(AudioTotals{All: 540, Owner: 420, APIKey: 120}, totals)
+	totals, err = repo.SumAudio(JobFilter{}, "", "")
+	assert.NoError(err)
+	assert.Equal(AudioTotals{All: 600}, totals)
+
+	assert.NoError(repo.Transition("a", "SUCCESS", "FAILURE"))
+	assert.True(errors.IsNotFound(repo.Transition("a", "SUCCESS", "FAILURE")))
+	assert.True(errors.IsNotFound(repo.Transition("z", "SUCCESS", "FAILURE")))
+	j, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Equal("FAILURE", j.Status)
+
+	assert.NoError(repo.Delete("a"))
+	assert.True(errors.IsNotFound(repo.Delete("a")))
+	_, err = repo.Get("a")
+	assert.True(errors.IsNotFound(err))
+}
+
+func TestFileScheduleRepositoryAdvance(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "schedules.json")
+	defer cleanup()
+
+	repo, err := NewFileScheduleRepository(path)
+	assert.NoError(err)
+	due := time.Date(2016, 6, 1, 2, 0, 0, 0, time.UTC)
+	assert.NoError(repo.Create(&Schedule{ID: "nightly", NextRun: due}))
+
+	next := due.Add(24 * time.Hour)
+	assert.NoError(repo.Advance("nightly", due, next))
+	// another process which saw the same run is too late
+	assert.True(errors.IsNotFound(repo.Advance("nightly", due, next)))
+	s, err := repo.Get("nightly")
+	assert.NoError(err)
+	assert.True(next.Equal(s.NextRun))
+}
+
+func TestFileCheckpointRepository(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "checkpoints.json")
+	defer cleanup()
+
+	repo, err := NewFileCheckpointRepository(path)
+	assert.NoError(err)
+	now := time.Now()
+	assert.NoError(repo.Put(&Checkpoint{Job: "a", Stage: "fetch", Data: `{"key":"1"}`, CreatedAt: now}))
+	assert.NoError(repo.Put(&Checkpoint{Job: "a", Stage: "transcribe-chunk-1", Data: "{}", CreatedAt: now.Add(time.Second)}))
+	assert.NoError(repo.Put(&Checkpoint{Job: "b", Stage: "fetch", Data: "{}", CreatedAt: now}))
+	// a stage which runs again replaces its checkpoint
+	assert.NoError(repo.Put(&Checkpoint{Job: "a", Stage: "fetch", Data: `{"key":"2"}`, CreatedAt: now}))
+
+	cp, err := repo.Get("a", "fetch")
+	assert.NoError(err)
+	assert.Equal(`{"key":"2"}`, cp.Data)
+	_, err = repo.Get("a", "split")
+	assert.True(errors.IsNotFound(err))
+
+	list, err := repo.List("a")
+	assert.NoError(err)
+	if assert.Len(list, 2) {
+		assert.Equal("fetch", list[0].Stage)
+		assert.Equal("transcribe-chunk-1", list[1].Stage)
+	}
+
+	assert.NoError(repo.Delete("a", "transcribe-chunk-1"))
+	assert.NoError(repo.Delete("a", "transcribe-chunk-1"))
+	assert.NoError(repo.DeleteJob("a"))
+	list, err = repo.List("a")
+	assert.NoError(err)
+	assert.Empty(list)
+	_, err = repo.Get("b", "fetch")
+	assert.NoError(err)
+}
+
+func TestFileJobLogRepositoryAppend(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "joblogs.json")
+	defer cleanup()
+
+	repo, err := NewFileJobLogRepository(path)
+	assert.NoError(err)
+
+	entries, err := repo.Get("a")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	assert.NoError(repo.Append("a", []LogEntry{{Message: "one"}}))
+	assert.NoError(repo.Append("a", []LogEntry{{Message: "two"}, {Message: "three"}}))
+	entries, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Equal([]LogEntry{{Message: "one"}, {Message: "two"}, {Message: "three"}}, entries)
+
+	many := make([]LogEntry, MaxLogEntries)
+	many[MaxLogEntries-1].Message = "last"
+	assert.NoError(repo.Append("a", many))
+	entries, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Len(entries, MaxLogEntries)
+	assert.Equal("last", entries[MaxLogEntries-1].Message)
+
+	assert.NoError(repo.Delete("a"))
+	entries, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Empty(entries)
+	// jobs which have logged nothing have nothing to delete
+	assert.NoError(repo.Delete("a"))
+}
+
+func TestFileQueueRepositoryLease(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "queue.json")
+	defer cleanup()
+
+	repo, err := NewFileQueueRepository(path)
+	assert.NoError(err)
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.NoError(repo.Enqueue("b", 0, "", now.Add(time.Second)))
+	assert.NoError(repo.Enqueue("a", 0, "", now))
+	assert.True(errors.IsAlreadyExists(repo.Enqueue("a", 0, "", now)))
+
+	// the job which has waited longest is leased first
+	e, err := repo.Lease("w1", now, time.Minute)
+	assert.NoError(err)
+	assert.Equal("a", e.ID)
+	assert.Equal("w1", e.Worker)
+	e, err = repo.Lease("w2", now, time.Minute)
+	assert.NoError(err)
+	assert.Equal("b", e.ID)
+	_, err = repo.Lease("w2", now, time.Minute)
+	assert.True(errors.IsNotFound(err))
+
+	// a lapsed lease can be taken by another worker
+	assert.NoError(repo.Renew("a", "w1", now.Add(30*time.Second), time.Minute))
+	e, err = repo.Lease("w3", now.Add(80*time.Second), time.Minute)
+	assert.NoError(err)
+	assert.Equal("b", e.ID)
+	e, err = repo.Lease("w3", now.Add(100*time.Second), time.Minute)
+	assert.NoError(err)
+	assert.Equal("a", e.ID)
+	assert.True(errors.IsNotFound(repo.Renew("a", "w1", now.Add(100*time.Second), time.Minute)))
+
+	assert.NoError(repo.Release("a", "w3"))
+	e, err = repo.Get("a")
+	assert.NoError(err)
+	assert.Empty(e.Worker)
+
+	n, err := repo.Count()
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.NoError(repo.Remove("a"))
+	assert.True(errors.IsNotFound(repo.Remove("a")))
+
+	// jobs with a higher priority jump the queue
+	assert.NoError(repo.Enqueue("c", 0, "", now))
+	assert.NoError(repo.Enqueue("urgent", 1, "", now.Add(time.Minute)))
+	e, err = repo.Lease("w4", now.Add(time.Hour), time.Minute)
+	assert.NoError(err)
+	assert.Equal("urgent", e.ID)
+
+	entries, err := repo.List()
+	assert.NoError(err)
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal([]string{"urgent", "c", "b"}, ids)
+	assert.Equal("w4", entries[0].Worker)
+
+	// only jobs which no worker has leased can be removed while waiting
+	assert.True(errors.IsNotFound(repo.RemoveWaiting("urgent")))
+	assert.NoError(repo.RemoveWaiting("c"))
+	assert.True(errors.IsNotFound(repo.RemoveWaiting("c")))
+}
+
+func TestFileQueueRepositoryTakesTurnsWithinPriorities(t *testing.T) {
+	assert := assert.New(t)
+	path, cleanup := tempPath(t, "queue.json")
+	defer cleanup()
+
+	repo, err := NewFileQueueRepository(path)
+	assert.NoError(err)
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	queue := func(id string, submitter string, priority int) {
+		now = now.Add(time.Second)
+		assert.NoError(repo.Enqueue(id, priority, submitter, now))
+	}
+	queue("backfill", "archive", -1)
+	for _, id := range []string{"a1", "a2", "a3"} {
+		queue(id, "alice", 0)
+	}
+	queue("b1", "bob", 0)
+	queue("urgent", "press", 1)
+	queue("a4", "alice", 0)
+
+	order := []string{}
+	for {
+		now = now.Add(time.Second)
+		e, err := repo.Lease("w", now, time.Hour)
+		if errors.IsNotFound(err) {
+			break
+		}
+		assert.NoError(err)
+		order = append(order, e.ID)
+	}
+	assert.Equal([]string{"urgent", "a1", "b1", "a2", "a3", "a4", "backfill"}, order)
+
+	// a submitter who has not leased for a while goes before one who just has
+	queue("a5", "alice", 0)
+	queue("b2", "bob", 0)
+	now = now.Add(time.Second)
+	e, err := repo.Lease("w", now, time.Hour)
+	assert.NoError(err)
+	assert.Equal("b2", e.ID)
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Feed is a subscription to a podcast's RSS or Atom feed. New episodes are
+// transcribed with the feed's options.
+type Feed struct {
+	ID             string `bson:"_id"`
+	Org            string
+	URL            string
+	Title          string
+	CreatedAt      time.Time
+	PolledAt       time.Time
+	LastError      string
+	EmailAddresses []string
+	SearchWords    []string
+	Language       string
+	// Seen holds the keys of every episode found in the feed so far.
+	Seen []string
+}
+
+// HasSeen reports whether the episode with the given key was found before.
+func (f *Feed) HasSeen(key string) bool {
+	for _, seen := range f.Seen {
+		if seen == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Episode describes a podcast episode.
+type Episode struct {
+	FeedID       string
+	FeedTitle    string
+	Key          string
+	Title        string
+	Link         string
+	Description  string
+	PublishedAt  time.Time
+	EnclosureURL string
+}
+
+// FeedRepository stores feeds. Get, Update and Delete return an error
+// satisfying errors.IsNotFound if there is no feed with the id.
+type FeedRepository interface {
+	Create(f *Feed) error
+	Get(id string) (*Feed, error)
+	// List returns every feed, oldest first.
+	List() ([]*Feed, error)
+	Update(f *Feed) error
+	Delete(id string) error
+}
+
+type mongoFeedRepository struct {
+	pool *Pool
+}
+
+// NewMongoFeedRepository returns a FeedRepository storing feeds in the
+// "feeds" collection.
+func NewMongoFeedRepository(pool *Pool) FeedRepository {
+	return &mongoFeedRepository{pool: pool}
+}
+
+func (r *mongoFeedRepository) Create(f *Feed) error {
+	return r.pool.with("feeds", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(f))
+	})
+}
+
+func (r *mongoFeedRepository) Get(id string) (*Feed, error) {
+	f := new(Feed)
+	err := r.pool.with("feeds", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(f), "feed %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *mongoFeedRepository) List() ([]*Feed, error) {
+	feeds := []*Feed{}
+	err := r.pool.with("feeds", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(bson.M{}).Sort("createdat").All(&feeds))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+func (r *mongoFeedRepository) Update(f *Feed) error {
+	return r.pool.with("feeds", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(f.ID, f), "feed %q", f.ID)
+	})
+}
+
+func (r *mongoFeedRepository) Delete(id string) error {
+	return r.pool.with("feeds", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "feed %q", id)
+	})
+}
+
+type fileFeedRepository struct {
+	c *fileCollection
+}
+
+// NewFileFeedRepository returns a FeedRepository storing feeds in the JSON
+// file at path.
+func NewFileFeedRepository(path string) (FeedRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileFeedRepository{c: c}, nil
+}
+
+func (r *fileFeedRepository) Create(f *Feed) error {
+	return r.c.insert(f.ID, f)
+}
+
+func (r *fileFeedRepository) Get(id string) (*Feed, error) {
+	f := new(Feed)
+	if err := r.c.get(id, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *fileFeedRepository) List() ([]*Feed, error) {
+	feeds := []*Feed{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		f := new(Feed)
+		if err := json.Unmarshal(raw, f); err != nil {
+			return err
+		}
+		feeds = append(feeds, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(feedsByCreatedAt(feeds))
+	return feeds, nil
+}
+
+func (r *fileFeedRepository) Update(f *Feed) error {
+	return r.c.update(f.ID, f)
+}
+
+func (r *fileFeedRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+// feedsByCreatedAt sorts feeds from least to most recently created.
+type feedsByCreatedAt []*Feed
+
+func (s feedsByCreatedAt) Len() int           { return len(s) }
+func (s feedsByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s feedsByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
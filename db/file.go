@@ -0,0 +1,155 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// fileCollection is a set of JSON documents keyed by id. Documents are kept in
+// memory and every change is written through to a single file.
+type fileCollection struct {
+	sync.RWMutex
+	path string
+	docs map[string]json.RawMessage
+}
+
+// openFileCollection loads the collection stored at path, which need not
+// exist yet.
+func openFileCollection(path string) (*fileCollection, error) {
+	c := &fileCollection{
+		path: path,
+		docs: make(map[string]json.RawMessage),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := json.Unmarshal(data, &c.docs); err != nil {
+		return nil, errors.Annotatef(err, "reading %s", path)
+	}
+	return c, nil
+}
+
+// save writes every document to disk. The caller must hold the write lock.
+func (c *fileCollection) save() error {
+	data, err := json.Marshal(c.docs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// write to a temporary file first so a crash never leaves a partial file
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, c.path))
+}
+
+// get decodes the document with the given id into v.
+func (c *fileCollection) get(id string, v interface{}) error {
+	c.RLock()
+	raw, ok := c.docs[id]
+	c.RUnlock()
+	if !ok {
+		return errors.NotFoundf("record %q", id)
+	}
+	return errors.Trace(json.Unmarshal(raw, v))
+}
+
+// insert adds v under id, failing if a document with that id exists.
+func (c *fileCollection) insert(id string, v interface{}) error {
+	return c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		if _, ok := docs[id]; ok {
+			return false, errors.AlreadyExistsf("record %q", id)
+		}
+		return true, setDoc(docs, id, v)
+	})
+}
+
+// update replaces the document with the given id by v.
+func (c *fileCollection) update(id string, v interface{}) error {
+	return c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		if _, ok := docs[id]; !ok {
+			return false, errors.NotFoundf("record %q", id)
+		}
+		return true, setDoc(docs, id, v)
+	})
+}
+
+// upsert stores v under id whether or not a document with that id exists.
+func (c *fileCollection) upsert(id string, v interface{}) error {
+	return c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		return true, setDoc(docs, id, v)
+	})
+}
+
+// remove deletes the document with the given id.
+func (c *fileCollection) remove(id string) error {
+	return c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		if _, ok := docs[id]; !ok {
+			return false, errors.NotFoundf("record %q", id)
+		}
+		delete(docs, id)
+		return true, nil
+	})
+}
+
+// each calls fn with every document until fn returns an error.
+func (c *fileCollection) each(fn func(raw json.RawMessage) error) error {
+	c.RLock()
+	defer c.RUnlock()
+	for _, raw := range c.docs {
+		if err := fn(raw); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// apply runs fn with exclusive access to the documents. If fn reports a
+// change, the documents are saved afterwards.
+func (c *fileCollection) apply(fn func(docs map[string]json.RawMessage) (bool, error)) error {
+	c.Lock()
+	defer c.Unlock()
+	changed, err := fn(c.docs)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	return c.save()
+}
+
+func setDoc(docs map[string]json.RawMessage, id string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	docs[id] = raw
+	return nil
+}
+
+// page returns the bounds of the slice of n sorted records selected by
+// offset and limit. A limit of zero selects every remaining record.
+func page(n int, offset int, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
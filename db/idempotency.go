@@ -0,0 +1,136 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IdempotencyKey records a request sent with an Idempotency-Key header, so
+// that retries of the request get its original result.
+type IdempotencyKey struct {
+	// ID combines who sent the request with the key they chose.
+	ID string `bson:"_id"`
+	// RequestHash is a hash of the request's method, URL and body.
+	RequestHash string
+	// Result is the id of the job or batch created by the request, or empty
+	// while the request is being handled.
+	Result    string
+	CreatedAt time.Time
+}
+
+// IdempotencyKeyRepository stores idempotency keys. Create returns an error
+// satisfying errors.IsAlreadyExists if there is a key with the id, and Get,
+// Update and Delete an error satisfying errors.IsNotFound if there is none.
+type IdempotencyKeyRepository interface {
+	Create(k *IdempotencyKey) error
+	Get(id string) (*IdempotencyKey, error)
+	Update(k *IdempotencyKey) error
+	Delete(id string) error
+	// DeleteCreatedBefore deletes every key created before t.
+	DeleteCreatedBefore(t time.Time) error
+}
+
+type mongoIdempotencyKeyRepository struct {
+	pool *Pool
+}
+
+// NewMongoIdempotencyKeyRepository returns an IdempotencyKeyRepository
+// storing keys in the "idempotencykeys" collection.
+func NewMongoIdempotencyKeyRepository(pool *Pool) IdempotencyKeyRepository {
+	return &mongoIdempotencyKeyRepository{pool: pool}
+}
+
+func (r *mongoIdempotencyKeyRepository) Create(k *IdempotencyKey) error {
+	return r.pool.with("idempotencykeys", func(c *mgo.Collection) error {
+		err := c.Insert(k)
+		if mgo.IsDup(err) {
+			return errors.AlreadyExistsf("idempotency key %q", k.ID)
+		}
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoIdempotencyKeyRepository) Get(id string) (*IdempotencyKey, error) {
+	k := new(IdempotencyKey)
+	err := r.pool.with("idempotencykeys", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(k), "idempotency key %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (r *mongoIdempotencyKeyRepository) Update(k *IdempotencyKey) error {
+	return r.pool.with("idempotencykeys", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(k.ID, k), "idempotency key %q", k.ID)
+	})
+}
+
+func (r *mongoIdempotencyKeyRepository) Delete(id string) error {
+	return r.pool.with("idempotencykeys", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "idempotency key %q", id)
+	})
+}
+
+func (r *mongoIdempotencyKeyRepository) DeleteCreatedBefore(t time.Time) error {
+	return r.pool.with("idempotencykeys", func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"createdat": bson.M{"$lt": t}})
+		return errors.Trace(err)
+	})
+}
+
+type fileIdempotencyKeyRepository struct {
+	c *fileCollection
+}
+
+// NewFileIdempotencyKeyRepository returns an IdempotencyKeyRepository
+// storing keys in the JSON file at path.
+func NewFileIdempotencyKeyRepository(path string) (IdempotencyKeyRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileIdempotencyKeyRepository{c: c}, nil
+}
+
+func (r *fileIdempotencyKeyRepository) Create(k *IdempotencyKey) error {
+	return r.c.insert(k.ID, k)
+}
+
+func (r *fileIdempotencyKeyRepository) Get(id string) (*IdempotencyKey, error) {
+	k := new(IdempotencyKey)
+	if err := r.c.get(id, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (r *fileIdempotencyKeyRepository) Update(k *IdempotencyKey) error {
+	return r.c.update(k.ID, k)
+}
+
+func (r *fileIdempotencyKeyRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+func (r *fileIdempotencyKeyRepository) DeleteCreatedBefore(t time.Time) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		changed := false
+		for id, raw := range docs {
+			k := new(IdempotencyKey)
+			if err := json.Unmarshal(raw, k); err != nil {
+				return false, errors.Trace(err)
+			}
+			if k.CreatedAt.Before(t) {
+				delete(docs, id)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaxLogEntries is the number of log entries kept for each job. Older entries
+// are dropped.
+const MaxLogEntries = 1000
+
+// LogEntry is a log message about a job.
+type LogEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	// Fields are the entry's other fields, such as "error".
+	Fields map[string]string `bson:",omitempty" json:",omitempty"`
+}
+
+// jobLog is the log of a job as stored.
+type jobLog struct {
+	ID      string `bson:"_id"`
+	Entries []LogEntry
+}
+
+// JobLogRepository stores the log entries of jobs.
+type JobLogRepository interface {
+	// Append adds entries to the log of the job with the given id.
+	Append(jobID string, entries []LogEntry) error
+	// Get returns the log entries of the job with the given id, oldest
+	// first. Jobs which have logged nothing have no entries.
+	Get(jobID string) ([]LogEntry, error)
+	// Delete removes the log of the job with the given id, if any.
+	Delete(jobID string) error
+}
+
+type mongoJobLogRepository struct {
+	pool *Pool
+}
+
+// NewMongoJobLogRepository returns a JobLogRepository storing logs in the
+// "joblogs" collection.
+func NewMongoJobLogRepository(pool *Pool) JobLogRepository {
+	return &mongoJobLogRepository{pool: pool}
+}
+
+func (r *mongoJobLogRepository) Append(jobID string, entries []LogEntry) error {
+	return r.pool.with("joblogs", func(c *mgo.Collection) error {
+		_, err := c.UpsertId(jobID, bson.M{"$push": bson.M{"entries": bson.M{
+			"$each":  entries,
+			"$slice": -MaxLogEntries,
+		}}})
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoJobLogRepository) Get(jobID string) ([]LogEntry, error) {
+	l := new(jobLog)
+	err := r.pool.with("joblogs", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(jobID).One(l), "log of job %q", jobID)
+	})
+	if errors.IsNotFound(err) {
+		return []LogEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.Entries, nil
+}
+
+func (r *mongoJobLogRepository) Delete(jobID string) error {
+	return r.pool.with("joblogs", func(c *mgo.Collection) error {
+		err := c.RemoveId(jobID)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return errors.Trace(err)
+	})
+}
+
+type fileJobLogRepository struct {
+	c *fileCollection
+}
+
+// NewFileJobLogRepository returns a JobLogRepository storing logs in the JSON
+// file at path.
+func NewFileJobLogRepository(path string) (JobLogRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileJobLogRepository{c: c}, nil
+}
+
+func (r *fileJobLogRepository) Append(jobID string, entries []LogEntry) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		l := &jobLog{ID: jobID}
+		if raw, ok := docs[jobID]; ok {
+			if err := json.Unmarshal(raw, l); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		l.Entries = append(l.Entries, entries...)
+		if len(l.Entries) > MaxLogEntries {
+			l.Entries = l.Entries[len(l.Entries)-MaxLogEntries:]
+		}
+		return true, setDoc(docs, jobID, l)
+	})
+}
+
+func (r *fileJobLogRepository) Get(jobID string) ([]LogEntry, error) {
+	l := new(jobLog)
+	err := r.c.get(jobID, l)
+	if errors.IsNotFound(err) {
+		return []LogEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.Entries, nil
+}
+
+func (r *fileJobLogRepository) Delete(jobID string) error {
+	err := r.c.remove(jobID)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,374 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Job records a transcription job and who submitted it. Its id is the id of
+// the task running the job, and of the transcript it produces. Jobs without
+// an Org belong to their Owner alone.
+type Job struct {
+	ID          string `bson:"_id"`
+	Owner       string
+	APIKey      string
+	Org         string
+	AudioURL    string
+	Language    string
+	SearchWords []string
+	// EmailAddresses, Force and Episode complete the description of jobs
+	// submitted through transcription.Submit, which are Resumable: if the
+	// server stops before they finish, the next process runs them again.
+	EmailAddresses []string `bson:",omitempty" json:",omitempty"`
+	Force          bool     `bson:",omitempty" json:",omitempty"`
+	Episode        *Episode `bson:",omitempty" json:",omitempty"`
+	Resumable      bool     `bson:",omitempty" json:",omitempty"`
+	// Priority is the name of the job's tasks.Priority, e.g. "HIGH", or
+	// empty for the default.
+	Priority string `bson:",omitempty" json:",omitempty"`
+	// StartAt is when a job which was scheduled to start later does so.
+	StartAt time.Time `bson:",omitempty" json:",omitempty"`
+	// TimeoutMinutes and StageTimeoutMinutes, by stage, override the
+	// configured time limits of each attempt at the job and of its stages.
+	TimeoutMinutes      int            `bson:",omitempty" json:",omitempty"`
+	StageTimeoutMinutes map[string]int `bson:",omitempty" json:",omitempty"`
+	// Labels describe the job, e.g. how it was submitted, and are given to
+	// its tasks. Their keys are listed with tasks.SourceLabel.
+	Labels map[string]string `bson:",omitempty" json:",omitempty"`
+	// ShareToken, if set, lets anyone holding it see the job's page and
+	// transcript, at /shared/<token>.
+	ShareToken string `bson:",omitempty" json:",omitempty"`
+	// Attempts is the number of times the job has been started.
+	Attempts int
+	// Status is the name of the job's tasks.Status, e.g. "SUCCESS".
+	Status     string
+	Error      string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	// AudioSeconds is the length of the audio sent for transcription, which
+	// is how the speech-to-text service bills.
+	AudioSeconds float64
+	// Stages records the latest run of each stage of the job's pipeline
+	// which has started, in the order they first started.
+	Stages []Stage `bson:",omitempty" json:",omitempty"`
+}
+
+// Stage records the latest run of a stage of a job's pipeline, such as
+// "fetch" or "transcribe-chunk-2".
+type Stage struct {
+	Name string
+	// Status is the name of the stage's tasks.Status: INPROGRESS, SUCCESS,
+	// FAILURE or TIMEDOUT.
+	Status     string
+	Attempts   int
+	Error      string `bson:",omitempty" json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Skipped is set if the stage did not need to run on the latest
+	// attempt, because the output of the stages after it had been
+	// checkpointed.
+	Skipped bool `bson:",omitempty" json:",omitempty"`
+}
+
+// JobFilter selects jobs in JobRepository.List. Zero fields match every job.
+type JobFilter struct {
+	Owner  string
+	Org    string
+	Status string
+	// ShareToken selects the job shared with the token.
+	ShareToken string
+	// Labels select jobs with every one of the labels.
+	Labels map[string]string
+	// CreatedSince and CreatedBefore select jobs created in [CreatedSince,
+	// CreatedBefore).
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	Offset        int
+	Limit         int
+}
+
+func (f JobFilter) matches(j *Job) bool {
+	if f.Owner != "" && j.Owner != f.Owner {
+		return false
+	}
+	if f.Org != "" && j.Org != f.Org {
+		return false
+	}
+	if f.Status != "" && j.Status != f.Status {
+		return false
+	}
+	if f.ShareToken != "" && j.ShareToken != f.ShareToken {
+		return false
+	}
+	for k, v := range f.Labels {
+		if j.Labels[k] != v {
+			return false
+		}
+	}
+	if !f.CreatedSince.IsZero() && j.CreatedAt.Before(f.CreatedSince) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !j.CreatedAt.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+func (f JobFilter) query() bson.M {
+	query := bson.M{}
+	if f.Owner != "" {
+		query["owner"] = f.Owner
+	}
+	if f.Org != "" {
+		query["org"] = f.Org
+	}
+	if f.Status != "" {
+		query["status"] = f.Status
+	}
+	if f.ShareToken != "" {
+		query["sharetoken"] = f.ShareToken
+	}
+	for k, v := range f.Labels {
+		query["labels."+k] = v
+	}
+	created := bson.M{}
+	if !f.CreatedSince.IsZero() {
+		created["$gte"] = f.CreatedSince
+	}
+	if !f.CreatedBefore.IsZero() {
+		created["$lt"] = f.CreatedBefore
+	}
+	if len(created) > 0 {
+		query["createdat"] = created
+	}
+	return query
+}
+
+// JobRepository stores jobs. Get, Update and Delete return an error
+// satisfying errors.IsNotFound if there is no job with the id.
+type JobRepository interface {
+	Create(j *Job) error
+	Get(id string) (*Job, error)
+	// List returns the jobs matching filter, most recent first.
+	List(filter JobFilter) ([]*Job, error)
+	// SumAudio adds up the AudioSeconds of the jobs matching filter, without
+	// listing them, in all and for those of the given owner and API key,
+	// which may be empty.
+	SumAudio(filter JobFilter, owner string, apiKey string) (AudioTotals, error)
+	Update(j *Job) error
+	// Transition changes the status of the job with the given id from from
+	// to to atomically, so that only one of several processes moves a job
+	// on. It returns an error satisfying errors.IsNotFound if there is no
+	// such job with the status from.
+	Transition(id string, from string, to string) error
+	Delete(id string) error
+}
+
+// AudioTotals are the seconds of audio transcribed by a set of jobs, in all
+// and by the jobs of one owner and of one API key.
+type AudioTotals struct {
+	All    float64
+	Owner  float64
+	APIKey float64
+}
+
+type mongoJobRepository struct {
+	pool *Pool
+}
+
+// NewMongoJobRepository returns a JobRepository storing jobs in the "jobs"
+// collection.
+func NewMongoJobRepository(pool *Pool) (JobRepository, error) {
+	err := pool.with("jobs", func(c *mgo.Collection) error {
+		return errors.Trace(c.EnsureIndex(mgo.Index{Key: []string{"-createdat"}}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoJobRepository{pool: pool}, nil
+}
+
+func (r *mongoJobRepository) Create(j *Job) error {
+	return r.pool.with("jobs", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(j))
+	})
+}
+
+func (r *mongoJobRepository) Get(id string) (*Job, error) {
+	j := new(Job)
+	err := r.pool.with("jobs", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(j), "job %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (r *mongoJobRepository) List(filter JobFilter) ([]*Job, error) {
+	jobs := []*Job{}
+	err := r.pool.with("jobs", func(c *mgo.Collection) error {
+		q := c.Find(filter.query()).Sort("-createdat").Skip(filter.Offset)
+		if filter.Limit > 0 {
+			q = q.Limit(filter.Limit)
+		}
+		return errors.Trace(q.All(&jobs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (r *mongoJobRepository) SumAudio(filter JobFilter, owner string, apiKey string) (AudioTotals, error) {
+	// sumIf adds up the audio of the jobs whose field has the value
+	sumIf := func(field string, value string) bson.M {
+		if value == "" {
+			return bson.M{"$sum": 0}
+		}
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{
+			bson.M{"$eq": []interface{}{"$" + field, value}}, "$audioseconds", 0,
+		}}}
+	}
+	var totals AudioTotals
+	err := r.pool.with("jobs", func(c *mgo.Collection) error {
+		err := c.Pipe([]bson.M{
+			{"$match": filter.query()},
+			{"$group": bson.M{
+				"_id":    nil,
+				"all":    bson.M{"$sum": "$audioseconds"},
+				"owner":  sumIf("owner", owner),
+				"apikey": sumIf("apikey", apiKey),
+			}},
+		}).One(&totals)
+		if err == mgo.ErrNotFound {
+			// no job matches
+			return nil
+		}
+		return errors.Trace(err)
+	})
+	return totals, err
+}
+
+func (r *mongoJobRepository) Update(j *Job) error {
+	return r.pool.with("jobs", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(j.ID, j), "job %q", j.ID)
+	})
+}
+
+func (r *mongoJobRepository) Transition(id string, from string, to string) error {
+	return r.pool.with("jobs", func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": id, "status": from}, bson.M{"$set": bson.M{"status": to}})
+		return mongoError(err, "%s job %q", from, id)
+	})
+}
+
+func (r *mongoJobRepository) Delete(id string) error {
+	return r.pool.with("jobs", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "job %q", id)
+	})
+}
+
+type fileJobRepository struct {
+	c *fileCollection
+}
+
+// NewFileJobRepository returns a JobRepository storing jobs in the JSON file
+// at path.
+func NewFileJobRepository(path string) (JobRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileJobRepository{c: c}, nil
+}
+
+func (r *fileJobRepository) Create(j *Job) error {
+	return r.c.insert(j.ID, j)
+}
+
+func (r *fileJobRepository) Get(id string) (*Job, error) {
+	j := new(Job)
+	if err := r.c.get(id, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (r *fileJobRepository) List(filter JobFilter) ([]*Job, error) {
+	jobs := []*Job{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		j := new(Job)
+		if err := json.Unmarshal(raw, j); err != nil {
+			return err
+		}
+		if filter.matches(j) {
+			jobs = append(jobs, j)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(jobsByCreatedAt(jobs))
+	start, end := page(len(jobs), filter.Offset, filter.Limit)
+	return jobs[start:end], nil
+}
+
+func (r *fileJobRepository) SumAudio(filter JobFilter, owner string, apiKey string) (AudioTotals, error) {
+	var totals AudioTotals
+	err := r.c.each(func(raw json.RawMessage) error {
+		j := new(Job)
+		if err := json.Unmarshal(raw, j); err != nil {
+			return err
+		}
+		if !filter.matches(j) {
+			return nil
+		}
+		totals.All += j.AudioSeconds
+		if owner != "" && j.Owner == owner {
+			totals.Owner += j.AudioSeconds
+		}
+		if apiKey != "" && j.APIKey == apiKey {
+			totals.APIKey += j.AudioSeconds
+		}
+		return nil
+	})
+	return totals, err
+}
+
+func (r *fileJobRepository) Update(j *Job) error {
+	return r.c.update(j.ID, j)
+}
+
+func (r *fileJobRepository) Transition(id string, from string, to string) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		j := new(Job)
+		if raw, ok := docs[id]; ok {
+			if err := json.Unmarshal(raw, j); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		if j.ID == "" || j.Status != from {
+			return false, errors.NotFoundf("%s job %q", from, id)
+		}
+		j.Status = to
+		return true, setDoc(docs, id, j)
+	})
+}
+
+func (r *fileJobRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+// jobsByCreatedAt sorts jobs from most to least recently created.
+type jobsByCreatedAt []*Job
+
+func (s jobsByCreatedAt) Len() int           { return len(s) }
+func (s jobsByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s jobsByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.After(s[j].CreatedAt) }
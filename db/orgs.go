@@ -0,0 +1,164 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Organization is a team whose members share jobs and transcripts.
+type Organization struct {
+	ID        string `bson:"_id"`
+	Name      string
+	CreatedAt time.Time
+	Members   []Member
+}
+
+// Member is a user belonging to an organization with a role: "admin",
+// "editor" or "viewer".
+type Member struct {
+	UserID string
+	Role   string
+}
+
+// Role returns the role of the user with the given id in the organization,
+// or "" if they are not a member.
+func (o *Organization) Role(userID string) string {
+	for _, m := range o.Members {
+		if m.UserID == userID {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+// OrganizationRepository stores organizations. Get, Update and Delete return
+// an error satisfying errors.IsNotFound if there is no organization with the
+// id.
+type OrganizationRepository interface {
+	Create(o *Organization) error
+	Get(id string) (*Organization, error)
+	// List returns the organizations which the user with the given id
+	// belongs to, or every organization if userID is empty, sorted by name.
+	List(userID string) ([]*Organization, error)
+	Update(o *Organization) error
+	Delete(id string) error
+}
+
+type mongoOrganizationRepository struct {
+	pool *Pool
+}
+
+// NewMongoOrganizationRepository returns an OrganizationRepository storing
+// organizations in the "organizations" collection.
+func NewMongoOrganizationRepository(pool *Pool) OrganizationRepository {
+	return &mongoOrganizationRepository{pool: pool}
+}
+
+func (r *mongoOrganizationRepository) Create(o *Organization) error {
+	return r.pool.with("organizations", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(o))
+	})
+}
+
+func (r *mongoOrganizationRepository) Get(id string) (*Organization, error) {
+	o := new(Organization)
+	err := r.pool.with("organizations", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(o), "organization %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (r *mongoOrganizationRepository) List(userID string) ([]*Organization, error) {
+	query := bson.M{}
+	if userID != "" {
+		query["members.userid"] = userID
+	}
+	orgs := []*Organization{}
+	err := r.pool.with("organizations", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(query).Sort("name").All(&orgs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+func (r *mongoOrganizationRepository) Update(o *Organization) error {
+	return r.pool.with("organizations", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(o.ID, o), "organization %q", o.ID)
+	})
+}
+
+func (r *mongoOrganizationRepository) Delete(id string) error {
+	return r.pool.with("organizations", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "organization %q", id)
+	})
+}
+
+type fileOrganizationRepository struct {
+	c *fileCollection
+}
+
+// NewFileOrganizationRepository returns an OrganizationRepository storing
+// organizations in the JSON file at path.
+func NewFileOrganizationRepository(path string) (OrganizationRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileOrganizationRepository{c: c}, nil
+}
+
+func (r *fileOrganizationRepository) Create(o *Organization) error {
+	return r.c.insert(o.ID, o)
+}
+
+func (r *fileOrganizationRepository) Get(id string) (*Organization, error) {
+	o := new(Organization)
+	if err := r.c.get(id, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (r *fileOrganizationRepository) List(userID string) ([]*Organization, error) {
+	orgs := []*Organization{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		o := new(Organization)
+		if err := json.Unmarshal(raw, o); err != nil {
+			return err
+		}
+		if userID == "" || o.Role(userID) != "" {
+			orgs = append(orgs, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(organizationsByName(orgs))
+	return orgs, nil
+}
+
+func (r *fileOrganizationRepository) Update(o *Organization) error {
+	return r.c.update(o.ID, o)
+}
+
+func (r *fileOrganizationRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+// organizationsByName sorts organizations alphabetically.
+type organizationsByName []*Organization
+
+func (s organizationsByName) Len() int           { return len(s) }
+func (s organizationsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s organizationsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
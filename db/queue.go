@@ -0,0 +1,391 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueueEntry is a job waiting in the shared queue for a worker to run it, or
+// leased by a worker which is running it. Its id is the job's id.
+type QueueEntry struct {
+	ID         string `bson:"_id"`
+	EnqueuedAt time.Time
+	// Priority is the value of the job's tasks.Priority. Jobs with a higher
+	// priority are leased first.
+	Priority int
+	// Submitter is who queued the job, as in tasks.TaskOptions. Jobs of the
+	// same priority are leased taking turns by submitter.
+	Submitter string
+	// Worker is the worker which leased the job, or empty if the job is
+	// waiting. The lease lapses at LeaseExpires unless the worker renews it,
+	// after which another worker may lease the job.
+	Worker       string
+	LeaseExpires time.Time
+}
+
+// leasable reports whether the entry can be leased at now.
+func (e *QueueEntry) leasable(now time.Time) bool {
+	return e.Worker == "" || e.LeaseExpires.Before(now)
+}
+
+// before reports whether the entry is due to be leased before other.
+func (e *QueueEntry) before(other *QueueEntry) bool {
+	if e.Priority != other.Priority {
+		return e.Priority > other.Priority
+	}
+	if !e.EnqueuedAt.Equal(other.EnqueuedAt) {
+		return e.EnqueuedAt.Before(other.EnqueuedAt)
+	}
+	return e.ID < other.ID
+}
+
+// nextTurn returns the entry to lease among first, which holds the leasable
+// entry due first of each submitter, given when each submitter last leased a
+// job: that of the submitter whose last lease is oldest among those with
+// jobs of the highest priority, so that submitters take turns. It returns nil
+// if first is empty.
+func nextTurn(first map[string]*QueueEntry, lastLeased map[string]time.Time) *QueueEntry {
+	var next *QueueEntry
+	for _, e := range first {
+		if next == nil || e.Priority > next.Priority {
+			next = e
+			continue
+		}
+		if e.Priority < next.Priority {
+			continue
+		}
+		last, nextLast := lastLeased[e.Submitter], lastLeased[next.Submitter]
+		if last.Before(nextLast) || last.Equal(nextLast) && e.before(next) {
+			next = e
+		}
+	}
+	return next
+}
+
+// QueueRepository stores the queue of jobs shared by workers. Enqueue returns
+// an error satisfying errors.IsAlreadyExists if the job is already queued,
+// and Get and Remove an error satisfying errors.IsNotFound if it is not.
+type QueueRepository interface {
+	Enqueue(id string, priority int, submitter string, now time.Time) error
+	Get(id string) (*QueueEntry, error)
+	// Lease leases a job with the highest priority, among those which are
+	// waiting or whose lease has lapsed, to worker for d: the one which has
+	// waited longest of the submitter whose last lease is oldest. It returns
+	// an error satisfying errors.IsNotFound if there is no such job.
+	Lease(worker string, now time.Time, d time.Duration) (*QueueEntry, error)
+	// Renew extends worker's lease of the job with the given id by d from
+	// now. It returns an error satisfying errors.IsNotFound if the job has
+	// been leased to another worker since.
+	Renew(id string, worker string, now time.Time, d time.Duration) error
+	// Release puts the job with the given id, leased by worker, back in the
+	// queue for any worker to lease.
+	Release(id string, worker string) error
+	Remove(id string) error
+	// RemoveWaiting removes the job with the given id if no worker has
+	// leased it. It returns an error satisfying errors.IsNotFound if the job
+	// is not queued or is leased.
+	RemoveWaiting(id string) error
+	// Count returns the number of queued jobs, whether leased or not.
+	Count() (int, error)
+	// List returns every queued job, whether leased or not, in the order in
+	// which they are due to be leased.
+	List() ([]*QueueEntry, error)
+}
+
+type mongoQueueRepository struct {
+	pool *Pool
+}
+
+// NewMongoQueueRepository returns a QueueRepository storing the queue in the
+// "queue" collection, and when each submitter last leased a job in the
+// "queueturns" collection.
+func NewMongoQueueRepository(pool *Pool) (QueueRepository, error) {
+	err := pool.with("queue", func(c *mgo.Collection) error {
+		return errors.Trace(c.EnsureIndex(mgo.Index{Key: []string{"-priority", "enqueuedat"}}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoQueueRepository{pool: pool}, nil
+}
+
+func (r *mongoQueueRepository) Enqueue(id string, priority int, submitter string, now time.Time) error {
+	return r.pool.with("queue", func(c *mgo.Collection) error {
+		err := c.Insert(&QueueEntry{ID: id, Priority: priority, Submitter: submitter, EnqueuedAt: now})
+		if mgo.IsDup(err) {
+			return errors.AlreadyExistsf("queued job %q", id)
+		}
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoQueueRepository) Get(id string) (*QueueEntry, error) {
+	e := new(QueueEntry)
+	err := r.pool.with("queue", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(e), "queued job %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (r *mongoQueueRepository) Lease(worker string, now time.Time, d time.Duration) (*QueueEntry, error) {
+	e := new(QueueEntry)
+	err := r.pool.with("queue", func(c *mgo.Collection) error {
+		leasable := []bson.M{
+			{"worker": ""},
+			{"leaseexpires": bson.M{"$lt": now}},
+		}
+		// another worker may lease the chosen job first, in which case the
+		// next turn is worked out again
+		for tries := 0; tries < 3; tries++ {
+			var groups []struct {
+				Entry QueueEntry
+			}
+			err := c.Pipe([]bson.M{
+				{"$match": bson.M{"$or": leasable}},
+				{"$sort": bson.D{{Name: "priority", Value: -1}, {Name: "enqueuedat", Value: 1}, {Name: "_id", Value: 1}}},
+				{"$group": bson.M{"_id": "$submitter", "entry": bson.M{"$first": "$$ROOT"}}},
+			}).All(&groups)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			first := make(map[string]*QueueEntry)
+			submitters := []string{}
+			for i := range groups {
+				first[groups[i].Entry.Submitter] = &groups[i].Entry
+				submitters = append(submitters, groups[i].Entry.Submitter)
+			}
+			var turns []struct {
+				Submitter  string `bson:"_id"`
+				LastLeased time.Time
+			}
+			turnsColl := c.Database.C("queueturns")
+			if err := turnsColl.Find(bson.M{"_id": bson.M{"$in": submitters}}).All(&turns); err != nil {
+				return errors.Trace(err)
+			}
+			lastLeased := make(map[string]time.Time)
+			for _, t := range turns {
+				lastLeased[t.Submitter] = t.LastLeased
+			}
+			next := nextTurn(first, lastLeased)
+			if next == nil {
+				return errors.NotFoundf("leasable job")
+			}
+
+			// findAndModify leases the job atomically, so that no two
+			// workers lease the same job
+			_, err = c.Find(bson.M{"_id": next.ID, "$or": leasable}).Apply(mgo.Change{
+				Update:    bson.M{"$set": bson.M{"worker": worker, "leaseexpires": now.Add(d)}},
+				ReturnNew: true,
+			}, e)
+			if err == mgo.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			_, err = turnsColl.UpsertId(next.Submitter, bson.M{"$set": bson.M{"lastleased": now}})
+			return errors.Trace(err)
+		}
+		return errors.NotFoundf("leasable job")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (r *mongoQueueRepository) Renew(id string, worker string, now time.Time, d time.Duration) error {
+	return r.pool.with("queue", func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": id, "worker": worker}, bson.M{"$set": bson.M{"leaseexpires": now.Add(d)}})
+		return mongoError(err, "lease of job %q by %s", id, worker)
+	})
+}
+
+func (r *mongoQueueRepository) Release(id string, worker string) error {
+	return r.pool.with("queue", func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": id, "worker": worker}, bson.M{"$set": bson.M{"worker": "", "leaseexpires": time.Time{}}})
+		return mongoError(err, "lease of job %q by %s", id, worker)
+	})
+}
+
+func (r *mongoQueueRepository) Remove(id string) error {
+	return r.pool.with("queue", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "queued job %q", id)
+	})
+}
+
+func (r *mongoQueueRepository) RemoveWaiting(id string) error {
+	return r.pool.with("queue", func(c *mgo.Collection) error {
+		return mongoError(c.Remove(bson.M{"_id": id, "worker": ""}), "waiting job %q", id)
+	})
+}
+
+func (r *mongoQueueRepository) Count() (int, error) {
+	n := 0
+	err := r.pool.with("queue", func(c *mgo.Collection) error {
+		var err error
+		n, err = c.Count()
+		return errors.Trace(err)
+	})
+	return n, err
+}
+
+func (r *mongoQueueRepository) List() ([]*QueueEntry, error) {
+	entries := []*QueueEntry{}
+	err := r.pool.with("queue", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(nil).Sort("-priority", "enqueuedat", "_id").All(&entries))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type fileQueueRepository struct {
+	c *fileCollection
+	// lastLeased holds when each submitter last leased a job. It is guarded
+	// by c.
+	lastLeased map[string]time.Time
+}
+
+// NewFileQueueRepository returns a QueueRepository storing the queue in the
+// JSON file at path. Only the workers of a single process can share it, and
+// when submitters last leased a job is kept in memory.
+func NewFileQueueRepository(path string) (QueueRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileQueueRepository{c: c, lastLeased: make(map[string]time.Time)}, nil
+}
+
+func (r *fileQueueRepository) Enqueue(id string, priority int, submitter string, now time.Time) error {
+	err := r.c.insert(id, &QueueEntry{ID: id, Priority: priority, Submitter: submitter, EnqueuedAt: now})
+	if errors.IsAlreadyExists(err) {
+		return errors.AlreadyExistsf("queued job %q", id)
+	}
+	return err
+}
+
+func (r *fileQueueRepository) Get(id string) (*QueueEntry, error) {
+	e := new(QueueEntry)
+	if err := r.c.get(id, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (r *fileQueueRepository) Lease(worker string, now time.Time, d time.Duration) (*QueueEntry, error) {
+	var leased *QueueEntry
+	err := r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		first := make(map[string]*QueueEntry)
+		for _, raw := range docs {
+			e := new(QueueEntry)
+			if err := json.Unmarshal(raw, e); err != nil {
+				return false, errors.Trace(err)
+			}
+			if !e.leasable(now) {
+				continue
+			}
+			if f, ok := first[e.Submitter]; !ok || e.before(f) {
+				first[e.Submitter] = e
+			}
+		}
+		leased = nextTurn(first, r.lastLeased)
+		if leased == nil {
+			return false, errors.NotFoundf("leasable job")
+		}
+		leased.Worker = worker
+		leased.LeaseExpires = now.Add(d)
+		r.lastLeased[leased.Submitter] = now
+		return true, setDoc(docs, leased.ID, leased)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leased, nil
+}
+
+// leased applies fn to the entry with the given id if it is leased by worker.
+func (r *fileQueueRepository) leased(id string, worker string, fn func(e *QueueEntry)) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		e := new(QueueEntry)
+		if raw, ok := docs[id]; ok {
+			if err := json.Unmarshal(raw, e); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		if e.ID == "" || e.Worker != worker {
+			return false, errors.NotFoundf("lease of job %q by %s", id, worker)
+		}
+		fn(e)
+		return true, setDoc(docs, id, e)
+	})
+}
+
+func (r *fileQueueRepository) Renew(id string, worker string, now time.Time, d time.Duration) error {
+	return r.leased(id, worker, func(e *QueueEntry) {
+		e.LeaseExpires = now.Add(d)
+	})
+}
+
+func (r *fileQueueRepository) Release(id string, worker string) error {
+	return r.leased(id, worker, func(e *QueueEntry) {
+		e.Worker = ""
+		e.LeaseExpires = time.Time{}
+	})
+}
+
+func (r *fileQueueRepository) Remove(id string) error {
+	return r.c.remove(id)
+}
+
+func (r *fileQueueRepository) RemoveWaiting(id string) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		e := new(QueueEntry)
+		if raw, ok := docs[id]; ok {
+			if err := json.Unmarshal(raw, e); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		if e.ID == "" || e.Worker != "" {
+			return false, errors.NotFoundf("waiting job %q", id)
+		}
+		delete(docs, id)
+		return true, nil
+	})
+}
+
+func (r *fileQueueRepository) Count() (int, error) {
+	n := 0
+	err := r.c.each(func(json.RawMessage) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (r *fileQueueRepository) List() ([]*QueueEntry, error) {
+	entries := []*QueueEntry{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		e := new(QueueEntry)
+		if err := json.Unmarshal(raw, e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].before(entries[k]) })
+	return entries, nil
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Schedule submits a transcription job with its options whenever its cron
+// expression falls due, e.g. to transcribe a recording published at the same
+// URL every night.
+type Schedule struct {
+	ID     string `bson:"_id"`
+	Org    string
+	APIKey string
+	Name   string
+	// Cron is a cron expression, read in the time zone TimeZone, which is UTC
+	// if empty.
+	Cron           string
+	TimeZone       string
+	AudioURL       string
+	Language       string
+	SearchWords    []string
+	EmailAddresses []string
+	Force          bool
+	Priority       string
+	CreatedAt      time.Time
+	// NextRun is when the schedule next submits a job.
+	NextRun   time.Time
+	LastRun   time.Time
+	LastJob   string
+	LastError string
+}
+
+// ScheduleRepository stores schedules. Get, Update and Delete return an error
+// satisfying errors.IsNotFound if there is no schedule with the id.
+type ScheduleRepository interface {
+	Create(s *Schedule) error
+	Get(id string) (*Schedule, error)
+	// List returns every schedule, oldest first.
+	List() ([]*Schedule, error)
+	Update(s *Schedule) error
+	Delete(id string) error
+	// Advance changes the NextRun of the schedule with the given id from
+	// from to to atomically, so that only one of several processes runs the
+	// schedule each time. It returns an error satisfying errors.IsNotFound if
+	// there is no such schedule due at from.
+	Advance(id string, from time.Time, to time.Time) error
+}
+
+type mongoScheduleRepository struct {
+	pool *Pool
+}
+
+// NewMongoScheduleRepository returns a ScheduleRepository storing schedules
+// in the "schedules" collection.
+func NewMongoScheduleRepository(pool *Pool) ScheduleRepository {
+	return &mongoScheduleRepository{pool: pool}
+}
+
+func (r *mongoScheduleRepository) Create(s *Schedule) error {
+	return r.pool.with("schedules", func(c *mgo.Collection) error {
+		return errors.Trace(c.Insert(s))
+	})
+}
+
+func (r *mongoScheduleRepository) Get(id string) (*Schedule, error) {
+	s := new(Schedule)
+	err := r.pool.with("schedules", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(s), "schedule %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *mongoScheduleRepository) List() ([]*Schedule, error) {
+	schedules := []*Schedule{}
+	err := r.pool.with("schedules", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(bson.M{}).Sort("createdat").All(&schedules))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (r *mongoScheduleRepository) Update(s *Schedule) error {
+	return r.pool.with("schedules", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(s.ID, s), "schedule %q", s.ID)
+	})
+}
+
+func (r *mongoScheduleRepository) Delete(id string) error {
+	return r.pool.with("schedules", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "schedule %q", id)
+	})
+}
+
+func (r *mongoScheduleRepository) Advance(id string, from time.Time, to time.Time) error {
+	return r.pool.with("schedules", func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": id, "nextrun": from}, bson.M{"$set": bson.M{"nextrun": to}})
+		return mongoError(err, "schedule %q due at %s", id, from)
+	})
+}
+
+type fileScheduleRepository struct {
+	c *fileCollection
+}
+
+// NewFileScheduleRepository returns a ScheduleRepository storing schedules in
+// the JSON file at path.
+func NewFileScheduleRepository(path string) (ScheduleRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileScheduleRepository{c: c}, nil
+}
+
+func (r *fileScheduleRepository) Create(s *Schedule) error {
+	return r.c.insert(s.ID, s)
+}
+
+func (r *fileScheduleRepository) Get(id string) (*Schedule, error) {
+	s := new(Schedule)
+	if err := r.c.get(id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *fileScheduleRepository) List() ([]*Schedule, error) {
+	schedules := []*Schedule{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		s := new(Schedule)
+		if err := json.Unmarshal(raw, s); err != nil {
+			return err
+		}
+		schedules = append(schedules, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(schedulesByCreatedAt(schedules))
+	return schedules, nil
+}
+
+func (r *fileScheduleRepository) Update(s *Schedule) error {
+	return r.c.update(s.ID, s)
+}
+
+func (r *fileScheduleRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+func (r *fileScheduleRepository) Advance(id string, from time.Time, to time.Time) error {
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		s := new(Schedule)
+		if raw, ok := docs[id]; ok {
+			if err := json.Unmarshal(raw, s); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+		if s.ID == "" || !s.NextRun.Equal(from) {
+			return false, errors.NotFoundf("schedule %q due at %s", id, from)
+		}
+		s.NextRun = to
+		return true, setDoc(docs, id, s)
+	})
+}
+
+// schedulesByCreatedAt sorts schedules from least to most recently created.
+type schedulesByCreatedAt []*Schedule
+
+func (s schedulesByCreatedAt) Len() int           { return len(s) }
+func (s schedulesByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s schedulesByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Transcript contains the full transcription and other information.
+type Transcript struct {
+	ID               string `bson:"_id"`
+	Transcript       string
+	AudioURL         string
+	AudioObject      string
+	TranscriptObject string
+	// Org is the organization of the job which produced the transcript.
+	Org         string
+	CompletedAt time.Time
+	Timestamps  []Timestamp
+	Confidences []Confidence
+	Keywords    []Keyword
+	// Episode is set for transcripts of podcast episodes found in a feed.
+	Episode *Episode `bson:",omitempty" json:",omitempty"`
+	// ContentKey identifies the audio and the options it was transcribed
+	// with, so that transcribing the same audio again can reuse this
+	// transcript.
+	ContentKey string `bson:",omitempty" json:",omitempty"`
+	// CachedFrom is the id of the transcript this one was copied from, if
+	// it was reused rather than transcribed.
+	CachedFrom string `bson:",omitempty" json:",omitempty"`
+}
+
+// Timestamp is the time at which a word was spoken, in seconds from the
+// start of the audio.
+type Timestamp struct {
+	Word      string
+	StartTime float64
+	EndTime   float64
+}
+
+// Confidence is the confidence that a word was transcribed correctly.
+type Confidence struct {
+	Word  string
+	Score float64
+}
+
+// Keyword is an occurrence of one of the search words.
+type Keyword struct {
+	Word       string
+	StartTime  float64
+	EndTime    float64
+	Confidence float64
+}
+
+// TranscriptFilter selects transcripts in TranscriptRepository.List. Zero
+// fields match every transcript.
+type TranscriptFilter struct {
+	AudioURL string
+	Org      string
+	// NoOrg selects transcripts which belong to no organization.
+	NoOrg           bool
+	ContentKey      string
+	CompletedAfter  time.Time
+	CompletedBefore time.Time
+	Offset          int
+	Limit           int
+}
+
+func (f TranscriptFilter) matches(t *Transcript) bool {
+	if f.AudioURL != "" && t.AudioURL != f.AudioURL {
+		return false
+	}
+	if f.Org != "" && t.Org != f.Org {
+		return false
+	}
+	if f.NoOrg && t.Org != "" {
+		return false
+	}
+	if f.ContentKey != "" && t.ContentKey != f.ContentKey {
+		return false
+	}
+	if !f.CompletedAfter.IsZero() && !t.CompletedAt.After(f.CompletedAfter) {
+		return false
+	}
+	if !f.CompletedBefore.IsZero() && !t.CompletedAt.Before(f.CompletedBefore) {
+		return false
+	}
+	return true
+}
+
+func (f TranscriptFilter) query() bson.M {
+	query := bson.M{}
+	if f.AudioURL != "" {
+		query["audiourl"] = f.AudioURL
+	}
+	if f.Org != "" {
+		query["org"] = f.Org
+	}
+	if f.NoOrg {
+		query["org"] = bson.M{"$in": []interface{}{"", nil}}
+	}
+	if f.ContentKey != "" {
+		query["contentkey"] = f.ContentKey
+	}
+	completed := bson.M{}
+	if !f.CompletedAfter.IsZero() {
+		completed["$gt"] = f.CompletedAfter
+	}
+	if !f.CompletedBefore.IsZero() {
+		completed["$lt"] = f.CompletedBefore
+	}
+	if len(completed) > 0 {
+		query["completedat"] = completed
+	}
+	return query
+}
+
+// TranscriptRepository stores transcripts. Get, Update and Delete return an
+// error satisfying errors.IsNotFound if there is no transcript with the id.
+type TranscriptRepository interface {
+	Create(t *Transcript) error
+	Get(id string) (*Transcript, error)
+	// List returns the transcripts matching filter, most recent first.
+	List(filter TranscriptFilter) ([]*Transcript, error)
+	Update(t *Transcript) error
+	Delete(id string) error
+}
+
+type mongoTranscriptRepository struct {
+	pool *Pool
+}
+
+// NewMongoTranscriptRepository returns a TranscriptRepository storing
+// transcripts in the "transcriptions" collection, which it indexes by content
+// key.
+func NewMongoTranscriptRepository(pool *Pool) (TranscriptRepository, error) {
+	err := pool.with("transcriptions", func(c *mgo.Collection) error {
+		return errors.Trace(c.EnsureIndex(mgo.Index{Key: []string{"contentkey"}, Sparse: true}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoTranscriptRepository{pool: pool}, nil
+}
+
+func (r *mongoTranscriptRepository) Create(t *Transcript) error {
+	return r.pool.with("transcriptions", func(c *mgo.Collection) error {
+		err := c.Insert(t)
+		if mgo.IsDup(err) {
+			return errors.AlreadyExistsf("transcript %q", t.ID)
+		}
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoTranscriptRepository) Get(id string) (*Transcript, error) {
+	t := new(Transcript)
+	err := r.pool.with("transcriptions", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(t), "transcript %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *mongoTranscriptRepository) List(filter TranscriptFilter) ([]*Transcript, error) {
+	transcripts := []*Transcript{}
+	err := r.pool.with("transcriptions", func(c *mgo.Collection) error {
+		q := c.Find(filter.query()).Sort("-completedat").Skip(filter.Offset)
+		if filter.Limit > 0 {
+			q = q.Limit(filter.Limit)
+		}
+		return errors.Trace(q.All(&transcripts))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transcripts, nil
+}
+
+func (r *mongoTranscriptRepository) Update(t *Transcript) error {
+	return r.pool.with("transcriptions", func(c *mgo.Collection) error {
+		return mongoError(c.UpdateId(t.ID, t), "transcript %q", t.ID)
+	})
+}
+
+func (r *mongoTranscriptRepository) Delete(id string) error {
+	return r.pool.with("transcriptions", func(c *mgo.Collection) error {
+		return mongoError(c.RemoveId(id), "transcript %q", id)
+	})
+}
+
+type fileTranscriptRepository struct {
+	c *fileCollection
+}
+
+// NewFileTranscriptRepository returns a TranscriptRepository storing
+// transcripts in the JSON file at path.
+func NewFileTranscriptRepository(path string) (TranscriptRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileTranscriptRepository{c: c}, nil
+}
+
+func (r *fileTranscriptRepository) Create(t *Transcript) error {
+	return r.c.insert(t.ID, t)
+}
+
+func (r *fileTranscriptRepository) Get(id string) (*Transcript, error) {
+	t := new(Transcript)
+	if err := r.c.get(id, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *fileTranscriptRepository) List(filter TranscriptFilter) ([]*Transcript, error) {
+	transcripts := []*Transcript{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		t := new(Transcript)
+		if err := json.Unmarshal(raw, t); err != nil {
+			return err
+		}
+		if filter.matches(t) {
+			transcripts = append(transcripts, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byCompletedAt(transcripts))
+	start, end := page(len(transcripts), filter.Offset, filter.Limit)
+	return transcripts[start:end], nil
+}
+
+func (r *fileTranscriptRepository) Update(t *Transcript) error {
+	return r.c.update(t.ID, t)
+}
+
+func (r *fileTranscriptRepository) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+// byCompletedAt sorts transcripts from most to least recently completed.
+type byCompletedAt []*Transcript
+
+func (s byCompletedAt) Len() int           { return len(s) }
+func (s byCompletedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCompletedAt) Less(i, j int) bool { return s[i].CompletedAt.After(s[j].CompletedAt) }
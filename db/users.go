@@ -0,0 +1,222 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// User is an account which can log in to the web interface.
+type User struct {
+	ID           string `bson:"_id"`
+	Email        string
+	Name         string
+	PasswordHash string
+	Admin        bool
+	CreatedAt    time.Time
+}
+
+// NormalizeEmail returns the form in which email addresses are stored and
+// looked up.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// UserRepository stores users. Email addresses are unique: Create returns an
+// error satisfying errors.IsAlreadyExists if the address is taken. Get,
+// GetByEmail and Update return an error satisfying errors.IsNotFound if there
+// is no such user.
+type UserRepository interface {
+	Create(u *User) error
+	Get(id string) (*User, error)
+	GetByEmail(email string) (*User, error)
+	// List returns every user, oldest first.
+	List() ([]*User, error)
+	Update(u *User) error
+}
+
+type mongoUserRepository struct {
+	pool *Pool
+}
+
+// NewMongoUserRepository returns a UserRepository storing users in the
+// "users" collection, which it indexes by email address.
+func NewMongoUserRepository(pool *Pool) (UserRepository, error) {
+	err := pool.with("users", func(c *mgo.Collection) error {
+		return errors.Trace(c.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoUserRepository{pool: pool}, nil
+}
+
+func (r *mongoUserRepository) Create(u *User) error {
+	u.Email = NormalizeEmail(u.Email)
+	return r.pool.with("users", func(c *mgo.Collection) error {
+		err := c.Insert(u)
+		if mgo.IsDup(err) {
+			return errors.AlreadyExistsf("user %q", u.Email)
+		}
+		return errors.Trace(err)
+	})
+}
+
+func (r *mongoUserRepository) Get(id string) (*User, error) {
+	u := new(User)
+	err := r.pool.with("users", func(c *mgo.Collection) error {
+		return mongoError(c.FindId(id).One(u), "user %q", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *mongoUserRepository) GetByEmail(email string) (*User, error) {
+	email = NormalizeEmail(email)
+	u := new(User)
+	err := r.pool.with("users", func(c *mgo.Collection) error {
+		return mongoError(c.Find(bson.M{"email": email}).One(u), "user %q", email)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *mongoUserRepository) List() ([]*User, error) {
+	users := []*User{}
+	err := r.pool.with("users", func(c *mgo.Collection) error {
+		return errors.Trace(c.Find(bson.M{}).Sort("createdat").All(&users))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *mongoUserRepository) Update(u *User) error {
+	u.Email = NormalizeEmail(u.Email)
+	return r.pool.with("users", func(c *mgo.Collection) error {
+		err := c.UpdateId(u.ID, u)
+		if mgo.IsDup(err) {
+			return errors.AlreadyExistsf("user %q", u.Email)
+		}
+		return mongoError(err, "user %q", u.ID)
+	})
+}
+
+type fileUserRepository struct {
+	c *fileCollection
+}
+
+// NewFileUserRepository returns a UserRepository storing users in the JSON
+// file at path.
+func NewFileUserRepository(path string) (UserRepository, error) {
+	c, err := openFileCollection(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileUserRepository{c: c}, nil
+}
+
+func (r *fileUserRepository) Create(u *User) error {
+	u.Email = NormalizeEmail(u.Email)
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		if _, ok := docs[u.ID]; ok {
+			return false, errors.AlreadyExistsf("record %q", u.ID)
+		}
+		if err := checkEmailFree(docs, u); err != nil {
+			return false, err
+		}
+		return true, setDoc(docs, u.ID, u)
+	})
+}
+
+func (r *fileUserRepository) Get(id string) (*User, error) {
+	u := new(User)
+	if err := r.c.get(id, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *fileUserRepository) GetByEmail(email string) (*User, error) {
+	email = NormalizeEmail(email)
+	var found *User
+	err := r.c.each(func(raw json.RawMessage) error {
+		u := new(User)
+		if err := json.Unmarshal(raw, u); err != nil {
+			return err
+		}
+		if u.Email == email {
+			found = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errors.NotFoundf("user %q", email)
+	}
+	return found, nil
+}
+
+func (r *fileUserRepository) List() ([]*User, error) {
+	users := []*User{}
+	err := r.c.each(func(raw json.RawMessage) error {
+		u := new(User)
+		if err := json.Unmarshal(raw, u); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(usersByCreatedAt(users))
+	return users, nil
+}
+
+func (r *fileUserRepository) Update(u *User) error {
+	u.Email = NormalizeEmail(u.Email)
+	return r.c.apply(func(docs map[string]json.RawMessage) (bool, error) {
+		if _, ok := docs[u.ID]; !ok {
+			return false, errors.NotFoundf("record %q", u.ID)
+		}
+		if err := checkEmailFree(docs, u); err != nil {
+			return false, err
+		}
+		return true, setDoc(docs, u.ID, u)
+	})
+}
+
+// checkEmailFree returns an error if a user other than u has u's email
+// address.
+func checkEmailFree(docs map[string]json.RawMessage, u *User) error {
+	for id, raw := range docs {
+		other := new(User)
+		if err := json.Unmarshal(raw, other); err != nil {
+			return errors.Trace(err)
+		}
+		if id != u.ID && other.Email == u.Email {
+			return errors.AlreadyExistsf("user %q", u.Email)
+		}
+	}
+	return nil
+}
+
+// usersByCreatedAt sorts users from least to most recently created.
+type usersByCreatedAt []*User
+
+func (s usersByCreatedAt) Len() int           { return len(s) }
+func (s usersByCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s usersByCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
@@ -0,0 +1,149 @@
+// Package events passes on the events of the tasks run by a
+// tasks.TaskExecuter: to the clients following jobs' progress, to the metrics
+// and to webhooks.
+package events
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/hack4impact/transcribe4all/metrics"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// Sink receives events. Send must not block for long, since every sink is
+// sent each event in turn.
+type Sink interface {
+	Send(e tasks.Event)
+}
+
+// dispatchBuffer is how many events may wait for the sinks before further
+// events are dropped.
+const dispatchBuffer = 256
+
+// Dispatch sends every event of the tasks run by ex to each of sinks, until
+// the returned function is called.
+func Dispatch(ex tasks.TaskExecuter, sinks ...Sink) func() {
+	events, unsubscribe := ex.Subscribe(dispatchBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			for _, s := range sinks {
+				s.Send(e)
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
+
+// Hub passes on events to those following particular tasks.
+type Hub struct {
+	sync.Mutex
+	next      int
+	following map[string]map[int]chan tasks.Event
+	closed    bool
+}
+
+// NewHub returns a Hub with no followers.
+func NewHub() *Hub {
+	return &Hub{following: make(map[string]map[int]chan tasks.Event)}
+}
+
+// Send passes e on to those following its task. Events which do not fit in a
+// follower's channel are dropped.
+func (h *Hub) Send(e tasks.Event) {
+	h.Lock()
+	defer h.Unlock()
+	for _, ch := range h.following[e.TaskID] {
+		select {
+		case ch <- e:
+		default:
+			log.WithField("task", e.TaskID).
+				Warnf("Dropped a %s event for a follower which is not keeping up", e.Type.Name())
+		}
+	}
+}
+
+// Follow returns a channel delivering the events of the task with the given
+// id, buffering up to buffer of them, and a function which stops following
+// the task and closes the channel. The channel is also closed when the hub
+// is.
+func (h *Hub) Follow(id string, buffer int) (<-chan tasks.Event, func()) {
+	ch := make(chan tasks.Event, buffer)
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.following[id] == nil {
+		h.following[id] = make(map[int]chan tasks.Event)
+	}
+	key := h.next
+	h.next++
+	h.following[id][key] = ch
+
+	return ch, func() {
+		h.Lock()
+		defer h.Unlock()
+		if _, ok := h.following[id][key]; !ok {
+			// already stopped, or the hub is closed
+			return
+		}
+		delete(h.following[id], key)
+		if len(h.following[id]) == 0 {
+			delete(h.following, id)
+		}
+		close(ch)
+	}
+}
+
+// Close closes the channels of every follower, e.g. so that the server can
+// shut down without waiting for those following jobs which are still
+// running.
+func (h *Hub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	for id, followers := range h.following {
+		for _, ch := range followers {
+			close(ch)
+		}
+		delete(h.following, id)
+	}
+	h.closed = true
+}
+
+// metricsSink records events in metrics.TaskEvents and how long tasks waited
+// to start in metrics.QueueWait.
+type metricsSink struct {
+	sync.Mutex
+	queued map[string]time.Time
+}
+
+// NewMetricsSink returns a Sink recording events in the app's metrics.
+func NewMetricsSink() Sink {
+	return &metricsSink{queued: make(map[string]time.Time)}
+}
+
+func (s *metricsSink) Send(e tasks.Event) {
+	metrics.TaskEvents.Inc(e.Type.Name())
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case e.Type == tasks.QUEUED:
+		s.queued[e.TaskID] = e.Time
+	case e.Type == tasks.STARTED:
+		if queued, ok := s.queued[e.TaskID]; ok {
+			metrics.QueueWait.Observe(e.Time.Sub(queued).Seconds())
+			delete(s.queued, e.TaskID)
+		}
+	case e.Type.Finished():
+		delete(s.queued, e.TaskID)
+	}
+}
@@ -0,0 +1,157 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/metrics"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// receive returns the next event on events, failing the test if none
+// arrives in time.
+func receive(t *testing.T, events <-chan tasks.Event) tasks.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return tasks.Event{}
+}
+
+func TestDispatchAndHub(t *testing.T) {
+	assert := assert.New(t)
+	ex := tasks.NewTaskExecuter(time.Hour)
+	hub := NewHub()
+	stop := Dispatch(ex, hub)
+	defer stop()
+
+	release := make(chan struct{})
+	id := ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+	other := ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	events, unfollow := hub.Follow(id, 10)
+	defer unfollow()
+	ex.ReportProgress(id, "halfway")
+	close(release)
+
+	// the task may have been queued and started before it was followed
+	types := []tasks.EventType{}
+	for e := receive(t, events); ; e = receive(t, events) {
+		assert.Equal(id, e.TaskID)
+		assert.NotEqual(other, e.TaskID)
+		if e.Type == tasks.PROGRESS {
+			assert.Equal("halfway", e.Message)
+		}
+		if e.Type != tasks.QUEUED && e.Type != tasks.STARTED {
+			types = append(types, e.Type)
+		}
+		if e.Type.Finished() {
+			break
+		}
+	}
+	assert.Equal([]tasks.EventType{tasks.PROGRESS, tasks.SUCCEEDED}, types)
+}
+
+func TestHubClose(t *testing.T) {
+	assert := assert.New(t)
+	hub := NewHub()
+	events, unfollow := hub.Follow("a", 1)
+	hub.Close()
+	_, open := <-events
+	assert.False(open)
+	// stopping after the hub closed does nothing
+	unfollow()
+
+	events, _ = hub.Follow("a", 1)
+	_, open = <-events
+	assert.False(open)
+	hub.Send(tasks.Event{Type: tasks.QUEUED, TaskID: "a"})
+}
+
+// metricValue returns the value of the metric series with the given name and
+// labels, or 0 if it has none yet.
+func metricValue(t *testing.T, series string) float64 {
+	var b bytes.Buffer
+	if err := metrics.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsSink(t *testing.T) {
+	assert := assert.New(t)
+	started := metricValue(t, `transcribe4all_task_events_total{type="started"}`)
+	waited := metricValue(t, "transcribe4all_queue_wait_seconds_sum")
+
+	s := NewMetricsSink()
+	queued := time.Now()
+	s.Send(tasks.Event{Type: tasks.QUEUED, TaskID: "a", Time: queued})
+	s.Send(tasks.Event{Type: tasks.STARTED, TaskID: "a", Time: queued.Add(2 * time.Second)})
+	s.Send(tasks.Event{Type: tasks.SUCCEEDED, TaskID: "a", Time: queued.Add(time.Minute)})
+	// a task resumed without being queued again
+	s.Send(tasks.Event{Type: tasks.STARTED, TaskID: "b", Time: queued})
+
+	assert.Equal(started+2, metricValue(t, `transcribe4all_task_events_total{type="started"}`))
+	assert.Equal(waited+2, metricValue(t, "transcribe4all_queue_wait_seconds_sum"))
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := assert.New(t)
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+		if first {
+			// the sink tries again
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	s := NewWebhookSink([]string{server.URL}, "secret", []tasks.EventType{tasks.SUCCEEDED, tasks.FAILED})
+	s.backoff = time.Millisecond
+	s.Send(tasks.Event{Type: tasks.STARTED, TaskID: "a"})
+	s.Send(tasks.Event{Type: tasks.FAILED, TaskID: "a", Error: "no audio"})
+	s.Close()
+
+	assert.Len(received, 1)
+	r := <-received
+	body := <-bodies
+	assert.Equal("failed", r.Header.Get(EventHeader))
+	assert.Equal(Sign("secret", body), r.Header.Get(SignatureHeader))
+	var e map[string]interface{}
+	assert.NoError(json.Unmarshal(body, &e))
+	assert.Equal("failed", e["type"])
+	assert.Equal("a", e["task"])
+	assert.Equal("no audio", e["error"])
+	assert.Equal(2, attempts)
+}
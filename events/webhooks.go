@@ -0,0 +1,147 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are the headers of webhook requests. The signature is the HMAC-SHA256
+// of the body, keyed with the webhook secret, in hex and prefixed with
+// "sha256=".
+const (
+	EventHeader     = "X-Transcribe4all-Event"
+	SignatureHeader = "X-Transcribe4all-Signature"
+)
+
+// webhookAttempts is how many times each event is posted to a webhook before
+// it is given up on.
+const webhookAttempts = 3
+
+// webhookBuffer is how many events may wait to be posted before further
+// events are dropped.
+const webhookBuffer = 1024
+
+// WebhookSink posts events as JSON to webhooks, one at a time, so that a slow
+// webhook holds up neither tasks nor the other sinks.
+type WebhookSink struct {
+	urls    []string
+	secret  string
+	types   map[tasks.EventType]bool
+	client  *http.Client
+	backoff time.Duration
+	queue   chan tasks.Event
+	done    chan struct{}
+}
+
+// NewWebhookSink returns a WebhookSink posting events of the given types, or
+// of every type if there are none, to each of urls, signed with secret unless
+// it is empty.
+func NewWebhookSink(urls []string, secret string, types []tasks.EventType) *WebhookSink {
+	s := &WebhookSink{
+		urls:    urls,
+		secret:  secret,
+		types:   make(map[tasks.EventType]bool),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+		queue:   make(chan tasks.Event, webhookBuffer),
+		done:    make(chan struct{}),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+	go s.run()
+	return s
+}
+
+// Send queues e to be posted, if it is of one of the sink's types.
+func (s *WebhookSink) Send(e tasks.Event) {
+	if len(s.types) > 0 && !s.types[e.Type] {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		log.WithField("task", e.TaskID).
+			Warnf("Dropped a %s event because the webhooks are not keeping up", e.Type.Name())
+	}
+}
+
+// Close posts the events already queued and stops the sink. Events sent
+// afterwards are dropped.
+func (s *WebhookSink) Close() {
+	close(s.queue)
+	<-s.done
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.WithField("task", e.TaskID).
+				Errorf("Could not encode the %s event: %v", e.Type.Name(), err)
+			continue
+		}
+		for _, url := range s.urls {
+			if err := s.post(url, e.Type, body); err != nil {
+				log.WithField("task", e.TaskID).
+					Errorf("Could not post the %s event to webhook %s: %v", e.Type.Name(), url, err)
+			}
+		}
+	}
+}
+
+// post posts body to url, trying again with growing pauses if it fails.
+func (s *WebhookSink) post(url string, t tasks.EventType, body []byte) error {
+	var err error
+	pause := s.backoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(pause)
+			pause *= 2
+		}
+		if err = s.postOnce(url, t, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *WebhookSink) postOnce(url string, t tasks.EventType, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, t.Name())
+	if s.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("the webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a webhook request with the given body, for
+// the SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,284 @@
+// Package feeds implements subscriptions to podcast feeds. Feeds are polled
+// periodically and every new episode is queued for transcription.
+package feeds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// PollInterval is how often subscribed feeds are checked for new episodes.
+const PollInterval = 30 * time.Minute
+
+var client = &http.Client{Timeout: time.Minute}
+
+// document matches both RSS 2.0, where items are inside a channel, and Atom,
+// where entries are children of the root element.
+type document struct {
+	XMLName xml.Name
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	GUID        string `xml:"guid"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+	Enclosures  []struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+type atomEntry struct {
+	Title     string `xml:"title"`
+	ID        string `xml:"id"`
+	Summary   string `xml:"summary"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Links     []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"link"`
+}
+
+// Parse reads an RSS or Atom feed and returns its title and the episodes
+// which have an audio or video enclosure, oldest first.
+func Parse(r io.Reader) (string, []db.Episode, error) {
+	doc := new(document)
+	if err := xml.NewDecoder(r).Decode(doc); err != nil {
+		return "", nil, errors.NewNotValid(err, "feed")
+	}
+
+	var title string
+	episodes := []db.Episode{}
+	switch doc.XMLName.Local {
+	case "rss":
+		title = doc.Channel.Title
+		for _, item := range doc.Channel.Items {
+			ep := db.Episode{
+				Title:       strings.TrimSpace(item.Title),
+				Key:         strings.TrimSpace(item.GUID),
+				Link:        strings.TrimSpace(item.Link),
+				Description: strings.TrimSpace(item.Description),
+				PublishedAt: parseTime(item.PubDate),
+			}
+			for _, enclosure := range item.Enclosures {
+				if isMedia(enclosure.Type) {
+					ep.EnclosureURL = strings.TrimSpace(enclosure.URL)
+					break
+				}
+			}
+			episodes = appendEpisode(episodes, ep)
+		}
+	case "feed":
+		title = doc.Title
+		for _, entry := range doc.Entries {
+			ep := db.Episode{
+				Title:       strings.TrimSpace(entry.Title),
+				Key:         strings.TrimSpace(entry.ID),
+				Description: strings.TrimSpace(entry.Summary),
+				PublishedAt: parseTime(entry.Published),
+			}
+			if ep.PublishedAt.IsZero() {
+				ep.PublishedAt = parseTime(entry.Updated)
+			}
+			for _, link := range entry.Links {
+				switch {
+				case link.Rel == "enclosure" && isMedia(link.Type) && ep.EnclosureURL == "":
+					ep.EnclosureURL = strings.TrimSpace(link.Href)
+				case (link.Rel == "" || link.Rel == "alternate") && ep.Link == "":
+					ep.Link = strings.TrimSpace(link.Href)
+				}
+			}
+			episodes = appendEpisode(episodes, ep)
+		}
+	default:
+		return "", nil, errors.NotValidf("feed with root element %q", doc.XMLName.Local)
+	}
+
+	sort.Stable(byPublishedAt(episodes))
+	return strings.TrimSpace(title), episodes, nil
+}
+
+// appendEpisode appends ep to episodes if it has an enclosure. Episodes
+// without a guid or id are keyed by their enclosure's URL.
+func appendEpisode(episodes []db.Episode, ep db.Episode) []db.Episode {
+	if ep.EnclosureURL == "" {
+		return episodes
+	}
+	if ep.Key == "" {
+		ep.Key = ep.EnclosureURL
+	}
+	return append(episodes, ep)
+}
+
+// isMedia reports whether an enclosure of the given MIME type can be
+// transcribed. Enclosures without a type are assumed to be audio.
+func isMedia(mimeType string) bool {
+	return mimeType == "" || strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+// timeLayouts are the date formats found in feeds. RSS uses RFC 822 dates,
+// often with four-digit years or without a day of the week, and Atom uses
+// RFC 3339.
+var timeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339,
+}
+
+func parseTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// byPublishedAt sorts episodes from least to most recently published.
+type byPublishedAt []db.Episode
+
+func (s byPublishedAt) Len() int           { return len(s) }
+func (s byPublishedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPublishedAt) Less(i, j int) bool { return s[i].PublishedAt.Before(s[j].PublishedAt) }
+
+// Fetch downloads and parses the feed at url.
+func Fetch(url string) (string, []db.Episode, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, errors.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return Parse(resp.Body)
+}
+
+// Subscribe fetches the feed f.URL and stores f. The backfill most recent
+// episodes are queued for transcription with queue, which returns the id of
+// the queued job, or "" if the episode cannot be queued yet and should be
+// tried again at the next poll; earlier episodes are skipped.
+func Subscribe(f *db.Feed, backfill int, queue func(*db.Feed, db.Episode) string) error {
+	title, episodes, err := Fetch(f.URL)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f.ID = newID()
+	f.Title = title
+	f.CreatedAt = time.Now()
+	f.PolledAt = f.CreatedAt
+	for i, ep := range episodes {
+		if i < len(episodes)-backfill {
+			f.Seen = append(f.Seen, ep.Key)
+		}
+	}
+	if err := db.Feeds.Create(f); err != nil {
+		return errors.Trace(err)
+	}
+	log.WithField("feed", f.ID).
+		Infof("Subscribed to %s", f.URL)
+
+	_, err = queueNew(f, episodes, queue)
+	return err
+}
+
+// Poll fetches the feed f.URL and queues its new episodes for transcription
+// with queue, oldest first. It returns the episodes which were queued.
+func Poll(f *db.Feed, queue func(*db.Feed, db.Episode) string) ([]db.Episode, error) {
+	title, episodes, err := Fetch(f.URL)
+	f.PolledAt = time.Now()
+	if err != nil {
+		f.LastError = err.Error()
+		if updateErr := db.Feeds.Update(f); updateErr != nil {
+			log.WithField("feed", f.ID).
+				Error(updateErr)
+		}
+		return nil, errors.Trace(err)
+	}
+	f.Title = title
+	f.LastError = ""
+	return queueNew(f, episodes, queue)
+}
+
+// queueNew queues the episodes which f has not seen, records them as seen
+// and saves f.
+func queueNew(f *db.Feed, episodes []db.Episode, queue func(*db.Feed, db.Episode) string) ([]db.Episode, error) {
+	queued := []db.Episode{}
+	for _, ep := range episodes {
+		if f.HasSeen(ep.Key) {
+			continue
+		}
+		ep.FeedID = f.ID
+		ep.FeedTitle = f.Title
+		id := queue(f, ep)
+		if id == "" {
+			// try again at the next poll
+			continue
+		}
+		f.Seen = append(f.Seen, ep.Key)
+		queued = append(queued, ep)
+		log.WithField("feed", f.ID).
+			Infof("Queued episode %q as task %s", ep.Title, id)
+	}
+	if err := db.Feeds.Update(f); err != nil {
+		return queued, errors.Trace(err)
+	}
+	return queued, nil
+}
+
+// Run polls every feed each interval until stop is closed.
+func Run(interval time.Duration, queue func(*db.Feed, db.Episode) string, stop <-chan struct{}) {
+	for {
+		feeds, err := db.Feeds.List()
+		if err != nil {
+			log.Error(err)
+		}
+		for _, f := range feeds {
+			if _, err := Poll(f, queue); err != nil {
+				log.WithField("feed", f.ID).
+					Warn(err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// newID returns a random feed id.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,161 @@
+package feeds
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// serveFixtures serves the files in testdata with {{server}} replaced by the
+// server's URL. Extra items can be added to the RSS feed through the returned
+// function.
+func serveFixtures() (*httptest.Server, func(item string)) {
+	extra := ""
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", filepath.Base(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		feed := strings.Replace(string(data), "<item>", extra+"<item>", 1)
+		w.Write([]byte(strings.Replace(feed, "{{server}}", server.URL, -1)))
+	}))
+	return server, func(item string) { extra += item }
+}
+
+func TestParseRSS(t *testing.T) {
+	assert := assert.New(t)
+	server, _ := serveFixtures()
+	defer server.Close()
+
+	title, episodes, err := Fetch(server.URL + "/podcast.rss")
+	assert.NoError(err)
+	assert.Equal("Community Radio Hour", title)
+	assert.Len(episodes, 2)
+
+	assert.Equal("Episode 1: Welcome", episodes[0].Title)
+	assert.Equal(server.URL+"/audio/1.mp3", episodes[0].Key)
+	assert.Equal("http://example.com/radio/1", episodes[0].Link)
+	assert.Equal("Meet the hosts.", episodes[0].Description)
+
+	assert.Equal("radio-2", episodes[1].Key)
+	assert.Equal(server.URL+"/audio/2.mp3", episodes[1].EnclosureURL)
+	assert.Equal(time.Date(2016, 6, 14, 13, 0, 0, 0, time.UTC), episodes[1].PublishedAt.UTC())
+}
+
+func TestParseAtom(t *testing.T) {
+	assert := assert.New(t)
+	server, _ := serveFixtures()
+	defer server.Close()
+
+	title, episodes, err := Fetch(server.URL + "/podcast.atom")
+	assert.NoError(err)
+	assert.Equal("Council Meetings", title)
+	assert.Len(episodes, 2)
+
+	assert.Equal("May meeting", episodes[0].Title)
+	assert.Equal("urn:example:council:2016-05", episodes[0].Key)
+	assert.Equal(server.URL+"/audio/may.mp3", episodes[0].EnclosureURL)
+	assert.Equal("http://example.com/council/2016-05", episodes[0].Link)
+	assert.Equal(time.Date(2016, 5, 18, 18, 0, 0, 0, time.UTC), episodes[0].PublishedAt)
+
+	assert.Equal("June meeting", episodes[1].Title)
+	assert.Equal(server.URL+"/audio/june.ogg", episodes[1].EnclosureURL)
+}
+
+func TestParseInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := Parse(strings.NewReader("<html><body>not a feed</body></html>"))
+	assert.Error(err)
+	_, _, err = Parse(strings.NewReader("not xml"))
+	assert.Error(err)
+}
+
+func TestSubscribeAndPoll(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "feeds")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Feeds, err = db.NewFileFeedRepository(filepath.Join(dir, "feeds.json"))
+	assert.NoError(err)
+
+	server, addItem := serveFixtures()
+	defer server.Close()
+
+	queued := []db.Episode{}
+	queue := func(f *db.Feed, ep db.Episode) string {
+		queued = append(queued, ep)
+		return "task"
+	}
+
+	f := &db.Feed{URL: server.URL + "/podcast.rss", Language: "en-GB"}
+	assert.NoError(Subscribe(f, 1, queue))
+	assert.Len(queued, 1)
+	assert.Equal("radio-2", queued[0].Key)
+	assert.Equal(f.ID, queued[0].FeedID)
+	assert.Equal("Community Radio Hour", queued[0].FeedTitle)
+
+	// nothing new
+	f, err = db.Feeds.Get(f.ID)
+	assert.NoError(err)
+	episodes, err := Poll(f, queue)
+	assert.NoError(err)
+	assert.Empty(episodes)
+	assert.Len(queued, 1)
+
+	addItem(`<item>
+      <title>Episode 3: The Market</title>
+      <guid>radio-3</guid>
+      <pubDate>Tue, 21 Jun 2016 09:00:00 -0400</pubDate>
+      <enclosure url="{{server}}/audio/3.mp3" type="audio/mpeg"/>
+    </item>`)
+
+	// an episode which cannot be queued yet is tried again
+	episodes, err = Poll(f, func(*db.Feed, db.Episode) string { return "" })
+	assert.NoError(err)
+	assert.Empty(episodes)
+	assert.False(f.HasSeen("radio-3"))
+
+	episodes, err = Poll(f, queue)
+	assert.NoError(err)
+	assert.Len(episodes, 1)
+	assert.Len(queued, 2)
+	assert.Equal("Episode 3: The Market", queued[1].Title)
+
+	stored, err := db.Feeds.Get(f.ID)
+	assert.NoError(err)
+	assert.True(stored.HasSeen("radio-3"))
+	assert.Empty(stored.LastError)
+}
+
+func TestPollRecordsErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "feeds")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Feeds, err = db.NewFileFeedRepository(filepath.Join(dir, "feeds.json"))
+	assert.NoError(err)
+
+	server, _ := serveFixtures()
+	defer server.Close()
+
+	f := &db.Feed{ID: "gone", URL: server.URL + "/missing.rss"}
+	assert.NoError(db.Feeds.Create(f))
+	_, err = Poll(f, func(*db.Feed, db.Episode) string { return "" })
+	assert.Error(err)
+
+	stored, err := db.Feeds.Get("gone")
+	assert.NoError(err)
+	assert.Contains(stored.LastError, "404")
+}
@@ -0,0 +1,122 @@
+// Package idempotency lets clients retry requests which create jobs without
+// creating the jobs twice, by sending the same Idempotency-Key header with
+// every attempt.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// MaxKeyLength is the length of the longest key accepted.
+const MaxKeyLength = 255
+
+// Window is how long keys are remembered.
+var Window = 24 * time.Hour
+
+// PendingTimeout is how long a request may hold its key before retries may
+// take it over, in case the server stopped while handling the request and
+// could not release the key.
+var PendingTimeout = 10 * time.Minute
+
+// ConflictError is returned by Begin when a key cannot be used for a request.
+type ConflictError struct {
+	message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.message
+}
+
+// IsConflict reports whether err was caused by a key which cannot be used.
+func IsConflict(err error) bool {
+	_, ok := errors.Cause(err).(*ConflictError)
+	return ok
+}
+
+// RequestHash returns the hash of a request, by which retries of the request
+// are told apart from different requests reusing a key.
+func RequestHash(method string, uri string, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, method+" "+uri+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Begin records that the request with the given hash was sent with key by
+// whoever scope names, such as an API key's id. If it is the first request
+// with the key in Window, Begin returns the new record, whose Result is
+// empty, and the request should go ahead. If it is a retry of a request which
+// has finished, Begin returns the record, whose Result is that request's. It
+// returns a *ConflictError if the key was used for a different request, or
+// if the request is still being handled and began less than PendingTimeout
+// ago.
+func Begin(scope string, key string, requestHash string, now time.Time) (*db.IdempotencyKey, error) {
+	if key == "" || len(key) > MaxKeyLength {
+		return nil, errors.NotValidf("idempotency key of length %d (the maximum is %d)", len(key), MaxKeyLength)
+	}
+	// forget expired keys so that they may be used again
+	if err := db.IdempotencyKeys.DeleteCreatedBefore(now.Add(-Window)); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	k := &db.IdempotencyKey{
+		ID:          scope + "/" + key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+	}
+	err := db.IdempotencyKeys.Create(k)
+	if err == nil {
+		return k, nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return nil, errors.Trace(err)
+	}
+
+	existing, err := db.IdempotencyKeys.Get(k.ID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if existing.RequestHash != requestHash {
+		return nil, &ConflictError{"the idempotency key was already used for a different request"}
+	}
+	if existing.Result == "" {
+		if existing.CreatedAt.After(now.Add(-PendingTimeout)) {
+			return nil, &ConflictError{"a request with the idempotency key is still being handled"}
+		}
+		// the request was abandoned, so this retry goes ahead instead
+		if err := Release(existing); err != nil {
+			return nil, err
+		}
+		if err := db.IdempotencyKeys.Create(k); err != nil {
+			if errors.IsAlreadyExists(err) {
+				return nil, &ConflictError{"a request with the idempotency key is still being handled"}
+			}
+			return nil, errors.Trace(err)
+		}
+		return k, nil
+	}
+	return existing, nil
+}
+
+// Finish records result, the id of what the request created, as the result
+// of the request begun with k.
+func Finish(k *db.IdempotencyKey, result string) error {
+	k.Result = result
+	return errors.Trace(db.IdempotencyKeys.Update(k))
+}
+
+// Release forgets k, whose request failed, so that it may be retried.
+func Release(k *db.IdempotencyKey) error {
+	err := db.IdempotencyKeys.Delete(k.ID)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return errors.Trace(err)
+}
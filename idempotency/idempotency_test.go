@@ -0,0 +1,79 @@
+package idempotency
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func useTempRepository(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.IdempotencyKeys, err = db.NewFileIdempotencyKeyRepository(filepath.Join(dir, "idempotencykeys.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBegin(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	now := time.Now()
+	hash := RequestHash("POST", "/add_job_json", []byte(`{"audioURL": "a.mp3"}`))
+
+	k, err := Begin("key1", "retry-me", hash, now)
+	assert.NoError(err)
+	assert.Empty(k.Result)
+
+	_, err = Begin("key1", "retry-me", hash, now)
+	assert.True(IsConflict(err), "still being handled")
+	_, err = Begin("key1", "retry-me", hash, now.Add(PendingTimeout-time.Second))
+	assert.True(IsConflict(err), "still being handled")
+
+	assert.NoError(Finish(k, "job1"))
+	k, err = Begin("key1", "retry-me", hash, now.Add(time.Hour))
+	assert.NoError(err)
+	assert.Equal("job1", k.Result)
+
+	other := RequestHash("POST", "/add_job_json", []byte(`{"audioURL": "b.mp3"}`))
+	_, err = Begin("key1", "retry-me", other, now)
+	assert.True(IsConflict(err), "different request")
+
+	// keys are separate for every scope
+	k, err = Begin("key2", "retry-me", other, now)
+	assert.NoError(err)
+	assert.Empty(k.Result)
+
+	// failed requests may be retried
+	assert.NoError(Release(k))
+	k, err = Begin("key2", "retry-me", other, now)
+	assert.NoError(err)
+	assert.Empty(k.Result)
+
+	// retries take over keys of requests which were abandoned
+	k, err = Begin("key2", "retry-me", other, now.Add(PendingTimeout+time.Second))
+	assert.NoError(err)
+	assert.Empty(k.Result)
+	_, err = Begin("key2", "retry-me", other, now.Add(PendingTimeout+time.Second))
+	assert.True(IsConflict(err), "taken over")
+
+	// expired keys may be reused
+	k, err = Begin("key1", "retry-me", other, now.Add(Window+time.Minute))
+	assert.NoError(err)
+	assert.Empty(k.Result)
+
+	_, err = Begin("key1", "", hash, now)
+	assert.True(errors.IsNotValid(err))
+	_, err = Begin("key1", strings.Repeat("k", MaxKeyLength+1), hash, now)
+	assert.True(errors.IsNotValid(err))
+}
@@ -0,0 +1,496 @@
+// Package jobs records transcription jobs in the database and keeps their
+// status up to date as their tasks run.
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/metrics"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// Submit queues task on ex and records it as the job j, whose ID, Status and
+// CreatedAt are filled in. The record is updated when the task finishes.
+func Submit(ex tasks.TaskExecuter, j *db.Job, task func(string) error, onFailure func(string, string)) (string, error) {
+	// the task must not finish before its record exists
+	created := make(chan struct{})
+	run := func(id string) error {
+		<-created
+		return track(id, task)
+	}
+
+	opts := options(j)
+	id, err := newID(ex)
+	if err != nil {
+		return "", err
+	}
+	opts.ID = id
+	if j.ID, err = ex.QueueTaskWith(opts, run, onFailure); err != nil {
+		return "", errors.Trace(err)
+	}
+	j.Status = tasks.INPROGRESS.Name()
+	j.CreatedAt = time.Now()
+	j.Attempts = 1
+	err = db.Jobs.Create(j)
+	close(created)
+	if err != nil {
+		return j.ID, errors.Trace(err)
+	}
+	return j.ID, nil
+}
+
+// Enqueue records j as a job and adds it to the shared queue, for a worker
+// process to run. Its ID, Status and CreatedAt are filled in.
+func Enqueue(j *db.Job) (string, error) {
+	id, err := newID(nil)
+	if err != nil {
+		return "", err
+	}
+	j.ID = id
+	j.Status = tasks.INPROGRESS.Name()
+	j.CreatedAt = time.Now()
+	if err := db.Jobs.Create(j); err != nil {
+		return "", errors.Trace(err)
+	}
+	opts := options(j)
+	if err := db.Queue.Enqueue(j.ID, int(opts.Priority), opts.Submitter, j.CreatedAt); err != nil {
+		return "", errors.Trace(err)
+	}
+	log.WithField("task", j.ID).
+		Info("Task queued for a worker")
+	return j.ID, nil
+}
+
+// Defer records j as a job which is started at start by StartDeferred or
+// EnqueueDeferred. Its ID, Status, StartAt and CreatedAt are filled in.
+func Defer(j *db.Job, start time.Time) (string, error) {
+	id, err := newID(nil)
+	if err != nil {
+		return "", err
+	}
+	j.ID = id
+	j.Status = tasks.SCHEDULED.Name()
+	j.StartAt = start
+	j.CreatedAt = time.Now()
+	if err := db.Jobs.Create(j); err != nil {
+		return "", errors.Trace(err)
+	}
+	log.WithField("task", j.ID).
+		Infof("Task scheduled to start at %s", start.Format(time.RFC3339))
+	return j.ID, nil
+}
+
+// StartDeferred runs task on ex for the job j, which was deferred with Defer
+// and is due. It returns an error satisfying errors.IsNotFound if the job has
+// already been started, e.g. by another server.
+func StartDeferred(ex tasks.TaskExecuter, j *db.Job, task func(string) error, onFailure func(string, string)) error {
+	if err := claim(j); err != nil {
+		return err
+	}
+	return Resume(ex, j, task, onFailure)
+}
+
+// EnqueueDeferred adds the job j, which was deferred with Defer and is due,
+// to the shared queue. It returns an error satisfying errors.IsNotFound if
+// the job has already been started, e.g. by another server.
+func EnqueueDeferred(j *db.Job) error {
+	if err := claim(j); err != nil {
+		return err
+	}
+	return Requeue(j)
+}
+
+// newID returns the id of a new job, which is neither the id of a recorded
+// job nor, unless ex is nil, that of a task known to ex.
+func newID(ex tasks.TaskExecuter) (string, error) {
+	return tasks.NewUniqueID(func(id string) (bool, error) {
+		if ex != nil && ex.GetTaskStatus(id) != tasks.NOTFOUND {
+			return true, nil
+		}
+		_, err := db.Jobs.Get(id)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// claim marks the deferred job j as in progress, unless another process has
+// already done so.
+func claim(j *db.Job) error {
+	if err := db.Jobs.Transition(j.ID, tasks.SCHEDULED.Name(), tasks.INPROGRESS.Name()); err != nil {
+		return err
+	}
+	j.Status = tasks.INPROGRESS.Name()
+	return nil
+}
+
+// Requeue adds the job j, which has a record but is not queued, e.g. because
+// it was interrupted when the previous process stopped, to the shared queue.
+func Requeue(j *db.Job) error {
+	opts := options(j)
+	return errors.Trace(db.Queue.Enqueue(j.ID, int(opts.Priority), opts.Submitter, time.Now()))
+}
+
+// options returns how the task of the job j is scheduled: at its priority,
+// taking turns with the jobs of other users, API keys and organizations. The
+// task carries the job's labels, its submitter and which attempt it is.
+func options(j *db.Job) tasks.TaskOptions {
+	// the priority was checked when the job was submitted
+	priority, _ := tasks.ParsePriority(j.Priority)
+	submitter := ""
+	switch {
+	case j.Owner != "":
+		submitter = "user:" + j.Owner
+	case j.APIKey != "":
+		submitter = "key:" + j.APIKey
+	case j.Org != "":
+		submitter = "org:" + j.Org
+	}
+	labels := map[string]string{}
+	for k, v := range j.Labels {
+		labels[k] = v
+	}
+	if submitter != "" {
+		labels[tasks.SubmitterLabel] = submitter
+	}
+	return tasks.TaskOptions{Priority: priority, Submitter: submitter, Labels: labels, Attempt: j.Attempts}
+}
+
+// Status returns the status of the job with the given id: that of its task
+// if ex is running it, or else the recorded one, as for jobs run by workers.
+func Status(ex tasks.TaskExecuter, id string) tasks.Status {
+	if status := ex.GetTaskStatus(id); status != tasks.NOTFOUND {
+		return status
+	}
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			log.WithField("task", id).
+				Errorf("Could not look up the job: %v", err)
+		}
+		return tasks.NOTFOUND
+	}
+	return tasks.ParseStatus(j.Status)
+}
+
+// Run records j as the job with the given id, whose task is already
+// running, then runs task and records its outcome.
+func Run(id string, j *db.Job, task func(string) error) error {
+	j.ID = id
+	j.Status = tasks.INPROGRESS.Name()
+	j.CreatedAt = time.Now()
+	j.Attempts = 1
+	if err := db.Jobs.Create(j); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the job: %v", err)
+	}
+	return track(id, task)
+}
+
+// Resume runs task on ex again for the job j, which was interrupted when the
+// previous process stopped, keeping its id. The record is updated when the
+// task finishes.
+func Resume(ex tasks.TaskExecuter, j *db.Job, task func(string) error, onFailure func(string, string)) error {
+	j.Attempts++
+	if err := db.Jobs.Update(j); err != nil {
+		return errors.Trace(err)
+	}
+	ex.ResumeTask(j.ID, options(j), func(id string) error {
+		return track(id, task)
+	}, onFailure)
+	return nil
+}
+
+// RecordAudio records the length of the audio transcribed by the job with
+// the given id. Jobs without a record, such as those run from the command
+// line, are ignored.
+func RecordAudio(id string, seconds float64) error {
+	j, err := db.Jobs.Get(id)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	j.AudioSeconds = seconds
+	return errors.Trace(db.Jobs.Update(j))
+}
+
+// StartStage records that the named stage of the pipeline of the job with the
+// given id has started. Jobs without a record are ignored.
+func StartStage(id string, name string) error {
+	return updateStage(id, name, func(s *db.Stage) {
+		s.Status = tasks.INPROGRESS.Name()
+		s.Attempts++
+		s.Error = ""
+		s.StartedAt = time.Now()
+		s.FinishedAt = time.Time{}
+		s.Skipped = false
+	})
+}
+
+// FinishStage records that the named stage of the pipeline of the job with
+// the given id has finished, having failed if err is not nil, or timed out if
+// err is a tasks.TimeoutError. Stages interrupted by the server stopping are
+// left in progress.
+func FinishStage(id string, name string, err error) error {
+	if errors.Cause(err) == tasks.ErrInterrupted {
+		return nil
+	}
+	return updateStage(id, name, func(s *db.Stage) {
+		s.Status = tasks.SUCCESS.Name()
+		if err != nil {
+			s.Status = failedStatus(err).Name()
+			s.Error = errors.Cause(err).Error()
+		}
+		s.FinishedAt = time.Now()
+	})
+}
+
+// SkipStage records that the named stage of the pipeline of the job with the
+// given id, which ran on an earlier attempt, did not need to run on this one.
+// Stages which have not run before are ignored.
+func SkipStage(id string, name string) error {
+	j, err := db.Jobs.Get(id)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for i := range j.Stages {
+		if j.Stages[i].Name == name {
+			j.Stages[i].Status = tasks.SUCCESS.Name()
+			j.Stages[i].Error = ""
+			j.Stages[i].Skipped = true
+			return errors.Trace(db.Jobs.Update(j))
+		}
+	}
+	return nil
+}
+
+// updateStage applies fn to the record of the named stage of the job with the
+// given id, adding one if the stage has not run before.
+func updateStage(id string, name string, fn func(s *db.Stage)) error {
+	j, err := db.Jobs.Get(id)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	i := 0
+	for i < len(j.Stages) && j.Stages[i].Name != name {
+		i++
+	}
+	if i == len(j.Stages) {
+		j.Stages = append(j.Stages, db.Stage{Name: name})
+	}
+	fn(&j.Stages[i])
+	return errors.Trace(db.Jobs.Update(j))
+}
+
+// Retry runs task on ex again for the job j, which has failed or timed out,
+// keeping its id. It returns an error satisfying errors.IsNotFound if the job
+// is no longer failed, e.g. because it is already being retried.
+func Retry(ex tasks.TaskExecuter, j *db.Job, task func(string) error, onFailure func(string, string)) error {
+	if err := reopen(j); err != nil {
+		return err
+	}
+	return Resume(ex, j, task, onFailure)
+}
+
+// EnqueueRetry adds the job j, which has failed or timed out, to the shared
+// queue to run again. It returns an error satisfying errors.IsNotFound if the
+// job is no longer failed.
+func EnqueueRetry(j *db.Job) error {
+	if err := reopen(j); err != nil {
+		return err
+	}
+	if err := db.Jobs.Update(j); err != nil {
+		return errors.Trace(err)
+	}
+	return Requeue(j)
+}
+
+// reopen marks the failed or timed out job j as in progress again, unless
+// another process has already done so.
+func reopen(j *db.Job) error {
+	err := db.Jobs.Transition(j.ID, tasks.FAILURE.Name(), tasks.INPROGRESS.Name())
+	if errors.IsNotFound(err) {
+		err = db.Jobs.Transition(j.ID, tasks.TIMEDOUT.Name(), tasks.INPROGRESS.Name())
+	}
+	if err != nil {
+		return err
+	}
+	j.Status = tasks.INPROGRESS.Name()
+	j.Error = ""
+	j.FinishedAt = time.Time{}
+	log.WithField("task", j.ID).
+		Info("Retrying the task")
+	return nil
+}
+
+// ErrCancelled is the error recorded for jobs cancelled before they started.
+var ErrCancelled = errors.New("the job was cancelled")
+
+// Cancel cancels the job with the given id, which is waiting to start: its
+// task waiting for its turn on ex, its entry in the shared queue waiting for a
+// worker, or its deferred start. The job is recorded as failed with
+// ErrCancelled. It returns an error satisfying errors.IsNotFound if there is
+// no such job, and errors.IsNotValid if it is not waiting to start.
+func Cancel(ex tasks.TaskExecuter, id string) error {
+	if _, err := db.Jobs.Get(id); err != nil {
+		return err
+	}
+	err := ex.Cancel(id)
+	if errors.IsNotFound(err) {
+		err = db.Queue.RemoveWaiting(id)
+	}
+	if errors.IsNotFound(err) {
+		err = db.Jobs.Transition(id, tasks.SCHEDULED.Name(), tasks.FAILURE.Name())
+	}
+	if errors.IsNotFound(err) || errors.IsNotValid(err) {
+		return errors.NotValidf("job %q (it is not waiting to start)", id)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.WithField("task", id).
+		Info("Job cancelled")
+	finish(id, ErrCancelled)
+	return nil
+}
+
+// Delete removes the job with the given id, which has finished, with its
+// transcript, checkpoints and log. Archived files are left in storage, since
+// transcripts reused from the job refer to them. It returns an error
+// satisfying errors.IsNotFound if there is no such job, and
+// errors.IsNotValid if it has not finished.
+func Delete(id string) error {
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		return err
+	}
+	if j.Status == tasks.INPROGRESS.Name() || j.Status == tasks.SCHEDULED.Name() {
+		return errors.NotValidf("job %q (only finished jobs can be deleted)", id)
+	}
+	if err := db.Transcripts.Delete(id); err != nil && !errors.IsNotFound(err) {
+		return errors.Trace(err)
+	}
+	if err := db.Checkpoints.DeleteJob(id); err != nil {
+		return errors.Trace(err)
+	}
+	if err := db.JobLogs.Delete(id); err != nil {
+		return errors.Trace(err)
+	}
+	if err := db.Jobs.Delete(id); err != nil {
+		return errors.Trace(err)
+	}
+	log.WithField("task", id).
+		Info("Job deleted")
+	return nil
+}
+
+// track runs task and records its outcome, even if it panics. Tasks
+// interrupted by the server stopping are left in progress.
+func track(id string, task func(string) error) error {
+	finished := false
+	defer func() {
+		if !finished {
+			// the task panicked
+			finish(id, errors.New("panic occurred"))
+		}
+	}()
+	err := task(id)
+	finished = true
+	if errors.Cause(err) != tasks.ErrInterrupted {
+		finish(id, err)
+	}
+	return err
+}
+
+// finish records the outcome of the job with the given id.
+func finish(id string, taskErr error) {
+	status := tasks.SUCCESS.Name()
+	if taskErr != nil {
+		status = failedStatus(taskErr).Name()
+	}
+	metrics.JobsFinished.Inc(status)
+
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the outcome of the job: %v", err)
+		return
+	}
+	j.FinishedAt = time.Now()
+	j.Status = status
+	if taskErr != nil {
+		j.Error = errors.Cause(taskErr).Error()
+	}
+	if err := db.Jobs.Update(j); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the outcome of the job: %v", err)
+	}
+}
+
+// failedStatus returns the status of a job or stage which failed with err:
+// TIMEDOUT if it ran out of time, and FAILURE otherwise.
+func failedStatus(err error) tasks.Status {
+	if tasks.IsTimeout(err) {
+		return tasks.TIMEDOUT
+	}
+	return tasks.FAILURE
+}
+
+// MaxAttempts is the number of times a job is started before it is given up
+// as failed, when the server keeps stopping while it runs.
+const MaxAttempts = 3
+
+// MarkInterrupted marks jobs which were in progress when the previous process
+// stopped as failed, unless they can be resumed, and returns those which can.
+func MarkInterrupted() ([]*db.Job, error) {
+	interrupted, err := db.Jobs.List(db.JobFilter{Status: tasks.INPROGRESS.Name()})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	resumable := []*db.Job{}
+	failed := 0
+	for _, j := range interrupted {
+		if _, err := db.Queue.Get(j.ID); err == nil {
+			// workers look after queued jobs
+			continue
+		}
+		if j.Resumable && j.Attempts < MaxAttempts {
+			resumable = append(resumable, j)
+			continue
+		}
+		if err := GiveUp(j); err != nil {
+			return nil, errors.Trace(err)
+		}
+		failed++
+	}
+	if failed > 0 {
+		log.Warnf("Marked %d interrupted job(s) as failed", failed)
+	}
+	return resumable, nil
+}
+
+// GiveUp marks the job j, which was interrupted by the server stopping, as
+// failed rather than resuming it.
+func GiveUp(j *db.Job) error {
+	j.Status = tasks.FAILURE.Name()
+	j.Error = "the server stopped before the job finished"
+	if j.Resumable {
+		j.Error += fmt.Sprintf(", %d times", j.Attempts)
+	}
+	j.FinishedAt = time.Now()
+	return errors.Trace(db.Jobs.Update(j))
+}
@@ -0,0 +1,408 @@
+package jobs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func useTempRepository(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Queue, err = db.NewFileQueueRepository(filepath.Join(dir, "queue.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// waitForStatus waits until the job with the given id has the given status.
+func waitForStatus(t *testing.T, id string, status tasks.Status) *db.Job {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if j, err := db.Jobs.Get(id); err == nil && j.Status == status.Name() {
+			return j
+		}
+	}
+	t.Fatalf("job %s did not reach status %s", id, status.Name())
+	return nil
+}
+
+func TestSubmitRecordsOutcome(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+	noop := func(string, string) {}
+
+	id, err := Submit(ex, &db.Job{Owner: "ada"}, func(string) error { return nil }, noop)
+	assert.NoError(err)
+	j := waitForStatus(t, id, tasks.SUCCESS)
+	assert.Equal("ada", j.Owner)
+	assert.False(j.FinishedAt.IsZero())
+
+	id, err = Submit(ex, &db.Job{}, func(string) error { return errors.New("no audio") }, noop)
+	assert.NoError(err)
+	j = waitForStatus(t, id, tasks.FAILURE)
+	assert.Equal("no audio", j.Error)
+
+	id, err = Submit(ex, &db.Job{}, func(string) error { panic("oops") }, noop)
+	assert.NoError(err)
+	waitForStatus(t, id, tasks.FAILURE)
+
+	// interrupted jobs are left to be resumed
+	id, err = Submit(ex, &db.Job{}, func(string) error { return tasks.ErrInterrupted }, noop)
+	assert.NoError(err)
+	assert.NoError(ex.Wait(context.Background()))
+	j, err = db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.INPROGRESS.Name(), j.Status)
+}
+
+func TestMarkInterrupted(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "running", Status: tasks.INPROGRESS.Name()}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "done", Status: tasks.SUCCESS.Name()}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "resumable", Status: tasks.INPROGRESS.Name(), Resumable: true, Attempts: 1}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "tried", Status: tasks.INPROGRESS.Name(), Resumable: true, Attempts: MaxAttempts}))
+	resumable, err := MarkInterrupted()
+	assert.NoError(err)
+	if assert.Len(resumable, 1) {
+		assert.Equal("resumable", resumable[0].ID)
+	}
+
+	j, err := db.Jobs.Get("running")
+	assert.NoError(err)
+	assert.Equal(tasks.FAILURE.Name(), j.Status)
+	j, err = db.Jobs.Get("done")
+	assert.NoError(err)
+	assert.Equal(tasks.SUCCESS.Name(), j.Status)
+	j, err = db.Jobs.Get("resumable")
+	assert.NoError(err)
+	assert.Equal(tasks.INPROGRESS.Name(), j.Status)
+	j, err = db.Jobs.Get("tried")
+	assert.NoError(err)
+	assert.Equal(tasks.FAILURE.Name(), j.Status)
+	assert.Equal("the server stopped before the job finished, 3 times", j.Error)
+}
+
+func TestEnqueueAndStatus(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	id, err := Enqueue(&db.Job{Owner: "ada", Resumable: true})
+	assert.NoError(err)
+	_, err = db.Queue.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.INPROGRESS, Status(ex, id))
+
+	// queued jobs are left to the workers
+	resumable, err := MarkInterrupted()
+	assert.NoError(err)
+	assert.Empty(resumable)
+
+	j, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	j.Status = tasks.SUCCESS.Name()
+	assert.NoError(db.Jobs.Update(j))
+	assert.Equal(tasks.SUCCESS, Status(ex, id))
+	assert.Equal(tasks.NOTFOUND, Status(ex, "unknown"))
+}
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+
+	assert.Equal(tasks.TaskOptions{
+		Priority:  tasks.HIGH,
+		Submitter: "user:ada",
+		Labels:    map[string]string{tasks.SubmitterLabel: "user:ada", tasks.SourceLabel: "web"},
+		Attempt:   2,
+	}, options(&db.Job{Owner: "ada", APIKey: "k", Priority: "HIGH", Attempts: 2, Labels: map[string]string{tasks.SourceLabel: "web"}}))
+	assert.Equal(tasks.TaskOptions{Submitter: "key:k", Labels: map[string]string{tasks.SubmitterLabel: "key:k"}},
+		options(&db.Job{APIKey: "k", Org: "o"}))
+	assert.Equal(tasks.TaskOptions{Priority: tasks.LOW, Submitter: "org:o", Labels: map[string]string{tasks.SubmitterLabel: "org:o"}},
+		options(&db.Job{Org: "o", Priority: "LOW"}))
+	assert.Equal(map[string]string{}, options(&db.Job{}).Labels)
+
+	id, err := Enqueue(&db.Job{Priority: "LOW"})
+	assert.NoError(err)
+	e, err := db.Queue.Get(id)
+	assert.NoError(err)
+	assert.Equal(int(tasks.LOW), e.Priority)
+}
+
+func TestDeferAndStart(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	start := time.Now().Add(time.Hour)
+	id, err := Defer(&db.Job{Owner: "ada", Resumable: true}, start)
+	assert.NoError(err)
+	assert.Equal(tasks.SCHEDULED, Status(ex, id))
+	j, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.True(start.Equal(j.StartAt))
+
+	// scheduled jobs are not interrupted by restarts
+	resumable, err := MarkInterrupted()
+	assert.NoError(err)
+	assert.Empty(resumable)
+
+	assert.NoError(StartDeferred(ex, j, func(string) error { return nil }, func(string, string) {}))
+	// only one server starts the job
+	assert.True(errors.IsNotFound(EnqueueDeferred(j)))
+	j = waitForStatus(t, id, tasks.SUCCESS)
+	assert.Equal(1, j.Attempts)
+}
+
+func TestResume(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	j := &db.Job{ID: "interrupted", Status: tasks.INPROGRESS.Name(), Resumable: true, Attempts: 1}
+	assert.NoError(db.Jobs.Create(j))
+	assert.NoError(Resume(ex, j, func(string) error { return nil }, func(string, string) {}))
+	j = waitForStatus(t, "interrupted", tasks.SUCCESS)
+	assert.Equal(2, j.Attempts)
+}
+
+func TestRunAndRecordAudio(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+
+	err := Run("watched", &db.Job{AudioURL: "/srv/in/talk.mp3"}, func(id string) error {
+		return RecordAudio(id, 90.5)
+	})
+	assert.NoError(err)
+	j, err := db.Jobs.Get("watched")
+	assert.NoError(err)
+	assert.Equal(tasks.SUCCESS.Name(), j.Status)
+	assert.Equal(90.5, j.AudioSeconds)
+
+	// jobs without a record are not metered
+	assert.NoError(RecordAudio("unknown", 10))
+}
+
+func TestStagesAndRetry(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	notified := false
+	task := func(id string) error {
+		for _, name := range []string{"fetch", "notify"} {
+			if err := StartStage(id, name); err != nil {
+				return err
+			}
+			var err error
+			if name == "notify" && !notified {
+				err = errors.New("mail server down")
+			}
+			if err := FinishStage(id, name, err); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := Run("failing", &db.Job{}, task)
+	assert.Error(err)
+	j, err := db.Jobs.Get("failing")
+	assert.NoError(err)
+	if assert.Len(j.Stages, 2) {
+		assert.Equal(tasks.SUCCESS.Name(), j.Stages[0].Status)
+		assert.Equal(tasks.FAILURE.Name(), j.Stages[1].Status)
+		assert.Equal("mail server down", j.Stages[1].Error)
+	}
+
+	notified = true
+	assert.NoError(Retry(ex, j, task, func(string, string) {}))
+	// the job is already being retried
+	assert.True(errors.IsNotFound(EnqueueRetry(j)))
+	j = waitForStatus(t, "failing", tasks.SUCCESS)
+	assert.Empty(j.Error)
+	if assert.Len(j.Stages, 2) {
+		assert.Equal(tasks.SUCCESS.Name(), j.Stages[1].Status)
+		assert.Equal(2, j.Stages[1].Attempts)
+		assert.Empty(j.Stages[1].Error)
+	}
+
+	assert.NoError(SkipStage("failing", "fetch"))
+	// stages which never ran are not recorded as skipped
+	assert.NoError(SkipStage("failing", "split"))
+	j, err = db.Jobs.Get("failing")
+	assert.NoError(err)
+	if assert.Len(j.Stages, 2) {
+		assert.True(j.Stages[0].Skipped)
+	}
+
+	// jobs without a record are ignored
+	assert.NoError(StartStage("unknown", "fetch"))
+}
+
+func TestTimeoutAndRetry(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	timedOut := true
+	task := func(id string) error {
+		if err := StartStage(id, "convert"); err != nil {
+			return err
+		}
+		var err error
+		if timedOut {
+			err = errors.Trace(&tasks.TimeoutError{What: "stage convert", Limit: time.Minute})
+		}
+		if err := FinishStage(id, "convert", err); err != nil {
+			return err
+		}
+		return err
+	}
+	id, err := Submit(ex, &db.Job{}, task, func(string, string) {})
+	assert.NoError(err)
+	j := waitForStatus(t, id, tasks.TIMEDOUT)
+	assert.Equal("stage convert exceeded its time limit of 1m0s", j.Error)
+	if assert.Len(j.Stages, 1) {
+		assert.Equal(tasks.TIMEDOUT.Name(), j.Stages[0].Status)
+	}
+
+	timedOut = false
+	assert.NoError(Retry(ex, j, task, func(string, string) {}))
+	j = waitForStatus(t, id, tasks.SUCCESS)
+	assert.Equal(2, j.Stages[0].Attempts)
+}
+
+func TestNewIDSkipsRecordedJobs(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+
+	id, err := newID(ex)
+	assert.NoError(err)
+	_, err = db.Jobs.Get(id)
+	assert.True(errors.IsNotFound(err))
+	assert.Equal(tasks.NOTFOUND, ex.GetTaskStatus(id))
+}
+
+func TestShare(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "job"}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "other"}))
+
+	_, err := Shared("")
+	assert.True(errors.IsNotFound(err))
+	token, err := Share("job")
+	assert.NoError(err)
+	assert.Len(token, 40)
+	assert.NotContains(token, "job")
+	again, err := Share("job")
+	assert.NoError(err)
+	assert.Equal(token, again)
+
+	j, err := Shared(token)
+	assert.NoError(err)
+	assert.Equal("job", j.ID)
+	_, err = Shared(token[:39] + "x")
+	assert.True(errors.IsNotFound(err))
+
+	assert.NoError(Unshare("job"))
+	_, err = Shared(token)
+	assert.True(errors.IsNotFound(err))
+	assert.NoError(Unshare("job"))
+	_, err = Share("unknown")
+	assert.True(errors.IsNotFound(err))
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepository(t))
+	ex := tasks.NewTaskExecuter(time.Hour)
+	ex.SetMaxRunning(1)
+	noop := func(string, string) {}
+	release := make(chan struct{})
+
+	running, err := Submit(ex, &db.Job{}, func(string) error { <-release; return nil }, noop)
+	assert.NoError(err)
+	waiting, err := Submit(ex, &db.Job{}, func(string) error { return nil }, noop)
+	assert.NoError(err)
+	queued, err := Enqueue(&db.Job{})
+	assert.NoError(err)
+	deferred, err := Defer(&db.Job{}, time.Now().Add(time.Hour))
+	assert.NoError(err)
+
+	assert.True(errors.IsNotFound(Cancel(ex, "unknown")))
+	assert.True(errors.IsNotValid(Cancel(ex, running)))
+	for _, id := range []string{waiting, queued, deferred} {
+		assert.NoError(Cancel(ex, id), id)
+		j := waitForStatus(t, id, tasks.FAILURE)
+		assert.Equal(ErrCancelled.Error(), j.Error)
+		assert.True(errors.IsNotValid(Cancel(ex, id)), id)
+	}
+	_, err = db.Queue.Get(queued)
+	assert.True(errors.IsNotFound(err))
+
+	// let the running job finish before the next test swaps the repositories
+	close(release)
+	waitForStatus(t, running, tasks.SUCCESS)
+}
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+	dir := useTempRepository(t)
+	defer os.RemoveAll(dir)
+	var err error
+	if db.Transcripts, err = db.NewFileTranscriptRepository(filepath.Join(dir, "transcripts.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Checkpoints, err = db.NewFileCheckpointRepository(filepath.Join(dir, "checkpoints.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.JobLogs, err = db.NewFileJobLogRepository(filepath.Join(dir, "joblogs.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "done", Status: tasks.SUCCESS.Name()}))
+	assert.NoError(db.Transcripts.Create(&db.Transcript{ID: "done"}))
+	assert.NoError(db.Checkpoints.Put(&db.Checkpoint{Job: "done", Stage: "archive"}))
+	assert.NoError(db.JobLogs.Append("done", []db.LogEntry{{Message: "finished"}}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "failed", Status: tasks.FAILURE.Name()}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "running", Status: tasks.INPROGRESS.Name()}))
+
+	assert.NoError(Delete("done"))
+	_, err = db.Jobs.Get("done")
+	assert.True(errors.IsNotFound(err))
+	_, err = db.Transcripts.Get("done")
+	assert.True(errors.IsNotFound(err))
+	checkpoints, err := db.Checkpoints.List("done")
+	assert.NoError(err)
+	assert.Empty(checkpoints)
+	entries, err := db.JobLogs.Get("done")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	// jobs without a transcript can be deleted too
+	assert.NoError(Delete("failed"))
+	assert.True(errors.IsNotFound(Delete("failed")))
+	assert.True(errors.IsNotValid(Delete("running")))
+}
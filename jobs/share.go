@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// Share returns the token with which anyone can see the job with the given
+// id, creating one if the job is not shared yet.
+func Share(id string) (string, error) {
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if j.ShareToken != "" {
+		return j.ShareToken, nil
+	}
+	j.ShareToken = newShareToken()
+	if err := db.Jobs.Update(j); err != nil {
+		return "", errors.Trace(err)
+	}
+	log.WithField("task", id).
+		Info("Job shared")
+	return j.ShareToken, nil
+}
+
+// Unshare revokes the token with which the job with the given id was shared,
+// if any.
+func Unshare(id string) error {
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		return err
+	}
+	if j.ShareToken == "" {
+		return nil
+	}
+	j.ShareToken = ""
+	if err := db.Jobs.Update(j); err != nil {
+		return errors.Trace(err)
+	}
+	log.WithField("task", id).
+		Info("Job no longer shared")
+	return nil
+}
+
+// Shared returns the job shared with token. It returns an error satisfying
+// errors.IsNotFound if there is none, e.g. because it is no longer shared.
+func Shared(token string) (*db.Job, error) {
+	if token == "" {
+		return nil, errors.NotFoundf("shared job")
+	}
+	list, err := db.Jobs.List(db.JobFilter{ShareToken: token, Limit: 1})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(list) == 0 {
+		return nil, errors.NotFoundf("shared job")
+	}
+	return list[0], nil
+}
+
+// newShareToken returns a random token for sharing a job. It says nothing
+// about the job, so that shared jobs cannot be found from their ids.
+func newShareToken() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -1,37 +1,325 @@
-// Package main initializes a web server.
+// Package main runs the transcribe4all web server and its command-line
+// client.
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
-	_ "net/http/pprof" // import for side effects
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/events"
+	"github.com/hack4impact/transcribe4all/idempotency"
+	"github.com/hack4impact/transcribe4all/joblogs"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/metrics"
+	"github.com/hack4impact/transcribe4all/storage"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/transcription"
+	"github.com/hack4impact/transcribe4all/usage"
+	"github.com/hack4impact/transcribe4all/watch"
 	"github.com/hack4impact/transcribe4all/web"
+	"github.com/juju/errors"
 )
 
-func init() {
+func main() {
+	flags := flag.NewFlagSet("transcribe4all", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv(config.EnvPrefix+"CONFIG"),
+		"configuration file (default $"+config.EnvPrefix+"CONFIG, or "+config.DefaultPath+" if it exists)")
+	flags.Usage = printUsage
+	// the flags come before the command, whose own flags follow it
+	flags.Parse(os.Args[1:])
+	if err := config.Load(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	setupLogging()
+
+	name := "serve"
+	args := flags.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	printUsage()
+	os.Exit(2)
+}
+
+// setupLogging sets the level of the log from the app config, and logs the
+// config without its secrets.
+func setupLogging() {
 	log.SetOutput(os.Stderr)
 	if config.Config.Debug {
 		log.SetLevel(log.DebugLevel)
 	} else {
 		log.SetLevel(log.InfoLevel)
 	}
+	log.Infof("%+v", config.Config.Redacted())
 }
 
-func main() {
-	router := web.NewRouter()
-	middlewareRouter := web.ApplyMiddleware(router)
+// configProblems returns what is wrong with the app config c: the problems
+// found by its Validate, and those with the settings whose valid values are
+// defined by other packages.
+func configProblems(c config.AppConfig) []error {
+	problems := c.Validate()
+	if err := transcription.ValidateTimeouts(c.JobTimeoutMinutes, c.StageTimeoutMinutes); err != nil {
+		problems = append(problems, errors.Annotate(err, "JobTimeoutMinutes or StageTimeoutMinutes"))
+	}
+	if len(c.WatchDirs) > 0 && c.WatchLanguage != "" && !transcription.ValidLanguage(c.WatchLanguage) {
+		problems = append(problems, errors.Errorf("WatchLanguage %q is not supported", c.WatchLanguage))
+	}
+	for _, name := range c.WebhookEvents {
+		if _, err := tasks.ParseEventType(name); err != nil {
+			problems = append(problems, errors.Errorf("WebhookEvents entry %q is not one of queued, started, progress, succeeded, failed, timeout, cancelled and expired", name))
+		}
+	}
+	return problems
+}
+
+// validateConfig returns an error listing every problem with the app config,
+// so that servers and workers do not start with settings which cannot work.
+func validateConfig() error {
+	problems := configProblems(config.Config)
+	if len(problems) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, p := range problems {
+		lines = append(lines, "  "+p.Error())
+	}
+	return errors.Errorf("the configuration has %d problem(s):\n%s", len(problems), strings.Join(lines, "\n"))
+}
+
+// publicURL returns the address at which users reach the app.
+func publicURL() string {
+	if config.Config.PublicURL != "" {
+		return strings.TrimSuffix(config.Config.PublicURL, "/")
+	}
+	return fmt.Sprintf("http://localhost:%d", config.Config.Port)
+}
+
+// setupDB opens the configured database, falling back to JSON files in
+// DataDir when no MongoURL is given.
+func setupDB() error {
+	dataDir := config.Config.DataDir
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	return db.Open(config.Config.MongoURL, config.Config.MongoDatabase, dataDir)
+}
+
+// setupQuotas sets the monthly audio quotas from the app config.
+func setupQuotas() {
+	usage.Limits = usage.Quotas{
+		Instance:  config.Config.MonthlyQuotaMinutes,
+		PerUser:   config.Config.UserMonthlyQuotaMinutes,
+		PerAPIKey: config.Config.APIKeyMonthlyQuotaMinutes,
+	}
+}
+
+// setupIdempotency sets how long idempotency keys are remembered from the
+// app config.
+func setupIdempotency() {
+	if hours := config.Config.IdempotencyKeyHours; hours > 0 {
+		idempotency.Window = time.Duration(hours) * time.Hour
+	}
+}
 
-	// serve http
-	http.Handle("/", middlewareRouter)
-	http.Handle("/static/", http.FileServer(http.Dir(".")))
+// setupJobLogs captures the log entries about each job, redacting the
+// secrets in the app config.
+func setupJobLogs() {
+	joblogs.Secrets = config.Config.Secrets()
+	log.AddHook(joblogs.NewHook())
+}
+
+// setupMetrics publishes the depth of the task queue as a metric and protects
+// the metrics with MetricsToken.
+func setupMetrics() {
+	metrics.NewGaugeFunc("transcribe4all_queue_depth", "Tasks queued or running.", func() float64 {
+		queued, err := db.Queue.Count()
+		if err != nil {
+			log.Errorf("Could not count the queued jobs: %v", err)
+		}
+		return float64(tasks.DefaultTaskExecuter.TaskCounts()[tasks.INPROGRESS] + queued)
+	})
+	web.MetricsToken = config.Config.MetricsToken
+}
+
+// setupEvents passes on the events of the tasks this process runs to those
+// following jobs' progress on the web, to the metrics and to the configured
+// WebhookURLs. The returned function stops passing them on, once the events
+// already queued for the webhooks have been posted.
+func setupEvents() (func(), error) {
+	types := []tasks.EventType{}
+	for _, name := range config.Config.WebhookEvents {
+		t, err := tasks.ParseEventType(name)
+		if err != nil {
+			return nil, errors.Annotate(err, "WebhookEvents")
+		}
+		types = append(types, t)
+	}
+	sinks := []events.Sink{web.Events, events.NewMetricsSink()}
+	var webhooks *events.WebhookSink
+	if len(config.Config.WebhookURLs) > 0 {
+		webhooks = events.NewWebhookSink(config.Config.WebhookURLs, config.Config.WebhookSecret, types)
+		sinks = append(sinks, webhooks)
+		log.Infof("Posting task events to %d webhook(s)", len(config.Config.WebhookURLs))
+	}
+	stop := events.Dispatch(tasks.DefaultTaskExecuter, sinks...)
+	return func() {
+		stop()
+		if webhooks != nil {
+			webhooks.Close()
+		}
+	}, nil
+}
 
-	log.Infof("Server is running at http://localhost:%d", config.Config.Port)
-	addr := fmt.Sprintf(":%d", config.Config.Port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Error(err)
+// setupStorage configures storage.Default from the app config. Configs
+// predating StorageDriver which contain Backblaze credentials keep using
+// Backblaze.
+func setupStorage() error {
+	driver := config.Config.StorageDriver
+	if driver == "" && len(config.Config.BackblazeAccountID) > 0 {
+		driver = "backblaze"
+	}
+	if driver == "" {
+		return nil
+	}
+
+	s, err := storage.New(storage.Options{
+		Driver:                  driver,
+		LocalPath:               config.Config.StoragePath,
+		LocalURL:                publicURL() + "/files",
+		SigningKey:              config.Config.SecretKey,
+		S3Endpoint:              config.Config.S3Endpoint,
+		S3Region:                config.Config.S3Region,
+		S3Bucket:                config.Config.S3Bucket,
+		S3AccessKeyID:           config.Config.S3AccessKeyID,
+		S3SecretAccessKey:       config.Config.S3SecretAccessKey,
+		BackblazeAccountID:      config.Config.BackblazeAccountID,
+		BackblazeApplicationKey: config.Config.BackblazeApplicationKey,
+		BackblazeBucket:         config.Config.BackblazeBucket,
+	})
+	if err != nil {
+		return err
+	}
+	storage.Default = s
+	log.Infof("Storing files using the %s driver", driver)
+	return nil
+}
+
+// setupWatcher starts watching the configured WatchDirs for audio files, if
+// any, until stop is closed. Files are transcribed in WatchLanguage.
+func setupWatcher(stop <-chan struct{}) error {
+	if len(config.Config.WatchDirs) == 0 {
+		return nil
+	}
+	if !transcription.ValidLanguage(config.Config.WatchLanguage) {
+		return errors.NotValidf("WatchLanguage %q", config.Config.WatchLanguage)
+	}
+
+	transcribe := func(id string, path string) (string, error) {
+		job := transcription.Job{AudioURL: path, Language: config.Config.WatchLanguage, LocalFile: true}
+		var transcript string
+		record := &db.Job{
+			AudioURL: path,
+			Language: job.Language,
+			Labels:   map[string]string{tasks.SourceLabel: "watch"},
+		}
+		err := jobs.Run(id, record, func(id string) error {
+			if err := usage.Check("", nil, time.Now()); err != nil {
+				return err
+			}
+			ctx, cancel := transcription.NewRunContext(context.Background(), job)
+			defer cancel()
+			t, err := transcription.Transcribe(ctx, id, job)
+			if err != nil {
+				return err
+			}
+			transcript = t.Transcript
+			return nil
+		})
+		return transcript, err
+	}
+	w := watch.New(config.Config.WatchDirs, tasks.DefaultTaskExecuter, transcribe)
+	if err := w.Start(); err != nil {
+		return err
+	}
+	go w.Run(stop)
+	return nil
+}
+
+// waitForSignal waits until the process is asked to stop with SIGINT or
+// SIGTERM, or returns the error received from failed. A second signal exits
+// straight away.
+func waitForSignal(failed <-chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+	}
+	go func() {
+		<-signals
+		log.Warn("Received a second signal, exiting without waiting for jobs")
+		os.Exit(1)
+	}()
+	return nil
+}
+
+// defaultShutdownGrace is how long running jobs are given to finish when the
+// server stops, unless ShutdownGraceSeconds is set.
+const defaultShutdownGrace = 30 * time.Second
+
+// shutdown stops the server or worker gracefully: it closes stop, so that
+// feeds, watched folders and workers no longer take on jobs, stops server, if
+// any, accepting requests, and waits for running jobs until the grace period
+// ends. Jobs still running then are interrupted, to be resumed by the next
+// process or another worker, and temporary files are removed.
+func shutdown(server *http.Server, stop chan struct{}) {
+	grace := defaultShutdownGrace
+	if seconds := config.Config.ShutdownGraceSeconds; seconds > 0 {
+		grace = time.Duration(seconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	close(stop)
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Could not finish handling every request: %v", err)
+		}
+	}
+	running := tasks.DefaultTaskExecuter.TaskCounts()[tasks.INPROGRESS]
+	if running > 0 {
+		log.Infof("Waiting up to %v for %d running job(s) to finish", grace, running)
+	}
+	if err := tasks.DefaultTaskExecuter.Wait(ctx); err != nil {
+		log.Warnf("Interrupting %d job(s) which did not finish in time; they will be resumed when the server restarts",
+			tasks.DefaultTaskExecuter.TaskCounts()[tasks.INPROGRESS])
+		transcription.StopCommands()
+	}
+	if err := transcription.RemoveTempFiles(); err != nil {
+		log.Errorf("Could not remove temporary files: %v", err)
 	}
+	log.Info("Server stopped")
 }
@@ -0,0 +1,257 @@
+// Package metrics keeps counters, gauges and histograms describing the app
+// and writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// These are the app's metrics.
+var (
+	JobsFinished = NewCounter("transcribe4all_jobs_finished_total",
+		"Jobs which have finished, by status.", "status")
+	StageDuration = NewHistogram("transcribe4all_stage_duration_seconds",
+		"Time spent in each stage of the transcription pipeline.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}, "stage")
+	EngineErrors = NewCounter("transcribe4all_engine_errors_total",
+		"Errors from the speech-to-text engine, by type.", "type")
+	AudioSeconds = NewCounter("transcribe4all_audio_seconds_total",
+		"Length of the audio sent for transcription.")
+	HTTPDuration = NewHistogram("transcribe4all_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route name and status code.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route", "code")
+	TaskEvents = NewCounter("transcribe4all_task_events_total",
+		"Events in the lives of tasks, by type.", "type")
+	QueueWait = NewHistogram("transcribe4all_queue_wait_seconds",
+		"Time tasks waited between being queued and starting.",
+		[]float64{0.1, 1, 5, 10, 30, 60, 300, 600, 1800, 3600})
+)
+
+// metric is a metric which can write itself in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// WriteText writes every metric in the Prometheus text exposition format, in
+// the order they were created.
+func WriteText(w io.Writer) error {
+	registry.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.Unlock()
+
+	out := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(out)
+	}
+	return errors.Trace(out.Flush())
+}
+
+// series holds the label names of a metric and maps the values of its labels
+// to the state of each series.
+type series struct {
+	name   string
+	help   string
+	labels []string
+	sync.Mutex
+	values map[string][]string
+}
+
+// key returns the key of the series with the given label values.
+func (s *series) key(labelValues []string) string {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label value(s), not %d", s.name, len(s.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := s.values[key]; !ok {
+		s.values[key] = append([]string{}, labelValues...)
+	}
+	return key
+}
+
+// sortedKeys returns the keys of the series in a stable order.
+func (s *series) sortedKeys() []string {
+	keys := []string{}
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelText formats the labels of the series with the given key, plus any
+// extra name and value pairs, as {name="value",...}.
+func (s *series) labelText(key string, extra ...string) string {
+	pairs := []string{}
+	for i, value := range s.values[key] {
+		pairs = append(pairs, s.labels[i]+`="`+escape(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (s *series) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, kind)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a metric which only goes up.
+type Counter struct {
+	series
+	counts map[string]float64
+}
+
+// NewCounter returns a counter with the given label names.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: series{name: name, help: help, labels: labels, values: map[string][]string{}},
+		counts: map[string]float64{},
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label
+// values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[c.key(labelValues)] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w, "counter")
+	if len(c.labels) == 0 && len(c.counts) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelText(key), formatFloat(c.counts[key]))
+	}
+}
+
+// Histogram counts observations, such as durations, in buckets.
+type Histogram struct {
+	series
+	// buckets are the upper bounds of the buckets, in increasing order.
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, in
+// increasing order, and label names.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		series:  series{name: name, help: help, labels: labels, values: map[string][]string{}},
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+	register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := h.key(labelValues)
+	if h.counts[key] == nil {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+// ObserveSince records the seconds elapsed since start in the series with
+// the given label values.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(w, "histogram")
+	for _, key := range h.sortedKeys() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(key, "le", formatFloat(bound)), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelText(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelText(key), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelText(key), h.totals[key])
+	}
+}
+
+// GaugeFunc is a metric whose value is read when the metrics are written.
+type GaugeFunc struct {
+	series
+	value func() float64
+}
+
+// NewGaugeFunc returns a gauge whose value is returned by value, which must
+// be safe to call from any goroutine.
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		series: series{name: name, help: help, values: map[string][]string{}},
+		value:  value,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func text(m metric) string {
+	var b bytes.Buffer
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounter(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCounter("test_errors_total", "Errors by type.", "type")
+	c.Inc("timeout")
+	c.Add(2, "auth")
+	c.Inc("timeout")
+	c.Inc(`a "quoted"\ type`)
+	assert.Equal(`# HELP test_errors_total Errors by type.
+# TYPE test_errors_total counter
+test_errors_total{type="a \"quoted\"\\ type"} 1
+test_errors_total{type="auth"} 2
+test_errors_total{type="timeout"} 2
+`, text(c))
+
+	unlabeled := NewCounter("test_seconds_total", "Seconds.")
+	assert.Contains(text(unlabeled), "\ntest_seconds_total 0\n")
+	unlabeled.Add(1.5)
+	assert.Contains(text(unlabeled), "\ntest_seconds_total 1.5\n")
+
+	assert.Panics(func() { c.Inc() })
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 10}, "stage")
+	h.Observe(0.5, "convert")
+	h.Observe(5, "convert")
+	h.Observe(50, "convert")
+	assert.Equal(t, `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="convert",le="1"} 1
+test_duration_seconds_bucket{stage="convert",le="10"} 2
+test_duration_seconds_bucket{stage="convert",le="+Inf"} 3
+test_duration_seconds_sum{stage="convert"} 55.5
+test_duration_seconds_count{stage="convert"} 3
+`, text(h))
+}
+
+func TestWriteText(t *testing.T) {
+	NewGaugeFunc("test_queue_depth", "Queued tasks.", func() float64 { return 3 })
+	var b bytes.Buffer
+	assert.NoError(t, WriteText(&b))
+	assert.True(t, strings.HasPrefix(b.String(), "# HELP transcribe4all_jobs_finished_total"))
+	assert.Contains(t, b.String(), "# TYPE test_queue_depth gauge\ntest_queue_depth 3\n")
+}
@@ -0,0 +1,159 @@
+// Package orgs implements organizations, their members' roles, and the
+// checks deciding who may see and change jobs and transcripts.
+package orgs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// The roles of organization members, from most to least powerful. Viewers
+// may read the organization's jobs and transcripts, editors may also submit
+// and delete them, and admins may also manage the members.
+const (
+	Admin  = "admin"
+	Editor = "editor"
+	Viewer = "viewer"
+)
+
+// Roles lists every role.
+var Roles = []string{Admin, Editor, Viewer}
+
+var ranks = map[string]int{Viewer: 1, Editor: 2, Admin: 3}
+
+// ValidRole reports whether role is one of Roles.
+func ValidRole(role string) bool {
+	return ranks[role] > 0
+}
+
+// Allows reports whether role grants everything that need does.
+func Allows(role string, need string) bool {
+	return ranks[role] > 0 && ranks[role] >= ranks[need]
+}
+
+// Create creates and stores an organization with the user with the given id
+// as its admin.
+func Create(name string, adminID string) (*db.Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.NewNotValid(nil, "the organization needs a name")
+	}
+	o := &db.Organization{
+		ID:        newID(),
+		Name:      name,
+		CreatedAt: time.Now(),
+		Members:   []db.Member{{UserID: adminID, Role: Admin}},
+	}
+	if err := db.Orgs.Create(o); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return o, nil
+}
+
+// SetMember adds the user with the given id to o with role, or changes their
+// role if they are already a member.
+func SetMember(o *db.Organization, userID string, role string) error {
+	if !ValidRole(role) {
+		return errors.NewNotValid(nil, "the role must be one of "+strings.Join(Roles, ", "))
+	}
+	members := []db.Member{}
+	for _, m := range o.Members {
+		if m.UserID != userID {
+			members = append(members, m)
+		}
+	}
+	members = append(members, db.Member{UserID: userID, Role: role})
+	return errors.Trace(setMembers(o, members))
+}
+
+// RemoveMember removes the user with the given id from o.
+func RemoveMember(o *db.Organization, userID string) error {
+	if o.Role(userID) == "" {
+		return errors.NotFoundf("member %q", userID)
+	}
+	members := []db.Member{}
+	for _, m := range o.Members {
+		if m.UserID != userID {
+			members = append(members, m)
+		}
+	}
+	return errors.Trace(setMembers(o, members))
+}
+
+// setMembers replaces the members of o, making sure that it keeps an admin.
+func setMembers(o *db.Organization, members []db.Member) error {
+	for _, m := range members {
+		if m.Role == Admin {
+			o.Members = members
+			return errors.Trace(db.Orgs.Update(o))
+		}
+	}
+	return errors.NewNotValid(nil, "an organization must keep at least one admin")
+}
+
+// Subject is whoever makes a request: a logged in user or, on the API, an
+// API key.
+type Subject struct {
+	User   *db.User
+	APIKey *db.APIKey
+}
+
+// Role returns the role s has in the organization with the given id, or "" if
+// it has none. Site administrators and API keys not tied to an organization
+// are admins of every organization.
+func Role(s Subject, org string) (string, error) {
+	if s.User != nil && s.User.Admin {
+		return Admin, nil
+	}
+	if k := s.APIKey; k != nil {
+		switch {
+		case k.Org == "":
+			return Admin, nil
+		case k.Org != org:
+			return "", nil
+		case k.Role == "":
+			return Editor, nil
+		}
+		return k.Role, nil
+	}
+	if s.User == nil || org == "" {
+		return "", nil
+	}
+	o, err := db.Orgs.Get(org)
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return o.Role(s.User.ID), nil
+}
+
+// Can reports whether s has at least the role need for a record, such as a
+// job, belonging to the organization org. Records without an organization
+// belong to the user with the id owner alone.
+func Can(s Subject, need string, org string, owner string) (bool, error) {
+	if org == "" && s.User != nil && !s.User.Admin {
+		return owner != "" && owner == s.User.ID, nil
+	}
+	role, err := Role(s, org)
+	if err != nil {
+		return false, err
+	}
+	return Allows(role, need), nil
+}
+
+// newID returns a random organization id.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+package orgs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestAllows(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Allows(Admin, Editor))
+	assert.True(Allows(Editor, Editor))
+	assert.True(Allows(Editor, Viewer))
+	assert.False(Allows(Viewer, Editor))
+	assert.False(Allows("", Viewer))
+	assert.False(Allows("owner", Viewer))
+}
+
+func TestMembers(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "orgs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Orgs, err = db.NewFileOrganizationRepository(filepath.Join(dir, "organizations.json"))
+	assert.NoError(err)
+
+	o, err := Create("Radio Free", "ada")
+	assert.NoError(err)
+	assert.Equal(Admin, o.Role("ada"))
+
+	assert.NoError(SetMember(o, "grace", Viewer))
+	assert.NoError(SetMember(o, "grace", Editor))
+	assert.Len(o.Members, 2)
+	assert.True(errors.IsNotValid(SetMember(o, "grace", "owner")))
+
+	// the last admin can be neither demoted nor removed
+	assert.True(errors.IsNotValid(SetMember(o, "ada", Viewer)))
+	assert.True(errors.IsNotValid(RemoveMember(o, "ada")))
+	assert.True(errors.IsNotFound(RemoveMember(o, "linus")))
+	assert.Equal(Admin, o.Role("ada"))
+
+	stored, err := db.Orgs.Get(o.ID)
+	assert.NoError(err)
+	assert.Equal(Editor, stored.Role("grace"))
+	list, err := db.Orgs.List("grace")
+	assert.NoError(err)
+	assert.Len(list, 1)
+	list, err = db.Orgs.List("linus")
+	assert.NoError(err)
+	assert.Len(list, 0)
+}
+
+func TestCan(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "orgs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Orgs, err = db.NewFileOrganizationRepository(filepath.Join(dir, "organizations.json"))
+	assert.NoError(err)
+
+	o, err := Create("Radio Free", "ada")
+	assert.NoError(err)
+	assert.NoError(SetMember(o, "grace", Viewer))
+
+	ada := Subject{User: &db.User{ID: "ada"}}
+	grace := Subject{User: &db.User{ID: "grace"}}
+	linus := Subject{User: &db.User{ID: "linus"}}
+	root := Subject{User: &db.User{ID: "root", Admin: true}}
+	instanceKey := Subject{APIKey: &db.APIKey{ID: "k1"}}
+	orgKey := Subject{APIKey: &db.APIKey{ID: "k2", Org: o.ID, Role: Viewer}}
+
+	cases := []struct {
+		s     Subject
+		need  string
+		org   string
+		owner string
+		can   bool
+	}{
+		{ada, Editor, o.ID, "", true},
+		{grace, Viewer, o.ID, "", true},
+		{grace, Editor, o.ID, "", false},
+		{linus, Viewer, o.ID, "", false},
+		{root, Admin, o.ID, "", true},
+		{instanceKey, Editor, o.ID, "", true},
+		{orgKey, Viewer, o.ID, "", true},
+		{orgKey, Editor, o.ID, "", false},
+		{linus, Viewer, "missing", "", false},
+		// personal jobs
+		{linus, Editor, "", "linus", true},
+		{ada, Viewer, "", "linus", false},
+		{ada, Viewer, "", "", false},
+		{root, Viewer, "", "linus", true},
+		{instanceKey, Viewer, "", "linus", true},
+		{orgKey, Viewer, "", "linus", false},
+	}
+	for _, c := range cases {
+		can, err := Can(c.s, c.need, c.org, c.owner)
+		assert.NoError(err)
+		assert.Equal(c.can, can, "%+v", c)
+	}
+}
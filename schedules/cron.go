@@ -0,0 +1,189 @@
+package schedules
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Spec is a parsed cron expression, which says at which minutes something
+// happens.
+type Spec struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, a day matches if both the day of the month and the day of
+	// the week match, unless both are restricted, in which case either one
+	// matching is enough.
+	domAny, dowAny bool
+}
+
+// descriptors are the shorthands which may replace a cron expression.
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// field describes one of the five fields of a cron expression.
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: []string{
+		"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec",
+	}}
+	// Sunday is both 0 and 7.
+	dowField = field{name: "day of week", min: 0, max: 7, names: []string{
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat",
+	}}
+)
+
+// ParseSpec parses a cron expression of five fields: minute, hour, day of
+// month, month and day of week, e.g. "30 2 * * 1-5" for 2:30 on weekdays.
+// Each field is "*" or a comma-separated list of numbers and ranges such as
+// "1-5", optionally with a step such as "*/15". Months and days of the week
+// may be given by their first three letters. The shorthands @yearly,
+// @monthly, @weekly, @daily and @hourly are accepted too.
+func ParseSpec(expr string) (*Spec, error) {
+	expr = strings.TrimSpace(expr)
+	fields := strings.Fields(expr)
+	if d, ok := descriptors[strings.ToLower(expr)]; ok {
+		fields = strings.Fields(d)
+	}
+	if len(fields) != 5 {
+		return nil, errors.NotValidf("cron expression %q (it needs five fields)", expr)
+	}
+
+	s := new(Spec)
+	var err error
+	for i, f := range []struct {
+		field
+		bits *uint64
+	}{
+		{minuteField, &s.minute},
+		{hourField, &s.hour},
+		{domField, &s.dom},
+		{monthField, &s.month},
+		{dowField, &s.dow},
+	} {
+		if *f.bits, err = f.parse(fields[i]); err != nil {
+			return nil, errors.NotValidf("cron expression %q (%v)", expr, err)
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parse returns the set of values matched by the field's text, as bits.
+func (f field) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, term := range strings.Split(text, ",") {
+		rangeText, step := term, 1
+		if i := strings.Index(term, "/"); i >= 0 {
+			n, err := strconv.Atoi(term[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.Errorf("bad step in %s %q", f.name, term)
+			}
+			rangeText, step = term[:i], n
+		}
+
+		var first, last int
+		switch {
+		case rangeText == "*":
+			first, last = f.min, f.max
+		case strings.Contains(rangeText, "-"):
+			bounds := strings.SplitN(rangeText, "-", 2)
+			var err error
+			if first, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if last, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if first > last {
+				return 0, errors.Errorf("backwards range in %s %q", f.name, term)
+			}
+		default:
+			var err error
+			if first, err = f.value(rangeText); err != nil {
+				return 0, err
+			}
+			last = first
+			if step > 1 {
+				// "5/15" means from 5 to the end in steps of 15
+				last = f.max
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of the field.
+func (f field) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.Errorf("%s %q is not between %d and %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+// dayMatches reports whether the spec matches the day of t.
+func (s *Spec) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t which the spec matches, in t's time
+// zone, or the zero time if there is none within five years, as for
+// "0 0 30 2 *".
+func (s *Spec) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !has(s.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !has(s.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !has(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,150 @@
+// Package schedules starts jobs at the times they were scheduled for: jobs
+// deferred until a given time, and recurring schedules, which submit a job
+// whenever their cron expression falls due. Both are stored in the database,
+// so that restarts do not lose them.
+package schedules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// PollInterval is how often deferred jobs and schedules are checked. Cron
+// expressions cannot say anything finer than a minute.
+const PollInterval = time.Minute
+
+// NextRun returns the first time after after at which the schedule s falls
+// due.
+func NextRun(s *db.Schedule, after time.Time) (time.Time, error) {
+	spec, err := ParseSpec(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the empty name is UTC
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.Time{}, errors.NotValidf("time zone %q", s.TimeZone)
+	}
+	next := spec.Next(after.In(loc))
+	if next.IsZero() {
+		return time.Time{}, errors.NotValidf("cron expression %q (it never falls due)", s.Cron)
+	}
+	return next.UTC(), nil
+}
+
+// Create checks the cron expression and time zone of s, fills in its ID,
+// CreatedAt and NextRun, and stores it.
+func Create(s *db.Schedule) error {
+	now := time.Now()
+	next, err := NextRun(s, now)
+	if err != nil {
+		return err
+	}
+	s.ID = newID()
+	s.CreatedAt = now
+	s.NextRun = next
+	if err := db.Schedules.Create(s); err != nil {
+		return errors.Trace(err)
+	}
+	log.WithField("schedule", s.ID).
+		Infof("Created schedule %q, next running at %s", s.Cron, s.NextRun.Format(time.RFC3339))
+	return nil
+}
+
+// Run calls Tick every interval until stop is closed.
+func Run(interval time.Duration, start func(*db.Job) error, submit func(*db.Schedule) (string, error), stop <-chan struct{}) {
+	for {
+		Tick(time.Now(), start, submit)
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Tick starts the deferred jobs which are due at now with start, which
+// returns an error satisfying errors.IsNotFound if another process started
+// the job first, and submits the job of every schedule due at now with
+// submit, which returns the job's id. Schedules which fell due more than once
+// while the server was stopped run once.
+func Tick(now time.Time, start func(*db.Job) error, submit func(*db.Schedule) (string, error)) {
+	deferred, err := db.Jobs.List(db.JobFilter{Status: tasks.SCHEDULED.Name()})
+	if err != nil {
+		log.Errorf("Could not list the scheduled jobs: %v", err)
+	}
+	// oldest first
+	for i := len(deferred) - 1; i >= 0; i-- {
+		j := deferred[i]
+		if j.StartAt.After(now) {
+			continue
+		}
+		if err := start(j); err != nil && !errors.IsNotFound(err) {
+			log.WithField("task", j.ID).
+				Errorf("Could not start the scheduled job: %v", err)
+		}
+	}
+
+	schedules, err := db.Schedules.List()
+	if err != nil {
+		log.Errorf("Could not list the schedules: %v", err)
+	}
+	for _, s := range schedules {
+		if s.NextRun.After(now) {
+			continue
+		}
+		if err := run(s, now, submit); err != nil {
+			log.WithField("schedule", s.ID).
+				Errorf("Could not run the schedule: %v", err)
+		}
+	}
+}
+
+// run submits the job of the schedule s, which is due at now, unless another
+// process got there first, and records the outcome.
+func run(s *db.Schedule, now time.Time, submit func(*db.Schedule) (string, error)) error {
+	next, err := NextRun(s, now)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = db.Schedules.Advance(s.ID, s.NextRun, next)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	s.NextRun = next
+	s.LastRun = now
+	s.LastError = ""
+	s.LastJob, err = submit(s)
+	if err != nil {
+		s.LastError = err.Error()
+		log.WithField("schedule", s.ID).
+			Warnf("Could not submit the scheduled job: %v", err)
+	} else {
+		log.WithField("schedule", s.ID).
+			Infof("Submitted job %s, next running at %s", s.LastJob, s.NextRun.Format(time.RFC3339))
+	}
+	if err := db.Schedules.Update(s); err != nil && !errors.IsNotFound(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// newID returns a random schedule id.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,138 @@
+package schedules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func TestParseSpecErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * smarch *",
+		"@fortnightly",
+	} {
+		_, err := ParseSpec(expr)
+		assert.True(t, errors.IsNotValid(err), "%q", expr)
+	}
+}
+
+func TestSpecNext(t *testing.T) {
+	assert := assert.New(t)
+	// a Wednesday
+	now := time.Date(2016, 6, 1, 10, 20, 30, 0, time.UTC)
+
+	for expr, want := range map[string]time.Time{
+		"* * * * *":         time.Date(2016, 6, 1, 10, 21, 0, 0, time.UTC),
+		"*/15 * * * *":      time.Date(2016, 6, 1, 10, 30, 0, 0, time.UTC),
+		"30 2 * * *":        time.Date(2016, 6, 2, 2, 30, 0, 0, time.UTC),
+		"0 1 * * sat,sun":   time.Date(2016, 6, 4, 1, 0, 0, 0, time.UTC),
+		"0 0 * * 7":         time.Date(2016, 6, 5, 0, 0, 0, 0, time.UTC),
+		"0 9-17/4 * * 1-5":  time.Date(2016, 6, 1, 13, 0, 0, 0, time.UTC),
+		"0 0 1 jan *":       time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		"@monthly":          time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC),
+		"@hourly":           time.Date(2016, 6, 1, 11, 0, 0, 0, time.UTC),
+		"0 0 29 feb *":      time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 13 * fri":      time.Date(2016, 6, 3, 0, 0, 0, 0, time.UTC), // either day matches
+		"0 0 13 * *":        time.Date(2016, 6, 13, 0, 0, 0, 0, time.UTC),
+		"20,40 10 1 6 *":    time.Date(2016, 6, 1, 10, 40, 0, 0, time.UTC),
+		"0 0 30 feb *":      {},
+		"  0   3  *  *  * ": time.Date(2016, 6, 2, 3, 0, 0, 0, time.UTC),
+	} {
+		spec, err := ParseSpec(expr)
+		if assert.NoError(err, expr) {
+			assert.Equal(want, spec.Next(now), expr)
+		}
+	}
+}
+
+func TestNextRunUsesTimeZone(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	next, err := NextRun(&db.Schedule{Cron: "0 2 * * *", TimeZone: "America/New_York"}, now)
+	assert.NoError(err)
+	// 2:00 EDT
+	assert.Equal(time.Date(2016, 6, 2, 6, 0, 0, 0, time.UTC), next)
+
+	_, err = NextRun(&db.Schedule{Cron: "0 2 * * *", TimeZone: "Mars/Olympus_Mons"}, now)
+	assert.True(errors.IsNotValid(err))
+	_, err = NextRun(&db.Schedule{Cron: "0 0 31 apr *"}, now)
+	assert.True(errors.IsNotValid(err))
+}
+
+func useTempRepositories(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "schedules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Schedules, err = db.NewFileScheduleRepository(filepath.Join(dir, "schedules.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTick(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+	now := time.Date(2016, 6, 1, 2, 0, 30, 0, time.UTC)
+
+	scheduled := tasks.SCHEDULED.Name()
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "due", Status: scheduled, StartAt: now.Add(-time.Hour)}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "later", Status: scheduled, StartAt: now.Add(time.Hour)}))
+	assert.NoError(db.Schedules.Create(&db.Schedule{ID: "nightly", Cron: "0 2 * * *", NextRun: now.Add(-30 * time.Second)}))
+	assert.NoError(db.Schedules.Create(&db.Schedule{ID: "weekly", Cron: "@weekly", NextRun: now.Add(72 * time.Hour)}))
+
+	started := []string{}
+	start := func(j *db.Job) error {
+		started = append(started, j.ID)
+		return nil
+	}
+	submitted := []string{}
+	submit := func(s *db.Schedule) (string, error) {
+		submitted = append(submitted, s.ID)
+		if len(submitted) > 1 {
+			return "", errors.New("quota used up")
+		}
+		return "job1", nil
+	}
+
+	Tick(now, start, submit)
+	assert.Equal([]string{"due"}, started)
+	assert.Equal([]string{"nightly"}, submitted)
+	s, err := db.Schedules.Get("nightly")
+	assert.NoError(err)
+	assert.Equal(time.Date(2016, 6, 2, 2, 0, 0, 0, time.UTC), s.NextRun)
+	assert.Equal(now, s.LastRun)
+	assert.Equal("job1", s.LastJob)
+
+	// the schedule does not run again until the next night
+	Tick(now.Add(time.Minute), start, submit)
+	assert.Equal([]string{"nightly"}, submitted)
+
+	Tick(s.NextRun, start, submit)
+	assert.Equal([]string{"nightly", "nightly"}, submitted)
+	s, err = db.Schedules.Get("nightly")
+	assert.NoError(err)
+	assert.Equal("quota used up", s.LastError)
+	assert.Equal(time.Date(2016, 6, 3, 2, 0, 0, 0, time.UTC), s.NextRun)
+}
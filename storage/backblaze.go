@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+
+	"github.com/juju/errors"
+)
+
+// Backblaze stores objects in a Backblaze B2 bucket.
+type Backblaze struct {
+	bucket *backblaze.Bucket
+}
+
+// NewBackblaze returns a Backblaze storing objects in the named bucket.
+func NewBackblaze(accountID string, applicationKey string, bucketName string) (*Backblaze, error) {
+	b2, err := backblaze.NewB2(backblaze.Credentials{
+		AccountID:      accountID,
+		ApplicationKey: applicationKey,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bucket, err := b2.Bucket(bucketName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if bucket == nil {
+		return nil, errors.NotFoundf("backblaze bucket %q", bucketName)
+	}
+	return &Backblaze{bucket: bucket}, nil
+}
+
+// Put uploads the contents of r under name.
+func (b *Backblaze) Put(name string, r io.Reader) error {
+	metadata := make(map[string]string) // empty metadata
+	if _, err := b.bucket.UploadFile(name, metadata, r); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Get downloads the object stored under name.
+func (b *Backblaze) Get(name string) (io.ReadCloser, error) {
+	_, reader, err := b.bucket.DownloadFileByName(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return reader, nil
+}
+
+// SignedURL returns the download URL of name. The B2 client library cannot
+// issue download authorizations, so the URL does not expire and only works
+// for public buckets.
+func (b *Backblaze) SignedURL(name string, expiry time.Duration) (string, error) {
+	url, err := b.bucket.FileURL(name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return url, nil
+}
+
+// Delete removes every version of the object stored under name.
+func (b *Backblaze) Delete(name string) error {
+	for {
+		versions, err := b.bucket.ListFileVersions(name, "", 100)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		deleted := 0
+		for _, file := range versions.Files {
+			if file.Name != name {
+				continue
+			}
+			if _, err := b.bucket.DeleteFileVersion(file.Name, file.ID); err != nil {
+				return errors.Trace(err)
+			}
+			deleted++
+		}
+		if deleted == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Local stores objects in a directory on the local filesystem. Signed URLs
+// point at the app itself, which serves the object after checking the
+// signature with Verify.
+type Local struct {
+	dir        string
+	baseURL    string
+	signingKey []byte
+}
+
+// NewLocal returns a Local storing objects below dir. baseURL is the address
+// at which the app serves local objects, e.g. "http://localhost:8080/files".
+func NewLocal(dir string, baseURL string, signingKey string) (*Local, error) {
+	if dir == "" {
+		return nil, errors.NotValidf("empty storage directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Local{
+		dir:        dir,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		signingKey: []byte(signingKey),
+	}, nil
+}
+
+func (l *Local) path(name string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(name)), nil
+}
+
+// Put stores the contents of r under name.
+func (l *Local) Put(name string, r io.Reader) error {
+	p, err := l.path(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Trace(err)
+	}
+
+	// write to a temporary file of its own first, so that readers never see
+	// partial objects and concurrent writers do not share one
+	file, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".*.part")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := file.Name()
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	// TempFile creates files only their owner can read
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Get opens the object stored under name.
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("object %q", name)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return file, nil
+}
+
+// SignedURL returns a URL for name which Verify accepts until expiry has
+// passed.
+func (l *Local) SignedURL(name string, expiry time.Duration) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", l.sign(name, expires))
+	return l.baseURL + "/" + name + "?" + query.Encode(), nil
+}
+
+// Verify checks the expires and signature query parameters of a URL returned
+// by SignedURL.
+func (l *Local) Verify(name string, expires string, signature string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errors.NotValidf("expiry %q", expires)
+	}
+	if time.Now().Unix() > unix {
+		return errors.Unauthorizedf("signed URL expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(l.sign(name, expires))) {
+		return errors.Unauthorizedf("invalid signature")
+	}
+	return nil
+}
+
+func (l *Local) sign(name string, expires string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	io.WriteString(mac, name+"\n"+expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delete removes the object stored under name.
+func (l *Local) Delete(name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// S3 stores objects in a bucket of an S3-compatible service such as Amazon S3
+// or MinIO. Requests are authenticated with AWS Signature Version 4 presigned
+// URLs, and buckets are addressed path-style (endpoint/bucket/name), which
+// every S3-compatible server supports.
+type S3 struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// maxS3Expiry is the longest validity S3 accepts for a presigned URL.
+const maxS3Expiry = 7 * 24 * time.Hour
+
+// NewS3 returns an S3 for the given bucket. endpoint is the base URL of the
+// service, e.g. "https://s3.amazonaws.com" or "http://minio:9000".
+func NewS3(endpoint string, region string, bucket string, accessKeyID string, secretAccessKey string) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.NotValidf("S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.NotValidf("empty S3 bucket")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		endpoint:        u,
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client:          http.DefaultClient,
+	}, nil
+}
+
+// Put uploads the contents of r under name.
+func (s *S3) Put(name string, r io.Reader) error {
+	body, size, cleanup, err := sizedReader(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cleanup()
+
+	req, err := s.request("PUT", name, time.Hour, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = nil
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads the object stored under name.
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	req, err := s.request("GET", name, time.Hour, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp.Body, nil
+}
+
+// SignedURL returns a presigned GET URL for name. S3 limits the validity of
+// presigned URLs to seven days, so longer expiries are shortened.
+func (s *S3) SignedURL(name string, expiry time.Duration) (string, error) {
+	if expiry > maxS3Expiry {
+		expiry = maxS3Expiry
+	}
+	name, err := cleanName(name)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return s.presign("GET", name, expiry, time.Now()), nil
+}
+
+// Delete removes the object stored under name.
+func (s *S3) Delete(name string) error {
+	req, err := s.request("DELETE", name, time.Hour, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) request(method string, name string, expiry time.Duration, body io.Reader) (*http.Request, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req, err := http.NewRequest(method, s.presign(method, name, expiry, time.Now()), body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return req, nil
+}
+
+// do sends req and converts error responses into errors.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.NotFoundf("object %q", req.URL.Path)
+	}
+	return nil, errors.Errorf("S3 %s %s failed with status %d: %s", req.Method, req.URL.Path, resp.StatusCode, message)
+}
+
+// presign returns a presigned URL for the object name.
+func (s *S3) presign(method string, name string, expiry time.Duration, now time.Time) string {
+	uri := "/" + s.bucket + "/" + name
+	if p := strings.TrimSuffix(s.endpoint.Path, "/"); p != "" {
+		uri = p + uri
+	}
+	query := presignV4(method, s.endpoint.Host, uri, s.region, s.accessKeyID, s.secretAccessKey, expiry, now)
+	return s.endpoint.Scheme + "://" + s.endpoint.Host + s3Escape(uri, false) + "?" + query
+}
+
+// presignV4 computes the query string of a presigned URL as described in
+// http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignV4(method string, host string, uri string, region string, accessKeyID string, secretAccessKey string, expiry time.Duration, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    accessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expiry / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = s3Escape(k, true) + "=" + s3Escape(params[k], true)
+	}
+	query := strings.Join(pairs, "&")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3Escape(uri, false),
+		query,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return query + "&X-Amz-Signature=" + signature
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way AWS expects: every byte except
+// unreserved characters is encoded, and slashes are kept unless encodeSlash
+// is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf = append(buf, c)
+		case c == '/' && !encodeSlash:
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,123 @@
+// Package storage implements interchangeable backends for storing audio files
+// and exported transcripts.
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Storage stores named objects such as archived audio and exported
+// transcripts. Names are slash-separated paths like "audio/abc.mp3".
+type Storage interface {
+	// Put stores the contents of r under name, replacing any existing object.
+	Put(name string, r io.Reader) error
+	// Get opens the object stored under name. The caller must close it.
+	Get(name string) (io.ReadCloser, error)
+	// SignedURL returns a URL from which the object can be downloaded without
+	// further credentials until expiry has passed.
+	SignedURL(name string, expiry time.Duration) (string, error)
+	// Delete removes the object stored under name.
+	Delete(name string) error
+}
+
+// Options contains the settings used by New to build a Storage.
+type Options struct {
+	// Driver is one of "local", "s3" or "backblaze".
+	Driver string
+
+	LocalPath  string
+	LocalURL   string
+	SigningKey string
+
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	BackblazeAccountID      string
+	BackblazeApplicationKey string
+	BackblazeBucket         string
+}
+
+// Default is the application-wide storage. It is nil when no storage driver
+// is configured, in which case nothing is archived.
+var Default Storage
+
+// New returns the Storage selected by opts.Driver.
+func New(opts Options) (Storage, error) {
+	switch opts.Driver {
+	case "local":
+		return NewLocal(opts.LocalPath, opts.LocalURL, opts.SigningKey)
+	case "s3":
+		return NewS3(opts.S3Endpoint, opts.S3Region, opts.S3Bucket, opts.S3AccessKeyID, opts.S3SecretAccessKey)
+	case "backblaze":
+		return NewBackblaze(opts.BackblazeAccountID, opts.BackblazeApplicationKey, opts.BackblazeBucket)
+	}
+	return nil, errors.NotValidf("storage driver %q", opts.Driver)
+}
+
+// PutFile stores the file at filePath under name.
+func PutFile(s Storage, name string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	return errors.Trace(s.Put(name, file))
+}
+
+// cleanName validates an object name and returns it in canonical form.
+func cleanName(name string) (string, error) {
+	cleaned := path.Clean("/" + name)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(name, "/") {
+		return "", errors.NotValidf("object name %q", name)
+	}
+	return cleaned, nil
+}
+
+// sizedReader returns a reader for r together with its length, which some
+// backends must know before uploading. Readers of unknown length are spooled
+// to a temporary file. The returned cleanup function must always be called.
+func sizedReader(r io.Reader) (io.Reader, int64, func(), error) {
+	noop := func() {}
+	switch v := r.(type) {
+	case *os.File:
+		stat, err := v.Stat()
+		if err != nil {
+			return nil, 0, noop, errors.Trace(err)
+		}
+		return v, stat.Size(), noop, nil
+	case interface {
+		Len() int
+	}:
+		return r, int64(v.Len()), noop, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "storage")
+	if err != nil {
+		return nil, 0, noop, errors.Trace(err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, noop, errors.Trace(err)
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		cleanup()
+		return nil, 0, noop, errors.Trace(err)
+	}
+	return tmp, n, cleanup, nil
+}
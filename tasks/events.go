@@ -0,0 +1,135 @@
+package tasks
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+// These are the types of events.
+// QUEUED: the task was queued, or queued again under the same id.
+// STARTED: the task started running.
+// PROGRESS: the task reported progress with TaskExecuter.ReportProgress.
+// SUCCEEDED: the task finished successfully.
+// FAILED: the task finished unsuccessfully.
+// TIMEOUT: the task ran out of time and was stopped.
+// CANCELLED: the task was cancelled before it started.
+// EXPIRED: the information about the task expired.
+const (
+	QUEUED EventType = iota
+	STARTED
+	PROGRESS
+	SUCCEEDED
+	FAILED
+	CANCELLED
+	EXPIRED
+	TIMEOUT
+)
+
+// eventTypes lists the event types in order.
+var eventTypes = []EventType{QUEUED, STARTED, PROGRESS, SUCCEEDED, FAILED, CANCELLED, EXPIRED, TIMEOUT}
+
+// Name returns the name of the event type, e.g. "succeeded".
+func (t EventType) Name() string {
+	switch t {
+	case QUEUED:
+		return "queued"
+	case STARTED:
+		return "started"
+	case PROGRESS:
+		return "progress"
+	case SUCCEEDED:
+		return "succeeded"
+	case FAILED:
+		return "failed"
+	case CANCELLED:
+		return "cancelled"
+	case EXPIRED:
+		return "expired"
+	case TIMEOUT:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// ParseEventType returns the event type with the given name, in any case.
+func ParseEventType(name string) (EventType, error) {
+	for _, t := range eventTypes {
+		if strings.EqualFold(t.Name(), name) {
+			return t, nil
+		}
+	}
+	return 0, errors.NotValidf("event type %q", name)
+}
+
+// Finished reports whether events of the type end a run of a task.
+func (t EventType) Finished() bool {
+	return t == SUCCEEDED || t == FAILED || t == CANCELLED || t == EXPIRED || t == TIMEOUT
+}
+
+// MarshalJSON writes the event type as its name.
+func (t EventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Name())
+}
+
+// Event reports a change in the life of a task.
+type Event struct {
+	Type   EventType `json:"type"`
+	TaskID string    `json:"task"`
+	Time   time.Time `json:"time"`
+	// Message describes the progress of PROGRESS events, and Error why the
+	// task failed for FAILED and TIMEOUT events.
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// subscribers holds the channels of those subscribed to an executer's events.
+type subscribers struct {
+	sync.Mutex
+	next     int
+	channels map[int]chan Event
+}
+
+// subscribe adds a subscriber whose channel buffers up to buffer events.
+func (s *subscribers) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	s.Lock()
+	if s.channels == nil {
+		s.channels = make(map[int]chan Event)
+	}
+	key := s.next
+	s.next++
+	s.channels[key] = ch
+	s.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.Lock()
+			delete(s.channels, key)
+			close(ch)
+			s.Unlock()
+		})
+	}
+}
+
+// publish sends e to every subscriber with room for it in its channel.
+func (s *subscribers) publish(e Event) {
+	s.Lock()
+	defer s.Unlock()
+	for _, ch := range s.channels {
+		select {
+		case ch <- e:
+		default:
+			// the subscriber has fallen behind; tasks must not wait for it
+			log.Warnf("Dropped a %s event for a subscriber which is not keeping up", e.Type.Name())
+		}
+	}
+}
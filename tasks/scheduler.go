@@ -0,0 +1,213 @@
+package tasks
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Priority orders waiting tasks: tasks with a higher priority start first.
+type Priority int
+
+// These are the priorities.
+// LOW: e.g. backfills of archives, which can wait.
+// NORMAL: the default.
+// HIGH: urgent tasks, which only administrators may queue.
+const (
+	LOW Priority = iota - 1
+	NORMAL
+	HIGH
+)
+
+// priorities lists the priorities from highest to lowest.
+var priorities = []Priority{HIGH, NORMAL, LOW}
+
+// Name returns the name of the priority constant, e.g. "HIGH".
+func (p Priority) Name() string {
+	switch p {
+	case LOW:
+		return "LOW"
+	case HIGH:
+		return "HIGH"
+	}
+	return "NORMAL"
+}
+
+// ParsePriority returns the priority with the given name, in any case. The
+// empty name is NORMAL.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return NORMAL, nil
+	}
+	for _, p := range priorities {
+		if strings.EqualFold(p.Name(), name) {
+			return p, nil
+		}
+	}
+	return NORMAL, errors.NotValidf("priority %q", name)
+}
+
+// TaskOptions describe how a task is scheduled.
+type TaskOptions struct {
+	// ID is the id of a new task, e.g. one from NewUniqueID, or empty to
+	// have the executer choose one.
+	ID       string
+	Priority Priority
+	// Submitter identifies who queued the task. Waiting tasks of the same
+	// priority take turns by submitter, so that one submitter's many tasks
+	// do not hold up another's few.
+	Submitter string
+	// Labels describe the task for TaskInfo, e.g. with SourceLabel.
+	Labels map[string]string
+	// Attempt is which attempt at the task this is, for tasks resumed from
+	// an earlier process. Zero counts the attempts queued on the executer.
+	Attempt int
+}
+
+// These are the keys of the labels of the app's tasks.
+// SourceLabel: how the task was submitted: "web", "api", "batch", "feed",
+// "schedule" or "watch".
+// SubmitterLabel: who submitted it, as in TaskOptions.Submitter.
+// EngineLabel: the speech-to-text engine transcribing the audio, e.g. "ibm".
+const (
+	SourceLabel    = "source"
+	SubmitterLabel = "submitter"
+	EngineLabel    = "engine"
+)
+
+// waitingTask is a task waiting for its turn to run.
+type waitingTask struct {
+	id        string
+	task      func(string) error
+	onFailure func(string, string)
+}
+
+// level holds the tasks waiting at one priority, by submitter.
+type level struct {
+	// turns lists the submitters with waiting tasks in the order in which
+	// they take turns.
+	turns []string
+	tasks map[string][]waitingTask
+}
+
+// scheduler decides when waiting tasks start. It starts tasks straight away
+// until maxRunning are running, and then one whenever another finishes.
+type scheduler struct {
+	sync.Mutex
+	// maxRunning is the number of tasks which may run at once, or 0 for no
+	// limit.
+	maxRunning int
+	running    int
+	levels     map[Priority]*level
+	start      func(t waitingTask)
+}
+
+func newScheduler(start func(t waitingTask)) *scheduler {
+	return &scheduler{levels: make(map[Priority]*level), start: start}
+}
+
+// add queues t with the given options and starts tasks if there is room.
+func (s *scheduler) add(t waitingTask, opts TaskOptions) {
+	if opts.Priority > HIGH {
+		opts.Priority = HIGH
+	} else if opts.Priority < LOW {
+		opts.Priority = LOW
+	}
+	s.Lock()
+	l, ok := s.levels[opts.Priority]
+	if !ok {
+		l = &level{tasks: make(map[string][]waitingTask)}
+		s.levels[opts.Priority] = l
+	}
+	if len(l.tasks[opts.Submitter]) == 0 {
+		l.turns = append(l.turns, opts.Submitter)
+	}
+	l.tasks[opts.Submitter] = append(l.tasks[opts.Submitter], t)
+	s.Unlock()
+	s.dispatch()
+}
+
+// done records that a task has finished and starts another if one is waiting.
+func (s *scheduler) done() {
+	s.Lock()
+	s.running--
+	s.Unlock()
+	s.dispatch()
+}
+
+// setMaxRunning changes the number of tasks which may run at once.
+func (s *scheduler) setMaxRunning(n int) {
+	s.Lock()
+	s.maxRunning = n
+	s.Unlock()
+	s.dispatch()
+}
+
+// dispatch starts waiting tasks while there is room for them.
+func (s *scheduler) dispatch() {
+	for {
+		s.Lock()
+		if s.maxRunning > 0 && s.running >= s.maxRunning {
+			s.Unlock()
+			return
+		}
+		t, ok := s.next()
+		if ok {
+			s.running++
+		}
+		s.Unlock()
+		if !ok {
+			return
+		}
+		s.start(t)
+	}
+}
+
+// remove removes the waiting task with the given id, reporting whether there
+// was one.
+func (s *scheduler) remove(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, l := range s.levels {
+		for i, submitter := range l.turns {
+			waiting := l.tasks[submitter]
+			for j, t := range waiting {
+				if t.id != id {
+					continue
+				}
+				l.tasks[submitter] = append(waiting[:j:j], waiting[j+1:]...)
+				if len(l.tasks[submitter]) == 0 {
+					delete(l.tasks, submitter)
+					l.turns = append(l.turns[:i:i], l.turns[i+1:]...)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// next removes and returns the task whose turn it is: that of the next
+// submitter in turn at the highest priority with waiting tasks. s must be
+// locked.
+func (s *scheduler) next() (waitingTask, bool) {
+	for _, p := range priorities {
+		l, ok := s.levels[p]
+		if !ok || len(l.turns) == 0 {
+			continue
+		}
+		submitter := l.turns[0]
+		t := l.tasks[submitter][0]
+		l.tasks[submitter] = l.tasks[submitter][1:]
+		l.turns = l.turns[1:]
+		if len(l.tasks[submitter]) > 0 {
+			// back of the line
+			l.turns = append(l.turns, submitter)
+		} else {
+			delete(l.tasks, submitter)
+		}
+		return t, true
+	}
+	return waitingTask{}, false
+}
@@ -0,0 +1,78 @@
+package tasks
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	assert := assert.New(t)
+	for name, p := range map[string]Priority{"": NORMAL, "low": LOW, "HIGH": HIGH, "Normal": NORMAL} {
+		parsed, err := ParsePriority(name)
+		assert.NoError(err)
+		assert.Equal(p, parsed)
+	}
+	_, err := ParsePriority("urgent")
+	assert.Error(err)
+}
+
+func TestSchedulerTakesTurnsWithinPriorities(t *testing.T) {
+	assert := assert.New(t)
+	ex := NewTaskExecuter(time.Hour)
+	ex.SetMaxRunning(1)
+
+	var mu sync.Mutex
+	order := []string{}
+	release := make(chan struct{})
+	ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+
+	queue := func(name string, submitter string, p Priority) {
+		ex.QueueTaskWith(TaskOptions{Priority: p, Submitter: submitter}, func(string) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}, func(a, b string) {})
+	}
+	queue("backfill", "archive", LOW)
+	for _, name := range []string{"a1", "a2", "a3"} {
+		queue(name, "alice", NORMAL)
+	}
+	queue("b1", "bob", NORMAL)
+	queue("urgent", "press", HIGH)
+	queue("a4", "alice", NORMAL)
+
+	close(release)
+	assert.NoError(ex.Wait(context.Background()))
+	assert.Equal([]string{"urgent", "a1", "b1", "a2", "a3", "a4", "backfill"}, order)
+}
+
+func TestSchedulerLimitsRunningTasks(t *testing.T) {
+	assert := assert.New(t)
+	ex := NewTaskExecuter(time.Hour)
+	ex.SetMaxRunning(2)
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	for i := 0; i < 10; i++ {
+		ex.QueueTask(func(string) error {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		}, func(a, b string) {})
+	}
+	assert.NoError(ex.Wait(context.Background()))
+	assert.Equal(2, most)
+}
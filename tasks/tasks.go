@@ -2,8 +2,11 @@
 package tasks
 
 import (
-	"math/rand"
+	"context"
+	"crypto/rand"
+	"fmt"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,23 +20,111 @@ type Status int
 // TaskExecuter executes a series of task functions.
 type TaskExecuter interface {
 	QueueTask(task func(string) error, onFailure func(string, string)) string
+	// QueueTaskWith queues a task scheduled according to opts. It returns an
+	// error satisfying errors.IsAlreadyExists if opts.ID is the id of a task
+	// the executer already knows.
+	QueueTaskWith(opts TaskOptions, task func(string) error, onFailure func(string, string)) (string, error)
+	// ResumeTask queues a task under the id of an earlier task, which was
+	// interrupted when the previous process stopped or failed and is being
+	// retried.
+	ResumeTask(id string, opts TaskOptions, task func(string) error, onFailure func(string, string))
+	// SetMaxRunning limits the number of tasks running at once to n; other
+	// tasks wait their turn. Zero means no limit, which is the default.
+	SetMaxRunning(n int)
 	GetTaskStatus(id string) Status
+	// GetTask returns what the executer knows of the task with the given
+	// id. It returns an error satisfying errors.IsNotFound if there is no
+	// such task, e.g. because its information expired.
+	GetTask(id string) (TaskInfo, error)
+	// ListTasks returns what the executer knows of the tasks matching
+	// filter, most recently queued first.
+	ListTasks(filter TaskFilter) []TaskInfo
+	// SetResult records a reference to what the task with the given id
+	// produced, such as the path of a transcript. Tasks the executer does
+	// not know are ignored.
+	SetResult(id string, result string)
+	// TaskCounts returns the number of tasks with each status, among those
+	// which have not expired.
+	TaskCounts() map[Status]int
+	// Wait waits until every task has finished, or until ctx is done, in
+	// which case it returns ctx's error.
+	Wait(ctx context.Context) error
+	// Subscribe returns a channel delivering the events of every task from
+	// now on, and a function which ends the subscription and closes the
+	// channel. Events which do not fit in the channel's buffer of buffer
+	// events are dropped, so that slow subscribers do not hold up tasks.
+	Subscribe(buffer int) (<-chan Event, func())
+	// ReportProgress publishes a PROGRESS event for the task with the given
+	// id, which is running, with a message such as "Stage convert started".
+	// Tasks the executer does not know are ignored.
+	ReportProgress(id string, message string)
+	// Cancel cancels the task with the given id, which is waiting for its
+	// turn to run: its status becomes FAILURE, without its onFailure being
+	// called. It returns an error satisfying errors.IsNotFound if there is no
+	// such task, and errors.IsNotValid if it is no longer waiting.
+	Cancel(id string) error
 	completeTask(id string, task func(string) error, onFailure func(string, string))
 }
 
-type taskInfo struct {
-	status  Status
-	started time.Time
+// TaskInfo describes a task known to an executer.
+type TaskInfo struct {
+	ID     string
+	Status Status
+	// Queued is when the task was last queued, Started when it last started
+	// running and Finished when it last finished. Started and Finished are
+	// zero until it does.
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+	// Attempts is the number of times the task has been queued, counting
+	// those in earlier processes if it was resumed with TaskOptions.Attempt.
+	Attempts int
+	// Error is the error of the latest attempt, if it failed or timed out.
+	Error string
+	// Labels are those given in the task's TaskOptions.
+	Labels map[string]string
+	// Result refers to what the task produced, as set with SetResult.
+	Result string
+}
+
+// TaskFilter selects tasks in ListTasks. Zero fields match every task.
+type TaskFilter struct {
+	// Statuses lists the statuses to match.
+	Statuses []Status
+	// Labels match tasks with every one of the labels.
+	Labels      map[string]string
+	QueuedSince time.Time
+}
+
+func (f TaskFilter) matches(info TaskInfo) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, s := range f.Statuses {
+			found = found || s == info.Status
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range f.Labels {
+		if info.Labels[k] != v {
+			return false
+		}
+	}
+	return f.QueuedSince.IsZero() || !info.Queued.Before(f.QueuedSince)
 }
 
 type concurrentTaskInfoMap struct {
 	sync.RWMutex
-	m map[string]taskInfo
+	m map[string]TaskInfo
 }
 
 type defaultExecuter struct {
 	cMap       concurrentTaskInfoMap
 	expiration time.Duration
+	running    sync.WaitGroup
+	sched      *scheduler
+	subs       subscribers
 }
 
 // These are some enumerated Status constants.
@@ -41,39 +132,119 @@ type defaultExecuter struct {
 // SUCCESS: Task finished successfully.
 // FAILURE: Task finished unsuccessfully.
 // NOTFOUND: Task could not be found.
+// SCHEDULED: Task is waiting for the time it was scheduled to start at. Only
+// job records have this status; executers know nothing of a task until it is
+// queued.
+// TIMEDOUT: Task ran out of time and was stopped.
 const (
 	INPROGRESS Status = iota
 	SUCCESS
 	FAILURE
 	NOTFOUND
+	SCHEDULED
+	TIMEDOUT
 )
 
+// ErrInterrupted is returned by tasks cut short because the process is
+// stopping. Such tasks stay in progress and their onFailure is not called, so
+// that they can be resumed by the next process.
+var ErrInterrupted = errors.New("the task was interrupted because the server is stopping")
+
+// TimeoutError is returned by tasks stopped because they, or a part of them,
+// ran out of time. Their status becomes TIMEDOUT rather than FAILURE.
+type TimeoutError struct {
+	// What ran out of time, e.g. "stage convert".
+	What  string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s exceeded its time limit of %v", e.What, e.Limit)
+}
+
+// IsTimeout reports whether err is caused by a TimeoutError.
+func IsTimeout(err error) bool {
+	_, ok := errors.Cause(err).(*TimeoutError)
+	return ok
+}
+
 // DefaultTaskExecuter is an instance of a NewTaskExecuter with a 24-hour
 // expiration.
 var DefaultTaskExecuter = NewTaskExecuter(time.Hour * 24)
 
 // put(k,v) maps k to v in the map
-func (c *concurrentTaskInfoMap) put(k string, v taskInfo) {
+func (c *concurrentTaskInfoMap) put(k string, v TaskInfo) {
 	c.Lock()
 	c.m[k] = v
 	c.Unlock()
 }
 
+// putNew(k,v) maps k to v in the map unless k is already in it, and reports
+// whether it did
+func (c *concurrentTaskInfoMap) putNew(k string, v TaskInfo) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.m[k]; ok {
+		return false
+	}
+	c.m[k] = v
+	return true
+}
+
 // get(k) returns the value of k in the map
-func (c *concurrentTaskInfoMap) get(k string) (taskInfo, bool) {
+func (c *concurrentTaskInfoMap) get(k string) (TaskInfo, bool) {
 	c.RLock()
 	v, ok := c.m[k]
 	c.RUnlock()
 	return v, ok
 }
 
-// setStatus sets the status of k if it is already in the map
-func (c *concurrentTaskInfoMap) setStatus(k string, s Status) {
-	if info, ok := c.get(k); ok {
-		info.status = s
-		c.put(k, info)
-		return
+// update applies fn to the value of k if it is already in the map
+func (c *concurrentTaskInfoMap) update(k string, fn func(info *TaskInfo)) {
+	c.Lock()
+	if info, ok := c.m[k]; ok {
+		fn(&info)
+		c.m[k] = info
 	}
+	c.Unlock()
+}
+
+// finish records that the task k finished with status s and the error
+// message errMessage
+func (c *concurrentTaskInfoMap) finish(k string, s Status, errMessage string) {
+	c.update(k, func(info *TaskInfo) {
+		info.Status = s
+		info.Error = errMessage
+		info.Finished = time.Now()
+	})
+}
+
+// Name returns the name of the status constant, e.g. "SUCCESS".
+func (s Status) Name() string {
+	switch s {
+	case INPROGRESS:
+		return "INPROGRESS"
+	case SUCCESS:
+		return "SUCCESS"
+	case FAILURE:
+		return "FAILURE"
+	case SCHEDULED:
+		return "SCHEDULED"
+	case TIMEDOUT:
+		return "TIMEDOUT"
+	}
+	return "NOTFOUND"
+}
+
+// ParseStatus returns the status with the given name, or NOTFOUND if there is
+// none.
+func ParseStatus(name string) Status {
+	for _, s := range []Status{INPROGRESS, SUCCESS, FAILURE, SCHEDULED, TIMEDOUT} {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return NOTFOUND
 }
 
 func (s Status) String() string {
@@ -88,6 +259,10 @@ func (s Status) String() string {
 		str = "The task failed."
 	case NOTFOUND:
 		str = "Error: task not found."
+	case SCHEDULED:
+		str = "The task is scheduled to start later."
+	case TIMEDOUT:
+		str = "The task ran out of time."
 	}
 	return str
 }
@@ -96,9 +271,12 @@ func (s Status) String() string {
 // task is deleted after expiration.
 func NewTaskExecuter(expiration time.Duration) TaskExecuter {
 	ex := &defaultExecuter{
-		cMap:       concurrentTaskInfoMap{m: make(map[string]taskInfo)},
+		cMap:       concurrentTaskInfoMap{m: make(map[string]TaskInfo)},
 		expiration: expiration,
 	}
+	ex.sched = newScheduler(func(t waitingTask) {
+		go ex.completeTask(t.id, t.task, t.onFailure)
+	})
 	go ex.deleteExpiredInfo()
 
 	return ex
@@ -108,82 +286,318 @@ func NewTaskExecuter(expiration time.Duration) TaskExecuter {
 // task panics, the panic will be caught. However, if the task launches another
 // goroutine which panics, the panic cannot be caught.
 func (ex *defaultExecuter) QueueTask(task func(string) error, onFailure func(string, string)) string {
-	id := generateID(20)
-	ex.cMap.put(id, taskInfo{
-		status:  INPROGRESS,
-		started: time.Now(),
-	})
-	log.WithField("task", id).
-		Info("Task started")
-	go ex.completeTask(id, task, onFailure)
+	// the executer chooses the id, so it cannot be taken
+	id, _ := ex.QueueTaskWith(TaskOptions{}, task, onFailure)
 	return id
 }
 
+// QueueTaskWith queues a task scheduled according to opts.
+func (ex *defaultExecuter) QueueTaskWith(opts TaskOptions, task func(string) error, onFailure func(string, string)) (string, error) {
+	if opts.ID != "" {
+		if err := ex.queue(opts.ID, opts, task, onFailure, false); err != nil {
+			return "", err
+		}
+		return opts.ID, nil
+	}
+	for {
+		id := NewID()
+		err := ex.queue(id, opts, task, onFailure, false)
+		if errors.IsAlreadyExists(err) {
+			log.WithField("task", id).
+				Error("Generated the id of an existing task")
+			continue
+		}
+		return id, err
+	}
+}
+
+// ResumeTask queues a task under the id of an earlier task, which was
+// interrupted when the previous process stopped or failed and is being
+// retried.
+func (ex *defaultExecuter) ResumeTask(id string, opts TaskOptions, task func(string) error, onFailure func(string, string)) {
+	ex.queue(id, opts, task, onFailure, true)
+}
+
+// queue records the task with the given id as in progress and hands it to
+// the scheduler. Unless resumed is set, it returns an error satisfying
+// errors.IsAlreadyExists if the executer already knows a task with the id.
+func (ex *defaultExecuter) queue(id string, opts TaskOptions, task func(string) error, onFailure func(string, string), resumed bool) error {
+	attempts := opts.Attempt
+	if attempts <= 0 {
+		previous, _ := ex.cMap.get(id)
+		attempts = previous.Attempts + 1
+	}
+	labels := make(map[string]string, len(opts.Labels))
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	info := TaskInfo{
+		ID:       id,
+		Status:   INPROGRESS,
+		Queued:   time.Now(),
+		Attempts: attempts,
+		Labels:   labels,
+	}
+	if resumed {
+		ex.cMap.put(id, info)
+		log.WithField("task", id).
+			Info("Task queued again")
+	} else {
+		if !ex.cMap.putNew(id, info) {
+			return errors.AlreadyExistsf("task %q", id)
+		}
+		log.WithField("task", id).
+			Info("Task queued")
+	}
+	ex.running.Add(1)
+	ex.publish(QUEUED, id, "", "")
+	ex.sched.add(waitingTask{id: id, task: task, onFailure: onFailure}, opts)
+	return nil
+}
+
+// publish sends an event about the task with the given id to the
+// subscribers.
+func (ex *defaultExecuter) publish(t EventType, id string, message string, errMessage string) {
+	ex.subs.publish(Event{Type: t, TaskID: id, Time: time.Now(), Message: message, Error: errMessage})
+}
+
+// Subscribe returns a channel delivering the events of every task from now
+// on, and a function which ends the subscription and closes the channel.
+func (ex *defaultExecuter) Subscribe(buffer int) (<-chan Event, func()) {
+	return ex.subs.subscribe(buffer)
+}
+
+// ReportProgress publishes a PROGRESS event for the task with the given id.
+func (ex *defaultExecuter) ReportProgress(id string, message string) {
+	if _, ok := ex.cMap.get(id); ok {
+		ex.publish(PROGRESS, id, message, "")
+	}
+}
+
+// Cancel cancels the task with the given id if it is waiting for its turn.
+func (ex *defaultExecuter) Cancel(id string) error {
+	if _, ok := ex.cMap.get(id); !ok {
+		return errors.NotFoundf("task %q", id)
+	}
+	if !ex.sched.remove(id) {
+		return errors.NotValidf("task %q (it is not waiting to start)", id)
+	}
+	log.WithField("task", id).
+		Info("Task cancelled")
+	ex.cMap.finish(id, FAILURE, "the task was cancelled")
+	ex.publish(CANCELLED, id, "", "")
+	ex.running.Done()
+	return nil
+}
+
+// SetMaxRunning limits the number of tasks running at once to n; other tasks
+// wait their turn. Zero means no limit.
+func (ex *defaultExecuter) SetMaxRunning(n int) {
+	ex.sched.setMaxRunning(n)
+}
+
 // GetTaskStatus gets the current status of a task.
 func (ex *defaultExecuter) GetTaskStatus(id string) Status {
 	if info, ok := ex.cMap.get(id); ok {
-		return info.status
+		return info.Status
 	}
 	return NOTFOUND
 }
 
+// GetTask returns what the executer knows of the task with the given id.
+func (ex *defaultExecuter) GetTask(id string) (TaskInfo, error) {
+	info, ok := ex.cMap.get(id)
+	if !ok {
+		return TaskInfo{}, errors.NotFoundf("task %q", id)
+	}
+	return info, nil
+}
+
+// ListTasks returns what the executer knows of the tasks matching filter,
+// most recently queued first.
+func (ex *defaultExecuter) ListTasks(filter TaskFilter) []TaskInfo {
+	list := []TaskInfo{}
+	ex.cMap.RLock()
+	for _, info := range ex.cMap.m {
+		if filter.matches(info) {
+			list = append(list, info)
+		}
+	}
+	ex.cMap.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Queued.Equal(list[j].Queued) {
+			return list[i].Queued.After(list[j].Queued)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// SetResult records a reference to what the task with the given id produced.
+func (ex *defaultExecuter) SetResult(id string, result string) {
+	ex.cMap.update(id, func(info *TaskInfo) {
+		info.Result = result
+	})
+}
+
+// TaskCounts returns the number of tasks with each status, among those which
+// have not expired.
+func (ex *defaultExecuter) TaskCounts() map[Status]int {
+	counts := map[Status]int{}
+	ex.cMap.RLock()
+	for _, info := range ex.cMap.m {
+		counts[info.Status]++
+	}
+	ex.cMap.RUnlock()
+	return counts
+}
+
+// Wait waits until every task has finished, or until ctx is done, in which
+// case it returns ctx's error.
+func (ex *defaultExecuter) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ex.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (ex *defaultExecuter) completeTask(id string, task func(string) error, onFailure func(string, string)) {
+	defer ex.running.Done()
+	defer ex.sched.done()
 	defer func() {
 		if r := recover(); r != nil {
 			log.WithField("task", id).
 				Errorln("Task failed", r)
 			debug.PrintStack()
-			go onFailure(id, "The error message is below. Please check logs for more details."+"\n\n"+"panic occurred")
-			ex.cMap.setStatus(id, FAILURE)
+			go onFailure(id, "The error message is below."+"\n\n"+"panic occurred")
+			ex.cMap.finish(id, FAILURE, "panic occurred")
+			ex.publish(FAILED, id, "", "panic occurred")
 		}
 	}()
 
+	log.WithField("task", id).
+		Info("Task started")
+	ex.cMap.update(id, func(info *TaskInfo) {
+		info.Started = time.Now()
+	})
+	ex.publish(STARTED, id, "", "")
+
 	// Run the task.
-	if err := task(id); err != nil {
+	err := task(id)
+	if errors.Cause(err) == ErrInterrupted {
+		log.WithField("task", id).
+			Warn("Task interrupted")
+		return
+	}
+	if IsTimeout(err) {
+		log.WithField("task", id).
+			Errorf("Task timed out: %v", errors.Cause(err))
+		go onFailure(id, "The task ran out of time."+"\n\n"+errors.Cause(err).Error())
+		ex.cMap.finish(id, TIMEDOUT, errors.Cause(err).Error())
+		ex.publish(TIMEOUT, id, "", errors.Cause(err).Error())
+		return
+	}
+	if err != nil {
 		log.WithFields(log.Fields{
 			"task":  id,
 			"error": errors.ErrorStack(err),
 		}).Error("Task failed")
-		go onFailure(id, "The error message is below. Please check logs for more details."+"\n\n"+errors.ErrorStack(err))
-		ex.cMap.setStatus(id, FAILURE)
+		go onFailure(id, "The error message is below."+"\n\n"+errors.ErrorStack(err))
+		ex.cMap.finish(id, FAILURE, err.Error())
+		ex.publish(FAILED, id, "", err.Error())
 		return
 	}
 
 	log.WithField("task", id).
 		Info("Task succeeded")
-	ex.cMap.setStatus(id, SUCCESS)
+	ex.cMap.finish(id, SUCCESS, "")
+	ex.publish(SUCCEEDED, id, "", "")
 }
 
 func (ex *defaultExecuter) deleteExpiredInfo() {
-	for range time.Tick(30 * time.Minute) {
-		m := ex.cMap.m
-		toDelete := []string{}
-
-		ex.cMap.RLock()
-		for k, v := range m {
-			if (time.Since(v.started)) > ex.expiration {
-				toDelete = append(toDelete, k)
-			}
+	for now := range time.Tick(30 * time.Minute) {
+		ex.expire(now)
+	}
+}
+
+// expire deletes the information about tasks queued longer than the
+// expiration before now.
+func (ex *defaultExecuter) expire(now time.Time) {
+	m := ex.cMap.m
+	toDelete := []string{}
+
+	ex.cMap.RLock()
+	for k, v := range m {
+		if now.Sub(v.Queued) > ex.expiration {
+			toDelete = append(toDelete, k)
 		}
-		ex.cMap.RUnlock()
+	}
+	ex.cMap.RUnlock()
+
+	ex.cMap.Lock()
+	for _, k := range toDelete {
+		log.WithField("task", k).
+			Debug("Expired from info map")
+		delete(m, k)
+	}
+	ex.cMap.Unlock()
+	for _, k := range toDelete {
+		ex.publish(EXPIRED, k, "", "")
+	}
+}
 
-		ex.cMap.Lock()
-		for _, k := range toDelete {
-			log.WithField("task", k).
-				Debug("Expired from info map")
-			delete(m, k)
+// NewID returns a new random task id, e.g. for a task which will run
+// elsewhere. Ids cannot be guessed from others.
+func NewID() string {
+	return generateID(20)
+}
+
+// idAttempts is how many ids NewUniqueID generates before giving up.
+const idAttempts = 5
+
+// NewUniqueID returns a new task id for which taken, which looks for it
+// among existing tasks, reports false.
+func NewUniqueID(taken func(id string) (bool, error)) (string, error) {
+	for i := 0; i < idAttempts; i++ {
+		id := NewID()
+		exists, err := taken(id)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if !exists {
+			return id, nil
 		}
-		ex.cMap.Unlock()
+		log.WithField("task", id).
+			Error("Generated the id of an existing task")
 	}
+	return "", errors.Errorf("could not generate an unused task id in %d attempts", idAttempts)
 }
 
-// Borrowed from https://siongui.github.io/2015/04/13/go-generate-random-string/
+// generateID returns a random string of strlen letters and digits, read from
+// crypto/rand.
 func generateID(strlen int) string {
-	rand.Seed(time.Now().UTC().UnixNano())
 	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	result := make([]byte, strlen)
-	for i := 0; i < strlen; i++ {
-		result[i] = chars[rand.Intn(len(chars))]
+	// bytes from maxByte up are discarded, so that every character is as
+	// likely as the others
+	const maxByte = 256 - 256%len(chars)
+	result := make([]byte, 0, strlen)
+	buf := make([]byte, strlen)
+	for len(result) < strlen {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, b := range buf {
+			if int(b) < maxByte && len(result) < strlen {
+				result = append(result, chars[int(b)%len(chars)])
+			}
+		}
 	}
 	return string(result)
 }
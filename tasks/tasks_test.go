@@ -1,25 +1,51 @@
 package tasks
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	juju "github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
 )
 
+// waitForEvent waits for an event of one of the given types about the task
+// with the given id, returning it.
+func waitForEvent(t *testing.T, events <-chan Event, id string, types ...EventType) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.TaskID != id {
+				continue
+			}
+			for _, typ := range types {
+				if e.Type == typ {
+					return e
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for an event about task %s", id)
+		}
+	}
+}
+
 func TestTaskErrorLeadsToErrorStatus(t *testing.T) {
 	assert := assert.New(t)
 	errorTask := func(a string) error {
 		return errors.New("This is the error text.")
 	}
 
-	ex := NewTaskExecuter()
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
 	id := ex.QueueTask(errorTask, func(a, b string) {})
-	status := ex.GetTaskStatus(id)
-	for status == INPROGRESS {
-		status = ex.GetTaskStatus(id)
-	}
-	assert.Equal(FAILURE, status)
+	e := waitForEvent(t, events, id, SUCCEEDED, FAILED)
+	assert.Equal(FAILED, e.Type)
+	assert.Equal("This is the error text.", e.Error)
+	assert.Equal(FAILURE, ex.GetTaskStatus(id))
 }
 
 func TestTaskPanicLeadsToErrorStatus(t *testing.T) {
@@ -28,13 +54,37 @@ func TestTaskPanicLeadsToErrorStatus(t *testing.T) {
 		panic("AHHH!!!")
 	}
 
-	ex := NewTaskExecuter()
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
 	id := ex.QueueTask(errorTask, func(a, b string) {})
-	status := ex.GetTaskStatus(id)
-	for status == INPROGRESS {
-		status = ex.GetTaskStatus(id)
+	assert.Equal(FAILED, waitForEvent(t, events, id, SUCCEEDED, FAILED).Type)
+	assert.Equal(FAILURE, ex.GetTaskStatus(id))
+}
+
+func TestTaskTimeoutLeadsToTimedOutStatus(t *testing.T) {
+	assert := assert.New(t)
+	// onFailure runs in a goroutine of its own, after the event is published
+	failures := make(chan string, 1)
+	timeoutTask := func(a string) error {
+		return juju.Trace(&TimeoutError{What: "stage convert", Limit: 30 * time.Minute})
 	}
-	assert.Equal(FAILURE, status)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	id := ex.QueueTask(timeoutTask, func(a, b string) { failures <- b })
+	e := waitForEvent(t, events, id, SUCCEEDED, FAILED, TIMEOUT)
+	assert.Equal(TIMEOUT, e.Type)
+	assert.Equal("stage convert exceeded its time limit of 30m0s", e.Error)
+	assert.Equal(TIMEDOUT, ex.GetTaskStatus(id))
+	select {
+	case failure := <-failures:
+		assert.Contains(failure, "stage convert exceeded its time limit")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for onFailure")
+	}
+	assert.False(IsTimeout(errors.New("stage convert exceeded its time limit")))
 }
 
 func TestTaskOkLeadsToSuccessStatus(t *testing.T) {
@@ -43,25 +93,288 @@ func TestTaskOkLeadsToSuccessStatus(t *testing.T) {
 		return nil
 	}
 
-	ex := NewTaskExecuter()
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
 	id := ex.QueueTask(errorTask, func(a, b string) {})
-	status := ex.GetTaskStatus(id)
-	for status == INPROGRESS {
-		status = ex.GetTaskStatus(id)
-	}
-	assert.Equal(SUCCESS, status)
+	assert.Equal(SUCCEEDED, waitForEvent(t, events, id, SUCCEEDED, FAILED).Type)
+	assert.Equal(SUCCESS, ex.GetTaskStatus(id))
 }
 
 func TestInProgressStatus(t *testing.T) {
 	assert := assert.New(t)
-	errorTask := func(a string) error {
-		for true {
+	release := make(chan struct{})
+	defer close(release)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	id := ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+	waitForEvent(t, events, id, STARTED)
+	assert.Equal(INPROGRESS, ex.GetTaskStatus(id))
+}
+
+func TestTaskCounts(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	defer close(release)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+	id := ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	waitForEvent(t, events, id, SUCCEEDED)
+	assert.Equal(map[Status]int{INPROGRESS: 1, SUCCESS: 1}, ex.TaskCounts())
+}
+
+func TestEventSequence(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	ex.ReportProgress("unknown", "ignored")
+	id := ex.QueueTask(func(id string) error {
+		ex.ReportProgress(id, "halfway")
+		return nil
+	}, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+
+	types := []EventType{}
+	for len(events) > 0 {
+		e := <-events
+		assert.Equal(id, e.TaskID)
+		if e.Type == PROGRESS {
+			assert.Equal("halfway", e.Message)
+		}
+		types = append(types, e.Type)
+	}
+	assert.Equal([]EventType{QUEUED, STARTED, PROGRESS, SUCCEEDED}, types)
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	defer close(release)
+	failed := false
+
+	ex := NewTaskExecuter(time.Hour)
+	ex.SetMaxRunning(1)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	running := ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+	waiting := ex.QueueTask(func(string) error { return nil }, func(a, b string) { failed = true })
+
+	assert.True(juju.IsNotFound(ex.Cancel("unknown")))
+	assert.True(juju.IsNotValid(ex.Cancel(running)))
+	assert.NoError(ex.Cancel(waiting))
+	waitForEvent(t, events, waiting, CANCELLED)
+	assert.Equal(FAILURE, ex.GetTaskStatus(waiting))
+	assert.True(juju.IsNotValid(ex.Cancel(waiting)))
+	assert.False(failed)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(1)
+	unsubscribe()
+	unsubscribe()
+	_, open := <-events
+	assert.False(open)
+	// publishing to no one does not block
+	ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+}
+
+func TestSlowSubscriberDoesNotHoldUpTasks(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	_, unsubscribe := ex.Subscribe(0)
+	defer unsubscribe()
+	ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+}
+
+func TestExpire(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	id := ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+
+	ex.(*defaultExecuter).expire(time.Now())
+	assert.Equal(SUCCESS, ex.GetTaskStatus(id))
+	ex.(*defaultExecuter).expire(time.Now().Add(2 * time.Hour))
+	assert.Equal(NOTFOUND, ex.GetTaskStatus(id))
+	assert.Equal(EXPIRED, waitForEvent(t, events, id, EXPIRED).Type)
+}
+
+func TestParseEventType(t *testing.T) {
+	assert := assert.New(t)
+	for _, typ := range eventTypes {
+		parsed, err := ParseEventType(strings.ToUpper(typ.Name()))
+		assert.NoError(err)
+		assert.Equal(typ, parsed)
+	}
+	_, err := ParseEventType("exploded")
+	assert.True(juju.IsNotValid(err))
+}
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+
+	ex := NewTaskExecuter(time.Hour)
+	ex.QueueTask(func(string) error { <-release; return nil }, func(a, b string) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, ex.Wait(ctx))
+
+	close(release)
+	assert.NoError(ex.Wait(context.Background()))
+}
+
+func TestResumeTask(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	ran := ""
+	ex.ResumeTask("interrupted", TaskOptions{}, func(id string) error { ran = id; return nil }, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+	assert.Equal("interrupted", ran)
+	assert.Equal(SUCCESS, ex.GetTaskStatus("interrupted"))
+}
+
+func TestGetTask(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewTaskExecuter(time.Hour)
+	_, err := ex.GetTask("unknown")
+	assert.True(juju.IsNotFound(err))
+
+	fail := true
+	task := func(id string) error {
+		if fail {
+			return errors.New("no audio")
 		}
+		ex.SetResult(id, "/transcripts/"+id)
 		return nil
 	}
+	labels := map[string]string{SourceLabel: "api"}
+	ex.ResumeTask("job", TaskOptions{Labels: labels, Attempt: 3}, task, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+	labels[SourceLabel] = "changed"
+	info, err := ex.GetTask("job")
+	assert.NoError(err)
+	assert.Equal("job", info.ID)
+	assert.Equal(FAILURE, info.Status)
+	assert.Equal("no audio", info.Error)
+	assert.Equal(3, info.Attempts)
+	assert.Equal(map[string]string{SourceLabel: "api"}, info.Labels)
+	assert.False(info.Started.Before(info.Queued))
+	assert.False(info.Finished.Before(info.Started))
+	assert.Empty(info.Result)
 
-	ex := NewTaskExecuter()
-	id := ex.QueueTask(errorTask, func(a, b string) {})
-	status := ex.GetTaskStatus(id)
-	assert.Equal(INPROGRESS, status)
+	// retrying on the same executer counts the attempt
+	fail = false
+	ex.ResumeTask("job", TaskOptions{}, task, func(a, b string) {})
+	assert.NoError(ex.Wait(context.Background()))
+	info, err = ex.GetTask("job")
+	assert.NoError(err)
+	assert.Equal(SUCCESS, info.Status)
+	assert.Empty(info.Error)
+	assert.Equal(4, info.Attempts)
+	assert.Equal("/transcripts/job", info.Result)
+}
+
+func TestListTasks(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	defer close(release)
+
+	ex := NewTaskExecuter(time.Hour)
+	events, unsubscribe := ex.Subscribe(10)
+	defer unsubscribe()
+	api := TaskOptions{Labels: map[string]string{SourceLabel: "api"}}
+	done, err := ex.QueueTaskWith(api, func(string) error { return nil }, func(a, b string) {})
+	assert.NoError(err)
+	waitForEvent(t, events, done, SUCCEEDED)
+	running, err := ex.QueueTaskWith(api, func(string) error { <-release; return nil }, func(a, b string) {})
+	assert.NoError(err)
+	waitForEvent(t, events, running, STARTED)
+	web := ex.QueueTask(func(string) error { return nil }, func(a, b string) {})
+	waitForEvent(t, events, web, SUCCEEDED)
+
+	ids := func(list []TaskInfo) []string {
+		ids := []string{}
+		for _, info := range list {
+			ids = append(ids, info.ID)
+		}
+		return ids
+	}
+	assert.Equal([]string{web, running, done}, ids(ex.ListTasks(TaskFilter{})))
+	assert.Equal([]string{running, done}, ids(ex.ListTasks(TaskFilter{Labels: api.Labels})))
+	assert.Equal([]string{web, done}, ids(ex.ListTasks(TaskFilter{Statuses: []Status{SUCCESS, FAILURE}})))
+	assert.Equal([]string{done}, ids(ex.ListTasks(TaskFilter{Labels: api.Labels, Statuses: []Status{SUCCESS}})))
+	assert.Empty(ex.ListTasks(TaskFilter{QueuedSince: time.Now().Add(time.Minute)}))
+}
+
+func TestNewID(t *testing.T) {
+	assert := assert.New(t)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := NewID()
+		assert.Regexp("^[a-zA-Z0-9]{20}$", id)
+		assert.False(seen[id])
+		seen[id] = true
+	}
+}
+
+func TestNewUniqueID(t *testing.T) {
+	assert := assert.New(t)
+	tries := 0
+	id, err := NewUniqueID(func(string) (bool, error) {
+		tries++
+		return tries < 3, nil
+	})
+	assert.NoError(err)
+	assert.Len(id, 20)
+	assert.Equal(3, tries)
+
+	_, err = NewUniqueID(func(string) (bool, error) { return true, nil })
+	assert.Error(err)
+	_, err = NewUniqueID(func(string) (bool, error) { return false, errors.New("database down") })
+	assert.Error(err)
+
+	ex := NewTaskExecuter(time.Hour)
+	id, err = ex.QueueTaskWith(TaskOptions{ID: "chosen"}, func(string) error { return nil }, func(a, b string) {})
+	assert.NoError(err)
+	assert.Equal("chosen", id)
+	assert.NoError(ex.Wait(context.Background()))
+	assert.Equal(SUCCESS, ex.GetTaskStatus("chosen"))
+
+	// the id of a known task cannot be chosen again
+	ran := false
+	_, err = ex.QueueTaskWith(TaskOptions{ID: "chosen"}, func(string) error { ran = true; return nil }, func(a, b string) {})
+	assert.True(juju.IsAlreadyExists(err))
+	assert.NoError(ex.Wait(context.Background()))
+	assert.False(ran)
+}
+
+func TestInterruptedTaskStaysInProgress(t *testing.T) {
+	assert := assert.New(t)
+	failed := false
+
+	ex := NewTaskExecuter(time.Hour)
+	id := ex.QueueTask(func(string) error { return ErrInterrupted }, func(a, b string) { failed = true })
+	assert.NoError(ex.Wait(context.Background()))
+	assert.Equal(INPROGRESS, ex.GetTaskStatus(id))
+	assert.False(failed)
 }
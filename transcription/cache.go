@@ -0,0 +1,89 @@
+package transcription
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// ContentKey returns the key identifying the transcript of the audio file at
+// path in the given language with the given search words. It hashes the
+// audio itself, so that the same recording downloaded from different URLs
+// has the same key, and normalizes the search words, whose order and
+// repetition do not change the transcript.
+func ContentKey(path string, language string, searchWords []string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", errors.Trace(err)
+	}
+	io.WriteString(hash, "\x00"+strings.TrimSpace(language))
+	for _, word := range normalizeWords(searchWords) {
+		io.WriteString(hash, "\x00"+word)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// normalizeWords returns the distinct non-empty search words, trimmed and
+// sorted.
+func normalizeWords(words []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word != "" && !seen[word] {
+			seen[word] = true
+			normalized = append(normalized, word)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// cachedTranscript returns the most recent transcript with the given content
+// key in the given organization, or nil if there is none. Transcripts are
+// never shared between organizations, and jobs in no organization only
+// reuse the transcripts of jobs in none.
+func cachedTranscript(key string, org string) (*db.Transcript, error) {
+	filter := db.TranscriptFilter{ContentKey: key, Org: org, NoOrg: org == "", Limit: 1}
+	found, err := db.Transcripts.List(filter)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found[0], nil
+}
+
+// reuseTranscript stores a copy of cached as the transcript of the job with
+// the given id, which transcribes the audio at source.
+func reuseTranscript(id string, source string, job Job, cached *db.Transcript) (*db.Transcript, error) {
+	t := *cached
+	t.ID = id
+	t.AudioURL = source
+	t.Episode = job.Episode
+	t.Org = job.Org
+	t.CompletedAt = time.Now()
+	// point at the transcript which was actually transcribed
+	if t.CachedFrom == "" {
+		t.CachedFrom = cached.ID
+	}
+	if err := db.Transcripts.Create(&t); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &t, nil
+}
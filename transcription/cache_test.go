@@ -0,0 +1,112 @@
+package transcription
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func writeAudio(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestContentKey(t *testing.T) {
+	assert := assert.New(t)
+	one := writeAudio(t, "some audio")
+	defer os.Remove(one)
+	copied := writeAudio(t, "some audio")
+	defer os.Remove(copied)
+	other := writeAudio(t, "other audio")
+	defer os.Remove(other)
+
+	key, err := ContentKey(one, "en-US", []string{"budget", "tax"})
+	assert.NoError(err)
+	same, err := ContentKey(copied, "en-US", []string{" tax", "budget", "", "tax"})
+	assert.NoError(err)
+	assert.Equal(key, same)
+
+	for _, different := range []struct {
+		path     string
+		language string
+		words    []string
+	}{
+		{other, "en-US", []string{"budget", "tax"}},
+		{one, "en-GB", []string{"budget", "tax"}},
+		{one, "en-US", []string{"budget"}},
+		{one, "en-US", []string{"Budget", "tax"}},
+	} {
+		k, err := ContentKey(different.path, different.language, different.words)
+		assert.NoError(err)
+		assert.NotEqual(key, k, "%v", different)
+	}
+
+	_, err = ContentKey(one+".missing", "en-US", nil)
+	assert.Error(err)
+}
+
+func TestCachedTranscriptStaysInItsOrg(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if db.Transcripts, err = db.NewFileTranscriptRepository(filepath.Join(dir, "transcripts.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// two organizations submit the same audio
+	audio := writeAudio(t, "the same audio")
+	defer os.Remove(audio)
+	key, err := ContentKey(audio, "en-US", nil)
+	assert.NoError(err)
+	assert.NoError(db.Transcripts.Create(&db.Transcript{
+		ID:               "first",
+		Org:              "red",
+		ContentKey:       key,
+		AudioObject:      "audio/first.mp3",
+		TranscriptObject: "transcripts/first.json",
+		CompletedAt:      time.Now(),
+	}))
+
+	cached, err := cachedTranscript(key, "blue")
+	assert.NoError(err)
+	assert.Nil(cached)
+	cached, err = cachedTranscript(key, "")
+	assert.NoError(err)
+	assert.Nil(cached)
+
+	cached, err = cachedTranscript(key, "red")
+	assert.NoError(err)
+	if assert.NotNil(cached) {
+		assert.Equal("first", cached.ID)
+		reused, err := reuseTranscript("second", "http://example.com/a.mp3", Job{Org: "red"}, cached)
+		assert.NoError(err)
+		assert.Equal("first", reused.CachedFrom)
+		assert.Equal("red", reused.Org)
+	}
+
+	assert.NoError(db.Transcripts.Create(&db.Transcript{ID: "personal", ContentKey: key, CompletedAt: time.Now()}))
+	cached, err = cachedTranscript(key, "")
+	assert.NoError(err)
+	if assert.NotNil(cached) {
+		assert.Equal("personal", cached.ID)
+	}
+	cached, err = cachedTranscript(key, "blue")
+	assert.NoError(err)
+	assert.Nil(cached)
+}
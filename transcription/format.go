@@ -0,0 +1,103 @@
+package transcription
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// Formats lists the names of the formats understood by Format.
+var Formats = []string{"txt", "json", "srt", "vtt"}
+
+// These limits decide when a subtitle cue ends.
+const (
+	maxCueWords      = 12
+	maxCueSeconds    = 6.0
+	maxCueGapSeconds = 1.5
+)
+
+type cue struct {
+	start float64
+	end   float64
+	words []string
+}
+
+// Format renders a transcript in the named format: "txt" for the plain
+// transcript, "json" for every stored field, and "srt" or "vtt" for subtitles
+// built from the word timestamps.
+func Format(t *db.Transcript, format string) ([]byte, error) {
+	switch format {
+	case "txt":
+		return []byte(t.Transcript + "\n"), nil
+	case "json":
+		data, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return append(data, '\n'), nil
+	case "srt", "vtt":
+		cues := makeCues(t.Timestamps)
+		if len(cues) == 0 {
+			return nil, errors.NotValidf("transcript without timestamps for %s output", format)
+		}
+		return formatCues(cues, format), nil
+	}
+	return nil, errors.NotSupportedf("format %q", format)
+}
+
+// makeCues groups word timestamps into subtitle cues.
+func makeCues(timestamps []db.Timestamp) []cue {
+	cues := []cue{}
+	var current *cue
+	for _, ts := range timestamps {
+		if current != nil &&
+			(len(current.words) >= maxCueWords ||
+				ts.EndTime-current.start > maxCueSeconds ||
+				ts.StartTime-current.end > maxCueGapSeconds ||
+				ts.StartTime < current.end) {
+			cues = append(cues, *current)
+			current = nil
+		}
+		if current == nil {
+			current = &cue{start: ts.StartTime}
+		}
+		current.end = ts.EndTime
+		current.words = append(current.words, ts.Word)
+	}
+	if current != nil {
+		cues = append(cues, *current)
+	}
+	return cues
+}
+
+func formatCues(cues []cue, format string) []byte {
+	var buf bytes.Buffer
+	separator := ","
+	if format == "vtt" {
+		buf.WriteString("WEBVTT\n\n")
+		separator = "."
+	}
+	for i, c := range cues {
+		if format == "srt" {
+			fmt.Fprintf(&buf, "%d\n", i+1)
+		}
+		fmt.Fprintf(&buf, "%s --> %s\n%s\n\n",
+			formatCueTime(c.start, separator),
+			formatCueTime(c.end, separator),
+			strings.Join(c.words, " "))
+	}
+	return buf.Bytes()
+}
+
+// formatCueTime formats seconds as HH:MM:SS followed by separator and
+// milliseconds.
+func formatCueTime(seconds float64, separator string) string {
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d",
+		millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
+}
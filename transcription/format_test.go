@@ -0,0 +1,45 @@
+package transcription
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+var formatTranscript = &db.Transcript{
+	Transcript: "hello world again",
+	Timestamps: []db.Timestamp{
+		{Word: "hello", StartTime: 0.5, EndTime: 1},
+		{Word: "world", StartTime: 1, EndTime: 1.25},
+		{Word: "again", StartTime: 3900, EndTime: 3900.5},
+	},
+}
+
+func TestFormatSRT(t *testing.T) {
+	assert := assert.New(t)
+
+	out, err := Format(formatTranscript, "srt")
+	assert.NoError(err)
+	assert.Equal("1\n00:00:00,500 --> 00:00:01,250\nhello world\n\n"+
+		"2\n01:05:00,000 --> 01:05:00,500\nagain\n\n", string(out))
+}
+
+func TestFormatVTT(t *testing.T) {
+	assert := assert.New(t)
+
+	out, err := Format(formatTranscript, "vtt")
+	assert.NoError(err)
+	assert.Equal("WEBVTT\n\n00:00:00.500 --> 00:00:01.250\nhello world\n\n"+
+		"01:05:00.000 --> 01:05:00.500\nagain\n\n", string(out))
+}
+
+func TestFormatErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := Format(&db.Transcript{Transcript: "no timestamps"}, "srt")
+	assert.Error(err)
+	_, err = Format(formatTranscript, "doc")
+	assert.Error(err)
+}
@@ -3,6 +3,7 @@ package transcription
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"io"
 	"net/http"
@@ -12,6 +13,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/metrics"
 )
 
 // IBMResult is the result of an IBM transcription. See
@@ -42,21 +46,62 @@ type ibmKeywordResult struct {
 	Confidence float64 `json:"confidence"`
 }
 
+// ibmLanguages lists the languages for which IBM offers a broadband model.
+var ibmLanguages = []string{"ar-AR", "de-DE", "en-GB", "en-US", "es-ES", "fr-FR", "ja-JP", "ko-KR", "pt-BR", "zh-CN"}
+
+// ValidLanguage reports whether audio in language can be transcribed. The
+// empty language means US English.
+func ValidLanguage(language string) bool {
+	if language == "" {
+		return true
+	}
+	for _, l := range ibmLanguages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+// ibmModel returns the IBM model used to transcribe audio in language.
+func ibmModel(language string) string {
+	if language == "" {
+		language = "en-US"
+	}
+	return language + "_BroadbandModel"
+}
+
 // TranscribeWithIBM transcribes a given audio file using the IBM Watson
-// Speech To Text API
-func TranscribeWithIBM(filePath string, searchWords []string, IBMUsername string, IBMPassword string) (*IBMResult, error) {
+// Speech To Text API. The connection is closed when ctx ends.
+func TranscribeWithIBM(ctx context.Context, filePath string, language string, searchWords []string, IBMUsername string, IBMPassword string) (*IBMResult, error) {
 	result := new(IBMResult)
 
-	url := "wss://stream.watsonplatform.net/speech-to-text/api/v1/recognize?model=en-US_BroadbandModel"
+	url := "wss://stream.watsonplatform.net/speech-to-text/api/v1/recognize?model=" + ibmModel(language)
 	header := http.Header{}
 	header.Set("Authorization", "Basic "+basicAuth(IBMUsername, IBMPassword))
 
 	dialer := websocket.DefaultDialer
-	ws, _, err := dialer.Dial(url, header)
+	ws, resp, err := dialer.Dial(url, header)
 	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			metrics.EngineErrors.Inc("auth")
+		} else {
+			metrics.EngineErrors.Inc("connect")
+		}
 		return nil, errors.Trace(err)
 	}
 	defer ws.Close()
+	// IBM never gives up on audio with inactivity_timeout -1, so the time
+	// limit of the stage is what bounds the wait for results
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
 
 	requestArgs := map[string]interface{}{
 		"action":             "start",
@@ -72,17 +117,23 @@ func TranscribeWithIBM(filePath string, searchWords []string, IBMUsername string
 	}
 
 	if err = ws.WriteJSON(requestArgs); err != nil {
+		metrics.EngineErrors.Inc("send")
 		return nil, errors.Trace(err)
 	}
 	log.Debug("Starting transcription using IBM")
 
 	if err = uploadFileWithWebsocket(ws, filePath); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Trace(ctx.Err())
+		}
+		metrics.EngineErrors.Inc("send")
 		return nil, errors.Trace(err)
 	}
 	log.Debugf("Successfully uploaded %s to IBM", filePath)
 
 	// write empty message to indicate end of uploading file
 	if err = ws.WriteMessage(websocket.BinaryMessage, []byte{}); err != nil {
+		metrics.EngineErrors.Inc("send")
 		return nil, errors.Trace(err)
 	}
 
@@ -96,6 +147,10 @@ func TranscribeWithIBM(filePath string, searchWords []string, IBMUsername string
 	for {
 		err := ws.ReadJSON(&result)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.Trace(ctx.Err())
+			}
+			metrics.EngineErrors.Inc("receive")
 			return nil, errors.Trace(err)
 		}
 		if len(result.Results) > 0 {
@@ -152,10 +207,10 @@ func keepConnectionOpen(ws *websocket.Conn, ticker *time.Ticker, quit chan struc
 }
 
 // GetTranscription gets the full transcript from an IBMResult.
-func GetTranscription(results []*IBMResult) *Transcription {
-	timestamps := []timestamp{}
-	confidences := []confidence{}
-	keywords := []ibmKeywordResult{}
+func GetTranscription(results []*IBMResult) *db.Transcript {
+	timestamps := []db.Timestamp{}
+	confidences := []db.Confidence{}
+	keywords := []db.Keyword{}
 
 	var transcriptBuffer bytes.Buffer
 	for _, result := range results {
@@ -163,25 +218,27 @@ func GetTranscription(results []*IBMResult) *Transcription {
 			bestHypothesis := subResult.Alternatives[0]
 			transcriptBuffer.WriteString(bestHypothesis.Transcript)
 			for _, ibmTimestamp := range bestHypothesis.Timestamps {
-				timestamps = append(timestamps, timestamp{
+				timestamps = append(timestamps, db.Timestamp{
 					Word:      ibmTimestamp[0].(string),
 					StartTime: ibmTimestamp[1].(float64),
 					EndTime:   ibmTimestamp[2].(float64),
 				})
 			}
 			for _, ibmConfidence := range bestHypothesis.WordConfidence {
-				confidences = append(confidences, confidence{
+				confidences = append(confidences, db.Confidence{
 					Word:  ibmConfidence[0].(string),
 					Score: ibmConfidence[1].(float64),
 				})
 			}
 			for _, ibmKeywordSlice := range subResult.KeywordMap {
-				keywords = append(keywords, ibmKeywordSlice...)
+				for _, ibmKeyword := range ibmKeywordSlice {
+					keywords = append(keywords, db.Keyword(ibmKeyword))
+				}
 			}
 		}
 	}
 
-	transcription := &Transcription{
+	transcription := &db.Transcript{
 		Transcript:  transcriptBuffer.String(),
 		CompletedAt: time.Now(),
 		Timestamps:  timestamps,
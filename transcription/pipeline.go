@@ -0,0 +1,779 @@
+package transcription
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/batch"
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/metrics"
+	"github.com/hack4impact/transcribe4all/storage"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/usage"
+)
+
+// Job describes the audio to transcribe and who to notify.
+type Job struct {
+	AudioURL       string   `json:"audioURL"`
+	EmailAddresses []string `json:"emailAddresses"`
+	SearchWords    []string `json:"searchWords"`
+	Language       string   `json:"language"`
+	// Episode describes the podcast episode being transcribed, if any.
+	Episode *db.Episode `json:"episode,omitempty"`
+	// Force transcribes the audio even if it has been transcribed with the
+	// same options before, instead of reusing that transcript.
+	Force bool `json:"force,omitempty"`
+	// Priority is the name of the job's tasks.Priority, e.g. "high". Only
+	// administrators may queue high-priority jobs, which callers must check.
+	Priority string `json:"priority,omitempty"`
+	// StartAt and DelaySeconds defer the job until a given time, or for a
+	// number of seconds after it is submitted.
+	StartAt      time.Time `json:"startAt,omitempty"`
+	DelaySeconds int       `json:"delaySeconds,omitempty"`
+	// TimeoutMinutes and StageTimeoutMinutes override JobTimeoutMinutes and
+	// StageTimeoutMinutes for the job.
+	TimeoutMinutes      int            `json:"timeoutMinutes,omitempty"`
+	StageTimeoutMinutes map[string]int `json:"stageTimeoutMinutes,omitempty"`
+	// Org is the organization the transcript belongs to. It is set by
+	// Submit from the job's record.
+	Org string `json:"-"`
+	// LocalFile allows AudioURL to be the path of a local file. Only the
+	// transcribe command and the watched folders set it, since submitters
+	// must not be able to read the server's files.
+	LocalFile bool `json:"-"`
+}
+
+// Validate checks that the job can be run.
+func (job Job) Validate() error {
+	if job.AudioURL == "" {
+		return errors.NotValidf("empty audio url")
+	}
+	if !job.LocalFile && !isWebURL(job.AudioURL) {
+		return errors.NotValidf("audio url %q, which is not an http or https url,", job.AudioURL)
+	}
+	if !ValidLanguage(job.Language) {
+		return errors.NotValidf("language %q", job.Language)
+	}
+	if _, err := tasks.ParsePriority(job.Priority); err != nil {
+		return err
+	}
+	if job.DelaySeconds < 0 {
+		return errors.NotValidf("negative delay")
+	}
+	if job.DelaySeconds > 0 && !job.StartAt.IsZero() {
+		return errors.NotValidf("job with both a start time and a delay")
+	}
+	return ValidateTimeouts(job.TimeoutMinutes, job.StageTimeoutMinutes)
+}
+
+// StartTime returns when the job, submitted at now, should start, or the zero
+// time if it should start straight away.
+func (job Job) StartTime(now time.Time) time.Time {
+	start := job.StartAt
+	if job.DelaySeconds > 0 {
+		start = now.Add(time.Duration(job.DelaySeconds) * time.Second)
+	}
+	if !start.After(now) {
+		return time.Time{}
+	}
+	return start
+}
+
+// MakeIBMTaskFunction returns a task function for transcription using IBM transcription functions.
+// The task stops, returning tasks.ErrInterrupted, if ctx ends.
+func MakeIBMTaskFunction(ctx context.Context, job Job) (task func(string) error, onFailure func(string, string)) {
+	parent := ctx
+	emailAddresses := recipients(job.EmailAddresses)
+	task = func(id string) error {
+		ctx, cancel := NewRunContext(parent, job)
+		defer cancel()
+		transcription, err := Transcribe(ctx, id, job)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tasks.DefaultTaskExecuter.SetResult(id, "/api/v1/transcripts/"+transcription.ID)
+
+		if len(config.Config.EmailUsername) > 0 && len(emailAddresses) > 0 {
+			body := "The transcript is below. It can also be found in the database."
+			if transcription.TranscriptObject != "" {
+				if url, err := storage.Default.SignedURL(transcription.TranscriptObject, linkExpiry); err == nil {
+					body += "\nIt can be downloaded for the next 7 days at " + url
+				}
+			}
+			err := runStage(ctx, id, StageNotify, func(ctx context.Context) error {
+				start := time.Now()
+				err := SendEmail(config.Config.EmailUsername, config.Config.EmailPassword, config.Config.EmailSMTPServer, config.Config.EmailPort, emailAddresses, fmt.Sprintf("IBM Transcription %s Complete", id), body+"\n\n"+transcription.Transcript)
+				metrics.StageDuration.ObserveSince(start, "notify")
+				return errors.Trace(err)
+			})
+			if err != nil {
+				return err
+			}
+			log.WithField("task", id).
+				Debugf("Sent email to %v", emailAddresses)
+		}
+		return nil
+	}
+
+	onFailure = func(id string, errMessage string) {
+		if len(config.Config.EmailUsername) == 0 || len(emailAddresses) == 0 {
+			return
+		}
+		errMessage += "\n\nThe job's log is shown on its page"
+		if config.Config.PublicURL != "" {
+			errMessage += ", " + strings.TrimSuffix(config.Config.PublicURL, "/") + "/jobs/" + id
+		}
+		errMessage += ", and API clients can fetch it from /api/v1/jobs/" + id + "/logs."
+		err := SendEmail(config.Config.EmailUsername, config.Config.EmailPassword, config.Config.EmailSMTPServer, config.Config.EmailPort, emailAddresses, fmt.Sprintf("IBM Transcription %s Failed", id), errMessage)
+		if err != nil {
+			log.WithField("task", id).
+				Debugf("Could not send error email to %v because of the error %v", emailAddresses, err.Error())
+			return
+		}
+		log.WithField("task", id).
+			Debugf("Sent email to %v", emailAddresses)
+	}
+	return task, onFailure
+}
+
+// recipients returns the addresses in emailAddresses which are not blank.
+func recipients(emailAddresses []string) []string {
+	var to []string
+	for _, address := range emailAddresses {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	return to
+}
+
+// EpisodeJob returns the job transcribing a podcast episode found in feed f.
+func EpisodeJob(f *db.Feed, ep db.Episode) Job {
+	return Job{
+		AudioURL:       ep.EnclosureURL,
+		EmailAddresses: f.EmailAddresses,
+		SearchWords:    f.SearchWords,
+		Language:       f.Language,
+		Episode:        &ep,
+	}
+}
+
+// QueueEpisode queues a transcription task for a podcast episode found in feed
+// f and returns its id, or "" if the monthly quota has been used up.
+func QueueEpisode(f *db.Feed, ep db.Episode) string {
+	if err := usage.Check("", nil, time.Now()); err != nil {
+		log.WithField("feed", f.ID).
+			Warnf("Not transcribing %q: %v", ep.Title, err)
+		return ""
+	}
+	id, err := Submit(EpisodeJob(f, ep), &db.Job{Org: f.Org, Labels: map[string]string{tasks.SourceLabel: "feed"}})
+	if err != nil {
+		log.WithField("task", id).
+			Error(err)
+	}
+	return id
+}
+
+// Submit queues a transcription task for job on tasks.DefaultTaskExecuter, or
+// in the shared queue for worker processes if UseWorkers is set, and stores
+// record, which says who submitted it, as the job's record. Jobs with a start
+// time in the future are only recorded, and started by StartDeferred. It
+// returns the task's id.
+func Submit(job Job, record *db.Job) (string, error) {
+	record.AudioURL = job.AudioURL
+	record.Language = job.Language
+	record.SearchWords = job.SearchWords
+	record.EmailAddresses = job.EmailAddresses
+	record.Force = job.Force
+	record.Episode = job.Episode
+	record.Resumable = true
+	labels := map[string]string{tasks.EngineLabel: "ibm"}
+	for k, v := range record.Labels {
+		labels[k] = v
+	}
+	record.Labels = labels
+	record.TimeoutMinutes = job.TimeoutMinutes
+	record.StageTimeoutMinutes = job.StageTimeoutMinutes
+	if p, err := tasks.ParsePriority(job.Priority); err == nil && p != tasks.NORMAL {
+		record.Priority = p.Name()
+	}
+	if start := job.StartTime(time.Now()); !start.IsZero() {
+		return jobs.Defer(record, start)
+	}
+	if config.Config.UseWorkers {
+		return jobs.Enqueue(record)
+	}
+	job.Org = record.Org
+	task, onFailure := MakeIBMTaskFunction(context.Background(), job)
+	return jobs.Submit(tasks.DefaultTaskExecuter, record, task, onFailure)
+}
+
+// RecordedTask returns the task function running the job recorded as j by
+// Submit, for resuming the job or running it on a worker. The task stops,
+// returning tasks.ErrInterrupted, if ctx ends.
+func RecordedTask(ctx context.Context, j *db.Job) (task func(string) error, onFailure func(string, string)) {
+	return MakeIBMTaskFunction(ctx, recordedJob(j))
+}
+
+// recordedJob returns the job recorded as j by Submit.
+func recordedJob(j *db.Job) Job {
+	return Job{
+		AudioURL:            j.AudioURL,
+		EmailAddresses:      j.EmailAddresses,
+		SearchWords:         j.SearchWords,
+		Language:            j.Language,
+		Episode:             j.Episode,
+		Force:               j.Force,
+		Priority:            j.Priority,
+		Org:                 j.Org,
+		TimeoutMinutes:      j.TimeoutMinutes,
+		StageTimeoutMinutes: j.StageTimeoutMinutes,
+	}
+}
+
+// StartDeferred starts the job recorded as j, which Submit deferred and which
+// is now due, or adds it to the shared queue if UseWorkers is set. It returns
+// an error satisfying errors.IsNotFound if the job has already been started.
+func StartDeferred(j *db.Job) error {
+	if config.Config.UseWorkers {
+		return jobs.EnqueueDeferred(j)
+	}
+	task, onFailure := RecordedTask(context.Background(), j)
+	return jobs.StartDeferred(tasks.DefaultTaskExecuter, j, task, onFailure)
+}
+
+// ScheduledJob returns the job which the schedule s submits.
+func ScheduledJob(s *db.Schedule) Job {
+	return Job{
+		AudioURL:       s.AudioURL,
+		EmailAddresses: s.EmailAddresses,
+		SearchWords:    s.SearchWords,
+		Language:       s.Language,
+		Force:          s.Force,
+		Priority:       s.Priority,
+	}
+}
+
+// QueueScheduled submits the job of the schedule s, which has fallen due, and
+// returns its id. It fails if the monthly quota has been used up.
+func QueueScheduled(s *db.Schedule) (string, error) {
+	var k *db.APIKey
+	if s.APIKey != "" {
+		var err error
+		if k, err = db.APIKeys.Get(s.APIKey); err != nil && !errors.IsNotFound(err) {
+			return "", errors.Trace(err)
+		}
+	}
+	if err := usage.Check("", k, time.Now()); err != nil {
+		return "", err
+	}
+	return Submit(ScheduledJob(s), &db.Job{
+		Org:    s.Org,
+		APIKey: s.APIKey,
+		Labels: map[string]string{tasks.SourceLabel: "schedule"},
+	})
+}
+
+// Resume runs the jobs in interrupted, which were submitted with Submit and
+// had not finished when the previous process stopped, again under their ids.
+// If UseWorkers is set, they are added to the shared queue instead.
+func Resume(interrupted []*db.Job) error {
+	for _, j := range interrupted {
+		if config.Config.UseWorkers {
+			if err := jobs.Requeue(j); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		task, onFailure := RecordedTask(context.Background(), j)
+		if err := jobs.Resume(tasks.DefaultTaskExecuter, j, task, onFailure); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(interrupted) > 0 {
+		log.Infof("Resumed %d interrupted job(s)", len(interrupted))
+	}
+	return nil
+}
+
+// Retry runs the failed job recorded as j again under its id, or adds it to
+// the shared queue if UseWorkers is set. Stages whose output was
+// checkpointed do not run again, so the job carries on from the stage which
+// failed, unless stage names a stage to run again from: its checkpoint and
+// those of the stages after it are discarded first. It returns an error
+// satisfying errors.IsNotValid if the job cannot be retried.
+func Retry(j *db.Job, stage string) error {
+	if !j.Resumable {
+		return errors.NotValidf("job %q (only jobs submitted through the website or API can be retried)", j.ID)
+	}
+	if j.Status != tasks.FAILURE.Name() && j.Status != tasks.TIMEDOUT.Name() {
+		return errors.NotValidf("job %q (only failed jobs can be retried)", j.ID)
+	}
+	if stage != "" {
+		i, _, err := stagePosition(stage)
+		if err != nil {
+			return err
+		}
+		store, _, _ := stagePosition(StageStore)
+		if _, err := db.Transcripts.Get(j.ID); err == nil && i < store {
+			return errors.NotValidf("stage %q of job %q (the transcript has been stored; delete it to run the stage again)", stage, j.ID)
+		}
+		if err := DiscardCheckpointsFrom(j.ID, stage); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	var err error
+	if config.Config.UseWorkers {
+		err = jobs.EnqueueRetry(j)
+	} else {
+		task, onFailure := RecordedTask(context.Background(), j)
+		err = jobs.Retry(tasks.DefaultTaskExecuter, j, task, onFailure)
+	}
+	if errors.IsNotFound(err) {
+		return errors.NotValidf("job %q (it is already being retried)", j.ID)
+	}
+	return err
+}
+
+// Engines lists the speech-to-text engines jobs can be transcribed with, by
+// the names recorded in their tasks.EngineLabel.
+var Engines = []string{"ibm"}
+
+// Rerun submits the finished job recorded as j again, as a new job for the
+// same owner which transcribes the audio afresh with the named engine, and
+// returns the new job's id. It returns an error satisfying errors.IsNotValid
+// if the job cannot be run again or there is no such engine.
+func Rerun(j *db.Job, engine string) (string, error) {
+	if !j.Resumable {
+		return "", errors.NotValidf("job %q (only jobs submitted through the website or API can be run again)", j.ID)
+	}
+	if j.Status == tasks.INPROGRESS.Name() || j.Status == tasks.SCHEDULED.Name() {
+		return "", errors.NotValidf("job %q (only finished jobs can be run again)", j.ID)
+	}
+	known := false
+	for _, e := range Engines {
+		known = known || e == engine
+	}
+	if !known {
+		return "", errors.NotValidf("engine %q (the engines are %s)", engine, strings.Join(Engines, ", "))
+	}
+	labels := map[string]string{}
+	for k, v := range j.Labels {
+		labels[k] = v
+	}
+	labels[tasks.SourceLabel] = "rerun"
+	labels[tasks.EngineLabel] = engine
+
+	job := recordedJob(j)
+	job.Force = true
+	id, err := Submit(job, &db.Job{Owner: j.Owner, APIKey: j.APIKey, Org: j.Org, Labels: labels})
+	if err != nil {
+		return id, err
+	}
+	log.WithField("task", id).
+		Infof("Running job %s again with %s", j.ID, engine)
+	return id, nil
+}
+
+// Transcribe runs the transcription pipeline for the job with the given id:
+// it fetches the audio at job.AudioURL, which is a URL, or a local file path
+// if job.LocalFile is set, transcribes it with IBM, archives the audio and
+// transcript if storage is configured, and stores the transcript under id.
+// Unless job.Force is set, audio which has already been transcribed with the
+// same options is not transcribed again; a copy of the earlier transcript is
+// stored instead.
+//
+// Each step runs as a named stage, recorded on the job's record. The output
+// of the stages transcribing chunks and archiving is checkpointed, so that
+// when a job which failed is retried, or one which was interrupted is
+// resumed, they do not run again for the same audio. The checkpoints are
+// discarded once the transcript is stored.
+//
+// The job stops when ctx ends. If ctx was made by NewRunContext, each stage
+// also stops when it runs out of time, failing with a tasks.TimeoutError.
+// TODO(#52): Quite a lot of the transcription process could be done concurrently.
+func Transcribe(ctx context.Context, id string, job Job) (*db.Transcript, error) {
+	// a resumed job may have stored its transcript before it was interrupted
+	if t, err := db.Transcripts.Get(id); err == nil {
+		return t, nil
+	}
+
+	source := job.AudioURL
+	var filePath, key string
+	err := runStage(ctx, id, StageFetch, func(ctx context.Context) error {
+		start := time.Now()
+		var err error
+		filePath, err = fetchAudio(ctx, source, job.LocalFile)
+		metrics.StageDuration.ObserveSince(start, "download")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.WithField("task", id).
+			Debugf("Fetched file at %s to %s", source, filePath)
+		key, err = ContentKey(filePath, job.Language, job.SearchWords)
+		return errors.Trace(err)
+	})
+	if filePath != "" {
+		defer os.Remove(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fetched fetchCheckpoint
+	if loadCheckpoint(id, StageFetch, &fetched) && fetched.ContentKey != key {
+		log.WithField("task", id).
+			Info("The audio has changed since the job last ran, so it is transcribed from the start")
+		if err := db.Checkpoints.DeleteJob(id); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	saveCheckpoint(id, StageFetch, fetchCheckpoint{ContentKey: key})
+
+	if !job.Force {
+		cached, err := cachedTranscript(key, job.Org)
+		if err != nil {
+			// the audio can still be transcribed
+			log.WithField("task", id).
+				Errorf("Could not look up earlier transcripts: %v", err)
+		}
+		if cached != nil {
+			log.WithField("task", id).
+				Infof("Reusing the transcript of job %s", cached.ID)
+			var transcription *db.Transcript
+			err := runStage(ctx, id, StageStore, func(ctx context.Context) error {
+				var err error
+				transcription, err = reuseTranscript(id, source, job, cached)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			discardCheckpoints(id)
+			return transcription, nil
+		}
+	}
+
+	ibmResults, err := transcribeChunks(ctx, id, job, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var transcription *db.Transcript
+	err = runStage(ctx, id, StageMerge, func(ctx context.Context) error {
+		transcription = GetTranscription(ibmResults)
+		transcription.ID = id
+		transcription.AudioURL = source
+		transcription.Episode = job.Episode
+		transcription.Org = job.Org
+		transcription.ContentKey = key
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if storage.Default != nil {
+		var archived archiveCheckpoint
+		if loadCheckpoint(id, StageArchive, &archived) {
+			transcription.AudioObject = archived.AudioObject
+			transcription.TranscriptObject = archived.TranscriptObject
+		} else {
+			err := runStage(ctx, id, StageArchive, func(ctx context.Context) error {
+				start := time.Now()
+				err := archive(id, filePath, transcription)
+				metrics.StageDuration.ObserveSince(start, "upload")
+				return errors.Trace(err)
+			})
+			if err != nil {
+				return nil, err
+			}
+			log.WithField("task", id).
+				Debugf("Archived %s and its transcript", filePath)
+			saveCheckpoint(id, StageArchive, archiveCheckpoint{
+				AudioObject:      transcription.AudioObject,
+				TranscriptObject: transcription.TranscriptObject,
+			})
+		}
+	}
+
+	err = runStage(ctx, id, StageStore, func(ctx context.Context) error {
+		start := time.Now()
+		err := db.Transcripts.Create(transcription)
+		metrics.StageDuration.ObserveSince(start, "store")
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("task", id).
+		Debugf("Stored transcript")
+	discardCheckpoints(id)
+
+	return transcription, nil
+}
+
+// transcribeChunks converts the audio at filePath to WAV, splits it into
+// chunks and transcribes each with IBM, for the job with the given id. Chunks
+// whose transcripts were checkpointed by an earlier attempt are not
+// transcribed again, and if every chunk's was, the audio is not even
+// converted.
+func transcribeChunks(ctx context.Context, id string, job Job, filePath string) ([]*IBMResult, error) {
+	var split splitCheckpoint
+	if loadCheckpoint(id, StageSplit, &split) {
+		if ibmResults := checkpointedChunks(id, split.Chunks); ibmResults != nil {
+			log.WithField("task", id).
+				Infof("Reusing the transcripts of all %d chunk(s) from an earlier attempt", split.Chunks)
+			for _, stage := range []string{StageConvert, StageSplit} {
+				if err := jobs.SkipStage(id, stage); err != nil {
+					log.WithField("task", id).
+						Errorf("Could not record that stage %s was skipped: %v", stage, err)
+				}
+			}
+			return ibmResults, nil
+		}
+	}
+
+	var wavPath string
+	var converting time.Duration
+	err := runStage(ctx, id, StageConvert, func(ctx context.Context) error {
+		start := time.Now()
+		var err error
+		wavPath, err = ConvertAudioIntoFormat(ctx, filePath, "wav")
+		// the conversions of the chunks to FLAC are added below
+		converting = time.Since(start)
+		if err != nil {
+			logCommandOutput(id, err)
+			return errors.Trace(err)
+		}
+		log.WithField("task", id).
+			Debugf("Converted file %s to %s", filePath, wavPath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(wavPath)
+	recordAudioLength(id, wavPath)
+
+	var wavPaths []string
+	err = runStage(ctx, id, StageSplit, func(ctx context.Context) error {
+		start := time.Now()
+		var err error
+		wavPaths, err = SplitWavFile(ctx, wavPath)
+		metrics.StageDuration.ObserveSince(start, "split")
+		if err != nil {
+			logCommandOutput(id, err)
+			return errors.Trace(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(wavPaths); i++ {
+		defer os.Remove(wavPaths[i])
+	}
+
+	log.WithField("task", id).
+		Debugf("Split file %s into %d file(s)", filePath, len(wavPaths))
+	if split.Chunks != 0 && split.Chunks != len(wavPaths) {
+		// the checkpoints are of chunks which no longer exist
+		if err := DiscardCheckpointsFrom(id, ChunkStage(0)); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	saveCheckpoint(id, StageSplit, splitCheckpoint{Chunks: len(wavPaths)})
+
+	ibmResults := []*IBMResult{}
+	reused := 0
+	var transcribing time.Duration
+	for i, wavPath := range wavPaths {
+		ibmResult := new(IBMResult)
+		if loadCheckpoint(id, ChunkStage(i), ibmResult) {
+			ibmResults = append(ibmResults, ibmResult)
+			reused++
+			continue
+		}
+
+		err := runStage(ctx, id, ChunkStage(i), func(ctx context.Context) error {
+			start := time.Now()
+			flacPath, err := ConvertAudioIntoFormat(ctx, wavPath, "flac")
+			converting += time.Since(start)
+			if err != nil {
+				logCommandOutput(id, err)
+				return errors.Trace(err)
+			}
+			defer os.Remove(flacPath)
+
+			log.WithField("task", id).
+				Debugf("Converted file %s to %s", wavPath, flacPath)
+
+			start = time.Now()
+			ibmResult, err = TranscribeWithIBM(ctx, flacPath, job.Language, job.SearchWords, config.Config.IBMUsername, config.Config.IBMPassword)
+			transcribing += time.Since(start)
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		saveCheckpoint(id, ChunkStage(i), ibmResult)
+		ibmResults = append(ibmResults, ibmResult)
+	}
+	if reused > 0 {
+		log.WithField("task", id).
+			Infof("Reused the transcripts of %d of %d chunk(s) from an earlier attempt", reused, len(wavPaths))
+	}
+	metrics.StageDuration.Observe(converting.Seconds(), "convert")
+	metrics.StageDuration.Observe(transcribing.Seconds(), "transcribe")
+	return ibmResults, nil
+}
+
+// checkpointedChunks returns the checkpointed transcripts of the n chunks of
+// the audio of the job with the given id, or nil unless there is one for
+// every chunk.
+func checkpointedChunks(id string, n int) []*IBMResult {
+	if n == 0 {
+		return nil
+	}
+	ibmResults := []*IBMResult{}
+	for i := 0; i < n; i++ {
+		ibmResult := new(IBMResult)
+		if !loadCheckpoint(id, ChunkStage(i), ibmResult) {
+			return nil
+		}
+		ibmResults = append(ibmResults, ibmResult)
+	}
+	return ibmResults
+}
+
+// recordAudioLength records the length of the WAV file at wavPath as the
+// length of the audio of the job with the given id.
+func recordAudioLength(id string, wavPath string) {
+	seconds, err := WavDuration(wavPath)
+	if err != nil {
+		log.WithField("task", id).
+			Warnf("Could not measure the length of %s: %v", wavPath, err)
+		return
+	}
+	metrics.AudioSeconds.Add(seconds)
+	if err := jobs.RecordAudio(id, seconds); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the length of the audio: %v", err)
+	}
+	log.WithField("task", id).
+		Debugf("Audio is %.1f seconds long", seconds)
+}
+
+// discardCheckpoints discards every checkpoint of the job with the given id,
+// which has stored its transcript.
+func discardCheckpoints(id string) {
+	if err := db.Checkpoints.DeleteJob(id); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not discard the job's checkpoints: %v", err)
+	}
+}
+
+// logCommandOutput logs the whole output of a command which failed while
+// running the job with the given id, since the error only carries its last
+// line.
+func logCommandOutput(id string, err error) {
+	if cmdErr, ok := errors.Cause(err).(*CommandError); ok {
+		log.WithField("task", id).
+			Errorf("%s output:\n%s", cmdErr.Command, cmdErr.Output)
+	}
+}
+
+// fetchAudio downloads the audio at source into the temporary directory if
+// source is a URL, or copies it there if local is set and source is a local
+// file.
+func fetchAudio(ctx context.Context, source string, local bool) (string, error) {
+	if isWebURL(source) {
+		return DownloadFileFromURL(ctx, source)
+	}
+	if !local {
+		return "", errors.NotValidf("audio url %q, which is not an http or https url,", source)
+	}
+	return CopyFileToTempDir(source)
+}
+
+// isWebURL reports whether source is an http or https URL.
+func isWebURL(source string) bool {
+	u, err := url.Parse(source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CopyFileToTempDir copies a local audio file into the temporary directory so
+// that intermediate files are not written next to it.
+func CopyFileToTempDir(filePath string) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer src.Close()
+
+	dir, err := tempDir()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	newPath := filepath.Join(dir, filepath.Base(filePath)+strconv.Itoa(int(time.Now().UnixNano())))
+	dst, err := os.Create(newPath)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(newPath)
+		return "", errors.Trace(err)
+	}
+	return newPath, nil
+}
+
+// linkExpiry is how long links to archived files sent to users stay valid.
+const linkExpiry = 7 * 24 * time.Hour
+
+// archive stores the audio file at filePath and the plain-text transcript
+// in storage.Default, recording their object names in transcription.
+func archive(id string, filePath string, transcription *db.Transcript) error {
+	audioObject := "audio/" + id + "/" + filepath.Base(filePath)
+	if err := storage.PutFile(storage.Default, audioObject, filePath); err != nil {
+		return errors.Trace(err)
+	}
+	transcription.AudioObject = audioObject
+
+	transcriptObject := "transcripts/" + id + ".txt"
+	if err := storage.Default.Put(transcriptObject, strings.NewReader(transcription.Transcript)); err != nil {
+		return errors.Trace(err)
+	}
+	transcription.TranscriptObject = transcriptObject
+	return nil
+}
+
+// NotifyBatchFinished emails the report of a finished batch to its summary
+// recipients.
+func NotifyBatchFinished(b *db.Batch) {
+	if len(config.Config.EmailUsername) == 0 || len(b.EmailAddresses) == 0 {
+		return
+	}
+	err := SendEmail(config.Config.EmailUsername, config.Config.EmailPassword, config.Config.EmailSMTPServer, config.Config.EmailPort, b.EmailAddresses, fmt.Sprintf("IBM Transcription Batch %s Complete", b.ID), batch.Report(b))
+	if err != nil {
+		log.WithField("batch", b.ID).
+			Errorf("Could not send summary email to %v because of the error %v", b.EmailAddresses, err.Error())
+		return
+	}
+	log.WithField("batch", b.ID).
+		Debugf("Sent summary email to %v", b.EmailAddresses)
+}
@@ -0,0 +1,85 @@
+package transcription
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func TestRerun(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "rerun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Queue, err = db.NewFileQueueRepository(filepath.Join(dir, "queue.json")); err != nil {
+		t.Fatal(err)
+	}
+	// queue the new job for workers rather than running it
+	defer func(c config.AppConfig) { config.Config = c }(config.Config)
+	config.Config.UseWorkers = true
+
+	j := &db.Job{
+		ID:        "old",
+		Owner:     "ada",
+		Org:       "hack4impact",
+		AudioURL:  "http://example.com/a.mp3",
+		Language:  "en-US",
+		Resumable: true,
+		Status:    tasks.SUCCESS.Name(),
+		Labels:    map[string]string{tasks.SourceLabel: "api", tasks.SubmitterLabel: "ada"},
+	}
+	id, err := Rerun(j, "ibm")
+	assert.NoError(err)
+	assert.NotEqual("old", id)
+	rerun, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal("ada", rerun.Owner)
+	assert.Equal("hack4impact", rerun.Org)
+	assert.Equal(j.AudioURL, rerun.AudioURL)
+	assert.True(rerun.Force)
+	assert.Equal("rerun", rerun.Labels[tasks.SourceLabel])
+	assert.Equal("ibm", rerun.Labels[tasks.EngineLabel])
+	assert.Equal("api", j.Labels[tasks.SourceLabel])
+	_, err = db.Queue.Get(id)
+	assert.NoError(err)
+
+	_, err = Rerun(j, "whisper")
+	assert.True(errors.IsNotValid(err))
+	_, err = Rerun(&db.Job{ID: "cli"}, "ibm")
+	assert.True(errors.IsNotValid(err))
+	_, err = Rerun(&db.Job{ID: "running", Resumable: true, Status: tasks.INPROGRESS.Name()}, "ibm")
+	assert.True(errors.IsNotValid(err))
+}
+
+func TestValidateOnlyAllowsLocalFilesIfAsked(t *testing.T) {
+	assert := assert.New(t)
+	for _, source := range []string{"/etc/passwd", "file:///etc/passwd", "ftp://example.com/a.mp3", "http:/a.mp3"} {
+		job := Job{AudioURL: source, Language: "en-US"}
+		assert.True(errors.IsNotValid(job.Validate()), source)
+		_, err := fetchAudio(context.Background(), source, false)
+		assert.True(errors.IsNotValid(err), source)
+	}
+	assert.NoError(Job{AudioURL: "https://example.com/a.mp3", Language: "en-US"}.Validate())
+	assert.NoError(Job{AudioURL: "/srv/in/talk.mp3", Language: "en-US", LocalFile: true}.Validate())
+}
+
+func TestRecipientsSkipsBlankAddresses(t *testing.T) {
+	assert := assert.New(t)
+	assert.Empty(recipients(nil))
+	assert.Empty(recipients([]string{"", " "}))
+	assert.Equal([]string{"ada@example.com"}, recipients([]string{"", " ada@example.com"}))
+}
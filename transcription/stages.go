@@ -0,0 +1,176 @@
+package transcription
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are the stages of the transcription pipeline, in the order they run.
+// The audio is transcribed in chunks, each by a stage named by ChunkStage,
+// between StageSplit and StageMerge.
+const (
+	StageFetch   = "fetch"
+	StageConvert = "convert"
+	StageSplit   = "split"
+	StageMerge   = "merge"
+	StageArchive = "archive"
+	StageStore   = "store"
+	StageNotify  = "notify"
+)
+
+// chunkStagePrefix begins the names of the stages transcribing chunks.
+const chunkStagePrefix = "transcribe-chunk-"
+
+// stages lists the stages in order, with chunkStagePrefix standing for those
+// transcribing chunks.
+var stages = []string{StageFetch, StageConvert, StageSplit, chunkStagePrefix, StageMerge, StageArchive, StageStore, StageNotify}
+
+// ChunkStage returns the name of the stage transcribing the chunk of the
+// audio with the given index, counting from zero, e.g. "transcribe-chunk-1"
+// for the first chunk.
+func ChunkStage(i int) string {
+	return chunkStagePrefix + strconv.Itoa(i+1)
+}
+
+// stagePosition returns where the named stage comes in the pipeline: its
+// index in stages and, for the stages transcribing chunks, the chunk's
+// number.
+func stagePosition(name string) (int, int, error) {
+	stage, chunk := name, 0
+	if strings.HasPrefix(name, chunkStagePrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, chunkStagePrefix))
+		if err != nil || n < 1 {
+			return 0, 0, errors.NotValidf("stage %q", name)
+		}
+		stage, chunk = chunkStagePrefix, n
+	}
+	for i, s := range stages {
+		if s == stage {
+			return i, chunk, nil
+		}
+	}
+	return 0, 0, errors.NotValidf("stage %q", name)
+}
+
+// runStage runs fn as the named stage of the job with the given id, recording
+// when it starts and how it finishes on the job's record, and reporting its
+// start as the task's progress. fn is passed a context derived from ctx, the
+// attempt's context from NewRunContext, which ends when the stage runs out of
+// time; the stage fails with a tasks.TimeoutError if it or the attempt does.
+// Stages are not started once the attempt has run out of time.
+func runStage(ctx context.Context, id string, name string, fn func(ctx context.Context) error) error {
+	limit := timeoutsOf(ctx).stage(name)
+	stageCtx, cancel := ctx, context.CancelFunc(func() {})
+	if limit > 0 {
+		stageCtx, cancel = context.WithTimeout(ctx, limit)
+	}
+	defer cancel()
+
+	tasks.DefaultTaskExecuter.ReportProgress(id, "Stage "+name+" started")
+	if err := jobs.StartStage(id, name); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the start of stage %s: %v", name, err)
+	}
+	var err error
+	ran := ctx.Err() == nil
+	if ran {
+		err = fn(stageCtx)
+	}
+	err = stageError(ctx, stageCtx, name, limit, ran, err)
+	if err := jobs.FinishStage(id, name, err); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not record the end of stage %s: %v", name, err)
+	}
+	if tasks.IsTimeout(err) {
+		log.WithField("task", id).
+			Warnf("Stage %s timed out: %v", name, errors.Cause(err))
+	} else if err != nil {
+		log.WithField("task", id).
+			Warnf("Stage %s failed", name)
+	}
+	return err
+}
+
+// fetchCheckpoint is the output of StageFetch which is kept. The other
+// checkpoints are only valid for the audio with the same content key.
+type fetchCheckpoint struct {
+	ContentKey string `json:"contentKey"`
+}
+
+// splitCheckpoint is the output of StageSplit which is kept.
+type splitCheckpoint struct {
+	Chunks int `json:"chunks"`
+}
+
+// archiveCheckpoint is the output of StageArchive.
+type archiveCheckpoint struct {
+	AudioObject      string `json:"audioObject"`
+	TranscriptObject string `json:"transcriptObject"`
+}
+
+// loadCheckpoint reads the checkpoint of the named stage of the job with the
+// given id into v, reporting whether there is one.
+func loadCheckpoint(id string, stage string, v interface{}) bool {
+	cp, err := db.Checkpoints.Get(id, stage)
+	if errors.IsNotFound(err) {
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(cp.Data), v)
+	}
+	if err != nil {
+		// the stage can still run again
+		log.WithField("task", id).
+			Errorf("Could not read the checkpoint of stage %s: %v", stage, err)
+		return false
+	}
+	return true
+}
+
+// saveCheckpoint stores v as the output of the named stage of the job with
+// the given id. Failing to do so only costs time if the job is retried, so
+// it is logged rather than failing the job.
+func saveCheckpoint(id string, stage string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = db.Checkpoints.Put(&db.Checkpoint{Job: id, Stage: stage, Data: string(data), CreatedAt: time.Now()})
+	}
+	if err != nil {
+		log.WithField("task", id).
+			Errorf("Could not checkpoint stage %s: %v", stage, err)
+	}
+}
+
+// DiscardCheckpointsFrom discards the checkpoints of the named stage of the
+// job with the given id and of the stages after it, so that they run again
+// when the job is retried.
+func DiscardCheckpointsFrom(id string, stage string) error {
+	from, fromChunk, err := stagePosition(stage)
+	if err != nil {
+		return err
+	}
+	checkpoints, err := db.Checkpoints.List(id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, cp := range checkpoints {
+		i, chunk, err := stagePosition(cp.Stage)
+		if err != nil || i < from || (i == from && chunk < fromChunk) {
+			continue
+		}
+		if err := db.Checkpoints.Delete(id, cp.Stage); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
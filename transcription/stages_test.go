@@ -0,0 +1,41 @@
+package transcription
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestDiscardCheckpointsFrom(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if db.Checkpoints, err = db.NewFileCheckpointRepository(filepath.Join(dir, "checkpoints.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stage := range []string{StageFetch, StageSplit, ChunkStage(0), ChunkStage(1), ChunkStage(9), StageArchive} {
+		saveCheckpoint("job", stage, struct{}{})
+	}
+	assert.NoError(DiscardCheckpointsFrom("job", ChunkStage(1)))
+	list, err := db.Checkpoints.List("job")
+	assert.NoError(err)
+	kept := []string{}
+	for _, cp := range list {
+		kept = append(kept, cp.Stage)
+	}
+	assert.Equal([]string{"fetch", "split", "transcribe-chunk-1"}, kept)
+
+	for _, stage := range []string{"transcribe-chunk-0", "transcribe-chunk-x", "upload"} {
+		assert.True(errors.IsNotValid(DiscardCheckpointsFrom("job", stage)), stage)
+	}
+}
@@ -0,0 +1,142 @@
+package transcription
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// ChunkStages stands for every stage transcribing a chunk of the audio in
+// time limits, e.g. in StageTimeoutMinutes.
+const ChunkStages = "transcribe-chunk"
+
+// DefaultJobTimeout is how long each attempt at a job may run, unless
+// JobTimeoutMinutes or the job says otherwise.
+const DefaultJobTimeout = 12 * time.Hour
+
+// DefaultStageTimeouts is how long each stage may run, unless
+// StageTimeoutMinutes or the job says otherwise. Transcribing a chunk takes
+// about as long as the chunk, which is at most 50 minutes of audio.
+var DefaultStageTimeouts = map[string]time.Duration{
+	StageFetch:   30 * time.Minute,
+	StageConvert: 30 * time.Minute,
+	StageSplit:   30 * time.Minute,
+	ChunkStages:  2 * time.Hour,
+	StageMerge:   5 * time.Minute,
+	StageArchive: 30 * time.Minute,
+	StageStore:   5 * time.Minute,
+	StageNotify:  5 * time.Minute,
+}
+
+// timeouts holds the time limits of an attempt at a job and of its stages.
+type timeouts struct {
+	job    time.Duration
+	stages map[string]time.Duration
+}
+
+// stage returns the time limit of the named stage.
+func (t timeouts) stage(name string) time.Duration {
+	if strings.HasPrefix(name, chunkStagePrefix) {
+		name = ChunkStages
+	}
+	return t.stages[name]
+}
+
+// timeouts returns the time limits of the job: the defaults, overridden by
+// those configured, overridden by the job's own. Zero means no override.
+func (job Job) timeouts() timeouts {
+	t := timeouts{job: DefaultJobTimeout, stages: make(map[string]time.Duration)}
+	for name, d := range DefaultStageTimeouts {
+		t.stages[name] = d
+	}
+	for _, override := range []struct {
+		job    int
+		stages map[string]int
+	}{
+		{config.Config.JobTimeoutMinutes, config.Config.StageTimeoutMinutes},
+		{job.TimeoutMinutes, job.StageTimeoutMinutes},
+	} {
+		if override.job > 0 {
+			t.job = time.Duration(override.job) * time.Minute
+		}
+		for name, minutes := range override.stages {
+			if minutes > 0 {
+				t.stages[name] = time.Duration(minutes) * time.Minute
+			}
+		}
+	}
+	return t
+}
+
+// ValidateTimeouts checks time limits given in minutes for a job and for
+// its stages, by name, as in JobTimeoutMinutes and StageTimeoutMinutes.
+func ValidateTimeouts(jobMinutes int, stageMinutes map[string]int) error {
+	if jobMinutes < 0 {
+		return errors.NotValidf("negative job time limit of %d minutes", jobMinutes)
+	}
+	for name, minutes := range stageMinutes {
+		if _, ok := DefaultStageTimeouts[name]; !ok {
+			return errors.NotValidf("time limit for stage %q (the stages are %s)", name,
+				strings.Join([]string{StageFetch, StageConvert, StageSplit, ChunkStages, StageMerge, StageArchive, StageStore, StageNotify}, ", "))
+		}
+		if minutes < 0 {
+			return errors.NotValidf("negative time limit of %d minutes for stage %q", minutes, name)
+		}
+	}
+	return nil
+}
+
+type timeoutsKey struct{}
+
+// NewRunContext returns the context of an attempt at job, which ends when
+// the attempt runs out of time, StopCommands is called or parent ends, and
+// carries the time limits of the job's stages for runStage.
+func NewRunContext(parent context.Context, job Job) (context.Context, context.CancelFunc) {
+	t := job.timeouts()
+	ctx, cancel := context.WithTimeout(context.WithValue(parent, timeoutsKey{}, t), t.job)
+	go func() {
+		select {
+		case <-commands.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// timeoutsOf returns the time limits carried by ctx, or none if it was not
+// made by NewRunContext.
+func timeoutsOf(ctx context.Context) timeouts {
+	t, _ := ctx.Value(timeoutsKey{}).(timeouts)
+	return t
+}
+
+// stageError returns the error of the named stage, which finished with err
+// with the context stageCtx, derived from the attempt's context ctx, or did
+// not run if ran is false: tasks.ErrInterrupted if StopCommands was called
+// or the attempt was cancelled, or a tasks.TimeoutError if the attempt or the
+// stage ran out of time.
+func stageError(ctx context.Context, stageCtx context.Context, name string, limit time.Duration, ran bool, err error) error {
+	if ran && err == nil {
+		return nil
+	}
+	switch {
+	case commands.Err() != nil:
+		return errors.Trace(tasks.ErrInterrupted)
+	case ctx.Err() == context.DeadlineExceeded:
+		return errors.Trace(&tasks.TimeoutError{What: "the job, during stage " + name + ",", Limit: timeoutsOf(ctx).job})
+	case stageCtx.Err() == context.DeadlineExceeded:
+		return errors.Trace(&tasks.TimeoutError{What: "stage " + name, Limit: limit})
+	case ctx.Err() == context.Canceled:
+		// e.g. a worker lost the job's lease
+		return errors.Trace(tasks.ErrInterrupted)
+	case !ran:
+		return errors.Trace(ctx.Err())
+	}
+	return err
+}
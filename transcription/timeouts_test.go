@@ -0,0 +1,107 @@
+package transcription
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func TestJobTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	defer func(c config.AppConfig) { config.Config = c }(config.Config)
+	config.Config.JobTimeoutMinutes = 60
+	config.Config.StageTimeoutMinutes = map[string]int{StageConvert: 10, ChunkStages: 90}
+
+	to := Job{StageTimeoutMinutes: map[string]int{ChunkStages: 0, StageFetch: 5}}.timeouts()
+	assert.Equal(time.Hour, to.job)
+	assert.Equal(5*time.Minute, to.stage(StageFetch))
+	assert.Equal(10*time.Minute, to.stage(StageConvert))
+	assert.Equal(90*time.Minute, to.stage(ChunkStage(3)))
+	assert.Equal(DefaultStageTimeouts[StageStore], to.stage(StageStore))
+
+	assert.Equal(2*time.Hour, Job{TimeoutMinutes: 120}.timeouts().job)
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(ValidateTimeouts(0, nil))
+	assert.NoError(ValidateTimeouts(60, map[string]int{ChunkStages: 90, StageNotify: 0}))
+	assert.True(errors.IsNotValid(ValidateTimeouts(-1, nil)))
+	assert.True(errors.IsNotValid(ValidateTimeouts(0, map[string]int{StageConvert: -5})))
+	assert.True(errors.IsNotValid(ValidateTimeouts(0, map[string]int{ChunkStage(0): 5})))
+}
+
+func TestStageTimeout(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "timeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "job"}))
+
+	to := timeouts{job: time.Hour, stages: map[string]time.Duration{StageConvert: 10 * time.Millisecond}}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), timeoutsKey{}, to), to.job)
+	defer cancel()
+	err = runStage(ctx, "job", StageConvert, func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.Trace(ctx.Err())
+	})
+	assert.True(tasks.IsTimeout(err))
+	assert.Equal("stage convert exceeded its time limit of 10ms", errors.Cause(err).Error())
+
+	// stages without a limit only stop when the attempt does
+	err = runStage(ctx, "job", StageSplit, func(ctx context.Context) error { return nil })
+	assert.NoError(err)
+
+	j, err := db.Jobs.Get("job")
+	assert.NoError(err)
+	if assert.Len(j.Stages, 2) {
+		assert.Equal(tasks.TIMEDOUT.Name(), j.Stages[0].Status)
+		assert.Equal(tasks.SUCCESS.Name(), j.Stages[1].Status)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	assert := assert.New(t)
+	to := timeouts{job: 10 * time.Millisecond, stages: map[string]time.Duration{}}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), timeoutsKey{}, to), to.job)
+	defer cancel()
+	<-ctx.Done()
+
+	ran := false
+	err := runStage(ctx, "unknown", StageMerge, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	assert.False(ran)
+	assert.True(tasks.IsTimeout(err))
+	assert.Equal("the job, during stage merge, exceeded its time limit of 10ms", errors.Cause(err).Error())
+}
+
+func TestRunContextEndsWithParent(t *testing.T) {
+	assert := assert.New(t)
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := NewRunContext(parent, Job{})
+	defer cancel()
+	assert.Equal(DefaultJobTimeout, timeoutsOf(ctx).job)
+	assert.NoError(ctx.Err())
+
+	cancelParent()
+	<-ctx.Done()
+	err := runStage(ctx, "unknown", StageMerge, func(ctx context.Context) error { return nil })
+	assert.Equal(tasks.ErrInterrupted, errors.Cause(err))
+}
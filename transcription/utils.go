@@ -5,8 +5,9 @@
 package transcription
 
 import (
-	"fmt"
+	"context"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/smtp"
 	"os"
@@ -14,16 +15,14 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"gopkg.in/kothar/go-backblaze.v0"
-	"gopkg.in/mgo.v2"
-
-	log "github.com/Sirupsen/logrus"
 	"github.com/jordan-wright/email"
 	"github.com/juju/errors"
 
 	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/tasks"
 )
 
 // SendEmail connects to an email server at host:port and sends an email from
@@ -44,24 +43,95 @@ func SendEmail(username string, password string, host string, port int, to []str
 	return nil
 }
 
-// ConvertAudioIntoFormat converts encoded audio into the required format.
-func ConvertAudioIntoFormat(filePath, fileExt string) (string, error) {
+// commands is the context of the external commands run by the package.
+var commands, stopCommands = context.WithCancel(context.Background())
+
+// StopCommands kills the external commands, such as ffmpeg, which are
+// running, and makes those started afterwards fail.
+func StopCommands() {
+	stopCommands()
+}
+
+// runCommand runs cmd and returns everything it wrote. Its output goes to a
+// file rather than a pipe, so that when it is killed the wait for it does not
+// hang on processes it started which still hold the output open.
+func runCommand(cmd *exec.Cmd) ([]byte, error) {
+	dir, err := tempDir()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	file, err := ioutil.TempFile(dir, "output")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	cmd.Stdout = file
+	cmd.Stderr = file
+	runErr := cmd.Run()
+	out, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return out, runErr
+}
+
+// ConvertAudioIntoFormat converts encoded audio into the required format. The
+// conversion is stopped when ctx ends.
+func ConvertAudioIntoFormat(ctx context.Context, filePath, fileExt string) (string, error) {
 	// http://cmusphinx.sourceforge.net/wiki/faq
 	// -ar 16000 sets frequency to required 16khz
 	// -ac 1 sets the number of audio channels to 1
 	newPath := filePath + "." + fileExt
 	os.Remove(newPath) // If it already exists, ffmpeg will throw an error
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-ar", "16000", "-ac", "1", newPath)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return "", errors.New(err.Error() + "\nCommand Output:" + string(out))
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", filePath, "-ar", "16000", "-ac", "1", newPath)
+	if out, err := runCommand(cmd); err != nil {
+		return "", commandError(ctx, "ffmpeg", err, out)
 	}
 	return newPath, nil
 }
 
-// DownloadFileFromURL locally downloads an audio file stored at url.
-func DownloadFileFromURL(url string) (string, error) {
+// CommandError is returned when an external command such as ffmpeg fails.
+type CommandError struct {
+	Command string
+	Err     error
+	// Output is everything the command wrote.
+	Output string
+}
+
+// Error returns the command's error followed by the last line of its
+// output, which usually explains the error.
+func (e *CommandError) Error() string {
+	message := e.Command + " failed: " + e.Err.Error()
+	lines := strings.Split(strings.TrimSpace(e.Output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		message += ": " + last
+	}
+	return message
+}
+
+// commandError returns the error of a command run with the context ctx which
+// failed with err and wrote output, tasks.ErrInterrupted if StopCommands
+// killed it, or the context's error if it was killed because ctx ended.
+func commandError(ctx context.Context, command string, err error, output []byte) error {
+	if commands.Err() != nil {
+		return errors.Trace(tasks.ErrInterrupted)
+	}
+	if ctx.Err() != nil {
+		return errors.Trace(ctx.Err())
+	}
+	return &CommandError{Command: command, Err: err, Output: string(output)}
+}
+
+// DownloadFileFromURL locally downloads an audio file stored at url. The
+// download is stopped when ctx ends.
+func DownloadFileFromURL(ctx context.Context, url string) (string, error) {
 	// Taken from https://github.com/thbar/golang-playground/blob/master/download-files.go
-	filePath := filePathFromURL(url)
+	dir, err := tempDir()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	filePath := filepath.Join(dir, filePathFromURL(url))
 	file, err := os.Create(filePath)
 	if err != nil {
 		return "", errors.Trace(err)
@@ -69,7 +139,12 @@ func DownloadFileFromURL(url string) (string, error) {
 	defer file.Close()
 
 	// Get file contents
-	response, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
@@ -94,8 +169,92 @@ func filePathFromURL(url string) string {
 	return filePath
 }
 
+// processTempDir is the directory of this process within the temporary
+// directory, so that it can clean up after itself without touching the files
+// of other processes sharing the temporary directory.
+var processTempDir struct {
+	sync.Mutex
+	path string
+}
+
+// tempDir returns the directory in which intermediate audio files are
+// written, creating it if necessary.
+func tempDir() (string, error) {
+	processTempDir.Lock()
+	defer processTempDir.Unlock()
+	if processTempDir.path != "" {
+		return processTempDir.path, nil
+	}
+
+	base := tempBase()
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	dir, err := ioutil.TempDir(base, "process")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	processTempDir.path = dir
+	return dir, nil
+}
+
+// tempBase returns the temporary directory shared by every process, which
+// holds a directory for each.
+func tempBase() string {
+	if config.Config.TempDir != "" {
+		return config.Config.TempDir
+	}
+	return filepath.Join(os.TempDir(), "transcribe4all")
+}
+
+// TempUsage describes the files in the temporary directory.
+type TempUsage struct {
+	Dir   string
+	Files int
+	Bytes int64
+}
+
+// GetTempUsage returns how many intermediate files there are in the temporary
+// directory, including those of other processes sharing it and those left
+// behind by processes which crashed, and how much space they take up.
+func GetTempUsage() (TempUsage, error) {
+	u := TempUsage{Dir: tempBase()}
+	err := filepath.Walk(u.Dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// the directory has not been created yet, or a job removed
+			// the file while it was being walked
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			u.Files++
+			u.Bytes += info.Size()
+		}
+		return nil
+	})
+	return u, errors.Trace(err)
+}
+
+// RemoveTempFiles removes the intermediate files written by this process,
+// including those of jobs which are still running.
+func RemoveTempFiles() error {
+	processTempDir.Lock()
+	defer processTempDir.Unlock()
+	if processTempDir.path == "" {
+		return nil
+	}
+	if err := os.RemoveAll(processTempDir.path); err != nil {
+		return errors.Trace(err)
+	}
+	processTempDir.path = ""
+	return nil
+}
+
 // SplitWavFile ensures that the input audio files to IBM are less than 100mb, with 5 seconds of redundancy between files.
-func SplitWavFile(wavFilePath string) ([]string, error) {
+// Splitting is stopped when ctx ends.
+func SplitWavFile(ctx context.Context, wavFilePath string) ([]string, error) {
 	// http://stackoverflow.com/questions/36632511/split-audio-file-into-several-files-each-below-a-size-threshold
 	// The Stack Overflow answer ultimately calculated the length of each audio chunk in seconds.
 	// chunk_length_in_sec = math.ceil((duration_in_sec * file_split_size ) / wav_file_size)
@@ -121,8 +280,8 @@ func SplitWavFile(wavFilePath string) ([]string, error) {
 		if i > 0 {
 			startingSecond -= 5
 		}
-		newFilePath := strconv.Itoa(i) + "_" + wavFilePath
-		if err := extractAudioSegment(wavFilePath, newFilePath, startingSecond, chunkLengthInSeconds); err != nil {
+		newFilePath := filepath.Join(filepath.Dir(wavFilePath), strconv.Itoa(i)+"_"+filepath.Base(wavFilePath))
+		if err := extractAudioSegment(ctx, wavFilePath, newFilePath, startingSecond, chunkLengthInSeconds); err != nil {
 			return []string{}, errors.Trace(err)
 		}
 		names[i] = newFilePath
@@ -153,191 +312,11 @@ func getNumChunks(filePath string) (int, error) {
 }
 
 // extractAudioSegment uses FFMPEG to write a new audio file starting at a given time of a given length
-func extractAudioSegment(inFilePath string, outFilePath string, ss int, t int) error {
+func extractAudioSegment(ctx context.Context, inFilePath string, outFilePath string, ss int, t int) error {
 	// -ss: starting second, -t: duration in seconds
-	cmd := exec.Command("ffmpeg", "-i", inFilePath, "-ss", strconv.Itoa(ss), "-t", strconv.Itoa(t), outFilePath)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.New(err.Error() + "\nOutput:\n" + string(out))
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", inFilePath, "-ss", strconv.Itoa(ss), "-t", strconv.Itoa(t), outFilePath)
+	if out, err := runCommand(cmd); err != nil {
+		return commandError(ctx, "ffmpeg", err, out)
 	}
 	return nil
 }
-
-// MakeIBMTaskFunction returns a task function for transcription using IBM transcription functions.
-// TODO(#52): Quite a lot of the transcription process could be done concurrently.
-func MakeIBMTaskFunction(audioURL string, emailAddresses []string, searchWords []string) (task func(string) error, onFailure func(string, string)) {
-	task = func(id string) error {
-		filePath, err := DownloadFileFromURL(audioURL)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		defer os.Remove(filePath)
-
-		log.WithField("task", id).
-			Debugf("Downloaded file at %s to %s", audioURL, filePath)
-
-		wavPath, err := ConvertAudioIntoFormat(filePath, "wav")
-		if err != nil {
-			return errors.Trace(err)
-		}
-		defer os.Remove(wavPath)
-
-		log.WithField("task", id).
-			Debugf("Converted file %s to %s", filePath, wavPath)
-
-		wavPaths, err := SplitWavFile(wavPath)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		for i := 0; i < len(wavPaths); i++ {
-			defer os.Remove(wavPaths[i])
-		}
-
-		log.WithField("task", id).
-			Debugf("Split file %s into %d file(s)", filePath, len(wavPaths))
-
-		ibmResults := []*IBMResult{}
-
-		for _, wavPath := range wavPaths {
-			flacPath, err := ConvertAudioIntoFormat(wavPath, "flac")
-			if err != nil {
-				return errors.Trace(err)
-			}
-			defer os.Remove(flacPath)
-
-			log.WithField("task", id).
-				Debugf("Converted file %s to %s", wavPath, flacPath)
-
-			ibmResult, err := TranscribeWithIBM(flacPath, searchWords, config.Config.IBMUsername, config.Config.IBMPassword)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			ibmResults = append(ibmResults, ibmResult)
-		}
-		transcription := GetTranscription(ibmResults)
-
-		if len(config.Config.BackblazeAccountID) > 0 {
-			audioURL, err := UploadFileToBackblaze(filePath, config.Config.BackblazeAccountID, config.Config.BackblazeApplicationKey, config.Config.BackblazeBucket)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			transcription.AudioURL = audioURL
-			log.WithField("task", id).
-				Debugf("Uploaded %s to backblaze", filePath)
-		}
-
-		if len(config.Config.MongoURL) > 0 {
-			if err := WriteToMongo(transcription, config.Config.MongoURL); err != nil {
-				return errors.Trace(err)
-			}
-			log.WithField("task", id).
-				Debugf("Wrote to mongo")
-		}
-
-		if len(config.Config.EmailUsername) > 0 {
-			if err := SendEmail(config.Config.EmailUsername, config.Config.EmailPassword, config.Config.EmailSMTPServer, config.Config.EmailPort, emailAddresses, fmt.Sprintf("IBM Transcription %s Complete", id), "The transcript is below. It can also be found in the database."+"\n\n"+transcription.Transcript); err != nil {
-				return errors.Trace(err)
-			}
-		}
-
-		log.WithField("task", id).
-			Debugf("Sent email to %v", emailAddresses)
-		return nil
-	}
-
-	onFailure = func(id string, errMessage string) {
-		err := SendEmail(config.Config.EmailUsername, config.Config.EmailPassword, "smtp.gmail.com", 587, emailAddresses, fmt.Sprintf("IBM Transcription %s Failed", id), errMessage)
-		if err != nil {
-			log.WithField("task", id).
-				Debugf("Could not send error email to %v because of the error %v", emailAddresses, err.Error())
-			return
-		}
-		log.WithField("task", id).
-			Debugf("Sent email to %v", emailAddresses)
-	}
-	return task, onFailure
-}
-
-// UploadFileToBackblaze uploads the given gile to the given backblaze bucket
-func UploadFileToBackblaze(filePath string, accountID string, applicationKey string, bucketName string) (string, error) {
-	b2, err := backblaze.NewB2(backblaze.Credentials{
-		AccountID:      accountID,
-		ApplicationKey: applicationKey,
-	})
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	bucket, err := b2.Bucket(bucketName)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	name := filepath.Base(filePath)
-	metadata := make(map[string]string) // empty metadata
-
-	_, err = bucket.UploadFile(name, metadata, file)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	url, err := bucket.FileURL(name)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	return url, nil
-}
-
-type mgoLogger struct{}
-
-func (mgoLogger) Output(_ int, s string) error {
-	log.Debug(s)
-	return nil
-}
-
-// Transcription contains the full transcription and other information.
-type Transcription struct {
-	Transcript  string
-	AudioURL    string
-	CompletedAt time.Time
-	Timestamps  []timestamp
-	Confidences []confidence
-	Keywords    []ibmKeywordResult
-}
-
-type timestamp struct {
-	Word      string
-	StartTime float64
-	EndTime   float64
-}
-
-type confidence struct {
-	Word  string
-	Score float64
-}
-
-// WriteToMongo takes a string and writes it to the database
-func WriteToMongo(data *Transcription, url string) error {
-	mgo.SetLogger(mgoLogger{})
-	session, err := mgo.Dial(url)
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-
-	session.SetMode(mgo.Monotonic, true)
-
-	c := session.DB("database").C("transcriptions")
-
-	// Insert data
-	err = c.Insert(&data)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,37 @@
+package transcription
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/config"
+)
+
+func TestGetTempUsage(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(c config.AppConfig) { config.Config = c }(config.Config)
+	config.Config.TempDir = filepath.Join(dir, "temp")
+
+	u, err := GetTempUsage()
+	assert.NoError(err)
+	assert.Equal(TempUsage{Dir: config.Config.TempDir}, u)
+
+	for _, path := range []string{"process1/a.wav", "process1/b.flac", "process2/c.mp3"} {
+		path = filepath.Join(config.Config.TempDir, path)
+		assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(ioutil.WriteFile(path, make([]byte, 100), 0644))
+	}
+	u, err = GetTempUsage()
+	assert.NoError(err)
+	assert.Equal(3, u.Files)
+	assert.Equal(int64(300), u.Bytes)
+}
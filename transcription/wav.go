@@ -0,0 +1,71 @@
+package transcription
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// WavDuration returns the length in seconds of the audio in the WAV file at
+// path, read from the file's header.
+func WavDuration(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return 0, errors.NotValidf("WAV file %s", path)
+	}
+
+	var byteRate uint32
+	offset := int64(12)
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(file, chunk); err != nil {
+			return 0, errors.NotValidf("WAV file %s without audio data", path)
+		}
+		offset += 8
+		id, size := string(chunk[:4]), binary.LittleEndian.Uint32(chunk[4:])
+		switch id {
+		case "fmt ":
+			format := make([]byte, 12)
+			if _, err := io.ReadFull(file, format); err != nil {
+				return 0, errors.NotValidf("WAV file %s", path)
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+			if _, err := file.Seek(offset+int64(size), io.SeekStart); err != nil {
+				return 0, errors.Trace(err)
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0, errors.NotValidf("WAV file %s without a format", path)
+			}
+			// a writer which could not seek back leaves the size unset
+			if size == 0 || size == 0xFFFFFFFF || offset+int64(size) > stat.Size() {
+				size = uint32(stat.Size() - offset)
+			}
+			return float64(size) / float64(byteRate), nil
+		default:
+			if _, err := file.Seek(int64(size), io.SeekCurrent); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+		offset += int64(size)
+		// chunks are padded to an even length
+		if size%2 == 1 {
+			offset++
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+	}
+}
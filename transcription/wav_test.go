@@ -0,0 +1,72 @@
+package transcription
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeWav writes a mono 16 kHz, 16 bit WAV file holding the given number of
+// seconds of silence, with a LIST chunk before the audio like ffmpeg writes.
+func writeWav(t *testing.T, seconds int, dataSize uint32) string {
+	var b bytes.Buffer
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	samples := make([]byte, seconds*32000)
+
+	b.WriteString("RIFF")
+	le(uint32(0))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	le(uint32(16))
+	le(uint16(1))     // PCM
+	le(uint16(1))     // channels
+	le(uint32(16000)) // sample rate
+	le(uint32(32000)) // byte rate
+	le(uint16(2))     // block align
+	le(uint16(16))    // bits per sample
+	b.WriteString("LIST")
+	le(uint32(3))
+	b.WriteString("abc\x00") // padded to an even length
+	b.WriteString("data")
+	le(dataSize)
+	b.Write(samples)
+
+	file, err := ioutil.TempFile("", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestWavDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	path := writeWav(t, 3, 3*32000)
+	defer os.Remove(path)
+	seconds, err := WavDuration(path)
+	assert.NoError(err)
+	assert.Equal(3.0, seconds)
+
+	// streamed files have no data size
+	streamed := writeWav(t, 2, 0xFFFFFFFF)
+	defer os.Remove(streamed)
+	seconds, err = WavDuration(streamed)
+	assert.NoError(err)
+	assert.Equal(2.0, seconds)
+
+	notWav, err := ioutil.TempFile("", "wav")
+	assert.NoError(err)
+	notWav.WriteString("ID3 not a wav file")
+	notWav.Close()
+	defer os.Remove(notWav.Name())
+	_, err = WavDuration(notWav.Name())
+	assert.Error(err)
+}
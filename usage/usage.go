@@ -0,0 +1,241 @@
+// Package usage meters the audio minutes transcribed each month and enforces
+// monthly quotas.
+package usage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// Quotas are the audio minutes which may be transcribed each month. Zero
+// means no limit. An API key's MonthlyMinutes overrides PerAPIKey.
+type Quotas struct {
+	Instance  int
+	PerUser   int
+	PerAPIKey int
+}
+
+// Limits are the quotas enforced by Check.
+var Limits Quotas
+
+// MonthStart returns the start of the month containing t, in UTC.
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// QuotaError is returned by Check when a quota has been used up.
+type QuotaError struct {
+	// Scope names whose quota was used up, e.g. "this API key".
+	Scope   string
+	Minutes int
+	Resets  time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("the monthly quota of %d audio minutes for %s has been used up; it resets on %s",
+		e.Minutes, e.Scope, e.Resets.Format("January 2, 2006"))
+}
+
+// IsQuotaExceeded reports whether err was caused by a used up quota.
+func IsQuotaExceeded(err error) bool {
+	_, ok := errors.Cause(err).(*QuotaError)
+	return ok
+}
+
+// Check returns a *QuotaError if the instance, the user with the given id or
+// the API key k, either of which may be empty, has used up its quota for the
+// month containing now. The length of audio is only known once a job has run,
+// so a job is accepted as long as some quota is left.
+func Check(userID string, k *db.APIKey, now time.Time) error {
+	keyQuota := Limits.PerAPIKey
+	if k != nil && k.MonthlyMinutes > 0 {
+		keyQuota = k.MonthlyMinutes
+	}
+	if Limits.Instance == 0 && (userID == "" || Limits.PerUser == 0) && (k == nil || keyQuota == 0) {
+		return nil
+	}
+
+	start := MonthStart(now)
+	keyID := ""
+	if k != nil {
+		keyID = k.ID
+	}
+	used, err := db.Jobs.SumAudio(db.JobFilter{CreatedSince: start}, userID, keyID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resets := start.AddDate(0, 1, 0)
+	switch {
+	case exceeded(used.All, Limits.Instance):
+		return &QuotaError{"this service", Limits.Instance, resets}
+	case userID != "" && exceeded(used.Owner, Limits.PerUser):
+		return &QuotaError{"your account", Limits.PerUser, resets}
+	case k != nil && exceeded(used.APIKey, keyQuota):
+		return &QuotaError{"this API key", keyQuota, resets}
+	}
+	return nil
+}
+
+func exceeded(seconds float64, quota int) bool {
+	return quota > 0 && seconds >= float64(quota)*60
+}
+
+// Row is the usage of one user, API key or organization, or of the whole
+// instance, in a month.
+type Row struct {
+	// Kind is "total", "user", "apikey" or "org".
+	Kind         string  `json:"kind"`
+	ID           string  `json:"id,omitempty"`
+	Name         string  `json:"name,omitempty"`
+	Jobs         int     `json:"jobs"`
+	AudioMinutes float64 `json:"audioMinutes"`
+	// QuotaMinutes is the applicable quota, or zero if there is none.
+	QuotaMinutes int `json:"quotaMinutes,omitempty"`
+}
+
+// Report is the usage in a month, broken down by user, API key and
+// organization.
+type Report struct {
+	Month   string `json:"month"`
+	Total   Row    `json:"total"`
+	Users   []Row  `json:"users"`
+	APIKeys []Row  `json:"apiKeys"`
+	Orgs    []Row  `json:"orgs"`
+}
+
+// MonthlyReport returns the usage in the month containing t. If org is not
+// empty, only the jobs of that organization are counted.
+func MonthlyReport(t time.Time, org string) (*Report, error) {
+	start := MonthStart(t)
+	jobs, err := db.Jobs.List(db.JobFilter{Org: org, CreatedSince: start, CreatedBefore: start.AddDate(0, 1, 0)})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r := &Report{
+		Month: start.Format("2006-01"),
+		Total: Row{Kind: "total"},
+	}
+	if org == "" {
+		r.Total.QuotaMinutes = Limits.Instance
+	}
+	users := map[string]*Row{}
+	keys := map[string]*Row{}
+	orgs := map[string]*Row{}
+	for _, j := range jobs {
+		minutes := j.AudioSeconds / 60
+		add(&r.Total, minutes)
+		if j.Owner != "" {
+			add(row(users, "user", j.Owner), minutes)
+		}
+		if j.APIKey != "" {
+			add(row(keys, "apikey", j.APIKey), minutes)
+		}
+		if j.Org != "" {
+			add(row(orgs, "org", j.Org), minutes)
+		}
+	}
+
+	if r.Users, err = rows(users, func(row *Row) error {
+		u, err := db.Users.Get(row.ID)
+		if err == nil {
+			row.Name = u.Email
+		}
+		row.QuotaMinutes = Limits.PerUser
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if r.APIKeys, err = rows(keys, func(row *Row) error {
+		k, err := db.APIKeys.Get(row.ID)
+		row.QuotaMinutes = Limits.PerAPIKey
+		if err == nil {
+			row.Name = k.Name
+			if k.MonthlyMinutes > 0 {
+				row.QuotaMinutes = k.MonthlyMinutes
+			}
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if r.Orgs, err = rows(orgs, func(row *Row) error {
+		o, err := db.Orgs.Get(row.ID)
+		if err == nil {
+			row.Name = o.Name
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func add(r *Row, minutes float64) {
+	r.Jobs++
+	r.AudioMinutes += minutes
+}
+
+func row(rows map[string]*Row, kind string, id string) *Row {
+	if rows[id] == nil {
+		rows[id] = &Row{Kind: kind, ID: id}
+	}
+	return rows[id]
+}
+
+// rows returns the rows sorted by id after naming each with name, which may
+// fail with a not found error for records which have been deleted.
+func rows(m map[string]*Row, name func(*Row) error) ([]Row, error) {
+	list := []Row{}
+	for _, r := range m {
+		if err := name(r); err != nil && !errors.IsNotFound(err) {
+			return nil, errors.Trace(err)
+		}
+		list = append(list, *r)
+	}
+	sort.Sort(rowsByID(list))
+	return list, nil
+}
+
+// WriteCSV writes the report as CSV with a header row.
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"month", "kind", "id", "name", "jobs", "audio_minutes", "quota_minutes"})
+	all := append([]Row{r.Total}, r.Users...)
+	all = append(all, r.APIKeys...)
+	all = append(all, r.Orgs...)
+	for _, row := range all {
+		quota := ""
+		if row.QuotaMinutes > 0 {
+			quota = strconv.Itoa(row.QuotaMinutes)
+		}
+		out.Write([]string{
+			r.Month,
+			row.Kind,
+			row.ID,
+			row.Name,
+			strconv.Itoa(row.Jobs),
+			strconv.FormatFloat(row.AudioMinutes, 'f', 2, 64),
+			quota,
+		})
+	}
+	out.Flush()
+	return errors.Trace(out.Error())
+}
+
+// rowsByID sorts rows by id.
+type rowsByID []Row
+
+func (s rowsByID) Len() int           { return len(s) }
+func (s rowsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rowsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,108 @@
+package usage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func useTempRepositories(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Users, err = db.NewFileUserRepository(filepath.Join(dir, "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.APIKeys, err = db.NewFileAPIKeyRepository(filepath.Join(dir, "apikeys.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Orgs, err = db.NewFileOrganizationRepository(filepath.Join(dir, "organizations.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+var october = time.Date(2016, 10, 15, 12, 0, 0, 0, time.UTC)
+
+func createJobs(t *testing.T) {
+	jobs := []*db.Job{
+		{ID: "a", Owner: "ada", AudioSeconds: 600, CreatedAt: october},
+		{ID: "b", Owner: "ada", Org: "radio", AudioSeconds: 300, CreatedAt: october},
+		{ID: "c", APIKey: "k", Org: "radio", AudioSeconds: 1200, CreatedAt: october},
+		// last month
+		{ID: "d", Owner: "ada", AudioSeconds: 6000, CreatedAt: october.AddDate(0, -1, 0)},
+	}
+	for _, j := range jobs {
+		if err := db.Jobs.Create(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+	defer func() { Limits = Quotas{} }()
+	createJobs(t)
+	k := &db.APIKey{ID: "k"}
+
+	assert.NoError(Check("ada", k, october))
+
+	Limits = Quotas{PerUser: 15, PerAPIKey: 30}
+	err := Check("ada", nil, october)
+	assert.True(IsQuotaExceeded(err))
+	assert.Equal("the monthly quota of 15 audio minutes for your account has been used up; it resets on November 1, 2016", err.Error())
+	assert.NoError(Check("grace", nil, october))
+	assert.NoError(Check("", k, october))
+	k.MonthlyMinutes = 20
+	assert.True(IsQuotaExceeded(Check("", k, october)))
+
+	// quotas reset every month
+	assert.NoError(Check("ada", nil, october.AddDate(0, 1, 0)))
+
+	Limits = Quotas{Instance: 35}
+	err = Check("grace", nil, october)
+	assert.True(IsQuotaExceeded(err))
+	assert.Contains(err.Error(), "this service")
+}
+
+func TestMonthlyReport(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+	createJobs(t)
+	assert.NoError(db.Users.Create(&db.User{ID: "ada", Email: "ada@example.com"}))
+	assert.NoError(db.APIKeys.Create(&db.APIKey{ID: "k", Name: "station", MonthlyMinutes: 100}))
+
+	r, err := MonthlyReport(october, "")
+	assert.NoError(err)
+	assert.Equal("2016-10", r.Month)
+	assert.Equal(3, r.Total.Jobs)
+	assert.Equal(35.0, r.Total.AudioMinutes)
+	assert.Equal([]Row{{Kind: "user", ID: "ada", Name: "ada@example.com", Jobs: 2, AudioMinutes: 15}}, r.Users)
+	assert.Equal([]Row{{Kind: "apikey", ID: "k", Name: "station", Jobs: 1, AudioMinutes: 20, QuotaMinutes: 100}}, r.APIKeys)
+	assert.Equal([]Row{{Kind: "org", ID: "radio", Jobs: 2, AudioMinutes: 25}}, r.Orgs)
+
+	var out bytes.Buffer
+	assert.NoError(r.WriteCSV(&out))
+	assert.Equal("month,kind,id,name,jobs,audio_minutes,quota_minutes\n"+
+		"2016-10,total,,,3,35.00,\n"+
+		"2016-10,user,ada,ada@example.com,2,15.00,\n"+
+		"2016-10,apikey,k,station,1,20.00,100\n"+
+		"2016-10,org,radio,,2,25.00,\n", out.String())
+
+	r, err = MonthlyReport(october, "radio")
+	assert.NoError(err)
+	assert.Equal(25.0, r.Total.AudioMinutes)
+	assert.Len(r.Users, 1)
+}
@@ -0,0 +1,99 @@
+// Package users implements user accounts with passwords.
+package users
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// MinPasswordLength is the length of the shortest password accepted.
+const MinPasswordLength = 8
+
+// cost is the bcrypt cost of password hashes. Tests lower it.
+var cost = bcrypt.DefaultCost
+
+// Register creates and stores a user. The error satisfies errors.IsNotValid
+// if the details are unacceptable and errors.IsAlreadyExists if the email
+// address is taken.
+func Register(email string, name string, password string, admin bool) (*db.User, error) {
+	email = db.NormalizeEmail(email)
+	if !strings.Contains(email, "@") {
+		return nil, errors.NewNotValid(nil, "the email address is not valid")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &db.User{
+		ID:           newID(),
+		Email:        email,
+		Name:         strings.TrimSpace(name),
+		PasswordHash: hash,
+		Admin:        admin,
+		CreatedAt:    time.Now(),
+	}
+	if err := db.Users.Create(u); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return u, nil
+}
+
+// Authenticate returns the user with the given email address and password.
+// The error satisfies errors.IsUnauthorized if they do not match a user.
+func Authenticate(email string, password string) (*db.User, error) {
+	u, err := db.Users.GetByEmail(email)
+	if errors.IsNotFound(errors.Cause(err)) {
+		// spend as long as a real check so that timing does not reveal
+		// which addresses have accounts
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errors.Unauthorizedf("wrong email address or password")
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, errors.Unauthorizedf("wrong email address or password")
+	}
+	return u, nil
+}
+
+// SetPassword changes the password of u.
+func SetPassword(u *db.User, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return errors.Trace(db.Users.Update(u))
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("password"), cost)
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", errors.NewNotValid(nil, fmt.Sprintf("the password must be at least %d characters long", MinPasswordLength))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(hash), nil
+}
+
+// newID returns a random user id.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,53 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func init() {
+	cost = bcrypt.MinCost
+}
+
+func TestRegisterAndAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "users")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	db.Users, err = db.NewFileUserRepository(filepath.Join(dir, "users.json"))
+	assert.NoError(err)
+
+	u, err := Register("Ada@Example.com", " Ada ", "correct horse", false)
+	assert.NoError(err)
+	assert.Equal("ada@example.com", u.Email)
+	assert.Equal("Ada", u.Name)
+	assert.NotContains(u.PasswordHash, "correct horse")
+
+	_, err = Register("ada@example.com", "Ada", "correct horse", false)
+	assert.True(errors.IsAlreadyExists(errors.Cause(err)))
+	_, err = Register("grace@example.com", "Grace", "short", false)
+	assert.True(errors.IsNotValid(errors.Cause(err)))
+	_, err = Register("grace", "Grace", "long enough", false)
+	assert.True(errors.IsNotValid(errors.Cause(err)))
+
+	authenticated, err := Authenticate("ada@example.com", "correct horse")
+	assert.NoError(err)
+	assert.Equal(u.ID, authenticated.ID)
+
+	_, err = Authenticate("ada@example.com", "battery staple")
+	assert.True(errors.IsUnauthorized(err))
+	_, err = Authenticate("nobody@example.com", "correct horse")
+	assert.True(errors.IsUnauthorized(err))
+
+	assert.NoError(SetPassword(u, "battery staple"))
+	_, err = Authenticate("ada@example.com", "battery staple")
+	assert.NoError(err)
+}
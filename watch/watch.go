@@ -0,0 +1,256 @@
+// Package watch implements ingesting audio files dropped into watched
+// directories. Once a file has stopped changing it is queued for
+// transcription, and when the task finishes the file is moved into the done
+// or failed subdirectory with a sidecar text file next to it.
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are the defaults used by New.
+// ScanInterval: how often the directories are scanned.
+// StableFor: how long a file must go unchanged before it is queued.
+const (
+	ScanInterval = 5 * time.Second
+	StableFor    = 10 * time.Second
+)
+
+// These are the subdirectories files are moved into.
+const (
+	processingDir = "processing"
+	doneDir       = "done"
+	failedDir     = "failed"
+)
+
+// audioExtensions are the extensions of files which are picked up. Anything
+// else, e.g. partial uploads, is ignored.
+var audioExtensions = map[string]bool{
+	".aac": true, ".aif": true, ".aiff": true, ".flac": true, ".m4a": true,
+	".mp3": true, ".mp4": true, ".oga": true, ".ogg": true, ".opus": true,
+	".wav": true, ".webm": true, ".wma": true,
+}
+
+// TranscribeFunc transcribes the audio file at path as the task with the
+// given id and returns the plain-text transcript.
+type TranscribeFunc func(id string, path string) (string, error)
+
+// Watcher watches directories for new audio files.
+type Watcher struct {
+	dirs       []string
+	ex         tasks.TaskExecuter
+	transcribe TranscribeFunc
+	interval   time.Duration
+	stableFor  time.Duration
+
+	sync.Mutex
+	// pending records when each file was first seen with its current size
+	// and modification time.
+	pending map[string]observation
+}
+
+type observation struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// New returns a Watcher which queues files found in dirs on ex, transcribing
+// them with transcribe.
+func New(dirs []string, ex tasks.TaskExecuter, transcribe TranscribeFunc) *Watcher {
+	return &Watcher{
+		dirs:       dirs,
+		ex:         ex,
+		transcribe: transcribe,
+		interval:   ScanInterval,
+		stableFor:  StableFor,
+		pending:    make(map[string]observation),
+	}
+}
+
+// Start creates the subdirectories of every watched directory and returns
+// files left in processing by a previous run to the directory, so that they
+// are picked up again.
+func (w *Watcher) Start() error {
+	for _, dir := range w.dirs {
+		for _, sub := range []string{processingDir, doneDir, failedDir} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		leftover, err := ioutil.ReadDir(filepath.Join(dir, processingDir))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, info := range leftover {
+			if _, err := move(filepath.Join(dir, processingDir, info.Name()), dir); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		log.Infof("Watching %s for audio files", dir)
+	}
+	return nil
+}
+
+// Run scans the directories every interval until stop is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	for {
+		w.scan()
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// scan queues every file which has been stable for long enough.
+func (w *Watcher) scan() {
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, dir := range w.dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Errorf("Could not scan %s: %v", dir, err)
+			continue
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() || strings.HasPrefix(name, ".") || !audioExtensions[strings.ToLower(filepath.Ext(name))] {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			seen[path] = true
+			if w.stable(path, info, now) {
+				w.queue(dir, path)
+			}
+		}
+	}
+
+	// forget files which disappeared
+	w.Lock()
+	for path := range w.pending {
+		if !seen[path] {
+			delete(w.pending, path)
+		}
+	}
+	w.Unlock()
+}
+
+// stable records an observation of the file and reports whether it has not
+// changed for stableFor.
+func (w *Watcher) stable(path string, info os.FileInfo, now time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+	o, ok := w.pending[path]
+	if !ok || o.size != info.Size() || !o.modTime.Equal(info.ModTime()) {
+		w.pending[path] = observation{size: info.Size(), modTime: info.ModTime(), since: now}
+		return false
+	}
+	if now.Sub(o.since) < w.stableFor {
+		return false
+	}
+	delete(w.pending, path)
+	return true
+}
+
+// queue moves the file at path into processing and queues a task
+// transcribing it.
+func (w *Watcher) queue(dir string, path string) {
+	processing, err := move(path, filepath.Join(dir, processingDir))
+	if err != nil {
+		log.Errorf("Could not claim %s: %v", path, err)
+		return
+	}
+
+	task := func(id string) error {
+		finished := false
+		defer func() {
+			if !finished {
+				// the transcription panicked
+				w.finish(id, dir, processing, "", errors.New("panic occurred"))
+			}
+		}()
+		transcript, err := w.transcribe(id, processing)
+		finished = true
+		if errors.Cause(err) == tasks.ErrInterrupted {
+			// Start returns it to the directory in the next process
+			return err
+		}
+		w.finish(id, dir, processing, transcript, err)
+		return err
+	}
+	opts := tasks.TaskOptions{Labels: map[string]string{tasks.SourceLabel: "watch"}}
+	// the executer chooses the id, so it cannot be taken
+	id, _ := w.ex.QueueTaskWith(opts, task, func(string, string) {})
+	log.WithField("task", id).
+		Infof("Queued %s", path)
+}
+
+// finish moves a processed file into done, with its transcript alongside, or
+// into failed, with the error alongside.
+func (w *Watcher) finish(id string, dir string, processing string, transcript string, err error) {
+	destination, sidecar := doneDir, transcript
+	if err != nil {
+		destination, sidecar = failedDir, fmt.Sprintf("Transcription task %s failed: %v\n", id, err)
+	}
+
+	moved, moveErr := move(processing, filepath.Join(dir, destination))
+	if moveErr != nil {
+		log.WithField("task", id).
+			Errorf("Could not move %s to %s: %v", processing, destination, moveErr)
+		return
+	}
+	// write to a temporary file first so that the sidecar appears complete
+	sidecarPath := strings.TrimSuffix(moved, filepath.Ext(moved)) + ".txt"
+	if err := ioutil.WriteFile(sidecarPath+".tmp", []byte(sidecar), 0644); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not write %s: %v", sidecarPath, err)
+		return
+	}
+	if err := os.Rename(sidecarPath+".tmp", sidecarPath); err != nil {
+		log.WithField("task", id).
+			Errorf("Could not write %s: %v", sidecarPath, err)
+		return
+	}
+	if err == nil {
+		w.ex.SetResult(id, sidecarPath)
+	}
+	log.WithField("task", id).
+		Debugf("Moved %s to %s", processing, moved)
+}
+
+// move moves the file at path into dir without overwriting another file,
+// numbering the name if necessary, and returns its new path.
+func move(path string, dir string) (string, error) {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	// the sidecar's name is checked too so that it never overwrites a file
+	newPath := filepath.Join(dir, base)
+	for i := 1; exists(newPath) || exists(strings.TrimSuffix(newPath, ext)+".txt"); i++ {
+		newPath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+	if err := os.Rename(path, newPath); err != nil {
+		return "", errors.Trace(err)
+	}
+	return newPath, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
@@ -0,0 +1,162 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func newTestWatcher(t *testing.T, transcribe TranscribeFunc) (*Watcher, string) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := New([]string{dir}, tasks.NewTaskExecuter(time.Hour), transcribe)
+	w.stableFor = 0
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return w, dir
+}
+
+// waitFor waits until the file at path exists.
+func waitFor(t *testing.T, path string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if exists(path) {
+			return
+		}
+	}
+	t.Fatalf("%s was not created", path)
+}
+
+func TestWatcherTranscribesStableFiles(t *testing.T) {
+	assert := assert.New(t)
+	w, dir := newTestWatcher(t, func(id string, path string) (string, error) {
+		if filepath.Base(path) == "broken.wav" {
+			return "", errors.New("unreadable audio")
+		}
+		return "hello world", nil
+	})
+	defer os.RemoveAll(dir)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "talk.mp3"), []byte("audio"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "broken.wav"), []byte("audio"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "notes.doc"), []byte("notes"), 0644))
+
+	// the first scan only observes the files
+	w.scan()
+	assert.True(exists(filepath.Join(dir, "talk.mp3")))
+
+	w.scan()
+	waitFor(t, filepath.Join(dir, "done", "talk.txt"))
+	waitFor(t, filepath.Join(dir, "failed", "broken.txt"))
+
+	assert.True(exists(filepath.Join(dir, "done", "talk.mp3")))
+	transcript, err := ioutil.ReadFile(filepath.Join(dir, "done", "talk.txt"))
+	assert.NoError(err)
+	assert.Equal("hello world", string(transcript))
+
+	assert.True(exists(filepath.Join(dir, "failed", "broken.wav")))
+	message, err := ioutil.ReadFile(filepath.Join(dir, "failed", "broken.txt"))
+	assert.NoError(err)
+	assert.Contains(string(message), "unreadable audio")
+
+	assert.True(exists(filepath.Join(dir, "notes.doc")))
+}
+
+func TestWatcherWaitsForFilesToStopChanging(t *testing.T) {
+	assert := assert.New(t)
+	queued := make(chan string, 1)
+	w, dir := newTestWatcher(t, func(id string, path string) (string, error) {
+		queued <- path
+		return "", nil
+	})
+	defer os.RemoveAll(dir)
+	w.stableFor = time.Hour
+
+	path := filepath.Join(dir, "talk.mp3")
+	assert.NoError(ioutil.WriteFile(path, []byte("aud"), 0644))
+	w.scan()
+	assert.NoError(ioutil.WriteFile(path, []byte("audio"), 0644))
+	w.scan()
+	w.scan()
+	assert.True(exists(path))
+
+	w.stableFor = 0
+	w.scan()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("file was not queued")
+	}
+}
+
+func TestMoveDoesNotOverwrite(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "watch")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(os.Mkdir(filepath.Join(dir, "done"), 0755))
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "done", "talk.txt"), nil, 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "talk.mp3"), nil, 0644))
+	moved, err := move(filepath.Join(dir, "talk.mp3"), filepath.Join(dir, "done"))
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "done", "talk (1).mp3"), moved)
+}
+
+func TestStartRequeuesLeftovers(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "watch")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(os.Mkdir(filepath.Join(dir, "processing"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "processing", "talk.mp3"), nil, 0644))
+
+	w := New([]string{dir}, tasks.NewTaskExecuter(time.Hour), nil)
+	assert.NoError(w.Start())
+	assert.True(exists(filepath.Join(dir, "talk.mp3")))
+	assert.True(exists(filepath.Join(dir, "failed")))
+}
+
+func TestRunStops(t *testing.T) {
+	w, dir := newTestWatcher(t, func(string, string) (string, error) { return "", nil })
+	defer os.RemoveAll(dir)
+	w.interval = time.Hour
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(stop)
+		close(stopped)
+	}()
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stop was closed")
+	}
+}
+
+func TestInterruptedFilesStayInProcessing(t *testing.T) {
+	assert := assert.New(t)
+	w, dir := newTestWatcher(t, func(string, string) (string, error) {
+		return "", tasks.ErrInterrupted
+	})
+	defer os.RemoveAll(dir)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "talk.mp3"), []byte("audio"), 0644))
+	w.scan()
+	w.scan()
+	assert.NoError(w.ex.Wait(context.Background()))
+	assert.True(exists(filepath.Join(dir, "processing", "talk.mp3")))
+	assert.False(exists(filepath.Join(dir, "failed", "talk.mp3")))
+}
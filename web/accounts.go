@@ -0,0 +1,156 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/users"
+)
+
+// userSession is the name of the session holding the id of the logged in
+// user.
+const userSession = "user"
+
+type accountPage struct {
+	Error        string
+	Email        string
+	Name         string
+	Next         string
+	Registration bool
+}
+
+// currentUser returns the logged in user, or nil.
+func currentUser(r *http.Request) *db.User {
+	session, err := store.Get(r, userSession)
+	if err != nil {
+		return nil
+	}
+	id, ok := session.Values["id"].(string)
+	if !ok {
+		return nil
+	}
+	u, err := db.Users.Get(id)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// requireUser returns the logged in user. If nobody is logged in, it
+// redirects to the login page and returns nil.
+func requireUser(w http.ResponseWriter, r *http.Request) *db.User {
+	u := currentUser(r)
+	if u == nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	}
+	return u
+}
+
+func logIn(w http.ResponseWriter, r *http.Request, u *db.User) error {
+	session, _ := store.Get(r, userSession)
+	session.Values["id"] = u.ID
+	return errors.Trace(session.Save(r, w))
+}
+
+// safeNext returns the local path to go to after logging in.
+func safeNext(next string) string {
+	// only follow paths on this site, not "//evil.example.com"
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		return "/"
+	}
+	return next
+}
+
+func loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, r, http.StatusOK, "login.html", accountPage{
+		Next:         safeNext(r.URL.Query().Get("next")),
+		Registration: !config.Config.DisableRegistration,
+	})
+}
+
+// loginHandler logs the user in with the email address and password
+// submitted in the login form.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	page := accountPage{
+		Email:        r.FormValue("email"),
+		Next:         safeNext(r.FormValue("next")),
+		Registration: !config.Config.DisableRegistration,
+	}
+	u, err := users.Authenticate(page.Email, r.FormValue("password"))
+	if errors.IsUnauthorized(err) {
+		page.Error = err.Error()
+		renderTemplate(w, r, http.StatusUnauthorized, "login.html", page)
+		return
+	}
+	if err == nil {
+		err = logIn(w, r, u)
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not log in", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, page.Next, http.StatusFound)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, userSession)
+	delete(session.Values, "id")
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func registerFormHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Config.DisableRegistration {
+		http.NotFound(w, r)
+		return
+	}
+	renderTemplate(w, r, http.StatusOK, "register.html", accountPage{Registration: true})
+}
+
+// registerHandler creates an account from the registration form and logs
+// the new user in.
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Config.DisableRegistration {
+		http.NotFound(w, r)
+		return
+	}
+	page := accountPage{
+		Email:        r.FormValue("email"),
+		Name:         r.FormValue("name"),
+		Registration: true,
+	}
+	if r.FormValue("password") != r.FormValue("confirm") {
+		page.Error = "The passwords do not match."
+		renderTemplate(w, r, http.StatusBadRequest, "register.html", page)
+		return
+	}
+
+	u, err := users.Register(page.Email, page.Name, r.FormValue("password"), false)
+	switch cause := errors.Cause(err); {
+	case errors.IsNotValid(cause):
+		page.Error = cause.Error()
+	case errors.IsAlreadyExists(cause):
+		page.Error = "There is already an account with that email address."
+	}
+	if page.Error != "" {
+		renderTemplate(w, r, http.StatusBadRequest, "register.html", page)
+		return
+	}
+	if err == nil {
+		err = logIn(w, r, u)
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not create the account", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,303 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+// adminJobsPerPage is the number of jobs listed on each page of the admin
+// dashboard.
+const adminJobsPerPage = 50
+
+// jobSources lists the values of the tasks.SourceLabel of jobs, by which the
+// admin dashboard filters them.
+var jobSources = []string{"web", "api", "batch", "feed", "schedule", "watch", "rerun"}
+
+// jobStatuses lists the statuses of recorded jobs.
+var jobStatuses = []string{
+	tasks.SCHEDULED.Name(),
+	tasks.INPROGRESS.Name(),
+	tasks.SUCCESS.Name(),
+	tasks.FAILURE.Name(),
+	tasks.TIMEDOUT.Name(),
+}
+
+// requireAdmin returns the logged in user if they administer the instance,
+// writing an error response and returning nil otherwise.
+func requireAdmin(w http.ResponseWriter, r *http.Request) *db.User {
+	u := requireUser(w, r)
+	if u == nil {
+		return nil
+	}
+	if !u.Admin {
+		http.Error(w, "only administrators can see this page", http.StatusForbidden)
+		return nil
+	}
+	return u
+}
+
+// workerStatus describes the jobs a worker has leased from the shared queue.
+type workerStatus struct {
+	Name string
+	Jobs []*db.QueueEntry
+	// Lapsed is set if the worker has not renewed any of its leases in
+	// time, which suggests that it has stopped.
+	Lapsed bool
+}
+
+// workerStatuses returns the status of each worker with jobs leased from the
+// shared queue, by name, and the number of jobs waiting for a worker.
+func workerStatuses(now time.Time) ([]*workerStatus, int, error) {
+	entries, err := db.Queue.List()
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	workers := []*workerStatus{}
+	byName := make(map[string]*workerStatus)
+	waiting := 0
+	for _, e := range entries {
+		if e.Worker == "" {
+			waiting++
+			continue
+		}
+		ws, ok := byName[e.Worker]
+		if !ok {
+			ws = &workerStatus{Name: e.Worker, Lapsed: true}
+			byName[e.Worker] = ws
+			workers = append(workers, ws)
+		}
+		ws.Jobs = append(ws.Jobs, e)
+		ws.Lapsed = ws.Lapsed && e.LeaseExpires.Before(now)
+	}
+	sort.Slice(workers, func(i, k int) bool { return workers[i].Name < workers[k].Name })
+	return workers, waiting, nil
+}
+
+// adminFilters holds the filters of the admin dashboard's list of jobs.
+type adminFilters struct {
+	Status string
+	Source string
+	// Owner is the email address of the user who submitted the jobs.
+	Owner string
+	Org   string
+}
+
+// jobFilter returns the filter selecting the jobs f lists.
+func (f adminFilters) jobFilter() (db.JobFilter, error) {
+	filter := db.JobFilter{Status: f.Status, Org: f.Org}
+	if f.Source != "" {
+		filter.Labels = map[string]string{tasks.SourceLabel: f.Source}
+	}
+	if f.Owner != "" {
+		u, err := db.Users.GetByEmail(db.NormalizeEmail(f.Owner))
+		if errors.IsNotFound(err) {
+			// no user's id is an email address, so no job matches
+			filter.Owner = f.Owner
+			return filter, nil
+		}
+		if err != nil {
+			return filter, errors.Trace(err)
+		}
+		filter.Owner = u.ID
+	}
+	return filter, nil
+}
+
+// adminHandler shows administrators what the server is doing: the tasks
+// running and waiting in this process, the workers sharing the queue, the
+// space taken up by temporary files, and the jobs recorded, newest first,
+// with actions to cancel, retry, run again or delete them.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireAdmin(w, r)
+	if u == nil {
+		return
+	}
+	q := r.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	filters := adminFilters{
+		Status: q.Get("status"),
+		Source: q.Get("source"),
+		Owner:  strings.TrimSpace(q.Get("owner")),
+		Org:    strings.TrimSpace(q.Get("org")),
+	}
+	filter, err := filters.jobFilter()
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the jobs", http.StatusInternalServerError)
+		return
+	}
+	// fetch one extra job to find out whether there is a next page
+	filter.Offset = (page - 1) * adminJobsPerPage
+	filter.Limit = adminJobsPerPage + 1
+	list, err := db.Jobs.List(filter)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the jobs", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		User     *db.User
+		Flashes  []interface{}
+		Filters  adminFilters
+		Statuses []string
+		Sources  []string
+		Engines  []string
+		// Running and Waiting are the tasks of this process.
+		Running    []tasks.TaskInfo
+		Waiting    []tasks.TaskInfo
+		MaxRunning int
+		UseWorkers bool
+		Workers    []*workerStatus
+		// Queued is the number of jobs waiting for a worker.
+		Queued    int
+		Temp      transcription.TempUsage
+		TempError string
+		Jobs      []*db.Job
+		// Query is the query of this page, which actions return to.
+		Query    string
+		Previous string
+		Next     string
+	}{
+		User:       u,
+		Filters:    filters,
+		Statuses:   jobStatuses,
+		Sources:    jobSources,
+		Engines:    transcription.Engines,
+		MaxRunning: config.Config.MaxConcurrentJobs,
+		UseWorkers: config.Config.UseWorkers,
+		Jobs:       list,
+		Query:      q.Encode(),
+	}
+	if len(list) > adminJobsPerPage {
+		data.Jobs = list[:adminJobsPerPage]
+		data.Next = pageQuery(q, page+1)
+	}
+	if page > 1 {
+		data.Previous = pageQuery(q, page-1)
+	}
+
+	for _, t := range tasks.DefaultTaskExecuter.ListTasks(tasks.TaskFilter{Statuses: []tasks.Status{tasks.INPROGRESS}}) {
+		if t.Started.IsZero() {
+			data.Waiting = append(data.Waiting, t)
+		} else {
+			data.Running = append(data.Running, t)
+		}
+	}
+	if data.Workers, data.Queued, err = workerStatuses(time.Now()); err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	if data.Temp, err = transcription.GetTempUsage(); err != nil {
+		log.Error(errors.ErrorStack(err))
+		data.TempError = "could not measure the temporary files"
+	}
+
+	session, err := store.Get(r, flashSession)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	data.Flashes = session.Flashes()
+	session.Save(r, w)
+	renderTemplate(w, r, http.StatusOK, "admin.html", data)
+}
+
+// pageQuery returns the query q showing the given page.
+func pageQuery(q url.Values, page int) string {
+	paged := url.Values{}
+	for k, v := range q {
+		paged[k] = v
+	}
+	paged.Set("page", strconv.Itoa(page))
+	return paged.Encode()
+}
+
+// adminJobAction runs action on the job with the id in the URL, if the
+// logged in user administers the instance, and goes back to the dashboard,
+// with the filters in the query form value, to say how it went. action
+// returns what it did.
+func adminJobAction(w http.ResponseWriter, r *http.Request, action func(j *db.Job) (string, error)) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	j, err := db.Jobs.Get(mux.Vars(r)["id"])
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not find the job", http.StatusInternalServerError)
+		return
+	}
+
+	var message flash
+	done, err := action(j)
+	switch {
+	case errors.IsNotValid(err) || errors.IsNotFound(err):
+		message = flash{Title: "Job " + j.ID, Body: err.Error(), Error: true}
+	case err != nil:
+		log.Error(errors.ErrorStack(err))
+		message = flash{Title: "Job " + j.ID, Body: "Something went wrong; the server's log says what.", Error: true}
+	default:
+		message = flash{Title: "Job " + j.ID, Body: done}
+	}
+	session, err := store.Get(r, flashSession)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	session.AddFlash(message)
+	session.Save(r, w)
+
+	// only keep the filters, so that the redirect stays on the dashboard
+	q, _ := url.ParseQuery(r.FormValue("query"))
+	http.Redirect(w, r, "/admin?"+q.Encode(), http.StatusFound)
+}
+
+// adminCancelJobHandler cancels a job which has not started yet.
+func adminCancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	adminJobAction(w, r, func(j *db.Job) (string, error) {
+		return "The job was cancelled.", jobs.Cancel(tasks.DefaultTaskExecuter, j.ID)
+	})
+}
+
+// adminRetryJobHandler runs a failed job again from the stage which failed.
+func adminRetryJobHandler(w http.ResponseWriter, r *http.Request) {
+	adminJobAction(w, r, func(j *db.Job) (string, error) {
+		return "The job is being retried.", transcription.Retry(j, "")
+	})
+}
+
+// adminRerunJobHandler submits a finished job again, as a new job, with the
+// engine named by the engine form value.
+func adminRerunJobHandler(w http.ResponseWriter, r *http.Request) {
+	adminJobAction(w, r, func(j *db.Job) (string, error) {
+		engine := r.FormValue("engine")
+		id, err := transcription.Rerun(j, engine)
+		return fmt.Sprintf("The job is running again with %s as job %s.", engine, id), err
+	})
+}
+
+// adminDeleteJobHandler deletes a finished job with its transcript and log.
+func adminDeleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	adminJobAction(w, r, func(j *db.Job) (string, error) {
+		return "The job was deleted.", jobs.Delete(j.ID)
+	})
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+)
+
+// apiKeyRow is an API key as listed on the admin page, with the limits
+// which apply to it.
+type apiKeyRow struct {
+	Key       *db.APIKey
+	RateLimit int
+	MaxJobs   int
+}
+
+// adminAPIKeysHandler lists the API keys, with a form for issuing another.
+func adminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireAdmin(w, r)
+	if u == nil {
+		return
+	}
+	renderAPIKeys(w, r, u, nil, "", "", http.StatusOK)
+}
+
+// renderAPIKeys renders the admin page of API keys. issued and token are the
+// key just issued and its token, which is only shown then, if any, and
+// message says why a key could not be issued.
+func renderAPIKeys(w http.ResponseWriter, r *http.Request, u *db.User, issued *db.APIKey, token string, message string, status int) {
+	keys, err := db.APIKeys.List()
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the API keys", http.StatusInternalServerError)
+		return
+	}
+	rows := []apiKeyRow{}
+	for _, k := range keys {
+		rows = append(rows, apiKeyRow{k, apikeys.RateLimit(k), apikeys.MaxJobs(k)})
+	}
+
+	session, err := store.Get(r, flashSession)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	flashes := session.Flashes()
+	session.Save(r, w)
+	renderTemplate(w, r, status, "apikeys.html", struct {
+		User    *db.User
+		Flashes []interface{}
+		Keys    []apiKeyRow
+		Roles   []string
+		Issued  *db.APIKey
+		Token   string
+		Error   string
+	}{u, flashes, rows, orgs.Roles, issued, token, message})
+}
+
+// adminIssueAPIKeyHandler issues an API key with the name, limits and
+// organization in the form, and shows its token, which is not shown again.
+func adminIssueAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireAdmin(w, r)
+	if u == nil {
+		return
+	}
+	k := &db.APIKey{
+		Name: strings.TrimSpace(r.FormValue("name")),
+		Org:  strings.TrimSpace(r.FormValue("org")),
+		Role: r.FormValue("role"),
+	}
+	var err error
+	if k.Name == "" {
+		err = errors.NotValidf("empty name")
+	}
+	for _, limit := range []struct {
+		field string
+		value *int
+	}{
+		{"rate", &k.RateLimit},
+		{"jobs", &k.MaxJobs},
+		{"minutes", &k.MonthlyMinutes},
+	} {
+		if s := strings.TrimSpace(r.FormValue(limit.field)); s != "" && err == nil {
+			if *limit.value, err = strconv.Atoi(s); err != nil {
+				err = errors.NotValidf("%s %q", limit.field, s)
+			}
+		}
+	}
+	var token string
+	if err == nil {
+		token, err = apikeys.Issue(k)
+	}
+	switch {
+	case errors.IsNotValid(err):
+		renderAPIKeys(w, r, u, nil, "", err.Error(), http.StatusBadRequest)
+		return
+	case errors.IsNotFound(err):
+		renderAPIKeys(w, r, u, nil, "", "There is no organization with the id "+k.Org+".", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not issue the API key", http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s issued the API key %s for %s", u.Email, k.ID, k.Name)
+	// the token must not be kept anywhere
+	w.Header().Set("Cache-Control", "no-store")
+	renderAPIKeys(w, r, u, k, token, "", http.StatusCreated)
+}
+
+// adminRevokeAPIKeyHandler revokes the API key with the id in the URL and
+// goes back to the list of keys.
+func adminRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireAdmin(w, r)
+	if u == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	err := apikeys.Revoke(id)
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not revoke the API key", http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s revoked the API key %s", u.Email, id)
+
+	session, err := store.Get(r, flashSession)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	session.AddFlash(flash{Title: "API key " + id, Body: "The key was revoked."})
+	session.Save(r, w)
+	http.Redirect(w, r, "/admin/apikeys", http.StatusFound)
+}
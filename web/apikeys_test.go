@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestAdminManagesAPIKeys(t *testing.T) {
+	assert := assert.New(t)
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+	admin := logInAs(t, &db.User{ID: "boss", Email: "boss@example.com", Admin: true})
+	user := logInAs(t, &db.User{ID: "ada", Email: "ada@example.com"})
+
+	assert.Equal(http.StatusForbidden, user.get(app, "/admin/apikeys").Code)
+	assert.Equal(http.StatusForbidden, user.post(app, "/admin/apikeys", url.Values{"name": {"Radio"}}).Code)
+
+	w := admin.post(app, "/admin/apikeys", url.Values{"name": {"Radio"}, "rate": {"ten"}})
+	assert.Equal(http.StatusBadRequest, w.Code)
+	w = admin.post(app, "/admin/apikeys", url.Values{"name": {"Radio"}, "org": {"nowhere"}})
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = admin.post(app, "/admin/apikeys", url.Values{"name": {"Radio"}, "rate": {"30"}})
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("no-store", w.Header().Get("Cache-Control"))
+	token := regexp.MustCompile(`t4a_[0-9a-f]+_[0-9a-f]+`).FindString(w.Body.String())
+	k, err := apikeys.Authenticate(token)
+	assert.NoError(err)
+	assert.Equal("Radio", k.Name)
+	assert.Equal(30, k.RateLimit)
+	assert.Contains(admin.get(app, "/admin/apikeys").Body.String(), k.ID)
+
+	assert.Equal(http.StatusForbidden, user.post(app, "/admin/apikeys/"+k.ID+"/revoke", url.Values{}).Code)
+	w = admin.post(app, "/admin/apikeys/"+k.ID+"/revoke", url.Values{})
+	assert.Equal(http.StatusFound, w.Code)
+	_, err = apikeys.Authenticate(token)
+	assert.Error(err)
+	assert.Equal(http.StatusNotFound, admin.post(app, "/admin/apikeys/unknown/revoke", url.Values{}).Code)
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+type contextKey int
+
+const apiKeyContextKey contextKey = iota
+
+// apiPaths are the path prefixes which require an API key.
+var apiPaths = []string{"/api/", "/add_job_json", "/job_status/"}
+
+var (
+	limiter    = apikeys.NewLimiter()
+	jobTracker = apikeys.NewTracker(tasks.DefaultTaskExecuter)
+)
+
+// requireAPIKey rejects requests to the API which do not carry a valid API
+// key, in an "Authorization: Bearer" or "X-API-Key" header, or which exceed
+// the key's rate limit.
+func requireAPIKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAPIPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token := apiToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transcribe4all"`)
+			writeJSONError(w, http.StatusUnauthorized, "an API key is required")
+			return
+		}
+		k, err := apikeys.Authenticate(token)
+		if errors.IsUnauthorized(err) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transcribe4all", error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			log.Error(errors.ErrorStack(err))
+			writeJSONError(w, http.StatusInternalServerError, "could not check the API key")
+			return
+		}
+
+		if ok, wait := limiter.Allow(k); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+
+		context.Set(r, apiKeyContextKey, k)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isAPIPath(path string) bool {
+	for _, prefix := range apiPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func apiToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// requestAPIKey returns the API key the request was made with, if any.
+func requestAPIKey(r *http.Request) *db.APIKey {
+	if k, ok := context.Get(r, apiKeyContextKey).(*db.APIKey); ok {
+		return k
+	}
+	return nil
+}
+
+// reserveJobs reserves places for n more jobs started with the request's API
+// key, which the jobs started by the request are added to. If the key may not
+// start them, it writes a 429 response and returns false. The reservation is
+// nil for requests made without a key; either way, the caller releases it once
+// the jobs have been started.
+func reserveJobs(w http.ResponseWriter, r *http.Request, n int) (*apikeys.Reservation, bool) {
+	k := requestAPIKey(r)
+	if k == nil {
+		return nil, true
+	}
+	reservation, err := jobTracker.Reserve(k, n)
+	if err != nil {
+		writeJSONError(w, http.StatusTooManyRequests, err.Error())
+		return nil, false
+	}
+	return reservation, true
+}
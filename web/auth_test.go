@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestAPIRequiresValidKey(t *testing.T) {
+	assert := assert.New(t)
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "job"}))
+	k := &db.APIKey{Name: "partner"}
+	token, err := apikeys.Issue(k)
+	assert.NoError(err)
+	revoked := &db.APIKey{Name: "former partner"}
+	revokedToken, err := apikeys.Issue(revoked)
+	assert.NoError(err)
+	assert.NoError(apikeys.Revoke(revoked.ID))
+
+	for _, path := range []string{"/job_status/job", "/api/v1/jobs/job/logs", "/api/v1/transcripts"} {
+		w := apiRequest(app, "GET", path, "", "")
+		assert.Equal(http.StatusUnauthorized, w.Code, path)
+		assert.Contains(w.Header().Get("WWW-Authenticate"), "Bearer")
+		assert.Contains(w.Body.String(), `"error":"an API key is required"`)
+		for _, bad := range []string{"t4a_nonsense", token[:len(token)-1] + "x", revokedToken} {
+			w = apiRequest(app, "GET", path, bad, "")
+			assert.Equal(http.StatusUnauthorized, w.Code, path)
+			assert.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token")
+		}
+		assert.Equal(http.StatusOK, apiRequest(app, "GET", path, token, "").Code, path)
+	}
+
+	// keys are also accepted in the X-API-Key header
+	r := httptest.NewRequest("GET", "/job_status/job", nil)
+	r.Header.Set("X-API-Key", token)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+}
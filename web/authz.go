@@ -0,0 +1,110 @@
+package web
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// requestSubject returns whoever made the request: the API key on the API,
+// and the logged in user elsewhere.
+func requestSubject(r *http.Request) orgs.Subject {
+	if k := requestAPIKey(r); k != nil {
+		return orgs.Subject{APIKey: k}
+	}
+	return orgs.Subject{User: currentUser(r)}
+}
+
+// access checks that whoever made the request has at least the role need for
+// a record of the organization org owned by owner. It returns 0 if they do,
+// http.StatusForbidden if they may only see the record, and
+// http.StatusNotFound if they may not see it at all, which does not reveal
+// that it exists.
+func access(r *http.Request, need string, org string, owner string) (int, error) {
+	s := requestSubject(r)
+	can, err := orgs.Can(s, need, org, owner)
+	if err != nil || can {
+		return 0, err
+	}
+	if need != orgs.Viewer {
+		canView, err := orgs.Can(s, orgs.Viewer, org, owner)
+		if err != nil {
+			return 0, err
+		}
+		if canView {
+			return http.StatusForbidden, nil
+		}
+	}
+	return http.StatusNotFound, nil
+}
+
+// isInstanceAdmin reports whether whoever made the request administers the
+// whole instance: an API key which is not restricted to an organization, or
+// a logged in administrator.
+func isInstanceAdmin(r *http.Request) bool {
+	if k := requestAPIKey(r); k != nil {
+		return k.Org == ""
+	}
+	u := currentUser(r)
+	return u != nil && u.Admin
+}
+
+// mayUsePriority reports whether whoever made the request may queue jobs with
+// the named priority. Only instance administrators may queue HIGH ones.
+func mayUsePriority(r *http.Request, name string) bool {
+	p, err := tasks.ParsePriority(name)
+	return err != nil || p < tasks.HIGH || isInstanceAdmin(r)
+}
+
+// checkAPIAccess calls access and writes a JSON error response about the
+// record, described by what, if the request may not go ahead.
+func checkAPIAccess(w http.ResponseWriter, r *http.Request, need string, org string, owner string, what string) bool {
+	status, err := access(r, need, org, owner)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not check permissions")
+		return false
+	}
+	switch status {
+	case http.StatusForbidden:
+		writeJSONError(w, status, "the API key's role does not allow this")
+		return false
+	case http.StatusNotFound:
+		writeJSONError(w, status, what+" not found")
+		return false
+	}
+	return true
+}
+
+// checkPageAccess calls access and writes an error page if the request may
+// not go ahead.
+func checkPageAccess(w http.ResponseWriter, r *http.Request, need string, org string, owner string) bool {
+	status, err := access(r, need, org, owner)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not check permissions", http.StatusInternalServerError)
+		return false
+	}
+	switch status {
+	case http.StatusForbidden:
+		http.Error(w, "you need the "+need+" role to do that", status)
+		return false
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+// apiKeyOrg returns the organization the request's API key is restricted to,
+// or "" if it acts for the whole instance.
+func apiKeyOrg(r *http.Request) string {
+	if k := requestAPIKey(r); k != nil {
+		return k.Org
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/apikeys"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func TestOrganizationRoles(t *testing.T) {
+	assert := assert.New(t)
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+	viewer := logInAs(t, &db.User{ID: "vic", Email: "vic@example.com"})
+	newsroom, err := orgs.Create("Newsroom", "ed")
+	assert.NoError(err)
+	assert.NoError(orgs.SetMember(newsroom, "vic", orgs.Viewer))
+	rival, err := orgs.Create("Rival", "rex")
+	assert.NoError(err)
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "ours", Org: newsroom.ID, Owner: "ed", Status: tasks.SCHEDULED.Name()}))
+	assert.NoError(db.Transcripts.Create(&db.Transcript{ID: "ours", Org: newsroom.ID}))
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "theirs", Org: rival.ID, Owner: "rex", Status: tasks.SCHEDULED.Name()}))
+	token, err := apikeys.Issue(&db.APIKey{Name: "viewer", Org: newsroom.ID, Role: orgs.Viewer})
+	assert.NoError(err)
+
+	// viewers see their organization's jobs, but cannot create or cancel
+	// them, or delete their transcripts
+	assert.Equal(http.StatusOK, viewer.get(app, "/jobs/ours").Code)
+	w := viewer.post(app, "/add_job", url.Values{"url": {"http://example.com/a.mp3"}, "language": {"en-US"}, "org": {newsroom.ID}})
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Equal(http.StatusForbidden, viewer.post(app, "/jobs/ours/cancel", url.Values{}).Code)
+	assert.Equal(http.StatusOK, apiRequest(app, "GET", "/job_status/ours", token, "").Code)
+	w = apiRequest(app, "POST", "/add_job_json", token, `{"audioURL": "http://example.com/a.mp3", "language": "en-US"}`)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Equal(http.StatusForbidden, apiRequest(app, "POST", "/api/v1/jobs/ours/cancel", token, "").Code)
+	assert.Equal(http.StatusForbidden, apiRequest(app, "DELETE", "/api/v1/transcripts/ours", token, "").Code)
+	j, err := db.Jobs.Get("ours")
+	assert.NoError(err)
+	assert.Equal(tasks.SCHEDULED.Name(), j.Status)
+	_, err = db.Transcripts.Get("ours")
+	assert.NoError(err)
+	list, err := db.Jobs.List(db.JobFilter{})
+	assert.NoError(err)
+	assert.Len(list, 2)
+
+	// other organizations' jobs cannot be seen at all
+	assert.Equal(http.StatusNotFound, viewer.get(app, "/jobs/theirs").Code)
+	assert.Equal(http.StatusNotFound, viewer.post(app, "/jobs/theirs/cancel", url.Values{}).Code)
+	assert.Equal(http.StatusNotFound, apiRequest(app, "GET", "/job_status/theirs", token, "").Code)
+	assert.Equal(http.StatusNotFound, apiRequest(app, "GET", "/api/v1/jobs/theirs/logs", token, "").Code)
+	assert.Equal(http.StatusNotFound, apiRequest(app, "POST", "/api/v1/jobs/theirs/cancel", token, "").Code)
+}
@@ -0,0 +1,152 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/batch"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+type batchResponse struct {
+	*db.Batch
+	Summary batch.Summary
+}
+
+func jobFromItem(item batch.Item) transcription.Job {
+	return transcription.Job{
+		AudioURL:       item.AudioURL,
+		EmailAddresses: item.EmailAddresses,
+		SearchWords:    item.SearchWords,
+		Language:       item.Language,
+		Force:          item.Force,
+	}
+}
+
+// createBatchHandler starts a transcription task for every item of a
+// manifest. The manifest is read as CSV if the request's Content-Type is
+// text/csv, in which case the summary's recipients, the jobs' priority and
+// their start time may be given in the emailAddresses, priority and startAt
+// query parameters, and as JSON otherwise. Retries sent with the same
+// Idempotency-Key header get the batch created the first time.
+func createBatchHandler(w http.ResponseWriter, r *http.Request) {
+	idempotent(w, r, func() string { return createBatch(w, r) }, func(id string) {
+		b, err := db.Batches.Get(id)
+		if err != nil {
+			log.Error(errors.ErrorStack(err))
+			writeJSONError(w, http.StatusInternalServerError, "could not find the batch")
+			return
+		}
+		writeJSON(w, http.StatusCreated, batchResponse{b, batch.Summarize(b)})
+	})
+}
+
+// createBatch creates the batch requested by createBatchHandler and returns
+// its id, or "" if it could not be created.
+func createBatch(w http.ResponseWriter, r *http.Request) string {
+	var m *batch.Manifest
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		m, err = batch.ParseCSV(r.Body)
+		if err == nil {
+			if emails := r.URL.Query().Get("emailAddresses"); emails != "" {
+				m.EmailAddresses = strings.Split(emails, ",")
+			}
+			m.Priority = r.URL.Query().Get("priority")
+			if start := r.URL.Query().Get("startAt"); start != "" {
+				if m.StartAt, err = time.Parse(time.RFC3339, start); err != nil {
+					err = errors.NotValidf("startAt %q", start)
+				}
+			}
+		}
+	} else {
+		m, err = batch.ParseJSON(r.Body)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+
+	if !mayUsePriority(r, m.Priority) {
+		writeJSONError(w, http.StatusForbidden, "only administrators may queue high-priority jobs")
+		return ""
+	}
+	m.Org = apiKeyOrg(r)
+	if !checkAPIAccess(w, r, orgs.Editor, m.Org, "", "organization's jobs") {
+		return ""
+	}
+	reservation, ok := reserveJobs(w, r, len(m.Items))
+	defer reservation.Release()
+	if !ok || !checkAPIQuota(w, r) {
+		return ""
+	}
+
+	executer := tasks.DefaultTaskExecuter
+	jobFor := func(item batch.Item) transcription.Job {
+		job := jobFromItem(item)
+		job.Priority = m.Priority
+		job.StartAt = m.StartAt
+		job.DelaySeconds = m.DelaySeconds
+		return job
+	}
+	validate := func(item batch.Item) error {
+		return jobFor(item).Validate()
+	}
+	record := db.Job{Org: m.Org, Labels: map[string]string{tasks.SourceLabel: "batch"}}
+	if k := requestAPIKey(r); k != nil {
+		record.APIKey = k.ID
+	}
+	queue := func(item batch.Item) (string, error) {
+		j := record
+		id, err := transcription.Submit(jobFor(item), &j)
+		if err != nil {
+			if id == "" {
+				return "", err
+			}
+			// the task runs even if it could not be recorded
+			log.Error(errors.ErrorStack(err))
+		}
+		reservation.Add(id)
+		return id, nil
+	}
+	b, err := batch.Submit(m, validate, queue)
+	if errors.IsNotValid(errors.Cause(err)) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return ""
+	}
+
+	go batch.Watch(b, executer, batch.PollInterval, transcription.NotifyBatchFinished)
+	writeJSON(w, http.StatusCreated, batchResponse{b, batch.Summarize(b)})
+	return b.ID
+}
+
+// batchStatusHandler returns a batch with the status of each of its jobs and
+// the aggregate status.
+func batchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	b, err := db.Batches.Get(id)
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "batch not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, b.Org, "", "batch") {
+		return
+	}
+	writeJSON(w, http.StatusOK, batchResponse{b, batch.Summarize(b)})
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/juju/errors"
+)
+
+// csrfSession is the name of the session holding the CSRF token, which every
+// form posted by a browser must carry in its csrfFieldName field.
+const (
+	csrfSession   = "csrf"
+	csrfFieldName = "csrf_token"
+)
+
+// cookieStore is a sessions.CookieStore whose cookies are also SameSite=Lax,
+// which the vendored gorilla/sessions cannot set, so that browsers leave them
+// out of forms posted from other sites.
+type cookieStore struct {
+	*sessions.CookieStore
+}
+
+// newCookieStore returns a cookieStore signing its cookies with secretKey.
+// The cookies are only sent over HTTPS if secure is set.
+func newCookieStore(secretKey string, secure bool) *cookieStore {
+	s := &cookieStore{sessions.NewCookieStore([]byte(secretKey))}
+	s.Options.HttpOnly = true
+	s.Options.Secure = secure
+	return s
+}
+
+// Get returns the session with the given name, as sessions.CookieStore.Get
+// does.
+func (s *cookieStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session with the given name without adding it to the
+// registry, as sessions.CookieStore.New does.
+func (s *cookieStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	var err error
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		err = securecookie.DecodeMulti(name, c.Value, &session.Values, s.Codecs...)
+		if err == nil {
+			session.IsNew = false
+		}
+	}
+	return session, err
+}
+
+// Save adds the session's cookie to the response.
+func (s *cookieStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cookie := sessions.NewCookie(session.Name(), encoded, session.Options)
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// csrfToken returns the CSRF token of the request's browser, giving it one
+// in w if it has none yet, so it must be called before the response is
+// written.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session, _ := store.Get(r, csrfSession)
+	if token, ok := session.Values["token"].(string); ok && token != "" {
+		return token
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	session.Values["token"] = token
+	if err := session.Save(r, w); err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	return token
+}
+
+// csrfFuncs returns the template function csrfField, which writes the hidden
+// field carrying the request's CSRF token into a form.
+func csrfFuncs(w http.ResponseWriter, r *http.Request) template.FuncMap {
+	token := csrfToken(w, r)
+	return template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfFieldName, token))
+		},
+	}
+}
+
+// checkCSRF rejects forms posted without the CSRF token of the browser's
+// session, which other sites cannot read, so that they cannot post forms
+// with the cookies of a logged in user. The API, whose requests carry API
+// keys rather than cookies, is left alone.
+func checkCSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || isAPIPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		session, _ := store.Get(r, csrfSession)
+		token, _ := session.Values["token"].(string)
+		sent := r.PostFormValue(csrfFieldName)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sent)) != 1 {
+			http.Error(w, "the form has expired; go back, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
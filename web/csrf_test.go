@@ -0,0 +1,49 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestForgedFormsAreRejected(t *testing.T) {
+	assert := assert.New(t)
+	app, cleanup := newTestApp(t)
+	defer cleanup()
+	admin := logInAs(t, &db.User{ID: "boss", Email: "boss@example.com", Admin: true})
+	other := logInAs(t, &db.User{ID: "ada", Email: "ada@example.com"})
+	assert.NoError(db.Jobs.Create(&db.Job{ID: "done"}))
+
+	// another site can post the form with the admin's cookies, but cannot
+	// read their token
+	w := admin.post(app, "/admin/jobs/done/delete", url.Values{csrfFieldName: {""}})
+	assert.Equal(http.StatusForbidden, w.Code)
+	w = admin.post(app, "/admin/jobs/done/delete", url.Values{csrfFieldName: {other.token}})
+	assert.Equal(http.StatusForbidden, w.Code)
+	_, err := db.Jobs.Get("done")
+	assert.NoError(err)
+
+	w = admin.post(app, "/admin/jobs/done/delete", url.Values{})
+	assert.Equal(http.StatusFound, w.Code)
+	_, err = db.Jobs.Get("done")
+	assert.Error(err)
+
+	// nor can it log a browser in to its own account
+	r := httptest.NewRequest("POST", "/login", strings.NewReader("email=evil%40example.com&password=password"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// session cookies are not sent with forms posted from other sites
+	for _, c := range admin.cookies {
+		assert.Equal(http.SameSiteLaxMode, c.SameSite, c.Name)
+		assert.True(c.HttpOnly, c.Name)
+	}
+}
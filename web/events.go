@@ -0,0 +1,152 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/handlers"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/events"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// Events passes on the events of the tasks run by this process to those
+// following jobs' progress. The server dispatches the executer's events to
+// it.
+var Events = events.NewHub()
+
+// keepAliveInterval is how often event streams with nothing to say send a
+// comment, so that proxies do not close them, and check whether the job has
+// finished elsewhere, e.g. on a worker.
+const keepAliveInterval = 15 * time.Second
+
+// jobEventsAPIHandler streams the events of a job as server-sent events until
+// it finishes.
+func jobEventsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Viewer)
+	if j == nil {
+		return
+	}
+	streamJobEvents(w, r, j.ID)
+}
+
+// jobEventsHandler streams the events of a job to its page.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Viewer)
+	if j == nil {
+		return
+	}
+	streamJobEvents(w, r, j.ID)
+}
+
+// streamJobEvents writes the events of the job with the given id as
+// server-sent events, named by their type, until the job finishes or the
+// client goes away. Jobs which have already finished get a single event
+// saying how.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// follow before looking at the record, so that no event is missed
+	following, stop := Events.Follow(id, 16)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if e, ok := finishedEvent(id); ok {
+		writeEvent(w, e)
+		flusher.Flush()
+		return
+	}
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-following:
+			if !ok {
+				// the server is shutting down
+				return
+			}
+			writeEvent(w, e)
+			flusher.Flush()
+			if e.Type.Finished() {
+				return
+			}
+		case <-ticker.C:
+			if e, ok := finishedEvent(id); ok {
+				writeEvent(w, e)
+				flusher.Flush()
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// finishedEvent returns an event saying how the job with the given id
+// finished, if it has, according to its record.
+func finishedEvent(id string) (tasks.Event, bool) {
+	j, err := db.Jobs.Get(id)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			log.Error(errors.ErrorStack(err))
+		}
+		return tasks.Event{}, false
+	}
+	e := tasks.Event{TaskID: id, Time: j.FinishedAt}
+	switch {
+	case j.Status == tasks.SUCCESS.Name():
+		e.Type = tasks.SUCCEEDED
+	case j.Status == tasks.FAILURE.Name() && j.Error == jobs.ErrCancelled.Error():
+		e.Type = tasks.CANCELLED
+	case j.Status == tasks.FAILURE.Name():
+		e.Type = tasks.FAILED
+		e.Error = j.Error
+	case j.Status == tasks.TIMEDOUT.Name():
+		e.Type = tasks.TIMEOUT
+		e.Error = j.Error
+	default:
+		return tasks.Event{}, false
+	}
+	return e, true
+}
+
+// writeEvent writes e as a server-sent event named by its type.
+func writeEvent(w http.ResponseWriter, e tasks.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type.Name(), data)
+}
+
+// compressUnlessStreaming compresses responses as handlers.CompressHandler
+// does, except for event streams, which compression would hold back.
+func compressUnlessStreaming(h http.Handler) http.Handler {
+	compressed := handlers.CompressHandler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		compressed.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/feeds"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+type feedRequest struct {
+	URL            string   `json:"url"`
+	EmailAddresses []string `json:"emailAddresses"`
+	SearchWords    []string `json:"searchWords"`
+	Language       string   `json:"language"`
+	// Backfill is the number of existing episodes to transcribe.
+	Backfill int `json:"backfill"`
+}
+
+// createFeedHandler subscribes to the podcast feed described by a JSON
+// object. New episodes are transcribed with the given options.
+func createFeedHandler(w http.ResponseWriter, r *http.Request) {
+	req := new(feedRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.URL == "" {
+		writeJSONError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+	if !transcription.ValidLanguage(req.Language) {
+		writeJSONError(w, http.StatusBadRequest, errors.NotValidf("language %q", req.Language).Error())
+		return
+	}
+	if req.Backfill < 0 {
+		writeJSONError(w, http.StatusBadRequest, "backfill must not be negative")
+		return
+	}
+
+	f := &db.Feed{
+		Org:            apiKeyOrg(r),
+		URL:            req.URL,
+		EmailAddresses: req.EmailAddresses,
+		SearchWords:    req.SearchWords,
+		Language:       req.Language,
+	}
+	if !checkAPIAccess(w, r, orgs.Editor, f.Org, "", "organization's feeds") {
+		return
+	}
+	if err := feeds.Subscribe(f, req.Backfill, transcription.QueueEpisode); err != nil {
+		// the feed could not be fetched or parsed
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, f)
+}
+
+// listFeedsHandler returns every feed subscription, or those of the API key's
+// organization if it is restricted to one.
+func listFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := db.Feeds.List()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if org := apiKeyOrg(r); org != "" {
+		visible := []*db.Feed{}
+		for _, f := range list {
+			if f.Org == org {
+				visible = append(visible, f)
+			}
+		}
+		list = visible
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getFeedHandler returns the feed subscription with the given id.
+func getFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f, err := db.Feeds.Get(id)
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, f.Org, "", "feed") {
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// deleteFeedHandler unsubscribes from the feed with the given id.
+func deleteFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	f, err := db.Feeds.Get(id)
+	if err == nil {
+		if !checkAPIAccess(w, r, orgs.Editor, f.Org, "", "feed") {
+			return
+		}
+		err = db.Feeds.Delete(id)
+	}
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/idempotency"
+)
+
+// idempotent handles a request which creates a job or batch with create,
+// which writes the response and returns the id of what it created, or "" if
+// nothing was created. If the request has an Idempotency-Key header, retries
+// of the request with the same key call replay with the id created the first
+// time instead, and different requests with the same key get a 409 response.
+func idempotent(w http.ResponseWriter, r *http.Request, create func() string, replay func(id string)) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		create()
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	scope := ""
+	if k := requestAPIKey(r); k != nil {
+		scope = k.ID
+	}
+	hash := idempotency.RequestHash(r.Method, r.URL.RequestURI(), body)
+	record, err := idempotency.Begin(scope, key, hash, time.Now())
+	switch {
+	case idempotency.IsConflict(err):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case errors.IsNotValid(err):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not check the idempotency key")
+		return
+	}
+	if record.Result != "" {
+		w.Header().Set("Idempotent-Replayed", "true")
+		replay(record.Result)
+		return
+	}
+
+	id := ""
+	defer func() {
+		// let the client retry requests which failed, even by panicking
+		if id == "" {
+			err = idempotency.Release(record)
+		} else {
+			err = idempotency.Finish(record, id)
+		}
+		if err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	}()
+	id = create()
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+func TestIdempotentReleasesFailedRequests(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if db.IdempotencyKeys, err = db.NewFileIdempotencyKeyRepository(filepath.Join(dir, "idempotencykeys.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// send sends a request with the key, handled by create, and returns
+	// the response code and whether create ran
+	send := func(create func() string) (int, bool) {
+		r := httptest.NewRequest("POST", "/add_job_json", strings.NewReader(`{"audioURL": "http://example.com/a.mp3"}`))
+		r.Header.Set("Idempotency-Key", "retry-me")
+		w := httptest.NewRecorder()
+		created := false
+		func() {
+			defer func() { recover() }()
+			idempotent(w, r, func() string { created = true; return create() }, func(id string) {
+				w.WriteHeader(http.StatusCreated)
+			})
+		}()
+		return w.Code, created
+	}
+
+	_, created := send(func() string { panic("the database is down") })
+	assert.True(created)
+	_, created = send(func() string { return "" })
+	assert.True(created, "the key of a request which panicked is released")
+	_, created = send(func() string { return "job1" })
+	assert.True(created, "the key of a request which failed is released")
+	code, created := send(func() string { return "job2" })
+	assert.False(created)
+	assert.Equal(http.StatusCreated, code)
+}
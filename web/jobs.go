@@ -0,0 +1,332 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/tasks"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+// jobsPerPage is the number of jobs listed on each page of "My jobs".
+const jobsPerPage = 25
+
+// myJobsHandler lists the jobs submitted by the logged in user, most recent
+// first.
+func myJobsHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// fetch one extra job to find out whether there is a next page
+	list, err := db.Jobs.List(db.JobFilter{Owner: u.ID, Offset: (page - 1) * jobsPerPage, Limit: jobsPerPage + 1})
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the jobs", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		User     *db.User
+		Jobs     []*db.Job
+		Previous int
+		Next     int
+	}{User: u, Jobs: list, Previous: page - 1}
+	if len(list) > jobsPerPage {
+		data.Jobs = list[:jobsPerPage]
+		data.Next = page + 1
+	}
+	renderTemplate(w, r, http.StatusOK, "jobs.html", data)
+}
+
+// userJob returns the job with the id in the URL if the logged in user has at
+// least the role need for it, writing an error response and returning nil
+// otherwise.
+func userJob(w http.ResponseWriter, r *http.Request, need string) (*db.User, *db.Job) {
+	u := requireUser(w, r)
+	if u == nil {
+		return nil, nil
+	}
+	j, err := db.Jobs.Get(mux.Vars(r)["id"])
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not find the job", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if !checkPageAccess(w, r, need, j.Org, j.Owner) {
+		return nil, nil
+	}
+	return u, j
+}
+
+// jobHandler shows a job and, once it has succeeded, its transcript.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	u, j := userJob(w, r, orgs.Viewer)
+	if j == nil {
+		return
+	}
+	data := struct {
+		User       *db.User
+		Job        *db.Job
+		Org        *db.Organization
+		Transcript *db.Transcript
+		Formats    []string
+		Log        []db.LogEntry
+		// CanRetry is set if the job failed and the user may retry it.
+		CanRetry bool
+		// CanEdit is set if the user may retry, cancel or share the job.
+		CanEdit bool
+		// ShareURL is the link with which the job is shared, if it is.
+		ShareURL string
+	}{User: u, Job: j, Formats: transcription.Formats}
+
+	status, err := access(r, orgs.Editor, j.Org, j.Owner)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	data.CanEdit = err == nil && status == 0
+	data.CanRetry = data.CanEdit && j.Resumable &&
+		(j.Status == tasks.FAILURE.Name() || j.Status == tasks.TIMEDOUT.Name())
+	if data.CanEdit && j.ShareToken != "" {
+		data.ShareURL = shareURL(j.ShareToken)
+	}
+
+	if j.Org != "" {
+		o, err := db.Orgs.Get(j.Org)
+		if err != nil && !errors.IsNotFound(err) {
+			log.Error(errors.ErrorStack(err))
+		}
+		data.Org = o
+	}
+
+	t, err := db.Transcripts.Get(j.ID)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error(errors.ErrorStack(err))
+	}
+	data.Transcript = t
+
+	if data.Log, err = db.JobLogs.Get(j.ID); err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+	renderTemplate(w, r, http.StatusOK, "job.html", data)
+}
+
+// jobLogsHandler responds with the log entries of a job, oldest first.
+func jobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	// jobs which were not recorded are treated as belonging to no
+	// organization, as in jobStatusHandler
+	j, err := db.Jobs.Get(id)
+	if errors.IsNotFound(err) {
+		j, err = &db.Job{ID: id}, nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not find the job")
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, j.Org, j.Owner, "job") {
+		return
+	}
+
+	entries, err := db.JobLogs.Get(id)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not read the log")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID      string        `json:"id"`
+		Entries []db.LogEntry `json:"entries"`
+	}{id, entries})
+}
+
+// retryJobHandler runs a failed job again from the stage which failed, or
+// from the stage named by the stage form value, and shows the job's page.
+func retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	err := transcription.Retry(j, r.FormValue("stage"))
+	if errors.IsNotValid(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not retry the job", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/jobs/"+j.ID, http.StatusFound)
+}
+
+// cancelJobHandler cancels a job which has not started yet and shows the
+// job's page.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	err := jobs.Cancel(tasks.DefaultTaskExecuter, j.ID)
+	if errors.IsNotValid(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not cancel the job", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/jobs/"+j.ID, http.StatusFound)
+}
+
+// apiJob returns the job with the id in the URL if the request's API key has
+// at least the role need for it, writing a JSON error response and returning
+// nil otherwise.
+func apiJob(w http.ResponseWriter, r *http.Request, need string) *db.Job {
+	j, err := db.Jobs.Get(mux.Vars(r)["id"])
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not find the job")
+		return nil
+	}
+	if !checkAPIAccess(w, r, need, j.Org, j.Owner, "job") {
+		return nil
+	}
+	return j
+}
+
+// jobStagesHandler responds with the stages of a job's pipeline which have
+// started, in the order they first started.
+func jobStagesHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Viewer)
+	if j == nil {
+		return
+	}
+	stages := j.Stages
+	if stages == nil {
+		stages = []db.Stage{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID     string     `json:"id"`
+		Status string     `json:"status"`
+		Stages []db.Stage `json:"stages"`
+	}{j.ID, j.Status, stages})
+}
+
+// retryJobAPIHandler runs a failed job again. The optional JSON body names the
+// stage to run again from, e.g. {"stage": "transcribe-chunk-3"}; by default
+// the job carries on from the stage which failed.
+func retryJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	req := struct {
+		Stage string `json:"stage"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err := transcription.Retry(j, req.Stage)
+	if errors.IsNotValid(err) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not retry the job")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}{j.ID, j.Status})
+}
+
+// cancelJobAPIHandler cancels a job which is waiting to start: queued behind
+// other jobs, waiting for a worker or deferred. Jobs which have started
+// cannot be cancelled.
+func cancelJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	err := jobs.Cancel(tasks.DefaultTaskExecuter, j.ID)
+	if errors.IsNotValid(err) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not cancel the job")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}{j.ID, tasks.FAILURE.Name()})
+}
+
+// jobTranscriptHandler downloads the transcript of a job in the format given
+// by the format query parameter.
+func jobTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Viewer)
+	if j == nil {
+		return
+	}
+	writeTranscript(w, r, j)
+}
+
+// writeTranscript responds with the transcript of the job j in the format
+// given by the format query parameter.
+func writeTranscript(w http.ResponseWriter, r *http.Request, j *db.Job) {
+	t, err := db.Transcripts.Get(j.ID)
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not find the transcript", http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "txt"
+	}
+	data, err := transcription.Format(t, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension("."+format))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+j.ID+"."+format+"\"")
+	w.Write(data)
+}
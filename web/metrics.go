@@ -0,0 +1,64 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/metrics"
+)
+
+// MetricsToken, if not empty, must be sent as "Authorization: Bearer <token>"
+// to read the metrics.
+var MetricsToken string
+
+// metricsHandler writes the app's metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if MetricsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transcribe4all"`)
+			http.Error(w, "a metrics token is required", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.WriteText(w); err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush flushes the response, if the underlying writer can, for event
+// streams.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument records how long h takes to handle requests for the route with
+// the given name.
+func instrument(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r)
+		metrics.HTTPDuration.ObserveSince(start, name, strconv.Itoa(recorder.status))
+	})
+}
@@ -0,0 +1,207 @@
+package web
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+)
+
+// memberRow is a member of an organization as shown on its page.
+type memberRow struct {
+	User *db.User
+	Role string
+}
+
+// userOrgs returns the organizations in which u has at least the role need.
+// Site administrators have every role in every organization.
+func userOrgs(u *db.User, need string) ([]*db.Organization, error) {
+	userID := u.ID
+	if u.Admin {
+		userID = ""
+	}
+	list, err := db.Orgs.List(userID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	allowed := []*db.Organization{}
+	for _, o := range list {
+		if u.Admin || orgs.Allows(o.Role(u.ID), need) {
+			allowed = append(allowed, o)
+		}
+	}
+	return allowed, nil
+}
+
+// orgsHandler lists the organizations of the logged in user.
+func orgsHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	renderOrgs(w, r, u, "", http.StatusOK)
+}
+
+func renderOrgs(w http.ResponseWriter, r *http.Request, u *db.User, message string, status int) {
+	list, err := userOrgs(u, orgs.Viewer)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the organizations", http.StatusInternalServerError)
+		return
+	}
+	renderTemplate(w, r, status, "orgs.html", struct {
+		User  *db.User
+		Orgs  []*db.Organization
+		Error string
+	}{u, list, message})
+}
+
+// createOrgHandler creates an organization with the logged in user as its
+// admin.
+func createOrgHandler(w http.ResponseWriter, r *http.Request) {
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	o, err := orgs.Create(r.FormValue("name"), u.ID)
+	if errors.IsNotValid(err) {
+		renderOrgs(w, r, u, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not create the organization", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/orgs/"+o.ID, http.StatusFound)
+}
+
+// userOrg returns the organization with the id in the URL if the logged in
+// user has at least the role need in it, writing an error response and
+// returning nil otherwise.
+func userOrg(w http.ResponseWriter, r *http.Request, need string) (*db.User, *db.Organization) {
+	u := requireUser(w, r)
+	if u == nil {
+		return nil, nil
+	}
+	o, err := db.Orgs.Get(mux.Vars(r)["id"])
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not find the organization", http.StatusInternalServerError)
+		return nil, nil
+	}
+	if !checkPageAccess(w, r, need, o.ID, "") {
+		return nil, nil
+	}
+	return u, o
+}
+
+// orgHandler shows the shared workspace of an organization: its members and
+// its most recent jobs.
+func orgHandler(w http.ResponseWriter, r *http.Request) {
+	u, o := userOrg(w, r, orgs.Viewer)
+	if o == nil {
+		return
+	}
+	renderOrg(w, r, u, o, "", http.StatusOK)
+}
+
+func renderOrg(w http.ResponseWriter, r *http.Request, u *db.User, o *db.Organization, message string, status int) {
+	members := []memberRow{}
+	for _, m := range o.Members {
+		mu, err := db.Users.Get(m.UserID)
+		if errors.IsNotFound(err) {
+			mu, err = &db.User{ID: m.UserID, Email: "(deleted user)"}, nil
+		}
+		if err != nil {
+			log.Error(errors.ErrorStack(err))
+			http.Error(w, "could not list the members", http.StatusInternalServerError)
+			return
+		}
+		members = append(members, memberRow{mu, m.Role})
+	}
+	list, err := db.Jobs.List(db.JobFilter{Org: o.ID, Limit: jobsPerPage})
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not list the jobs", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, r, status, "org.html", struct {
+		User    *db.User
+		Org     *db.Organization
+		Members []memberRow
+		Jobs    []*db.Job
+		CanEdit bool
+		IsAdmin bool
+		Roles   []string
+		Error   string
+	}{
+		User:    u,
+		Org:     o,
+		Members: members,
+		Jobs:    list,
+		CanEdit: u.Admin || orgs.Allows(o.Role(u.ID), orgs.Editor),
+		IsAdmin: u.Admin || orgs.Allows(o.Role(u.ID), orgs.Admin),
+		Roles:   orgs.Roles,
+		Error:   message,
+	})
+}
+
+// setMemberHandler adds the user with the submitted email address to the
+// organization, or changes their role.
+func setMemberHandler(w http.ResponseWriter, r *http.Request) {
+	u, o := userOrg(w, r, orgs.Admin)
+	if o == nil {
+		return
+	}
+	member, err := db.Users.GetByEmail(r.FormValue("email"))
+	if errors.IsNotFound(err) {
+		renderOrg(w, r, u, o, "There is no account with that email address.", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = orgs.SetMember(o, member.ID, r.FormValue("role"))
+	}
+	if errors.IsNotValid(err) {
+		renderOrg(w, r, u, o, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not change the members", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/orgs/"+o.ID, http.StatusFound)
+}
+
+// removeMemberHandler removes a user from the organization.
+func removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	u, o := userOrg(w, r, orgs.Admin)
+	if o == nil {
+		return
+	}
+	err := orgs.RemoveMember(o, mux.Vars(r)["user"])
+	if errors.IsNotValid(err) {
+		renderOrg(w, r, u, o, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.IsNotFound(errors.Cause(err)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not change the members", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/orgs/"+o.ID, http.StatusFound)
+}
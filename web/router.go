@@ -3,15 +3,18 @@ package web
 
 import (
 	"net/http"
+	"strings"
 
 	logMiddleware "github.com/bakins/logrus-middleware"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
+
+	"github.com/hack4impact/transcribe4all/config"
 )
 
 // NewRouter creates and returns a mux.Router with default routes.
 func NewRouter() *mux.Router {
+	store = newCookieStore(config.Config.SecretKey, strings.HasPrefix(config.Config.PublicURL, "https://"))
 	router := mux.NewRouter()
 
 	for _, route := range routes {
@@ -19,19 +22,20 @@ func NewRouter() *mux.Router {
 			Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(route.HandlerFunc)
+			Handler(instrument(route.Name, route.HandlerFunc))
 	}
 
 	return router
 }
 
 // ApplyMiddleware wraps the router in some middleware. This middleware includes
-// logging and gzip compression.
+// logging, gzip compression of everything but event streams, API key
+// authentication and checking the CSRF tokens of forms.
 func ApplyMiddleware(router http.Handler) http.Handler {
 	loggingHandler := func(h http.Handler) http.Handler {
 		m := new(logMiddleware.Middleware)
 		return m.Handler(h, "")
 	}
-	middlewareRouter := alice.New(handlers.CompressHandler, loggingHandler).Then(router)
+	middlewareRouter := alice.New(compressUnlessStreaming, loggingHandler, requireAPIKey, checkCSRF).Then(router)
 	return middlewareRouter
 }
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+)
+
+// newTestApp returns the app's handler, with the records in a temporary
+// directory, and a function cleaning up after it.
+func newTestApp(t *testing.T) (http.Handler, func()) {
+	dir, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open("", "", dir); err != nil {
+		t.Fatal(err)
+	}
+	c := config.Config
+	config.Config.SecretKey = "secret"
+	// the templates are found from the root of the repository
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	return ApplyMiddleware(NewRouter()), func() {
+		os.Chdir(wd)
+		config.Config = c
+		os.RemoveAll(dir)
+	}
+}
+
+// browser holds the cookies of a browser in which a user is logged in and
+// its CSRF token.
+type browser struct {
+	cookies []*http.Cookie
+	token   string
+}
+
+// logInAs records u and returns a browser in which u is logged in.
+func logInAs(t *testing.T, u *db.User) *browser {
+	if err := db.Users.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := logIn(w, r, u); err != nil {
+		t.Fatal(err)
+	}
+	token := csrfToken(w, r)
+	return &browser{w.Result().Cookies(), token}
+}
+
+// post posts form to app from b, with b's CSRF token unless the form has
+// one.
+func (b *browser) post(app http.Handler, target string, form url.Values) *httptest.ResponseRecorder {
+	if _, ok := form[csrfFieldName]; !ok {
+		form.Set(csrfFieldName, b.token)
+	}
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.send(app, r)
+}
+
+// get gets target from app with b.
+func (b *browser) get(app http.Handler, target string) *httptest.ResponseRecorder {
+	return b.send(app, httptest.NewRequest("GET", target, nil))
+}
+
+func (b *browser) send(app http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+// apiRequest sends a request with the JSON body, if any, to app's API with
+// the API key token, if any.
+func apiRequest(app http.Handler, method string, target string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
@@ -6,15 +6,22 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
-	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/storage"
 	"github.com/hack4impact/transcribe4all/tasks"
 	"github.com/hack4impact/transcribe4all/transcription"
+	"github.com/hack4impact/transcribe4all/usage"
+	"github.com/juju/errors"
 )
 
 type route struct {
@@ -24,15 +31,11 @@ type route struct {
 	HandlerFunc http.HandlerFunc
 }
 
-type transcriptionJobData struct {
-	AudioURL       string   `json:"audioURL"`
-	EmailAddresses []string `json:"emailAddresses"`
-	SearchWords    []string `json:"searchWords"`
-}
-
 type flash struct {
 	Title string
 	Body  string
+	// Error makes the flash a warning rather than a success message.
+	Error bool
 }
 
 var routes = []route{
@@ -54,12 +57,318 @@ var routes = []route{
 		"/health",
 		healthHandler,
 	},
+	route{
+		"metrics",
+		"GET",
+		"/metrics",
+		metricsHandler,
+	},
 	route{
 		"job_status",
 		"GET",
 		"/job_status/{id}",
 		jobStatusHandler,
 	},
+	route{
+		"create_batch",
+		"POST",
+		"/api/v1/batches",
+		createBatchHandler,
+	},
+	route{
+		"batch_status",
+		"GET",
+		"/api/v1/batches/{id}",
+		batchStatusHandler,
+	},
+	route{
+		"create_feed",
+		"POST",
+		"/api/v1/feeds",
+		createFeedHandler,
+	},
+	route{
+		"list_feeds",
+		"GET",
+		"/api/v1/feeds",
+		listFeedsHandler,
+	},
+	route{
+		"get_feed",
+		"GET",
+		"/api/v1/feeds/{id}",
+		getFeedHandler,
+	},
+	route{
+		"delete_feed",
+		"DELETE",
+		"/api/v1/feeds/{id}",
+		deleteFeedHandler,
+	},
+	route{
+		"create_schedule",
+		"POST",
+		"/api/v1/schedules",
+		createScheduleHandler,
+	},
+	route{
+		"list_schedules",
+		"GET",
+		"/api/v1/schedules",
+		listSchedulesHandler,
+	},
+	route{
+		"get_schedule",
+		"GET",
+		"/api/v1/schedules/{id}",
+		getScheduleHandler,
+	},
+	route{
+		"delete_schedule",
+		"DELETE",
+		"/api/v1/schedules/{id}",
+		deleteScheduleHandler,
+	},
+	route{
+		"list_transcripts",
+		"GET",
+		"/api/v1/transcripts",
+		listTranscriptsHandler,
+	},
+	route{
+		"get_transcript",
+		"GET",
+		"/api/v1/transcripts/{id}",
+		getTranscriptHandler,
+	},
+	route{
+		"delete_transcript",
+		"DELETE",
+		"/api/v1/transcripts/{id}",
+		deleteTranscriptHandler,
+	},
+	route{
+		"usage",
+		"GET",
+		"/api/v1/usage",
+		usageHandler,
+	},
+	route{
+		"job_logs",
+		"GET",
+		"/api/v1/jobs/{id}/logs",
+		jobLogsHandler,
+	},
+	route{
+		"job_stages",
+		"GET",
+		"/api/v1/jobs/{id}/stages",
+		jobStagesHandler,
+	},
+	route{
+		"retry_job",
+		"POST",
+		"/api/v1/jobs/{id}/retry",
+		retryJobAPIHandler,
+	},
+	route{
+		"cancel_job",
+		"POST",
+		"/api/v1/jobs/{id}/cancel",
+		cancelJobAPIHandler,
+	},
+	route{
+		"job_events",
+		"GET",
+		"/api/v1/jobs/{id}/events",
+		jobEventsAPIHandler,
+	},
+	route{
+		"share_job",
+		"POST",
+		"/api/v1/jobs/{id}/share",
+		shareJobAPIHandler,
+	},
+	route{
+		"unshare_job",
+		"DELETE",
+		"/api/v1/jobs/{id}/share",
+		unshareJobAPIHandler,
+	},
+	route{
+		"login_form",
+		"GET",
+		"/login",
+		loginFormHandler,
+	},
+	route{
+		"login",
+		"POST",
+		"/login",
+		loginHandler,
+	},
+	route{
+		"logout",
+		"POST",
+		"/logout",
+		logoutHandler,
+	},
+	route{
+		"register_form",
+		"GET",
+		"/register",
+		registerFormHandler,
+	},
+	route{
+		"register",
+		"POST",
+		"/register",
+		registerHandler,
+	},
+	route{
+		"my_jobs",
+		"GET",
+		"/jobs",
+		myJobsHandler,
+	},
+	route{
+		"job",
+		"GET",
+		"/jobs/{id}",
+		jobHandler,
+	},
+	route{
+		"job_transcript",
+		"GET",
+		"/jobs/{id}/transcript",
+		jobTranscriptHandler,
+	},
+	route{
+		"retry_job_form",
+		"POST",
+		"/jobs/{id}/retry",
+		retryJobHandler,
+	},
+	route{
+		"cancel_job_form",
+		"POST",
+		"/jobs/{id}/cancel",
+		cancelJobHandler,
+	},
+	route{
+		"job_events_page",
+		"GET",
+		"/jobs/{id}/events",
+		jobEventsHandler,
+	},
+	route{
+		"share_job_form",
+		"POST",
+		"/jobs/{id}/share",
+		shareJobHandler,
+	},
+	route{
+		"unshare_job_form",
+		"POST",
+		"/jobs/{id}/unshare",
+		unshareJobHandler,
+	},
+	route{
+		"shared_job",
+		"GET",
+		"/shared/{token}",
+		sharedJobHandler,
+	},
+	route{
+		"shared_transcript",
+		"GET",
+		"/shared/{token}/transcript",
+		sharedTranscriptHandler,
+	},
+	route{
+		"admin",
+		"GET",
+		"/admin",
+		adminHandler,
+	},
+	route{
+		"admin_cancel_job",
+		"POST",
+		"/admin/jobs/{id}/cancel",
+		adminCancelJobHandler,
+	},
+	route{
+		"admin_retry_job",
+		"POST",
+		"/admin/jobs/{id}/retry",
+		adminRetryJobHandler,
+	},
+	route{
+		"admin_rerun_job",
+		"POST",
+		"/admin/jobs/{id}/rerun",
+		adminRerunJobHandler,
+	},
+	route{
+		"admin_delete_job",
+		"POST",
+		"/admin/jobs/{id}/delete",
+		adminDeleteJobHandler,
+	},
+	route{
+		"admin_apikeys",
+		"GET",
+		"/admin/apikeys",
+		adminAPIKeysHandler,
+	},
+	route{
+		"admin_issue_apikey",
+		"POST",
+		"/admin/apikeys",
+		adminIssueAPIKeyHandler,
+	},
+	route{
+		"admin_revoke_apikey",
+		"POST",
+		"/admin/apikeys/{id}/revoke",
+		adminRevokeAPIKeyHandler,
+	},
+	route{
+		"orgs",
+		"GET",
+		"/orgs",
+		orgsHandler,
+	},
+	route{
+		"create_org",
+		"POST",
+		"/orgs",
+		createOrgHandler,
+	},
+	route{
+		"org",
+		"GET",
+		"/orgs/{id}",
+		orgHandler,
+	},
+	route{
+		"set_member",
+		"POST",
+		"/orgs/{id}/members",
+		setMemberHandler,
+	},
+	route{
+		"remove_member",
+		"POST",
+		"/orgs/{id}/members/{user}/remove",
+		removeMemberHandler,
+	},
+	route{
+		"files",
+		"GET",
+		"/files/{name:.+}",
+		filesHandler,
+	},
 	route{
 		"form",
 		"GET",
@@ -69,7 +378,9 @@ var routes = []route{
 }
 
 var (
-	store        = sessions.NewCookieStore([]byte(config.Config.SecretKey))
+	// store keeps sessions in cookies signed with SecretKey. NewRouter
+	// creates it, once the config has been loaded.
+	store        *cookieStore
 	flashSession = "flash"
 )
 
@@ -79,38 +390,134 @@ func init() {
 }
 
 // initiateTranscriptionJobHandlerJSON takes a POST request containing a json object,
-// decodes it into a transcriptionJobData struct, and starts a transcription task.
+// decodes it into a transcription.Job struct, starts a transcription task and
+// responds with the task's id. Retries sent with the same Idempotency-Key
+// header get the id of the task started the first time.
 func initiateTranscriptionJobHandlerJSON(w http.ResponseWriter, r *http.Request) {
-	jsonData := new(transcriptionJobData)
+	idempotent(w, r, func() string { return createJob(w, r) }, func(id string) {
+		writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+	})
+}
+
+// createJob starts the transcription task requested by
+// initiateTranscriptionJobHandlerJSON and returns its id, or "" if it could
+// not be started.
+func createJob(w http.ResponseWriter, r *http.Request) string {
+	jsonData := new(transcription.Job)
 
 	// unmarshal from the response body directly into our struct
 	if err := json.NewDecoder(r.Body).Decode(jsonData); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+	if err := jsonData.Validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+	if !mayUsePriority(r, jsonData.Priority) {
+		writeJSONError(w, http.StatusForbidden, "only administrators may queue high-priority jobs")
+		return ""
+	}
+	record := &db.Job{Org: apiKeyOrg(r), Labels: map[string]string{tasks.SourceLabel: "api"}}
+	if !checkAPIAccess(w, r, orgs.Editor, record.Org, "", "organization's jobs") {
+		return ""
+	}
+	reservation, ok := reserveJobs(w, r, 1)
+	defer reservation.Release()
+	if !ok || !checkAPIQuota(w, r) {
+		return ""
 	}
 
-	executer := tasks.DefaultTaskExecuter
-	executer.QueueTask(transcription.MakeIBMTaskFunction(jsonData.AudioURL, jsonData.EmailAddresses, jsonData.SearchWords))
+	if k := requestAPIKey(r); k != nil {
+		record.APIKey = k.ID
+	}
+	id, err := transcription.Submit(*jsonData, record)
+	if err != nil {
+		// the task runs even if it could not be recorded, unless it was
+		// to be queued for a worker
+		log.Error(errors.ErrorStack(err))
+		if id == "" {
+			writeJSONError(w, http.StatusInternalServerError, "could not queue the job")
+			return ""
+		}
+	}
+	reservation.Add(id)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+	return id
 }
 
 // initiateTranscriptionJobHandler takes a POST request from a form,
-// decodes it into a transcriptionJobData struct, and starts a transcription task.
+// decodes it into a transcription.Job struct, and starts a transcription task
+// owned by the logged in user.
 func initiateTranscriptionJobHandler(w http.ResponseWriter, r *http.Request) {
-	executer := tasks.DefaultTaskExecuter
-	emails := strings.Split(r.FormValue("emails"), ",")
-	words := strings.Split(r.FormValue("words"), ",")
-	log.Println(emails, words, len(emails), len(words))
-	id := executer.QueueTask(transcription.MakeIBMTaskFunction(r.FormValue("url"), emails, words))
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	job := transcription.Job{
+		AudioURL:       r.FormValue("url"),
+		EmailAddresses: strings.Split(r.FormValue("emails"), ","),
+		SearchWords:    strings.Split(r.FormValue("words"), ","),
+		Language:       r.FormValue("language"),
+		Force:          r.FormValue("force") != "",
+		Priority:       r.FormValue("priority"),
+	}
+	if err := job.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !mayUsePriority(r, job.Priority) {
+		http.Error(w, "only administrators may queue high-priority jobs", http.StatusForbidden)
+		return
+	}
+	org := r.FormValue("org")
+	if !checkPageAccess(w, r, orgs.Editor, org, u.ID) {
+		return
+	}
+
+	var message flash
+	err := usage.Check(u.ID, nil, time.Now())
+	if usage.IsQuotaExceeded(err) {
+		message = flash{
+			Title: "Quota used up",
+			Body:  fmt.Sprintf("The job was not started because %s.", err),
+			Error: true,
+		}
+	} else {
+		if err != nil {
+			// metering problems should not stop transcription
+			log.Error(errors.ErrorStack(err))
+		}
+		id, err := transcription.Submit(job, &db.Job{
+			Owner:  u.ID,
+			Org:    org,
+			Labels: map[string]string{tasks.SourceLabel: "web"},
+		})
+		if err != nil {
+			// the task runs even if it could not be recorded, unless it
+			// was to be queued for a worker
+			log.Error(errors.ErrorStack(err))
+		}
+		if id == "" {
+			message = flash{
+				Title: "Task not started",
+				Body:  "The job could not be queued. Please try again later.",
+				Error: true,
+			}
+		} else {
+			message = flash{
+				Title: "Task Started!",
+				Body:  fmt.Sprintf("Task %s was successfully started. The results will be emailed to you upon completion and listed under My jobs.", id),
+			}
+		}
+	}
 
 	session, err := store.Get(r, flashSession)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	session.AddFlash(flash{
-		Title: "Task Started!",
-		Body:  fmt.Sprintf("Task %s was successfully started. The results will be emailed to you upon completion.", id),
-	})
+	session.AddFlash(message)
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -126,16 +533,70 @@ func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
 	args := mux.Vars(r)
 	id := args["id"]
 
-	executer := tasks.DefaultTaskExecuter
-	status := executer.GetTaskStatus(id)
+	// jobs which were not recorded, such as those of watched folders, are
+	// treated as belonging to no organization
+	j, err := db.Jobs.Get(id)
+	if errors.IsNotFound(err) {
+		j, err = &db.Job{ID: id}, nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not find the job")
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, j.Org, j.Owner, "job") {
+		return
+	}
+
+	status := jobs.Status(tasks.DefaultTaskExecuter, id)
 	io.WriteString(w, status.String())
 }
 
+// filesHandler serves objects from local storage to holders of a URL signed by
+// storage.Local.SignedURL.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	local, ok := storage.Default.(*storage.Local)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	if err := local.Verify(name, query.Get("expires"), query.Get("signature")); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	file, err := local.Get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)})
+	if disposition == "" {
+		// the name cannot be written in the header
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	io.Copy(w, file)
+}
+
 func formHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("templates/form.html")
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	t, err := template.New("form.html").Funcs(csrfFuncs(w, r)).ParseFiles("templates/form.html")
 	if err != nil {
 		log.Fatal(err)
 	}
+	editable, err := userOrgs(u, orgs.Editor)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+	}
 
 	session, err := store.Get(r, flashSession)
 	if err != nil {
@@ -145,7 +606,11 @@ func formHandler(w http.ResponseWriter, r *http.Request) {
 	flashes := session.Flashes()
 	session.Save(r, w)
 
-	err = t.Execute(w, flashes)
+	err = t.Execute(w, struct {
+		Flashes []interface{}
+		User    *db.User
+		Orgs    []*db.Organization
+	}{flashes, u, editable})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/schedules"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+type scheduleRequest struct {
+	Name           string   `json:"name"`
+	Cron           string   `json:"cron"`
+	TimeZone       string   `json:"timeZone"`
+	AudioURL       string   `json:"audioURL"`
+	EmailAddresses []string `json:"emailAddresses"`
+	SearchWords    []string `json:"searchWords"`
+	Language       string   `json:"language"`
+	Force          bool     `json:"force"`
+	Priority       string   `json:"priority"`
+}
+
+// createScheduleHandler creates the recurring schedule described by a JSON
+// object, which submits a transcription job with the given options whenever
+// its cron expression falls due.
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	req := new(scheduleRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s := &db.Schedule{
+		Org:            apiKeyOrg(r),
+		Name:           req.Name,
+		Cron:           req.Cron,
+		TimeZone:       req.TimeZone,
+		AudioURL:       req.AudioURL,
+		EmailAddresses: req.EmailAddresses,
+		SearchWords:    req.SearchWords,
+		Language:       req.Language,
+		Force:          req.Force,
+		Priority:       req.Priority,
+	}
+	if err := transcription.ScheduledJob(s).Validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !mayUsePriority(r, s.Priority) {
+		writeJSONError(w, http.StatusForbidden, "only administrators may queue high-priority jobs")
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Editor, s.Org, "", "organization's schedules") {
+		return
+	}
+	if k := requestAPIKey(r); k != nil {
+		s.APIKey = k.ID
+	}
+	err := schedules.Create(s)
+	if errors.IsNotValid(err) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not create the schedule")
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// listSchedulesHandler returns every schedule, or those of the API key's
+// organization if it is restricted to one.
+func listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := db.Schedules.List()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if org := apiKeyOrg(r); org != "" {
+		visible := []*db.Schedule{}
+		for _, s := range list {
+			if s.Org == org {
+				visible = append(visible, s)
+			}
+		}
+		list = visible
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getScheduleHandler returns the schedule with the given id.
+func getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s, err := db.Schedules.Get(id)
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "schedule not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, s.Org, "", "schedule") {
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// deleteScheduleHandler deletes the schedule with the given id. Jobs it has
+// already submitted carry on.
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s, err := db.Schedules.Get(id)
+	if err == nil {
+		if !checkAPIAccess(w, r, orgs.Editor, s.Org, "", "schedule") {
+			return
+		}
+		err = db.Schedules.Delete(id)
+	}
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "schedule not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/config"
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/transcription"
+)
+
+// shareURL returns the link to the page of the job shared with token, which
+// is absolute if PublicURL is set.
+func shareURL(token string) string {
+	return strings.TrimSuffix(config.Config.PublicURL, "/") + "/shared/" + token
+}
+
+// shareJobHandler shares a job, creating a link to a page showing it and its
+// transcript to anyone, and shows the job's page with the link.
+func shareJobHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	if _, err := jobs.Share(j.ID); err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not share the job", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/jobs/"+j.ID, http.StatusFound)
+}
+
+// unshareJobHandler revokes the link with which a job was shared and shows
+// the job's page.
+func unshareJobHandler(w http.ResponseWriter, r *http.Request) {
+	_, j := userJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	if err := jobs.Unshare(j.ID); err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not stop sharing the job", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/jobs/"+j.ID, http.StatusFound)
+}
+
+// shareJobAPIHandler shares a job, responding with the token and link with
+// which anyone can see it. Sharing a job which is already shared responds
+// with its existing link.
+func shareJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	token, err := jobs.Share(j.ID)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not share the job")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}{j.ID, token, shareURL(token)})
+}
+
+// unshareJobAPIHandler revokes the link with which a job was shared.
+func unshareJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	j := apiJob(w, r, orgs.Editor)
+	if j == nil {
+		return
+	}
+	if err := jobs.Unshare(j.ID); err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not stop sharing the job")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedJob returns the job shared with the token in the URL, writing an
+// error response and returning nil if there is none. Responses about shared
+// jobs keep the token out of Referer headers and search engines.
+func sharedJob(w http.ResponseWriter, r *http.Request) *db.Job {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	j, err := jobs.Shared(mux.Vars(r)["token"])
+	if errors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		http.Error(w, "could not find the job", http.StatusInternalServerError)
+		return nil
+	}
+	return j
+}
+
+// sharedJobHandler shows a shared job and, once it has succeeded, its
+// transcript, to anyone with the link.
+func sharedJobHandler(w http.ResponseWriter, r *http.Request) {
+	j := sharedJob(w, r)
+	if j == nil {
+		return
+	}
+	t, err := db.Transcripts.Get(j.ID)
+	if err != nil && !errors.IsNotFound(err) {
+		log.Error(errors.ErrorStack(err))
+	}
+	renderTemplate(w, r, http.StatusOK, "shared.html", struct {
+		User       *db.User
+		Job        *db.Job
+		Token      string
+		Transcript *db.Transcript
+		Formats    []string
+	}{currentUser(r), j, j.ShareToken, t, transcription.Formats})
+}
+
+// sharedTranscriptHandler downloads the transcript of a shared job in the
+// format given by the format query parameter.
+func sharedTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	j := sharedJob(w, r)
+	if j == nil {
+		return
+	}
+	writeTranscript(w, r, j)
+}
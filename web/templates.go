@@ -0,0 +1,72 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var templateFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("Jan 2, 2006 15:04")
+	},
+	"statusColor": func(status string) string {
+		switch status {
+		case "SUCCESS":
+			return "green"
+		case "FAILURE":
+			return "red"
+		case "TIMEDOUT":
+			return "orange"
+		case "SCHEDULED":
+			return "grey"
+		}
+		return "blue"
+	},
+	"join": strings.Join,
+	"bytes": func(n int64) string {
+		const unit = 1024
+		if n < unit {
+			return fmt.Sprintf("%d B", n)
+		}
+		div, exp := int64(unit), 0
+		for m := n / unit; m >= unit; m /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+	},
+	"duration": func(seconds float64) string {
+		if seconds == 0 {
+			return ""
+		}
+		return (time.Duration(seconds) * time.Second).String()
+	},
+}
+
+// renderTemplate renders templates/name, which can use the templates defined
+// in templates/layout.html, as a response to r with the given status code.
+func renderTemplate(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	t, err := template.New(name).Funcs(templateFuncs).Funcs(csrfFuncs(w, r)).ParseFiles(
+		filepath.Join("templates", "layout.html"),
+		filepath.Join("templates", name),
+	)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "could not render the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/orgs"
+)
+
+// listTranscriptsHandler returns the stored transcripts matching the query
+// parameters audioURL, after, before (RFC 3339 times), offset and limit.
+// Keys restricted to an organization only see its transcripts.
+func listTranscriptsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := transcriptFilterFromQuery(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Org = apiKeyOrg(r)
+
+	transcripts, err := db.Transcripts.List(filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, transcripts)
+}
+
+func transcriptFilterFromQuery(r *http.Request) (db.TranscriptFilter, error) {
+	query := r.URL.Query()
+	filter := db.TranscriptFilter{AudioURL: query.Get("audioURL")}
+
+	var err error
+	if s := query.Get("after"); s != "" {
+		if filter.CompletedAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, errors.NotValidf("after %q", s)
+		}
+	}
+	if s := query.Get("before"); s != "" {
+		if filter.CompletedBefore, err = time.Parse(time.RFC3339, s); err != nil {
+			return filter, errors.NotValidf("before %q", s)
+		}
+	}
+	if s := query.Get("offset"); s != "" {
+		if filter.Offset, err = strconv.Atoi(s); err != nil || filter.Offset < 0 {
+			return filter, errors.NotValidf("offset %q", s)
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil || filter.Limit < 0 {
+			return filter, errors.NotValidf("limit %q", s)
+		}
+	}
+	return filter, nil
+}
+
+// getTranscriptHandler returns the transcript with the given id.
+func getTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	transcript, err := db.Transcripts.Get(id)
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "transcript not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !checkAPIAccess(w, r, orgs.Viewer, transcript.Org, "", "transcript") {
+		return
+	}
+	writeJSON(w, http.StatusOK, transcript)
+}
+
+// deleteTranscriptHandler deletes the transcript with the given id.
+func deleteTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	transcript, err := db.Transcripts.Get(id)
+	if err == nil {
+		if !checkAPIAccess(w, r, orgs.Editor, transcript.Org, "", "transcript") {
+			return
+		}
+		err = db.Transcripts.Delete(id)
+	}
+	if errors.IsNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, "transcript not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
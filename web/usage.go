@@ -0,0 +1,67 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/orgs"
+	"github.com/hack4impact/transcribe4all/usage"
+)
+
+// checkAPIQuota checks that neither the request's API key nor the instance
+// has used up its monthly audio quota. If one has, it writes a 429 response
+// and returns false.
+func checkAPIQuota(w http.ResponseWriter, r *http.Request) bool {
+	err := usage.Check("", requestAPIKey(r), time.Now())
+	if usage.IsQuotaExceeded(err) {
+		writeJSONError(w, http.StatusTooManyRequests, err.Error())
+		return false
+	}
+	if err != nil {
+		// metering problems should not stop transcription
+		log.Error(errors.ErrorStack(err))
+	}
+	return true
+}
+
+// usageHandler reports the audio minutes transcribed in the month given by
+// the month query parameter (e.g. 2016-10, default the current month), as
+// JSON or, if the format query parameter is "csv", as CSV. Keys restricted to
+// an organization need its admin role and only see its usage.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	org := apiKeyOrg(r)
+	if !checkAPIAccess(w, r, orgs.Admin, org, "", "usage") {
+		return
+	}
+
+	month := time.Now()
+	if s := r.URL.Query().Get("month"); s != "" {
+		var err error
+		if month, err = time.Parse("2006-01", s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.NotValidf("month %q", s).Error())
+			return
+		}
+	}
+	report, err := usage.MonthlyReport(month, org)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		writeJSONError(w, http.StatusInternalServerError, "could not compute the usage")
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"usage-"+report.Month+".csv\"")
+		if err := report.WriteCSV(w); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
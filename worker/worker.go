@@ -0,0 +1,215 @@
+// Package worker runs jobs from the queue shared by the web server and worker
+// processes. A worker leases a job, renews the lease while the job runs and
+// removes the job from the queue when it finishes. If the worker dies, the
+// lease lapses and another worker leases the job.
+package worker
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/juju/errors"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+// These are the defaults used by New.
+// LeaseDuration: how long a lease lasts unless it is renewed.
+// PollInterval: how often an idle worker looks for a job.
+const (
+	LeaseDuration = time.Minute
+	PollInterval  = 5 * time.Second
+)
+
+// TaskFunc returns the task running the job recorded as j, and the function
+// to call if it fails. ctx ends if the worker loses the job's lease, when the
+// task should stop and return tasks.ErrInterrupted, since another worker now
+// runs the job.
+type TaskFunc func(ctx context.Context, j *db.Job) (task func(string) error, onFailure func(string, string))
+
+// Worker runs jobs from the shared queue.
+type Worker struct {
+	name        string
+	concurrency int
+	ex          tasks.TaskExecuter
+	taskFor     TaskFunc
+	lease       time.Duration
+	interval    time.Duration
+}
+
+// New returns a Worker called name, which must be unique among the workers,
+// running up to concurrency jobs at a time on ex.
+func New(name string, concurrency int, ex tasks.TaskExecuter, taskFor TaskFunc) *Worker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Worker{
+		name:        name,
+		concurrency: concurrency,
+		ex:          ex,
+		taskFor:     taskFor,
+		lease:       LeaseDuration,
+		interval:    PollInterval,
+	}
+}
+
+// Run leases and runs jobs until stop is closed. Jobs which are running then
+// carry on; wait for them with the executer's Wait.
+func (w *Worker) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(stop)
+		}()
+	}
+	wg.Wait()
+}
+
+// loop runs one job at a time until stop is closed.
+func (w *Worker) loop(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		done, err := w.runNext()
+		if err != nil {
+			log.Errorf("Could not run the next job: %v", err)
+		}
+		if done == nil {
+			// wait for jobs to be queued
+			select {
+			case <-stop:
+				return
+			case <-time.After(w.interval):
+			}
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		case <-done:
+		}
+	}
+}
+
+// runNext leases the next job and starts running it. It returns a channel
+// which is closed when the job finishes, or nil if no job was waiting.
+func (w *Worker) runNext() (<-chan struct{}, error) {
+	e, err := db.Queue.Lease(w.name, time.Now(), w.lease)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	done := make(chan struct{})
+
+	j, err := db.Jobs.Get(e.ID)
+	if err == nil && j.Status == tasks.INPROGRESS.Name() && j.Attempts >= jobs.MaxAttempts {
+		// the workers which leased the job kept dying
+		err = jobs.GiveUp(j)
+	}
+	if errors.IsNotFound(err) || (err == nil && j.Status != tasks.INPROGRESS.Name()) {
+		// the job was deleted or has finished
+		close(done)
+		return done, errors.Trace(db.Queue.Remove(e.ID))
+	}
+	if err != nil {
+		if releaseErr := db.Queue.Release(e.ID, w.name); releaseErr != nil {
+			log.WithField("task", e.ID).
+				Errorf("Could not release the job: %v", releaseErr)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task, onFailure := w.taskFor(ctx, j)
+	renewing := make(chan struct{})
+	go w.renew(e.ID, renewing, cancel)
+	run := func(id string) (err error) {
+		defer close(done)
+		defer close(renewing)
+		defer cancel()
+		defer func() {
+			if p := recover(); p != nil {
+				log.WithField("task", id).
+					Errorf("Task panicked: %v\n%s", p, debug.Stack())
+				err = errors.Errorf("the task panicked: %v", p)
+			}
+			if ctx.Err() != nil {
+				// whatever the task did, the job is another worker's now
+				err = errors.Annotate(tasks.ErrInterrupted, "the lease of the job was lost")
+			}
+			w.settle(id, err)
+		}()
+		return task(id)
+	}
+	log.WithField("task", j.ID).
+		Infof("Leased the job (attempt %d)", j.Attempts+1)
+	if err := jobs.Resume(w.ex, j, run, onFailure); err != nil {
+		close(renewing)
+		cancel()
+		if releaseErr := db.Queue.Release(e.ID, w.name); releaseErr != nil {
+			log.WithField("task", e.ID).
+				Errorf("Could not release the job: %v", releaseErr)
+		}
+		return nil, errors.Trace(err)
+	}
+	return done, nil
+}
+
+// renew renews the lease of the job with the given id until stop is closed.
+// If the lease is lost, because another worker has leased the job or the
+// lease ran out before it could be renewed, it calls lost to stop the job.
+func (w *Worker) renew(id string, stop <-chan struct{}, lost func()) {
+	ticker := time.NewTicker(w.lease / 3)
+	defer ticker.Stop()
+	expires := time.Now().Add(w.lease)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			err := db.Queue.Renew(id, w.name, now, w.lease)
+			if err == nil {
+				expires = now.Add(w.lease)
+				continue
+			}
+			if errors.IsNotFound(err) || !now.Before(expires) {
+				log.WithField("task", id).
+					Errorf("Lost the lease of the job, so it is stopped: %v", err)
+				lost()
+				return
+			}
+			log.WithField("task", id).
+				Warnf("Could not renew the lease of the job: %v", err)
+		}
+	}
+}
+
+// settle removes the job with the given id from the queue once its task has
+// returned err, or puts it back if the task was interrupted.
+func (w *Worker) settle(id string, err error) {
+	if errors.Cause(err) == tasks.ErrInterrupted {
+		if err := db.Queue.Release(id, w.name); err != nil {
+			log.WithField("task", id).
+				Errorf("Could not put the job back in the queue: %v", err)
+		}
+		return
+	}
+	if err := db.Queue.Remove(id); err != nil && !errors.IsNotFound(err) {
+		log.WithField("task", id).
+			Errorf("Could not remove the job from the queue: %v", err)
+	}
+}
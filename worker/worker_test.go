@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hack4impact/transcribe4all/db"
+	"github.com/hack4impact/transcribe4all/jobs"
+	"github.com/hack4impact/transcribe4all/tasks"
+)
+
+func useTempRepositories(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Jobs, err = db.NewFileJobRepository(filepath.Join(dir, "jobs.json")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Queue, err = db.NewFileQueueRepository(filepath.Join(dir, "queue.json")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// waitForEmptyQueue waits until every job has left the queue.
+func waitForEmptyQueue(t *testing.T) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if n, err := db.Queue.Count(); err == nil && n == 0 {
+			return
+		}
+	}
+	t.Fatal("the queue was not emptied")
+}
+
+func TestWorkerRunsQueuedJobs(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+
+	good, err := jobs.Enqueue(&db.Job{AudioURL: "good"})
+	assert.NoError(err)
+	bad, err := jobs.Enqueue(&db.Job{AudioURL: "bad"})
+	assert.NoError(err)
+
+	w := New("w1", 2, tasks.NewTaskExecuter(time.Hour), func(_ context.Context, j *db.Job) (func(string) error, func(string, string)) {
+		return func(string) error {
+			if j.AudioURL == "bad" {
+				return errors.New("bad audio")
+			}
+			return nil
+		}, func(string, string) {}
+	})
+	w.interval = time.Millisecond
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	waitForEmptyQueue(t)
+	assert.NoError(w.ex.Wait(context.Background()))
+	j, err := db.Jobs.Get(good)
+	assert.NoError(err)
+	assert.Equal(tasks.SUCCESS.Name(), j.Status)
+	assert.Equal(1, j.Attempts)
+	j, err = db.Jobs.Get(bad)
+	assert.NoError(err)
+	assert.Equal(tasks.FAILURE.Name(), j.Status)
+	assert.Equal("bad audio", j.Error)
+}
+
+func TestWorkerTakesOverLapsedLeases(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+
+	id, err := jobs.Enqueue(&db.Job{})
+	assert.NoError(err)
+	// a worker which died after leasing the job
+	_, err = db.Queue.Lease("dead", time.Now().Add(-time.Hour), time.Minute)
+	assert.NoError(err)
+	j, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	j.Attempts = 1
+	assert.NoError(db.Jobs.Update(j))
+
+	w := New("w2", 1, tasks.NewTaskExecuter(time.Hour), func(context.Context, *db.Job) (func(string) error, func(string, string)) {
+		return func(string) error { return nil }, func(string, string) {}
+	})
+	done, err := w.runNext()
+	assert.NoError(err)
+	<-done
+	waitForEmptyQueue(t)
+	assert.NoError(w.ex.Wait(context.Background()))
+	j, err = db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.SUCCESS.Name(), j.Status)
+	assert.Equal(2, j.Attempts)
+}
+
+func TestWorkerGivesUpAndReleases(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+
+	tried, err := jobs.Enqueue(&db.Job{Resumable: true})
+	assert.NoError(err)
+	j, err := db.Jobs.Get(tried)
+	assert.NoError(err)
+	j.Attempts = jobs.MaxAttempts
+	assert.NoError(db.Jobs.Update(j))
+
+	w := New("w3", 1, tasks.NewTaskExecuter(time.Hour), func(context.Context, *db.Job) (func(string) error, func(string, string)) {
+		return func(string) error { return tasks.ErrInterrupted }, func(string, string) {}
+	})
+	// the job which was interrupted too often fails
+	done, err := w.runNext()
+	assert.NoError(err)
+	<-done
+	j, err = db.Jobs.Get(tried)
+	assert.NoError(err)
+	assert.Equal(tasks.FAILURE.Name(), j.Status)
+	_, err = db.Queue.Get(tried)
+	assert.Error(err)
+
+	// an interrupted job goes back in the queue
+	id, err := jobs.Enqueue(&db.Job{})
+	assert.NoError(err)
+	done, err = w.runNext()
+	assert.NoError(err)
+	<-done
+	assert.NoError(w.ex.Wait(context.Background()))
+	e, err := db.Queue.Get(id)
+	assert.NoError(err)
+	assert.Empty(e.Worker)
+	j, err = db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.INPROGRESS.Name(), j.Status)
+}
+
+func TestWorkerStopsJobsWhoseLeaseIsLost(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+
+	id, err := jobs.Enqueue(&db.Job{})
+	assert.NoError(err)
+	w := New("w4", 1, tasks.NewTaskExecuter(time.Hour), func(ctx context.Context, j *db.Job) (func(string) error, func(string, string)) {
+		return func(string) error {
+			select {
+			case <-ctx.Done():
+				return tasks.ErrInterrupted
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}, func(string, string) {}
+	})
+	w.lease = 30 * time.Millisecond
+	done, err := w.runNext()
+	assert.NoError(err)
+	// another worker takes the job over, as if the lease had lapsed
+	_, err = db.Queue.Lease("w5", time.Now().Add(time.Hour), time.Hour)
+	assert.NoError(err)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job was not stopped")
+	}
+	assert.NoError(w.ex.Wait(context.Background()))
+	e, err := db.Queue.Get(id)
+	assert.NoError(err)
+	assert.Equal("w5", e.Worker)
+	j, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.INPROGRESS.Name(), j.Status)
+}
+
+func TestWorkerFailsPanickingJobs(t *testing.T) {
+	assert := assert.New(t)
+	defer os.RemoveAll(useTempRepositories(t))
+
+	id, err := jobs.Enqueue(&db.Job{})
+	assert.NoError(err)
+	w := New("w6", 1, tasks.NewTaskExecuter(time.Hour), func(context.Context, *db.Job) (func(string) error, func(string, string)) {
+		return func(string) error { panic("AHHH!!!") }, func(string, string) {}
+	})
+	done, err := w.runNext()
+	assert.NoError(err)
+	<-done
+	assert.NoError(w.ex.Wait(context.Background()))
+	_, err = db.Queue.Get(id)
+	assert.Error(err)
+	j, err := db.Jobs.Get(id)
+	assert.NoError(err)
+	assert.Equal(tasks.FAILURE.Name(), j.Status)
+	assert.Contains(j.Error, "panicked")
+}